@@ -0,0 +1,167 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// auditChunk is how many parents Audit hashes at a time, so that a big
+// forest's rows don't all have to be in memory at once
+const auditChunk = 1 << 16
+
+// AuditReport is everything Forest.Audit found wrong with a forest.
+type AuditReport struct {
+	// BadNodes are the interior positions whose hash isn't the hash of
+	// their two children, or that have an empty child
+	BadNodes []uint64
+
+	// EmptyLeaves are the leaf positions below numLeaves with no hash
+	EmptyLeaves []uint64
+
+	// BadPositions are the leaf positions that the position map has
+	// missing or pointing somewhere else
+	BadPositions []uint64
+
+	// StaleEntries is how many entries in the position map don't point to
+	// their leaf.  That's the entries for BadPositions plus any for leaves
+	// that aren't in the forest anymore.
+	StaleEntries uint64
+
+	// Repaired is true if the bad nodes and position map entries were
+	// rebuilt from the leaves
+	Repaired bool
+}
+
+// OK returns true if the audit didn't find anything wrong.
+func (r *AuditReport) OK() bool {
+	return len(r.BadNodes) == 0 && len(r.EmptyLeaves) == 0 &&
+		len(r.BadPositions) == 0 && r.StaleEntries == 0
+}
+
+// String lists everything the audit found, one line per position.
+func (r *AuditReport) String() string {
+	if r.OK() {
+		return "audit ok\n"
+	}
+	s := fmt.Sprintf("audit found %d bad nodes, %d empty leaves, "+
+		"%d bad positions, %d stale position map entries\n",
+		len(r.BadNodes), len(r.EmptyLeaves), len(r.BadPositions),
+		r.StaleEntries)
+	for _, pos := range r.EmptyLeaves {
+		s += fmt.Sprintf("empty leaf @%d\n", pos)
+	}
+	for _, pos := range r.BadNodes {
+		s += fmt.Sprintf("bad node @%d\n", pos)
+	}
+	for _, pos := range r.BadPositions {
+		s += fmt.Sprintf("position map wrong for leaf @%d\n", pos)
+	}
+	if r.Repaired {
+		s += "repaired\n"
+	}
+	return s
+}
+
+// Audit checks the whole forest: every interior node is hashed again from
+// its children and every leaf is looked up in the position map.  Unlike
+// sanity and PosMapSanity it doesn't stop at the first problem; everything
+// wrong is in the returned AuditReport.
+//
+// With repair, every interior node is rebuilt from the leaf row, bottom up,
+// and the position map is rebuilt if it was wrong.  Empty leaves can't be
+// repaired; Audit returns an error and changes nothing if there are any.
+// Audit reads every position so it takes about as long as rebuilding the
+// forest does.
+func (f *Forest) Audit(repair bool) (*AuditReport, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.numLeaves > 1<<f.rows {
+		return nil, fmt.Errorf("Audit: forest has %d leaves but only %d rows",
+			f.numLeaves, f.rows)
+	}
+
+	report := new(AuditReport)
+	for pos := uint64(0); pos < f.numLeaves; pos++ {
+		h := f.read(pos)
+		if h == empty {
+			report.EmptyLeaves = append(report.EmptyLeaves, pos)
+			continue
+		}
+		mapPos, ok := f.positionMap.Get(h.Mini())
+		if !ok || mapPos != pos {
+			report.BadPositions = append(report.BadPositions, pos)
+		}
+	}
+	f.positionMap.ForEach(func(m MiniHash, pos uint64) {
+		if pos >= f.numLeaves || f.read(pos).Mini() != m {
+			report.StaleEntries++
+		}
+	})
+
+	if repair && len(report.EmptyLeaves) != 0 {
+		return report, fmt.Errorf("Audit: can't repair forest with %d "+
+			"empty leaves", len(report.EmptyLeaves))
+	}
+
+	report.BadNodes = f.auditNodes(repair)
+
+	if repair {
+		if len(report.BadPositions) != 0 || report.StaleEntries != 0 {
+			err := f.rebuildPositionMap()
+			if err != nil {
+				return report, fmt.Errorf("Audit: %s", err.Error())
+			}
+		}
+		report.Repaired = true
+	}
+
+	return report, nil
+}
+
+// auditNodes hashes every interior node from its children, a row at a
+// time, and returns the positions that don't match.  With repair the
+// right hashes get written so the rows above are checked against them.
+func (f *Forest) auditNodes(repair bool) []uint64 {
+	var bad []uint64
+	jobs := make([]parentJob, 0, auditChunk)
+
+	for r := uint8(1); r <= f.rows; r++ {
+		rowStart := parentMany(0, r, f.rows)
+		rowNodes := f.numLeaves >> r
+
+		for start := uint64(0); start < rowNodes; start += auditChunk {
+			jobs = jobs[:0]
+			for i := start; i < rowNodes && i < start+auditChunk; i++ {
+				pos := rowStart + i
+				left := child(pos, f.rows)
+				j := parentJob{
+					pos: pos,
+					l:   f.read(left),
+					r:   f.read(left | 1),
+				}
+				// the hashers won't hash an empty child.  Every node
+				// below numLeaves has a hash, so one that's empty was
+				// zeroed, and the parent can't be checked.
+				if j.l == empty || j.r == empty {
+					bad = append(bad, pos)
+					continue
+				}
+				jobs = append(jobs, j)
+			}
+			hashParents(f.hasher, jobs, f.hashWorkers)
+
+			for _, j := range jobs {
+				if f.read(j.pos) == j.par {
+					continue
+				}
+				bad = append(bad, j.pos)
+				if repair {
+					f.write(j.pos, j.par)
+				}
+			}
+		}
+	}
+
+	sortUint64s(bad)
+	return bad
+}
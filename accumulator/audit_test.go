@@ -0,0 +1,109 @@
+package accumulator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestForestAudit(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(20)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("good forest failed audit: %s", report.String())
+	}
+	roots := f.GetRoots()
+
+	// mess up two interior nodes, one in a row above the other, and the
+	// position map
+	low := parent(2, f.rows)
+	high := parentMany(8, 3, f.rows)
+	f.data.write(low, Hash{0x01})
+	f.data.write(high, Hash{0x02})
+	f.positionMap.Put(f.data.read(5).Mini(), 6)
+	f.positionMap.Put(MiniHash{0x03}, 1)
+
+	report, err = f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parents of low and high are hashed from the bad hashes so
+	// they're wrong too, but nothing above them is as they're checked
+	// against what's stored
+	wantBad := []uint64{low, parent(low, f.rows), high, parent(high, f.rows)}
+	sortUint64s(wantBad)
+	if !reflect.DeepEqual(report.BadNodes, wantBad) {
+		t.Fatalf("bad nodes %v, expected %v", report.BadNodes, wantBad)
+	}
+	if !reflect.DeepEqual(report.BadPositions, []uint64{5}) {
+		t.Fatalf("bad positions %v, expected [5]", report.BadPositions)
+	}
+	if report.StaleEntries != 2 {
+		t.Fatalf("%d stale entries, expected 2", report.StaleEntries)
+	}
+	if report.Repaired {
+		t.Fatal("audit without repair says it repaired")
+	}
+
+	report, err = f.Audit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired {
+		t.Fatal("audit with repair didn't repair")
+	}
+	if !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("repaired forest has different roots")
+	}
+	report, err = f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("repaired forest failed audit: %s", report.String())
+	}
+
+	// a zeroed interior node is bad, and so is its parent which can't be
+	// hashed from it
+	mid := parent(4, f.rows)
+	f.data.write(mid, empty)
+	report, err = f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBad = []uint64{mid, parent(mid, f.rows)}
+	if !reflect.DeepEqual(report.BadNodes, wantBad) {
+		t.Fatalf("bad nodes %v, expected %v", report.BadNodes, wantBad)
+	}
+	_, err = f.Audit(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("repaired forest has different roots")
+	}
+
+	// empty leaves can't be repaired
+	f.data.write(3, empty)
+	report, err = f.Audit(true)
+	if err == nil {
+		t.Fatal("repaired a forest with an empty leaf")
+	}
+	if !reflect.DeepEqual(report.EmptyLeaves, []uint64{3}) {
+		t.Fatalf("empty leaves %v, expected [3]", report.EmptyLeaves)
+	}
+}
@@ -109,14 +109,26 @@ func (bp *BatchProof) SerializeSize() int {
 	return 8 + (8 * (len(bp.Targets))) + (32 * (len(bp.Proof)))
 }
 
-// Deserialize gives a BatchProof back from a reader.
+// Deserialize gives a BatchProof back from a reader.  It reads either
+// encoding, from Serialize or from SerializeCompact.
 func (bp *BatchProof) Deserialize(r io.Reader) (err error) {
-	var numTargets, numHashes uint32
-	err = binary.Read(r, binary.BigEndian, &numTargets)
+	// the first byte says which encoding it is
+	var count [4]byte
+	_, err = io.ReadFull(r, count[:1])
+	if err != nil {
+		return
+	}
+	if count[0] == compactBPVersion {
+		return bp.deserializeCompact(r)
+	}
+	_, err = io.ReadFull(r, count[1:])
 	if err != nil {
 		return
 	}
 
+	var numHashes uint32
+	numTargets := binary.BigEndian.Uint32(count[:])
+
 	if numTargets > 1<<16 {
 		err = fmt.Errorf("%d targets - too many\n", numTargets)
 		return
@@ -158,10 +170,19 @@ func (bp *BatchProof) Deserialize(r io.Reader) (err error) {
 
 // DeserializeBPFromBytes, given serialized bytes, returns a pointer to the
 // deserialized batchproof. The deserialization is the same as Deserialize() method
-// on BatchProof
+// on BatchProof, and reads either encoding.
 func DeserializeBPFromBytes(serialized []byte) (*BatchProof, error) {
 	var numTargets, numHashes uint32
 
+	if len(serialized) > 0 && serialized[0] == compactBPVersion {
+		bp := new(BatchProof)
+		err := bp.deserializeCompact(bytes.NewReader(serialized[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return bp, nil
+	}
+
 	reader := bytes.NewReader(serialized)
 
 	err := binary.Read(reader, binary.BigEndian, &numTargets)
@@ -214,6 +235,179 @@ func DeserializeBPFromBytes(serialized []byte) (*BatchProof, error) {
 	return &bp, nil
 }
 
+// The compact encoding of a BatchProof is, in order:
+// 1byte compactBPVersion
+// 1byte flags
+// varint numTargets
+// []Targets (signed varint, each the difference from the one before)
+// varint numHashes
+// omitted bitmap ((numHashes+7)/8 bytes, only if the flag is set)
+// []Hashes (32 bytes each, leaving out the omitted ones)
+//
+// Serialize starts with a 4 byte big endian numTargets that's at most 1<<16,
+// so its first byte is always 0.  That's how the two are told apart.
+const compactBPVersion = 0x01
+
+// compactBPOmitted is the flag for an omitted bitmap being there.
+const compactBPOmitted = 0x01
+
+// SerializeCompact serializes a batchproof to a writer with varints instead
+// of fixed size integers.  Targets are delta coded; they're usually close to
+// sorted so the deltas are small.
+//
+// Proof hashes that are empty are left out, for hashes the receiver can
+// compute or already has.  They come back empty from Deserialize and the
+// receiver has to fill them in before verifying.
+func (bp *BatchProof) SerializeCompact(w io.Writer) error {
+	b := make([]byte, 0, bp.SerializeCompactSize())
+	var scratch [binary.MaxVarintLen64]byte
+
+	var flags byte
+	if bp.numOmitted() > 0 {
+		flags |= compactBPOmitted
+	}
+	b = append(b, compactBPVersion, flags)
+
+	n := binary.PutUvarint(scratch[:], uint64(len(bp.Targets)))
+	b = append(b, scratch[:n]...)
+	var prev uint64
+	for _, t := range bp.Targets {
+		n = binary.PutVarint(scratch[:], int64(t-prev))
+		b = append(b, scratch[:n]...)
+		prev = t
+	}
+
+	n = binary.PutUvarint(scratch[:], uint64(len(bp.Proof)))
+	b = append(b, scratch[:n]...)
+	if flags&compactBPOmitted != 0 {
+		bitmap := make([]byte, (len(bp.Proof)+7)/8)
+		for i, h := range bp.Proof {
+			if h == empty {
+				bitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		b = append(b, bitmap...)
+	}
+	for _, h := range bp.Proof {
+		if h != empty {
+			b = append(b, h[:]...)
+		}
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+// SerializeCompactSize returns the number of bytes it would take to
+// serialize the BatchProof with SerializeCompact.
+func (bp *BatchProof) SerializeCompactSize() int {
+	var scratch [binary.MaxVarintLen64]byte
+
+	// version and flags
+	size := 2
+	size += binary.PutUvarint(scratch[:], uint64(len(bp.Targets)))
+	var prev uint64
+	for _, t := range bp.Targets {
+		size += binary.PutVarint(scratch[:], int64(t-prev))
+		prev = t
+	}
+	size += binary.PutUvarint(scratch[:], uint64(len(bp.Proof)))
+
+	omitted := bp.numOmitted()
+	if omitted > 0 {
+		size += (len(bp.Proof) + 7) / 8
+	}
+	return size + 32*(len(bp.Proof)-omitted)
+}
+
+// numOmitted returns how many of the proof hashes are empty
+func (bp *BatchProof) numOmitted() int {
+	var omitted int
+	for _, h := range bp.Proof {
+		if h == empty {
+			omitted++
+		}
+	}
+	return omitted
+}
+
+// deserializeCompact reads a BatchProof from SerializeCompact, after the
+// version byte.
+func (bp *BatchProof) deserializeCompact(r io.Reader) error {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &oneByteReader{r: r}
+	}
+
+	flags, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("compact bp deser flags err %s", err.Error())
+	}
+	if flags&^compactBPOmitted != 0 {
+		return fmt.Errorf("compact bp deser unknown flags %x", flags)
+	}
+
+	numTargets, err := binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("compact bp deser err %s", err.Error())
+	}
+	if numTargets > 1<<16 {
+		return fmt.Errorf("%d targets - too many", numTargets)
+	}
+	bp.Targets = make([]uint64, numTargets)
+	var prev uint64
+	for i := range bp.Targets {
+		delta, err := binary.ReadVarint(br)
+		if err != nil {
+			return fmt.Errorf("compact bp deser target %d err %s",
+				i, err.Error())
+		}
+		prev += uint64(delta)
+		bp.Targets[i] = prev
+	}
+
+	numHashes, err := binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("compact bp deser err %s", err.Error())
+	}
+	if numHashes > 1<<16 {
+		return fmt.Errorf("%d hashes - too many", numHashes)
+	}
+	var bitmap []byte
+	if flags&compactBPOmitted != 0 {
+		bitmap = make([]byte, (numHashes+7)/8)
+		_, err = io.ReadFull(r, bitmap)
+		if err != nil {
+			return fmt.Errorf("compact bp deser bitmap err %s", err.Error())
+		}
+	}
+	bp.Proof = make([]Hash, numHashes)
+	for i := range bp.Proof {
+		if bitmap != nil && bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			// omitted, leave it empty
+			continue
+		}
+		_, err = io.ReadFull(r, bp.Proof[i][:])
+		if err != nil {
+			return fmt.Errorf("compact bp deser hash %d err %s",
+				i, err.Error())
+		}
+	}
+	return nil
+}
+
+// oneByteReader makes an io.Reader into an io.ByteReader without reading
+// ahead, so whatever comes after the proof is still there to read.
+type oneByteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (o *oneByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(o.r, o.b[:])
+	return o.b[0], err
+}
+
 // ToString for debugging, shows the blockproof
 func (bp *BatchProof) ToString() string {
 	s := fmt.Sprintf("%d targets: ", len(bp.Targets))
@@ -244,6 +438,64 @@ type targPos struct {
 	val Hash
 }
 
+// VerifyBatchProof verifies a batchproof for the targets against the roots of
+// an accumulator with numLeaves leaves, without needing a Forest or Pollard.
+// roots are in the order GetRoots gives them.  It returns the parent nodes it
+// computed on the way up to the roots, by position, for callers that want to
+// cache them.
+//
+// NOTE: targets MUST be in the same order they were proven in, like
+// Forest.VerifyBatchProof.
+func VerifyBatchProof(roots []Hash, numLeaves uint64, targets []Hash,
+	bp BatchProof) (map[uint64]Hash, error) {
+
+	return VerifyBatchProofWithHasher(
+		DefaultHasher, roots, numLeaves, targets, bp)
+}
+
+// VerifyBatchProofWithHasher is VerifyBatchProof for an accumulator that
+// uses a hash function other than the default.
+func VerifyBatchProofWithHasher(hasher Hasher, roots []Hash,
+	numLeaves uint64, targets []Hash, bp BatchProof) (map[uint64]Hash, error) {
+
+	// verifyBatchProof trusts these to be right
+	if uint8(len(roots)) != numRoots(numLeaves) {
+		return nil, fmt.Errorf("VerifyBatchProof: %d roots but %d leaves "+
+			"have %d", len(roots), numLeaves, numRoots(numLeaves))
+	}
+	for _, t := range bp.Targets {
+		if t >= numLeaves {
+			return nil, fmt.Errorf("VerifyBatchProof: target %d but only "+
+				"%d leaves", t, numLeaves)
+		}
+	}
+	// the hashers panic on empty hashes, and a proof could have any
+	for i, h := range targets {
+		if h == empty {
+			return nil, fmt.Errorf("VerifyBatchProof: target %d is empty", i)
+		}
+	}
+	for i, h := range bp.Proof {
+		if h == empty {
+			return nil, fmt.Errorf(
+				"VerifyBatchProof: proof hash %d is empty", i)
+		}
+	}
+
+	trees, _, err := verifyBatchProof(
+		targets, bp, roots, numLeaves, hasher, nil)
+	if err != nil {
+		return nil, fmt.Errorf("VerifyBatchProof: %s", err.Error())
+	}
+	computed := make(map[uint64]Hash)
+	for _, tree := range trees {
+		for _, mt := range tree {
+			computed[mt.parent.Pos] = mt.parent.Val
+		}
+	}
+	return computed, nil
+}
+
 // verifyBatchProof verifies a batchproof by checking against the set of known
 // correct roots.
 // Takes a BatchProof, the accumulator roots, and the number of leaves in the forest.
@@ -257,6 +509,7 @@ type targPos struct {
 // TODO OH WAIT -- this is not how to to it!  Don't hash all the way up to the
 // roots to verify -- just hash up to any populated node!  Saves a ton of CPU!
 func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeaves uint64,
+	hasher Hasher,
 	// cached should be a function that fetches nodes from the pollard and
 	// indicates whether they exist or not, this is only useful for the pollard
 	// and nil should be passed for the forest.
@@ -427,7 +680,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 					return nil, nil, err
 				}
 			} else {
-				hash = parentHash(left.Val, right.Val)
+				hash = hasher.Parent(left.Val, right.Val)
 				if hash != cachedParent {
 					// The calculated hash did not match the cached parent.
 					err := fmt.Errorf("verifyBatchProof: calculated parent hash of %x doesn't"+
@@ -437,7 +690,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 				}
 			}
 		} else {
-			hash = parentHash(left.Val, right.Val)
+			hash = hasher.Parent(left.Val, right.Val)
 		}
 
 		// sort the miniTrees by which tree they are in
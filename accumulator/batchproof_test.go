@@ -1,7 +1,9 @@
 package accumulator
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -103,6 +105,96 @@ func TestVerifyBatchProof(t *testing.T) {
 	}
 }
 
+// TestStatelessVerifyBatchProof checks VerifyBatchProof against a forest:
+// it takes the proofs the forest does, and the nodes it computes are the
+// forest's.
+func TestStatelessVerifyBatchProof(t *testing.T) {
+	tagged, _ := NewHasher(TaggedSHA256)
+	for _, hasher := range []Hasher{DefaultHasher, tagged} {
+		f := NewForestWithHasher(RamForest, nil, "", 0, hasher)
+		sc := newSimChain(0x07)
+		for b := 0; b < 100; b++ {
+			adds, _, delHashes := sc.NextBlock(50)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			computed, err := VerifyBatchProofWithHasher(hasher,
+				f.GetRoots(), f.numLeaves, delHashes, bp)
+			if err != nil {
+				t.Fatalf("block %d: %s", b, err.Error())
+			}
+			if len(bp.Targets) != 0 && len(computed) == 0 {
+				t.Fatalf("block %d: no nodes computed", b)
+			}
+			for pos, h := range computed {
+				if f.data.read(pos) != h {
+					t.Fatalf("block %d: computed %x at %d, forest has %x",
+						b, h.Prefix(), pos, f.data.read(pos).Prefix())
+				}
+			}
+
+			if len(bp.Proof) != 0 {
+				bad := bp
+				bad.Proof = append([]Hash{}, bp.Proof...)
+				bad.Proof[0][0] ^= 0x01
+				_, err = VerifyBatchProofWithHasher(hasher,
+					f.GetRoots(), f.numLeaves, delHashes, bad)
+				if err == nil {
+					t.Fatalf("block %d: tampered proof verified", b)
+				}
+			}
+
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// roots and targets that don't go with numLeaves
+	f := NewForest(RamForest, nil, "", 0)
+	adds := []Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}, {Hash: Hash{3}}}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := f.ProveBatch([]Hash{adds[0].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyBatchProof(f.GetRoots(), 3, []Hash{adds[0].Hash}, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyBatchProof(f.GetRoots()[:1], 3, []Hash{adds[0].Hash}, bp)
+	if err == nil {
+		t.Fatal("verified with a root missing")
+	}
+	bp.Targets = []uint64{5}
+	_, err = VerifyBatchProof(f.GetRoots(), 3, []Hash{adds[0].Hash}, bp)
+	if err == nil {
+		t.Fatal("verified a target past the last leaf")
+	}
+
+	// empty hashes are errors, not panics in the hasher
+	bp, err = f.ProveBatch([]Hash{adds[0].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyBatchProof(f.GetRoots(), 3, []Hash{empty}, bp)
+	if err == nil {
+		t.Fatal("verified an empty target")
+	}
+	bp.Proof = append([]Hash{}, bp.Proof...)
+	bp.Proof[0] = empty
+	_, err = VerifyBatchProof(f.GetRoots(), 3, []Hash{adds[0].Hash}, bp)
+	if err == nil {
+		t.Fatal("verified a proof with an empty hash")
+	}
+}
+
 // In a two leaf tree:
 // We prove one node, then delete the other one.
 // Now, the proof of the first node should not pass verification.
@@ -145,3 +237,79 @@ func TestProofShouldNotValidateAfterNodeDeleted(t *testing.T) {
 			proofIndex))
 	}
 }
+
+// TestBatchProofCompact checks that compact proofs come back the same, are
+// smaller, and that both encodings are read by Deserialize and
+// DeserializeBPFromBytes.
+func TestBatchProofCompact(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x1f)
+	var legacySize, compactSize int
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(50)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bp.Targets) == 0 {
+			continue
+		}
+
+		// leave out every third hash
+		for i := range bp.Proof {
+			if b%2 == 0 && i%3 == 0 {
+				bp.Proof[i] = empty
+			}
+		}
+
+		var legacy, compact bytes.Buffer
+		err = bp.Serialize(&legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bp.SerializeCompact(&compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compact.Len() != bp.SerializeCompactSize() {
+			t.Fatalf("block %d compact proof is %d bytes, size says %d",
+				b, compact.Len(), bp.SerializeCompactSize())
+		}
+		legacySize += legacy.Len()
+		compactSize += compact.Len()
+
+		for _, ser := range [][]byte{legacy.Bytes(), compact.Bytes()} {
+			got, err := DeserializeBPFromBytes(ser)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			if !reflect.DeepEqual(*got, bp) {
+				t.Fatalf("block %d DeserializeBPFromBytes got\n%s\nexpected\n%s",
+					b, got.ToString(), bp.ToString())
+			}
+
+			// Deserialize shouldn't read past the end of the proof
+			r := bytes.NewBuffer(append(ser, 0xaa))
+			var fromReader BatchProof
+			err = fromReader.Deserialize(r)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			if !reflect.DeepEqual(fromReader, bp) {
+				t.Fatalf("block %d Deserialize got\n%s\nexpected\n%s",
+					b, fromReader.ToString(), bp.ToString())
+			}
+			if r.Len() != 1 {
+				t.Fatalf("block %d %d bytes left after Deserialize", b, r.Len())
+			}
+		}
+	}
+	if compactSize >= legacySize {
+		t.Fatalf("compact proofs %d bytes, legacy %d bytes",
+			compactSize, legacySize)
+	}
+}
@@ -0,0 +1,86 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// ClientModel is a bridge node's copy of what a client's pollard holds.
+// A client pollard only changes with the blocks it's given and its
+// RememberPolicy, so a pollard with the same policy that's given the same
+// blocks holds the same nodes.  The bridge can leave those hashes out of the
+// proofs it sends that client, and the client's IngestBatchProof fills them
+// back in from its own cache.
+type ClientModel struct {
+	pollard Pollard
+}
+
+// NewClientModel returns a ClientModel for a client that starts with an
+// empty accumulator and remembers with policy, e.g. a TTLPolicy with the
+// client's lookahead as the Window.  policy needs to be a new one with the
+// same parameters as the client's, and not used by anything else.  A nil
+// hasher means DefaultHasher.
+func NewClientModel(policy RememberPolicy, hasher Hasher) *ClientModel {
+	cm := &ClientModel{pollard: NewPollard(hasher)}
+	cm.pollard.Policy = policy
+	return cm
+}
+
+// Trim returns a copy of bp with the proof hashes the client already has
+// set to empty.  SerializeCompact leaves empty hashes out.  The model has
+// to be at the same block as the proof.
+func (cm *ClientModel) Trim(bp BatchProof) BatchProof {
+	trimmed := BatchProof{Targets: bp.Targets, Proof: make([]Hash, len(bp.Proof))}
+	copy(trimmed.Proof, bp.Proof)
+
+	cached := cm.pollard.cachedProof(bp)
+	if len(cached) != len(bp.Proof) {
+		// not a proof for this accumulator; leave it to the client to
+		// reject it
+		return trimmed
+	}
+	for i, h := range cached {
+		if h != empty {
+			trimmed.Proof[i] = empty
+		}
+	}
+	return trimmed
+}
+
+// Update moves the model forward one block the same way the client does,
+// with IngestBatchProof and then Modify.  bp can be either the trimmed or
+// the full proof.  adds need their TTLs set if the policy uses them.
+func (cm *ClientModel) Update(adds []Leaf, bp BatchProof, delHashes []Hash) error {
+	err := cm.pollard.IngestBatchProof(delHashes, bp, false)
+	if err != nil {
+		return fmt.Errorf("ClientModel Update: %s", err.Error())
+	}
+	_, err = cm.pollard.Modify(adds, bp.Targets)
+	if err != nil {
+		return fmt.Errorf("ClientModel Update: %s", err.Error())
+	}
+	return nil
+}
+
+// NumLeaves returns the number of leaves the client has.
+func (cm *ClientModel) NumLeaves() uint64 {
+	return cm.pollard.numLeaves
+}
+
+// ProveBatchTrimmed is ProveBatch for a client, leaving out the proof hashes
+// the client already has.
+func (f *Forest) ProveBatchTrimmed(hs []Hash, cm *ClientModel) (BatchProof, error) {
+	f.mtx.Lock()
+	numLeaves := f.numLeaves
+	f.mtx.Unlock()
+	if cm.NumLeaves() != numLeaves {
+		return BatchProof{}, fmt.Errorf(
+			"ProveBatchTrimmed: client has %d leaves, forest has %d",
+			cm.NumLeaves(), numLeaves)
+	}
+
+	bp, err := f.ProveBatch(hs)
+	if err != nil {
+		return bp, err
+	}
+	return cm.Trim(bp), nil
+}
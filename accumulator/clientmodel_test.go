@@ -0,0 +1,89 @@
+package accumulator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestClientModelTrim(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	var client, nocache Pollard
+	client.Policy = &TTLPolicy{Window: 8}
+	cm := NewClientModel(&TTLPolicy{Window: 8}, nil)
+
+	var full, trimmed int
+	sc := newSimChain(0x0f)
+	for b := 0; b < 200; b++ {
+		adds, durations, delHashes := sc.NextBlock(8)
+		for i := range adds {
+			adds[i].TTL = durations[i]
+		}
+
+		bp, err := f.ProveBatchTrimmed(delHashes, cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fullBP, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bp.Targets, fullBP.Targets) {
+			t.Fatalf("block %d trimmed targets differ", b)
+		}
+		full += fullBP.SerializeCompactSize()
+		trimmed += bp.SerializeCompactSize()
+
+		// send it over the wire
+		var buf bytes.Buffer
+		err = bp.SerializeCompact(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got BatchProof
+		err = got.Deserialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.IngestBatchProof(delHashes, got, false)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		// a pollard that doesn't cache can't fill in a trimmed proof
+		if bp.numOmitted() > 0 {
+			err = nocache.VerifyBatchProof(delHashes, got)
+			if err == nil {
+				t.Fatalf("block %d trimmed proof verified without cache", b)
+			}
+		}
+		err = nocache.IngestBatchProof(delHashes, fullBP, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = nocache.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cm.Update(adds, bp, delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.GetRoots(), client.rootHashesForward()) {
+			t.Fatalf("block %d roots differ", b)
+		}
+	}
+	if trimmed >= full {
+		t.Fatalf("trimmed proofs are %d bytes, full proofs %d bytes",
+			trimmed, full)
+	}
+}
@@ -0,0 +1,61 @@
+package accumulator
+
+import (
+	"fmt"
+	"os"
+)
+
+// ConvertForest returns a copy of f that keeps its hashes as forestType.
+// forestFile, cowPath and cowMaxCache are the same as for NewForest.
+// DiskForest, RamForest, CacheForest and MmapForest can already restore
+// each other's forest file, so this is for moving to and from a CowForest.
+//
+// The hashes are streamed over one at a time so it only takes the memory
+// the two forests take.  f can't be modified while this runs.
+func ConvertForest(f *Forest, forestType ForestType, forestFile *os.File,
+	cowPath string, cowMaxCache int) (*Forest, error) {
+
+	switch forestType {
+	case DiskForest, CacheForest, MmapForest:
+		if forestFile == nil {
+			return nil, fmt.Errorf("ConvertForest: no forest file given")
+		}
+	case CowForest:
+		if cowPath == "" {
+			return nil, fmt.Errorf("ConvertForest: no cow path given")
+		}
+	case RamForest:
+	default:
+		return nil, fmt.Errorf("ConvertForest: unknown forest type %d",
+			forestType)
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	to := NewForestWithHasher(
+		forestType, forestFile, cowPath, cowMaxCache, f.hasher)
+	to.hashWorkers = f.hashWorkers
+
+	// grow a row at a time the same as reMap does; the cow forest adds
+	// its tables one row at a time.
+	for to.rows < f.rows {
+		to.rows++
+		to.data.resize((2 << to.rows) - 1)
+	}
+	to.numLeaves = f.numLeaves
+
+	// a new forest is all empty so only the rest needs writing
+	for pos := uint64(0); pos < (2<<f.rows)-1; pos++ {
+		h := f.read(pos)
+		if h != empty {
+			to.data.write(pos, h)
+		}
+	}
+
+	f.positionMap.ForEach(func(m MiniHash, pos uint64) {
+		to.positionMap.Put(m, pos)
+	})
+
+	return to, nil
+}
@@ -0,0 +1,117 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConvertForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convertforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cow := NewForest(CowForest, nil, filepath.Join(dir, "cow"), 500)
+	sc := newSimChain(0x3f)
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		bp, err := cow.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cow.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cow -> ram -> disk -> cow
+	ram, err := ConvertForest(cow, RamForest, nil, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConverted(cow, ram)
+	if err != nil {
+		t.Fatal("cow to ram:", err)
+	}
+	diskFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := ConvertForest(ram, DiskForest, diskFile, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConverted(ram, disk)
+	if err != nil {
+		t.Fatal("ram to disk:", err)
+	}
+	cowPath := filepath.Join(dir, "cow2")
+	cow2, err := ConvertForest(disk, CowForest, nil, cowPath, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConverted(disk, cow2)
+	if err != nil {
+		t.Fatal("disk to cow:", err)
+	}
+
+	// the converted forests keep working
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		for _, f := range []*Forest{ram, cow2} {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = checkConverted(ram, cow2)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+	}
+
+	// and the converted cow forest restores
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cow2.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreForest(miscFile, nil, false, false, false, cowPath, 500, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConverted(ram, restored)
+	if err != nil {
+		t.Fatal("restored cow:", err)
+	}
+}
+
+// checkConverted checks that the forests have the same leaves, positions
+// and roots.
+func checkConverted(from, to *Forest) error {
+	err := from.AssertEqual(to)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(from.GetRoots(), to.GetRoots()) {
+		return fmt.Errorf("roots differ")
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compacting a CowForest
+//
+// Every change to a committed treeTable writes a whole new file, so a
+// CowForest leaves a lot of old treeTables behind.  The compactor removes
+// them, along with any treeTables nothing points to at all, and rewrites
+// the treeTables that end in empty treeBlocks (as the bottom row does after
+// a remap) without them.
+//
+// The compactor does its reading, writing and removing without holding the
+// forest's lock, and only takes it to look at or change the manifest, so it
+// doesn't hold up Modify.  It never changes a file a manifest on disk points
+// to: a rewritten treeTable gets a new fileNum like any other changed
+// treeTable, and the old one goes in staleFiles until the manifests that
+// point to it are gone.
+
+// sparseTableEmpty is the fraction (1/sparseTableEmpty) of a treeTable's
+// treeBlocks that have to be empty ones at its end for the compactor to
+// rewrite it
+const sparseTableEmpty = 4
+
+// compactStats is what the compactor has done
+type compactStats struct {
+	removedTables   uint64
+	rewrittenTables uint64
+	freedBytes      int64
+}
+
+// compactor runs compact on a CowForest in the background
+type compactor struct {
+	stop chan bool
+	done chan bool
+}
+
+// CowDiskUsage is how much disk a CowForest takes up and what the compactor
+// has done about it.
+type CowDiskUsage struct {
+	// TreeTables and Bytes are all the treeTable files on disk
+	TreeTables int
+	Bytes      int64
+
+	// LiveTables and LiveBytes are the treeTables the forest points to now
+	LiveTables int
+	LiveBytes  int64
+
+	// StaleTables and StaleBytes are the rest: the treeTables only older
+	// manifests point to and the ones nothing points to
+	StaleTables int
+	StaleBytes  int64
+
+	// ManifestBytes is the size of the manifests on disk
+	ManifestBytes int64
+
+	// RemovedTables, RewrittenTables and FreedBytes are what the compactor
+	// has done since the forest was loaded.  FreedBytes is the size of the
+	// treeTables it removed.
+	RemovedTables   uint64
+	RewrittenTables uint64
+	FreedBytes      int64
+}
+
+// String puts the disk usage on one line.
+func (u *CowDiskUsage) String() string {
+	return fmt.Sprintf("%d treeTables %d bytes (live %d %d bytes, "+
+		"stale %d %d bytes) manifests %d bytes; compactor removed %d "+
+		"rewrote %d freed %d bytes\n", u.TreeTables, u.Bytes,
+		u.LiveTables, u.LiveBytes, u.StaleTables, u.StaleBytes,
+		u.ManifestBytes, u.RemovedTables, u.RewrittenTables, u.FreedBytes)
+}
+
+// Compact removes the stale treeTables of a CowForest that no manifest on
+// disk points to anymore and rewrites the sparse ones.  It's what the
+// compactor started by StartCompactor does every interval, and only holds
+// the forest's lock for a moment at a time.  It returns an error if the
+// forest isn't a CowForest.
+func (f *Forest) Compact() error {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return fmt.Errorf("Compact: not a CowForest")
+	}
+	err := cow.compact(dataLocker{f})
+	if err != nil {
+		return fmt.Errorf("Compact: %s", err.Error())
+	}
+	return nil
+}
+
+// StartCompactor runs Compact on a CowForest every interval until
+// StopCompactor is called.  While it runs, stale treeTables are left for
+// it instead of being removed when the forest is committed.  It returns an
+// error if the forest isn't a CowForest or the compactor is already
+// running.
+func (f *Forest) StartCompactor(interval time.Duration) error {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return fmt.Errorf("StartCompactor: not a CowForest")
+	}
+	if f.compactor != nil {
+		return fmt.Errorf("StartCompactor: already running")
+	}
+
+	f.mtx.Lock()
+	cow.meta.backgroundClean = true
+	f.mtx.Unlock()
+
+	c := &compactor{stop: make(chan bool), done: make(chan bool)}
+	f.compactor = c
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			err := cow.compact(dataLocker{f})
+			if err != nil {
+				fmt.Printf("CowForest compactor: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopCompactor stops the compactor and waits for it to finish what it's
+// doing.  It does nothing if the compactor isn't running.
+func (f *Forest) StopCompactor() {
+	c := f.compactor
+	if c == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	f.compactor = nil
+
+	if cow, ok := f.data.(*cowForest); ok {
+		f.mtx.Lock()
+		cow.meta.backgroundClean = false
+		f.mtx.Unlock()
+	}
+}
+
+// CowDiskUsage returns how much disk a CowForest takes up.  It returns an
+// error if the forest isn't a CowForest.
+func (f *Forest) CowDiskUsage() (*CowDiskUsage, error) {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return nil, fmt.Errorf("CowDiskUsage: not a CowForest")
+	}
+
+	f.mtx.Lock()
+	live := cow.liveTables()
+	usage := &CowDiskUsage{
+		RemovedTables:   cow.meta.compacted.removedTables,
+		RewrittenTables: cow.meta.compacted.rewrittenTables,
+		FreedBytes:      cow.meta.compacted.freedBytes,
+	}
+	f.mtx.Unlock()
+
+	tables, err := listTreeTables(cow.meta.fBasePath)
+	if err != nil {
+		return nil, err
+	}
+	for fileNum, name := range tables {
+		info, err := os.Stat(name)
+		if err != nil {
+			// removed since it was listed
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		usage.TreeTables++
+		usage.Bytes += info.Size()
+		if live[fileNum] {
+			usage.LiveTables++
+			usage.LiveBytes += info.Size()
+		} else {
+			usage.StaleTables++
+			usage.StaleBytes += info.Size()
+		}
+	}
+
+	nums, err := listManifests(cow.meta.fBasePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, num := range nums {
+		info, err := os.Stat(filepath.Join(cow.meta.fBasePath,
+			manifestFName(num)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		usage.ManifestBytes += info.Size()
+	}
+
+	return usage, nil
+}
+
+// dataLocker locks both the forest's mtx and its dataMtx, so that the
+// compactor doesn't change cow while Modify or a snapshot is reading it.
+type dataLocker struct {
+	f *Forest
+}
+
+func (l dataLocker) Lock() {
+	l.f.mtx.Lock()
+	l.f.dataMtx.Lock()
+}
+
+func (l dataLocker) Unlock() {
+	l.f.dataMtx.Unlock()
+	l.f.mtx.Unlock()
+}
+
+// compact is Compact.  mtx is the forest's lock, which compact holds only
+// while it's looking at or changing cow.
+func (cow *cowForest) compact(mtx sync.Locker) error {
+	err := cow.removeStaleTables(mtx)
+	if err != nil {
+		return err
+	}
+	err = cow.removeOrphanTables(mtx)
+	if err != nil {
+		return err
+	}
+	return cow.rewriteSparseTables(mtx)
+}
+
+// removeStaleTables removes the stale treeTables that no manifest on disk
+// points to anymore
+func (cow *cowForest) removeStaleTables(mtx sync.Locker) error {
+	mtx.Lock()
+	remove := cow.takeRemovable()
+	mtx.Unlock()
+
+	for _, fileNum := range remove {
+		err := cow.removeTable(mtx, fileNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphanTables removes the treeTables that neither the forest nor any
+// manifest on disk points to.  They're left over from a crash, or were
+// stale when the program last stopped.
+func (cow *cowForest) removeOrphanTables(mtx sync.Locker) error {
+	mtx.Lock()
+	// Tables newer than this are being written.  Any manifest committed
+	// from now on only points to newer tables or ones in live.
+	newest := cow.manifest.fileNum
+	live := cow.liveTables()
+	for _, stale := range cow.meta.staleFiles {
+		// removeStaleTables gets to these once they can go
+		live[stale.fileNum] = true
+	}
+	mtx.Unlock()
+
+	nums, err := listManifests(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		m := new(manifest)
+		err = m.load(cow.meta.fBasePath, num)
+		if err != nil {
+			// removed by a commit since it was listed
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, row := range m.location {
+			for _, fileNum := range row {
+				live[fileNum] = true
+			}
+		}
+	}
+
+	tables, err := listTreeTables(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
+	for fileNum := range tables {
+		if fileNum > newest || live[fileNum] {
+			continue
+		}
+		err = cow.removeTable(mtx, fileNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTable removes a treeTable file and counts it
+func (cow *cowForest) removeTable(mtx sync.Locker, fileNum uint64) error {
+	fName := cow.getTreeTableFName(fileNum)
+	info, err := os.Stat(fName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if verbose {
+		fmt.Printf("CLEANING UP file %d\n", fileNum)
+	}
+	err = os.Remove(fName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	mtx.Lock()
+	cow.meta.compacted.removedTables++
+	cow.meta.compacted.freedBytes += info.Size()
+	mtx.Unlock()
+	return nil
+}
+
+// sparseTable is a committed treeTable the compactor may rewrite
+type sparseTable struct {
+	treeBlockRow    uint8
+	treeTableOffset int
+	fileNum         uint64
+}
+
+// rewriteSparseTables rewrites the committed treeTables that end in enough
+// empty treeBlocks without them
+func (cow *cowForest) rewriteSparseTables(mtx sync.Locker) error {
+	var candidates []sparseTable
+	mtx.Lock()
+	for row, tables := range cow.manifest.location {
+		for offset, fileNum := range tables {
+			if fileNum > cow.meta.committedFileNum {
+				continue
+			}
+			candidates = append(candidates, sparseTable{
+				treeBlockRow:    uint8(row),
+				treeTableOffset: offset,
+				fileNum:         fileNum,
+			})
+		}
+	}
+	mtx.Unlock()
+
+	for _, c := range candidates {
+		err := cow.rewriteSparseTable(mtx, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteSparseTable rewrites the treeTable without the empty treeBlocks
+// at its end, if there are enough of them.  The new table is synced before
+// the forest points to it, like the tables in a commit.
+func (cow *cowForest) rewriteSparseTable(mtx sync.Locker, c sparseTable) error {
+	// the table can't change as a manifest on disk points to it, but it may
+	// have been replaced and removed since the candidates were picked
+	oldName := cow.getTreeTableFName(c.fileNum)
+	buf, err := ioutil.ReadFile(oldName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	tt, err := decodeTreeTable(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %s", oldName, err.Error())
+	}
+
+	count := tt.treeBlockCount()
+	used := count
+	for used > 0 && tt.memTreeBlocks[used-1].isEmpty() {
+		used--
+	}
+	if count == 0 || (count-used)*sparseTableEmpty < count {
+		return nil
+	}
+	for i := used; i < count; i++ {
+		tt.memTreeBlocks[i] = nil
+	}
+
+	mtx.Lock()
+	if cow.manifest.location[c.treeBlockRow][c.treeTableOffset] != c.fileNum {
+		mtx.Unlock()
+		return nil
+	}
+	cow.manifest.fileNum++
+	newFileNum := cow.manifest.fileNum
+	compression := cow.manifest.compression
+	mtx.Unlock()
+
+	newName := cow.getTreeTableFName(newFileNum)
+	err = saveTreeTableToDisk(tt, newName, true, compression)
+	if err != nil {
+		return err
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// the table got written to since it was read, so the rewrite is out
+	// of date
+	if cow.manifest.location[c.treeBlockRow][c.treeTableOffset] != c.fileNum {
+		return os.Remove(newName)
+	}
+	cow.manifest.location[c.treeBlockRow][c.treeTableOffset] = newFileNum
+	// if it's in the cache it hasn't been written to, so it's the same
+	// table under the new fileNum
+	if table, cached := cow.cachedTreeTables[c.fileNum]; cached {
+		table.treeTable = tt
+		cow.cachedTreeTables[newFileNum] = table
+		delete(cow.cachedTreeTables, c.fileNum)
+	}
+	cow.meta.staleFiles = append(cow.meta.staleFiles, staleFile{
+		fileNum:     c.fileNum,
+		manifestNum: cow.manifest.currentManifestNum,
+	})
+	cow.meta.compacted.rewrittenTables++
+
+	return nil
+}
+
+// liveTables returns the fileNums the forest points to now
+func (cow *cowForest) liveTables() map[uint64]bool {
+	live := make(map[uint64]bool)
+	for _, row := range cow.manifest.location {
+		for _, fileNum := range row {
+			live[fileNum] = true
+		}
+	}
+	return live
+}
+
+// listTreeTables returns the treeTable files in path by fileNum
+func listTreeTables(path string) (map[uint64]string, error) {
+	names, err := filepath.Glob(filepath.Join(path, "*"+extension))
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[uint64]string, len(names))
+	for _, name := range names {
+		fileNum, err := strconv.ParseUint(
+			strings.TrimSuffix(filepath.Base(name), extension), 10, 64)
+		if err != nil {
+			// not a treeTable
+			continue
+		}
+		tables[fileNum] = name
+	}
+	return tables, nil
+}
+
+// isEmpty returns true if all the hashes in the treeBlock are empty
+func (tb *treeBlock) isEmpty() bool {
+	for _, h := range tb.leaves {
+		if h != empty {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCowCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowcompact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cowDir := filepath.Join(dir, "cow")
+
+	f := NewForest(CowForest, nil, cowDir, 4)
+	sc := newSimChain(0x07)
+	for height := int32(1); height <= 101; height++ {
+		// the last block takes the forest past 2048 leaves, and the remap
+		// leaves the bottom row's table half empty
+		numAdds := uint32(100)
+		if height == 101 {
+			numAdds = 600
+		}
+		adds, _, delHashes := sc.NextBlock(numAdds)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height%10 == 0 || height == 101 {
+			err = f.Checkpoint(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	roots := f.GetRoots()
+
+	// a table nothing points to, as if left by a crash
+	live, err := ioutil.ReadFile(treeTableFName(cowDir,
+		f.data.(*cowForest).manifest.location[0][0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := treeTableFName(cowDir, 0)
+	err = ioutil.WriteFile(orphan, live, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := f.CowDiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(orphan)
+	if !os.IsNotExist(err) {
+		t.Fatalf("orphan table not removed: %v", err)
+	}
+
+	// once the manifests that point to the tables that were rewritten are
+	// gone, so are those tables
+	for i := int32(1); i <= manifestsKept; i++ {
+		err = f.Checkpoint(101)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkCowFiles(cowDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := f.CowDiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.RewrittenTables == 0 {
+		t.Fatalf("no sparse tables rewritten: %s", after.String())
+	}
+	if after.RemovedTables == 0 || after.StaleTables != 0 ||
+		after.Bytes >= before.Bytes {
+		t.Fatalf("before compacting: %safter: %s",
+			before.String(), after.String())
+	}
+
+	if !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("roots changed by compacting")
+	}
+	report, err := f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatal(report.String())
+	}
+
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreForest(miscFile, nil, false, false, false,
+		cowDir, 4, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.GetRoots(), roots) {
+		t.Fatal("restored roots differ")
+	}
+	report, err = restored.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatal(report.String())
+	}
+}
+
+// TestCowCompactor runs the compactor while the forest is being modified
+func TestCowCompactor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowcompactor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewForest(CowForest, nil, dir, 4)
+	ram := NewForest(RamForest, nil, "", 0)
+	err = f.StartCompactor(time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.StartCompactor(time.Millisecond)
+	if err == nil {
+		t.Fatal("started the compactor twice")
+	}
+
+	sc := newSimChain(0x07)
+	for height := int32(1); height <= 150; height++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		bp, err := ram.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ram.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.GetRoots(), ram.GetRoots()) {
+			t.Fatalf("block %d roots differ", height)
+		}
+		if height%5 == 0 {
+			err = f.Checkpoint(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	f.StopCompactor()
+
+	report, err := f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatal(report.String())
+	}
+	usage, err := f.CowDiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.RemovedTables == 0 {
+		t.Fatalf("compactor removed nothing: %s", usage.String())
+	}
+}
@@ -0,0 +1,373 @@
+package accumulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The miscforestfile and the pollard file start with a 4 byte magic and a
+// 4 byte format version, and end with a crc32 of everything before it.
+// The magics start with 0xff so they can't be mistaken for the files saved
+// before there was a header, which start with a big endian numLeaves.
+//
+// The forest file keeps the hashes at the start so the disk backends can
+// keep using position * 32 as the offset.  The checksums go in a footer
+// after the hashes: a crc32 for every forestChecksumBlock bytes, then
+//
+// [8 length of the hashes] [4 block size] [4 version] [8 magic] [4 crc32]
+//
+// where the last crc32 is of the footer before it.  A footer is only
+// there while the forest is closed; RestoreForest takes it off for the
+// backends that work on the file itself.
+
+// fileFormatVersion is the version written in the headers and the footer
+const fileFormatVersion uint32 = 1
+
+// forestChecksumBlock is how many bytes of the forest file each checksum
+// covers.  32768 hashes.
+const forestChecksumBlock = 1 << 20
+
+// forestFooterTail is the length of the fixed part at the end of the footer
+const forestFooterTail = 8 + 4 + 4 + 8 + 4
+
+var (
+	miscFileMagic     = [4]byte{0xff, 'u', 'm', 'f'}
+	pollardFileMagic  = [4]byte{0xff, 'u', 'p', 'l'}
+	forestFooterMagic = [8]byte{'u', 'f', 'o', 'r', 'e', 's', 't', 0xff}
+)
+
+// crcTable is the crc32 table for every checksum the accumulator saves
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrorCorruptForest  = errors.New("forest file is corrupted")
+	ErrorCorruptMisc    = errors.New("miscforestfile is corrupted")
+	ErrorCorruptPollard = errors.New("pollard file is corrupted")
+
+	// ErrorUnsealedForest is what RestoreForest gives back for a forest
+	// file with no checksums because it wasn't closed.  ResealForestFile
+	// puts them back.
+	ErrorUnsealedForest = errors.New("forest file has no checksums. It " +
+		"wasn't closed cleanly")
+)
+
+// ForestChecksumError is what RestoreForest gives back when blocks of the
+// forest file don't match their checksums.
+type ForestChecksumError struct {
+	// BadBlocks are the blocks that don't match, in order
+	BadBlocks []uint64
+	// Length is how many bytes of hashes the footer covers
+	Length int64
+}
+
+// Positions gives the first and last forest positions in a block
+func (e *ForestChecksumError) Positions(block uint64) (uint64, uint64) {
+	first := block * forestChecksumBlock / leafSize
+	end := (block + 1) * forestChecksumBlock
+	if end > uint64(e.Length) {
+		end = uint64(e.Length)
+	}
+	return first, end/leafSize - 1
+}
+
+func (e *ForestChecksumError) Error() string {
+	first, last := e.Positions(e.BadBlocks[0])
+	s := fmt.Sprintf("%s: block %d (positions %d to %d) checksum doesn't "+
+		"match", ErrorCorruptForest.Error(), e.BadBlocks[0], first, last)
+	if len(e.BadBlocks) > 1 {
+		s += fmt.Sprintf(", and %d more blocks don't", len(e.BadBlocks)-1)
+	}
+	return s
+}
+
+// forestChecksums gives the crc32 of every block of the first length bytes
+func forestChecksums(r io.ReaderAt, length int64) ([]uint32, error) {
+	sums := make([]uint32, 0,
+		(length+forestChecksumBlock-1)/forestChecksumBlock)
+	buf := make([]byte, forestChecksumBlock)
+	for offset := int64(0); offset < length; offset += forestChecksumBlock {
+		b := buf
+		if length-offset < forestChecksumBlock {
+			b = buf[:length-offset]
+		}
+		_, err := r.ReadAt(b, offset)
+		if err != nil {
+			return nil, fmt.Errorf("forest checksums at %d: %s",
+				offset, err.Error())
+		}
+		sums = append(sums, crc32.Checksum(b, crcTable))
+	}
+	return sums, nil
+}
+
+// writeForestFooter puts the footer for sums after the first length bytes
+// of the file and cuts off whatever was after it.
+func writeForestFooter(file *os.File, length int64, sums []uint32) error {
+	footer := make([]byte, len(sums)*4+forestFooterTail)
+	for i, sum := range sums {
+		binary.BigEndian.PutUint32(footer[i*4:], sum)
+	}
+	tail := footer[len(sums)*4:]
+	binary.BigEndian.PutUint64(tail[0:8], uint64(length))
+	binary.BigEndian.PutUint32(tail[8:12], forestChecksumBlock)
+	binary.BigEndian.PutUint32(tail[12:16], fileFormatVersion)
+	copy(tail[16:24], forestFooterMagic[:])
+	binary.BigEndian.PutUint32(tail[24:28],
+		crc32.Checksum(footer[:len(footer)-4], crcTable))
+
+	_, err := file.WriteAt(footer, length)
+	if err != nil {
+		return fmt.Errorf("write forest footer: %s", err.Error())
+	}
+	err = file.Truncate(length + int64(len(footer)))
+	if err != nil {
+		return fmt.Errorf("write forest footer: %s", err.Error())
+	}
+	return file.Sync()
+}
+
+// readForestFooter reads the footer at the end of the forest file and
+// gives back how many bytes of hashes it covers and their checksums.
+func readForestFooter(file *os.File) (int64, []uint32, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if stat.Size() < forestFooterTail {
+		return 0, nil, ErrorUnsealedForest
+	}
+	tail := make([]byte, forestFooterTail)
+	_, err = file.ReadAt(tail, stat.Size()-forestFooterTail)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(tail[16:24], forestFooterMagic[:]) {
+		return 0, nil, ErrorUnsealedForest
+	}
+	version := binary.BigEndian.Uint32(tail[12:16])
+	if version != fileFormatVersion {
+		return 0, nil, fmt.Errorf("forest file format version %d, "+
+			"only know %d", version, fileFormatVersion)
+	}
+	length := int64(binary.BigEndian.Uint64(tail[0:8]))
+	blockSize := int64(binary.BigEndian.Uint32(tail[8:12]))
+	if blockSize != forestChecksumBlock || length < 0 ||
+		length > stat.Size() {
+
+		return 0, nil, fmt.Errorf("%s: bad footer", ErrorCorruptForest.Error())
+	}
+	numSums := (length + blockSize - 1) / blockSize
+	footerLen := numSums*4 + forestFooterTail
+	if length+footerLen != stat.Size() {
+		return 0, nil, fmt.Errorf("%s: %d bytes of hashes and a %d byte "+
+			"footer but the file is %d bytes", ErrorCorruptForest.Error(),
+			length, footerLen, stat.Size())
+	}
+	footer := make([]byte, footerLen)
+	_, err = file.ReadAt(footer, length)
+	if err != nil {
+		return 0, nil, err
+	}
+	if crc32.Checksum(footer[:footerLen-4], crcTable) !=
+		binary.BigEndian.Uint32(footer[footerLen-4:]) {
+
+		return 0, nil, fmt.Errorf("%s: footer checksum doesn't match",
+			ErrorCorruptForest.Error())
+	}
+	sums := make([]uint32, numSums)
+	for i := range sums {
+		sums[i] = binary.BigEndian.Uint32(footer[i*4:])
+	}
+	return length, sums, nil
+}
+
+// checkForestFile checks every block of the forest file against the
+// footer and gives back how many bytes of hashes there are.  If blocks
+// don't match the error is a *ForestChecksumError.
+func checkForestFile(file *os.File) (int64, error) {
+	length, sums, err := readForestFooter(file)
+	if err != nil {
+		return 0, err
+	}
+	got, err := forestChecksums(file, length)
+	if err != nil {
+		return 0, err
+	}
+	var bad []uint64
+	for i := range sums {
+		if got[i] != sums[i] {
+			bad = append(bad, uint64(i))
+		}
+	}
+	if len(bad) != 0 {
+		return 0, &ForestChecksumError{BadBlocks: bad, Length: length}
+	}
+	return length, nil
+}
+
+// ResealForestFile writes new checksums for the hashes in a forest file,
+// accepting whatever is in there now.  It's for repairing a forest that
+// RestoreForest refused with a ForestChecksumError or ErrorUnsealedForest;
+// the forest should be audited and repaired right after.  A forest file
+// with no footer is all hashes, and has to be big enough for the rows in
+// the miscforestfile.
+func ResealForestFile(miscForestFile io.Reader, forestFile *os.File) error {
+	length, _, err := readForestFooter(forestFile)
+	if err == ErrorUnsealedForest {
+		length, err = unsealedForestLength(miscForestFile, forestFile)
+	}
+	if err != nil {
+		return fmt.Errorf("ResealForestFile: %s", err.Error())
+	}
+	sums, err := forestChecksums(forestFile, length)
+	if err != nil {
+		return fmt.Errorf("ResealForestFile: %s", err.Error())
+	}
+	return writeForestFooter(forestFile, length, sums)
+}
+
+// unsealedForestLength checks that a forest file without a footer could
+// be the forest the miscforestfile is for, and gives back its length.
+// The rows can be behind the forest file, since the miscforestfile is
+// only written when the forest is closed.
+func unsealedForestLength(
+	miscForestFile io.Reader, forestFile *os.File) (int64, error) {
+
+	_, rows, _, _, err := readMiscFile(miscForestFile)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := forestFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	need := int64((2<<rows)-1) * leafSize
+	if stat.Size()%leafSize != 0 || stat.Size() < need {
+		return 0, fmt.Errorf("%s: %d bytes, but %d rows need %d",
+			ErrorCorruptForest.Error(), stat.Size(), rows, need)
+	}
+	return stat.Size(), nil
+}
+
+// forestFileData is a ForestData that works on the forest file itself
+type forestFileData interface {
+	// forestFile writes out everything and gives back the file
+	forestFile() (*os.File, error)
+}
+
+func (d *diskForestData) forestFile() (*os.File, error) {
+	return d.file, nil
+}
+
+func (d *cacheForestData) forestFile() (*os.File, error) {
+	flushCacheToDisk(d)
+	return d.file, nil
+}
+
+// sealForestFile puts the checksums footer on the forest file of a
+// backend that works on the file, before it's closed.
+func sealForestFile(data ForestData) error {
+	fd, ok := data.(forestFileData)
+	if !ok {
+		return nil
+	}
+	file, err := fd.forestFile()
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sums, err := forestChecksums(file, stat.Size())
+	if err != nil {
+		return err
+	}
+	return writeForestFooter(file, stat.Size(), sums)
+}
+
+// writeMiscFile writes the miscforestfile: the header, numLeaves, rows,
+// the hash type and the checksum.
+func writeMiscFile(w io.Writer, numLeaves uint64, rows uint8,
+	hashType HashType) error {
+
+	buf := make([]byte, 0, 4+4+8+1+1+4)
+	buf = append(buf, miscFileMagic[:]...)
+	buf = appendUint32(buf, fileFormatVersion)
+	buf = appendUint64(buf, numLeaves)
+	buf = append(buf, rows, byte(hashType))
+	buf = appendUint32(buf, crc32.Checksum(buf, crcTable))
+	_, err := w.Write(buf)
+	return err
+}
+
+// readMiscFile reads the miscforestfile.  versioned is false for files
+// saved before there was a header; those don't have checksums, and might
+// not have a hash type either, in which case it's sha512_256.
+func readMiscFile(r io.Reader) (numLeaves uint64, rows uint8,
+	hashType HashType, versioned bool, err error) {
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	hashType = SHA512_256
+	if len(buf) < 4 || !bytes.Equal(buf[:4], miscFileMagic[:]) {
+		// no header
+		if len(buf) < 9 {
+			err = fmt.Errorf("%s: %d bytes", ErrorCorruptMisc.Error(),
+				len(buf))
+			return
+		}
+		numLeaves = binary.BigEndian.Uint64(buf)
+		rows = buf[8]
+		if len(buf) > 9 {
+			hashType = HashType(buf[9])
+		}
+		return
+	}
+	versioned = true
+	if len(buf) < 8 {
+		err = fmt.Errorf("%s: %d bytes", ErrorCorruptMisc.Error(), len(buf))
+		return
+	}
+	version := binary.BigEndian.Uint32(buf[4:8])
+	if version != fileFormatVersion {
+		err = fmt.Errorf("miscforestfile format version %d, only know %d",
+			version, fileFormatVersion)
+		return
+	}
+	if len(buf) != 4+4+8+1+1+4 {
+		err = fmt.Errorf("%s: %d bytes", ErrorCorruptMisc.Error(), len(buf))
+		return
+	}
+	if crc32.Checksum(buf[:len(buf)-4], crcTable) !=
+		binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+
+		err = fmt.Errorf("%s: checksum doesn't match",
+			ErrorCorruptMisc.Error())
+		return
+	}
+	numLeaves = binary.BigEndian.Uint64(buf[8:16])
+	rows = buf[16]
+	hashType = HashType(buf[17])
+	return
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var x [4]byte
+	binary.BigEndian.PutUint32(x[:], v)
+	return append(b, x[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var x [8]byte
+	binary.BigEndian.PutUint64(x[:], v)
+	return append(b, x[:]...)
+}
@@ -0,0 +1,281 @@
+package accumulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForestFileChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forestchecksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forestPath := filepath.Join(dir, "forestfile.dat")
+	miscPath := filepath.Join(dir, "miscforestfile.dat")
+
+	// enough leaves for the forest file to be more than one block
+	ram := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	for b := 0; b < 40; b++ {
+		adds, _, _ := sc.NextBlock(500)
+		_, err = ram.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots := ram.GetRoots()
+
+	forestFile, err := os.Create(forestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ram.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile.Close()
+	miscFile, err := os.Create(miscPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ram.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Close()
+
+	restore := func(toRAM, cached bool) (*Forest, error) {
+		miscFile, err := os.Open(miscPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer miscFile.Close()
+		forestFile, err := os.OpenFile(forestPath, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RestoreForest(miscFile, forestFile, toRAM, cached, false,
+			"", 0, nil, nil)
+	}
+	// restores, checks the roots and closes the forest again
+	restoreAndClose := func(toRAM, cached bool) {
+		f, err := restore(toRAM, cached)
+		if err != nil {
+			t.Fatalf("ram %v cache %v: %s", toRAM, cached, err.Error())
+		}
+		if !reflect.DeepEqual(f.GetRoots(), roots) {
+			t.Fatalf("ram %v cache %v: roots differ", toRAM, cached)
+		}
+		if toRAM {
+			forestFile, err := os.OpenFile(forestPath, os.O_RDWR, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.WriteForestToDisk(forestFile, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			forestFile.Close()
+		}
+		miscFile, err := os.Create(miscPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer miscFile.Close()
+		err = f.WriteMiscData(miscFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	restoreAndClose(false, false)
+	restoreAndClose(false, true)
+	restoreAndClose(true, false)
+
+	// a bit flip in the second block
+	forestFile, err = os.OpenFile(forestPath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forestFile.WriteAt([]byte{0x01}, 40000*leafSize+7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, toRAM := range []bool{true, false} {
+		_, err = restore(toRAM, false)
+		cerr, ok := err.(*ForestChecksumError)
+		if !ok {
+			t.Fatalf("ram %v: expected a ForestChecksumError, got %v",
+				toRAM, err)
+		}
+		if !reflect.DeepEqual(cerr.BadBlocks, []uint64{1}) {
+			t.Fatalf("bad blocks %v, expected [1]", cerr.BadBlocks)
+		}
+		if !strings.Contains(err.Error(), "block 1 (positions 32768 to 65534)") {
+			t.Fatalf("error doesn't say where: %s", err.Error())
+		}
+	}
+
+	// once resealed the flipped bit is part of the forest
+	miscFile, err = os.Open(miscPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ResealForestFile(miscFile, forestFile)
+	miscFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile.Close()
+	f, err := restore(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := f.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("flipped bit passed audit")
+	}
+
+	// a forest file that wasn't closed has no footer
+	err = os.Truncate(forestPath, int64(len(ram.data.(*ramForestData).m)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restore(false, false)
+	if err != ErrorUnsealedForest {
+		t.Fatalf("restored a forest file without checksums: %v", err)
+	}
+
+	// it can be resealed with the rows from the miscforestfile, but not if
+	// it's too short for them
+	forestFile, err = os.OpenFile(forestPath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	reseal := func() error {
+		miscFile, err := os.Open(miscPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer miscFile.Close()
+		return ResealForestFile(miscFile, forestFile)
+	}
+	err = reseal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = restore(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("resealed forest has different roots")
+	}
+	err = os.Truncate(forestPath, leafSize*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reseal()
+	if err == nil {
+		t.Fatal("resealed a forest file too short for its rows")
+	}
+}
+
+func TestMiscFile(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeMiscFile(&buf, 1234, 11, TaggedSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numLeaves, rows, hashType, versioned, err := readMiscFile(
+		bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numLeaves != 1234 || rows != 11 || hashType != TaggedSHA256 ||
+		!versioned {
+
+		t.Fatalf("read %d leaves %d rows hash type %d versioned %v",
+			numLeaves, rows, hashType, versioned)
+	}
+
+	// a flip in the magic reads as a file from before the header
+	for i := len(miscFileMagic); i < buf.Len(); i++ {
+		b := append([]byte{}, buf.Bytes()...)
+		b[i] ^= 0x10
+		_, _, _, _, err = readMiscFile(bytes.NewReader(b))
+		if err == nil {
+			t.Fatalf("flipped bit in byte %d not caught", i)
+		}
+	}
+	_, _, _, _, err = readMiscFile(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err == nil {
+		t.Fatal("cut short misc file read")
+	}
+
+	// files from before the header, with and without a hash type
+	var legacy bytes.Buffer
+	binary.Write(&legacy, binary.BigEndian, uint64(1234))
+	legacy.WriteByte(11)
+	for _, expected := range []HashType{SHA512_256, TaggedSHA256} {
+		if expected == TaggedSHA256 {
+			legacy.WriteByte(byte(TaggedSHA256))
+		}
+		numLeaves, rows, hashType, versioned, err = readMiscFile(
+			bytes.NewReader(legacy.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numLeaves != 1234 || rows != 11 || hashType != expected ||
+			versioned {
+
+			t.Fatalf("read legacy %d leaves %d rows hash type %d "+
+				"versioned %v", numLeaves, rows, hashType, versioned)
+		}
+	}
+}
+
+func TestPollardChecksum(t *testing.T) {
+	p := NewPollard(nil)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(13)
+	_, err := p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(pollardFileMagic); i < len(b); i++ {
+		corrupt := append([]byte{}, b...)
+		corrupt[i] ^= 0x10
+		var q Pollard
+		err = q.RestorePollard(bytes.NewReader(corrupt))
+		if err == nil {
+			t.Fatalf("flipped bit in byte %d not caught", i)
+		}
+	}
+	var q Pollard
+	err = q.RestorePollard(bytes.NewReader(b[:len(b)-3]))
+	if err == nil || !strings.Contains(err.Error(), "cut short") {
+		t.Fatalf("cut short pollard: %v", err)
+	}
+	corrupt := append([]byte{}, b...)
+	corrupt[20] ^= 0x01
+	err = q.RestorePollard(bytes.NewReader(corrupt))
+	if err == nil || !strings.Contains(err.Error(), "checksum doesn't match") {
+		t.Fatalf("corrupt pollard: %v", err)
+	}
+}
@@ -1,11 +1,12 @@
 package accumulator
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"sort"
+	"sync"
 	"time"
 )
 
@@ -63,7 +64,34 @@ type Forest struct {
 	data ForestData
 
 	// map from hashes to positions.
-	positionMap map[MiniHash]uint64
+	positionMap PositionMap
+
+	// hasher is the hash function used for all the parent hashes
+	hasher Hasher
+
+	// hashWorkers is how many goroutines hash each row in reHash and
+	// hashRow.  0 or 1 hashes everything on the calling goroutine.
+	hashWorkers int
+
+	// snapshots are the snapshots of this forest that haven't been
+	// released.  Before anything in the forest changes, the old value is
+	// saved for each of them.
+	snapshots []*snapshotData
+
+	// mtx is held by Modify, Undo, Add, Prove, ProveBatch and GetRoots for
+	// as long as they run.  The rest of the Forest methods aren't safe to
+	// call while those run.
+	mtx sync.Mutex
+
+	// dataMtx is held around each read and change of data, positionMap,
+	// rows and snapshots, but not for a whole block.  It's the only lock
+	// snapshots take, so they can be read from other goroutines without
+	// waiting for Modify.
+	dataMtx sync.Mutex
+
+	// compactor is the CowForest's compactor when it's running.  It's
+	// started and stopped by StartCompactor and StopCompactor.
+	compactor *compactor
 
 	/*
 	 * below are just for testing / benchmarking
@@ -73,15 +101,16 @@ type Forest struct {
 	// Meant for testing / benchmarking.
 	historicHashes uint64
 
-	// timeRem represents how long Remove() function took.
+	// timeRem represents how long the removev4() function took.
 	// Meant for testing / benchmarking.
 	timeRem time.Duration
 
-	// timeMST represents how long the moveSubTree() function took.
+	// timeMST represents how long swapping subtrees in removev4() took.
 	// Meant for testing / benchmarking.
 	timeMST time.Duration
 
-	// timeInHash represents how long the hash operations (reHash) took.
+	// timeInHash represents how long the hash operations (reHash and
+	// hashRow) took.
 	// Meant for testing / benchmarking.
 	timeInHash time.Duration
 
@@ -94,8 +123,8 @@ type Forest struct {
 	timeInVerify time.Duration
 }
 
-// ForestType defines the 4 type of forests:
-// DiskForest, RamForest, CacheForest, CowForest
+// ForestType defines the 5 type of forests:
+// DiskForest, RamForest, CacheForest, CowForest, MmapForest
 type ForestType int
 
 const (
@@ -112,20 +141,34 @@ const (
 	//               Pass cached = true to create a cacheForest.
 	CacheForest
 	// CowForest   - A copy-on-write (really a redirect on write) forest. It strikes
-	//               a balance between ram usage and speed. Not compatible with other
-	//               forest types though (meaning there isn't functionality implemented
-	//               to convert a CowForest to DiskForest and vise-versa). Pass a filepath
+	//               a balance between ram usage and speed. Can't restore from the other
+	//               forest types' files or the other way around; use ConvertForest
+	//               to convert a CowForest to DiskForest and vise-versa. Pass a filepath
 	//               and cowMaxCache(how much MB to use in ram) to create a CowForest.
 	CowForest
+	// MmapForest  - keeps the entire forest on disk like DiskForest, but memory-maps
+	//               the file instead of reading and writing it. Linux only. Is
+	//               compatible with DiskForest, RamForest and CacheForest. Pass an
+	//               os.File as forestFile to create a MmapForest.
+	MmapForest
 )
 
 // NewForest initializes a Forest and returns it. The given arguments determine
 // what type of forest it will be.
 func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMaxCache int) *Forest {
+	return NewForestWithHasher(
+		forestType, forestFile, cowPath, cowMaxCache, DefaultHasher)
+}
+
+// NewForestWithHasher is NewForest but with a hash function other than the
+// default.
+func NewForestWithHasher(forestType ForestType, forestFile *os.File,
+	cowPath string, cowMaxCache int, hasher Hasher) *Forest {
 
 	f := new(Forest)
 	f.numLeaves = 0
 	f.rows = 0
+	f.hasher = hasher
 
 	switch forestType {
 	case DiskForest:
@@ -144,11 +187,18 @@ func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMa
 		if err != nil {
 			panic(err)
 		}
+		d.manifest.hashType = hasher.Type()
+		f.data = d
+	case MmapForest:
+		d, err := newMmapForestData(forestFile)
+		if err != nil {
+			panic(err)
+		}
 		f.data = d
 	}
 
 	f.data.resize((2 << f.rows) - 1)
-	f.positionMap = make(map[MiniHash]uint64)
+	f.positionMap = newRamPositionMap()
 	return f
 }
 
@@ -172,9 +222,11 @@ func (f *Forest) removev4(dels []uint64) error {
 	// TODO Maybe pollard and forest can both satisfy the same interface..?
 	for r := uint8(0); r < f.rows; r++ {
 		hashDirt = updateDirt(hashDirt, swapRows[r], f.numLeaves, f.rows)
+		swaptime := time.Now()
 		for _, swap := range swapRows[r] {
 			f.swapNodes(swap, r)
 		}
+		f.timeMST += time.Since(swaptime)
 		// do all the hashes at once at the end
 		err := f.hashRow(hashDirt)
 		if err != nil {
@@ -238,9 +290,9 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 		panic("got non-moving swap")
 	}
 	if row == 0 {
-		f.data.swapHash(s.from, s.to)
-		f.positionMap[f.data.read(s.to).Mini()] = s.to
-		f.positionMap[f.data.read(s.from).Mini()] = s.from
+		f.swapHash(s.from, s.to)
+		f.setPos(f.read(s.to).Mini(), s.to)
+		f.setPos(f.read(s.from).Mini(), s.from)
 		return
 	}
 	a := childMany(s.from, row, f.rows)
@@ -249,19 +301,26 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 
 	// happens before the actual swap, so swapping a and b
 	for i := uint64(0); i < run; i++ {
-		f.positionMap[f.data.read(a+i).Mini()] = b + i
-		f.positionMap[f.data.read(b+i).Mini()] = a + i
+		f.setPos(f.read(a+i).Mini(), b+i)
+		f.setPos(f.read(b+i).Mini(), a+i)
 	}
 
 	// start at the bottom and go to the top
 	for r := uint8(0); r <= row; r++ {
-		f.data.swapHashRange(a, b, run)
+		f.swapHashRange(a, b, run)
 		a = parent(a, f.rows)
 		b = parent(b, f.rows)
 		run >>= 1
 	}
 }
 
+// SetHashWorkers sets how many goroutines hash the parents in each row when
+// the forest is modified.  The roots come out the same no matter how many
+// workers there are.  0 or 1 (the default) hashes on the calling goroutine.
+func (f *Forest) SetHashWorkers(workers int) {
+	f.hashWorkers = workers
+}
+
 // reHash hashes new data in the forest based on dirty positions.
 // right now it seems "dirty" means the node itself moved, not that the
 // parent has changed children.
@@ -271,6 +330,9 @@ func (f *Forest) reHash(dirt []uint64) error {
 	if f.rows == 0 || len(dirt) == 0 { // nothing to hash
 		return nil
 	}
+	starttime := time.Now()
+	defer func() { f.timeInHash += time.Since(starttime) }()
+
 	positionList := NewPositionList()
 	defer positionList.Free()
 
@@ -302,6 +364,7 @@ func (f *Forest) reHash(dirt []uint64) error {
 	// halfway up...
 
 	var currentRow, nextRow []uint64
+	var jobs []parentJob
 
 	// floor by floor
 	for r = uint8(0); r < f.rows; r++ {
@@ -339,15 +402,21 @@ func (f *Forest) reHash(dirt []uint64) error {
 			left := right ^ 1
 			parpos := parent(left, f.rows)
 
-			if f.data.read(left) == empty || f.data.read(right) == empty {
-				f.data.write(parpos, empty)
+			lh, rh := f.read(left), f.read(right)
+			if lh == empty || rh == empty {
+				f.write(parpos, empty)
 			} else {
-				par := parentHash(f.data.read(left), f.data.read(right))
-				f.historicHashes++
-				f.data.write(parpos, par)
+				jobs = append(jobs, parentJob{pos: parpos, l: lh, r: rh})
 			}
 			nextRow = append(nextRow, parpos)
 		}
+		hashParents(f.hasher, jobs, f.hashWorkers)
+		for _, j := range jobs {
+			f.write(j.pos, j.par)
+		}
+		f.historicHashes += uint64(len(jobs))
+		jobs = jobs[:0]
+
 		if rootRows[len(rootRows)-1] == r {
 			positionList.list = positionList.list[:len(rootRows)-1]
 			rootRows = rootRows[:len(rootRows)-1]
@@ -364,13 +433,20 @@ func (f *Forest) reHash(dirt []uint64) error {
 func (f *Forest) cleanup(overshoot uint64) {
 	for p := f.numLeaves; p < f.numLeaves+overshoot; p++ {
 		// TODO this probably does nothing. or at least should.
-		delete(f.positionMap, f.data.read(p).Mini()) // clear position map
+		f.delPos(f.read(p).Mini()) // clear position map
 	}
 }
 
 // Add adds leaves to the forest.  This is the easy part.
 func (f *Forest) Add(adds []Leaf) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	f.addv2(adds)
+	err := f.commitPositions()
+	if err != nil {
+		// TODO better to return err
+		panic(err)
+	}
 }
 
 // Add adds leaves to the forest.  This is the easy part.
@@ -383,20 +459,20 @@ func (f *Forest) addv2(adds []Leaf) {
 		// reset positionList
 		positionList.list = positionList.list[:0]
 
-		f.positionMap[add.Mini()] = f.numLeaves
+		f.setPos(add.Mini(), f.numLeaves)
 		getRootsForwards(f.numLeaves, f.rows, &positionList.list)
 		pos := f.numLeaves
 		n := add.Hash
-		f.data.write(pos, n)
+		f.write(pos, n)
 		add.Hash = empty
 
 		for h := uint8(0); (f.numLeaves>>h)&1 == 1; h++ {
 			rootPos := len(positionList.list) - int(h+1)
 			// grab, pop, swap, hash, new
-			root := f.data.read(positionList.list[rootPos]) // grab
-			n = parentHash(root, n)                         // hash
-			pos = parent(pos, f.rows)                       // rise
-			f.data.write(pos, n)                            // write
+			root := f.read(positionList.list[rootPos]) // grab
+			n = f.hasher.Parent(root, n)               // hash
+			pos = parent(pos, f.rows)                  // rise
+			f.write(pos, n)                            // write
 		}
 		f.numLeaves++
 	}
@@ -407,6 +483,9 @@ func (f *Forest) addv2(adds []Leaf) {
 // adds, which show up on the right.
 // Also, the deletes need there to be correct proof data, so you should first call Verify().
 func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	numdels, numadds := len(delsUn), len(adds)
 	delta := int64(numadds - numdels) // watch 32/64 bit
 	if int64(f.numLeaves)+delta < 0 {
@@ -434,10 +513,12 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	}
 
 	// v3 should do the exact same thing as v2 now
+	remtime := time.Now()
 	err := f.removev4(dels)
 	if err != nil {
 		return nil, err
 	}
+	f.timeRem += time.Since(remtime)
 	f.cleanup(uint64(numdels))
 
 	// save the leaves past the edge for undo
@@ -449,11 +530,14 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 
 	f.addv2(adds)
 
+	err = f.commitPositions()
 	return ub, err
 }
 
 // reMap changes the rows in the forest
 func (f *Forest) reMap(destRows uint8) error {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
 
 	if destRows == f.rows {
 		return fmt.Errorf("can't remap %d to %d... it's the same",
@@ -475,6 +559,8 @@ func (f *Forest) reMap(destRows uint8) error {
 	// I don't think you ever need to remap down.  It really doesn't
 	// matter.  Something to program someday if you feel like it for fun.
 	// rows increase
+	// (this writes to f.data directly; nothing moves as far as snapshots
+	// are concerned since they find positions by row, see translatePos)
 	f.data.resize((2 << destRows) - 1)
 	pos := uint64(1 << destRows) // leftmost position of row 1
 	reach := pos >> 1            // how much to next row up
@@ -520,15 +606,15 @@ func (f *Forest) sanity() error {
 
 	getRootsForwards(f.numLeaves, f.rows, &positionList.list)
 	for _, t := range positionList.list {
-		if f.data.read(t) == empty {
+		if f.read(t) == empty {
 			return fmt.Errorf("Forest has %d leaves %d roots, but root @%d is empty",
 				f.numLeaves, len(positionList.list), t)
 		}
 	}
 
-	if uint64(len(f.positionMap)) > f.numLeaves {
+	if f.positionMap.Len() > f.numLeaves {
 		return fmt.Errorf("sanity: positionMap %d leaves but forest %d leaves",
-			len(f.positionMap), f.numLeaves)
+			f.positionMap.Len(), f.numLeaves)
 	}
 
 	return nil
@@ -537,44 +623,102 @@ func (f *Forest) sanity() error {
 // PosMapSanity is costly / slow: check that everything in posMap is correct
 func (f *Forest) PosMapSanity() error {
 	for i := uint64(0); i < f.numLeaves; i++ {
-		if f.positionMap[f.data.read(i).Mini()] != i {
+		pos, _ := f.positionMap.Get(f.read(i).Mini())
+		if pos != i {
 			return fmt.Errorf("positionMap error: map says %x @%d but @%d",
-				f.data.read(i).Prefix(), f.positionMap[f.data.read(i).Mini()], i)
+				f.read(i).Prefix(), pos, i)
 		}
 	}
 	return nil
 }
 
 // RestoreForest restores the forest on restart. Needed when resuming after exiting.
-// miscForestFile is where numLeaves and rows is stored
+// miscForestFile is where numLeaves and rows is stored.
+// toRAM, cached and mmap pick between RamForest, CacheForest and MmapForest
+// for the forestFile; if none are set it's a DiskForest.
+// The forestFile is checked against its checksums first.  If blocks don't
+// match the error is a *ForestChecksumError saying which, and if it has none
+// because it wasn't closed it's ErrorUnsealedForest.
+// If positionMap is nil the position map is kept in ram and rebuilt from the
+// leaves.  Otherwise it's the position map saved with the forest; if it
+// doesn't match the forest it gets rebuilt.
+// If hasher is nil the forest uses whatever hash function it was saved with,
+// otherwise it's an error if the saved forest uses a different one.
 func RestoreForest(
 	miscForestFile *os.File, forestFile *os.File,
-	toRAM, cached bool, cow string, cowMaxCache int) (*Forest, error) {
+	toRAM, cached, mmap bool, cow string, cowMaxCache int,
+	positionMap PositionMap, hasher Hasher) (*Forest, error) {
 
 	// start a forest for restore
 	f := new(Forest)
 
-	// Restore the numLeaves
-	err := binary.Read(miscForestFile, binary.BigEndian, &f.numLeaves)
-	if err != nil {
-		return nil, err
-	}
-	// Restore number of rows
+	// Restore numLeaves, the number of rows and the hash type.
 	// TODO optimize away "rows" and only save in minimzed form
 	// (this requires code to shrink the forest
-	binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+	numLeaves, rows, hashType, versioned, err := readMiscFile(miscForestFile)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("RestoreForest: %s", err.Error())
 	}
+	f.numLeaves, f.rows = numLeaves, rows
+	if hasher == nil {
+		hasher, err = NewHasher(hashType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkHashType(hashType, hasher)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreForest: %s", err.Error())
+	}
+	f.hasher = hasher
 
+	var rebuildPositionMap bool
 	if cow != "" {
 		cowData, err := loadCowForest(cow, cowMaxCache)
 		if err != nil {
 			return nil, err
 		}
+		err = checkHashType(cowData.manifest.hashType, hasher)
+		if err != nil {
+			return nil, fmt.Errorf("RestoreForest manifest: %s", err.Error())
+		}
+		// miscForestFile is only written on a clean exit so after a crash
+		// it can be older or newer than the checkpoint the forest is at
+		if !cowData.manifest.legacy &&
+			cowData.manifest.numLeaves != f.numLeaves {
+
+			fmt.Printf("RestoreForest: forest file has %d leaves but "+
+				"checkpoint at block %d has %d, using the checkpoint\n",
+				f.numLeaves, cowData.manifest.currentBlockHeight,
+				cowData.manifest.numLeaves)
+			f.numLeaves = cowData.manifest.numLeaves
+			f.rows = cowData.manifest.forestRows
+			// the position map was saved with a different forest
+			rebuildPositionMap = true
+		}
 
 		f.data = cowData
 	} else {
+		// forest files saved with a versioned miscforestfile have
+		// checksums.  The backends that work on the file don't want the
+		// footer there; it goes back on when the forest is closed.
+		if versioned {
+			length, err := checkForestFile(forestFile)
+			if err != nil {
+				_, ok := err.(*ForestChecksumError)
+				if ok || err == ErrorUnsealedForest {
+					return nil, err
+				}
+				return nil, fmt.Errorf("RestoreForest: %s", err.Error())
+			}
+			if !toRAM {
+				err = forestFile.Truncate(length)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
 		// open the forest file on disk even if we're going to ram
 		diskData := new(diskForestData)
 		diskData.file = forestFile
@@ -596,6 +740,11 @@ func RestoreForest(
 			}
 
 			f.data = ramData
+		} else if mmap {
+			f.data, err = newMmapForestData(forestFile)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			if cached {
 				// on disk, with cache
@@ -611,45 +760,184 @@ func RestoreForest(
 		}
 	}
 
-	// Restore positionMap by rebuilding from all leaves
-	f.positionMap = make(map[MiniHash]uint64)
-	for i := uint64(0); i < f.numLeaves; i++ {
-		f.positionMap[f.data.read(i).Mini()] = i
-	}
-	if f.positionMap == nil {
-		return nil, fmt.Errorf("Generated positionMap is nil")
-	}
-
 	// for cacheForestData the `hashCount` field gets
 	// set throught the size() call.
 	f.data.size()
 
+	// Restore positionMap, by rebuilding from all leaves if it's in ram
+	// or doesn't match
+	if positionMap != nil && !rebuildPositionMap &&
+		f.positionMapMatches(positionMap) {
+
+		f.positionMap = positionMap
+		return f, nil
+	}
+	if positionMap == nil {
+		positionMap = newRamPositionMap()
+	}
+	f.positionMap = positionMap
+	err = f.rebuildPositionMap()
+	if err != nil {
+		return nil, err
+	}
+
 	return f, nil
 }
 
+// UsePositionMap makes the forest keep its leaf positions in positionMap
+// instead of in ram.  Whatever was in positionMap is replaced with the
+// forest's leaves.
+func (f *Forest) UsePositionMap(positionMap PositionMap) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
+	old := f.positionMap
+	f.positionMap = positionMap
+	err := f.rebuildPositionMap()
+	if err != nil {
+		f.positionMap = old
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// positionMapMatches checks that a saved position map goes with the
+// forest.  The map is committed on every Modify but the forest is only
+// saved on close and at checkpoints, so after a crash the map can be ahead
+// of the forest.  It only matches if it hasn't changed since it was saved
+// along with a forest with as many leaves.
+func (f *Forest) positionMapMatches(positionMap PositionMap) bool {
+	numLeaves, ok := positionMap.SavedWith()
+	return ok && numLeaves == f.numLeaves &&
+		positionMap.Len() == f.numLeaves
+}
+
+// rebuildPositionMap clears the position map and puts in all the leaves,
+// committing every posMapBatchSize leaves so the changes don't pile up
+func (f *Forest) rebuildPositionMap() error {
+	err := f.positionMap.Clear()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < f.numLeaves; i++ {
+		f.positionMap.Put(f.data.read(i).Mini(), i)
+		if (i+1)%posMapBatchSize != 0 {
+			continue
+		}
+		err = f.positionMap.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return f.positionMap.Commit()
+}
+
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
-		l := f.data.read(pos).Mini()
-		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l, f.positionMap[l])
+		l := f.read(pos).Mini()
+		mapPos, _ := f.positionMap.Get(l)
+		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l, mapPos)
 	}
 
 	return s
 }
 
-// WriteMiscData writes the numLeaves and rows to miscForestFile
+// Checkpoint saves a CowForest to disk at block height, so that if the
+// program stops without closing the forest RestoreForest can go back to
+// it.  RestoreForest goes back further if the newest checkpoint is torn.
+// It does nothing for the other forest types.
+func (f *Forest) Checkpoint(height int32) error {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return nil
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	cow.manifest.numLeaves = f.numLeaves
+	cow.manifest.currentBlockHeight = height
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	err := cow.commit()
+	if err != nil {
+		return fmt.Errorf("Checkpoint: %s", err.Error())
+	}
+	err = f.positionMap.Saved(f.numLeaves)
+	if err != nil {
+		return fmt.Errorf("Checkpoint: %s", err.Error())
+	}
+	return cow.clean()
+}
+
+// SetCowCompression sets how a CowForest compresses the treeTables it
+// writes from now on.  It's saved in the manifest, so a restored forest
+// keeps compressing the same way.  The treeTables already on disk are read
+// whichever way they were written.  It does nothing for the other forest
+// types.
+func (f *Forest) SetCowCompression(compression TableCompression) error {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return nil
+	}
+	if compression > SnappyCompression {
+		return fmt.Errorf("SetCowCompression: %s", compression.String())
+	}
+	f.mtx.Lock()
+	cow.manifest.compression = compression
+	f.mtx.Unlock()
+	return nil
+}
+
+// CowCompression returns how a CowForest compresses its treeTables.  It's
+// NoCompression for the other forest types.
+func (f *Forest) CowCompression() TableCompression {
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return NoCompression
+	}
+	return cow.manifest.compression
+}
+
+// CheckpointHeight returns the block height of the last checkpoint of a
+// CowForest; after RestoreForest, that's the block height the forest is
+// at.  It returns false if it's not a CowForest or it has no checkpoint.
+func (f *Forest) CheckpointHeight() (int32, bool) {
+	cow, ok := f.data.(*cowForest)
+	if !ok || cow.manifest.legacy || cow.manifest.currentManifestNum == 0 {
+		return 0, false
+	}
+	return cow.manifest.currentBlockHeight, true
+}
+
+// WriteMiscData writes the numLeaves, rows and hash type to miscForestFile.
+// A forest kept in the forest file gets its checksums written and is closed.
 func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
-	err := binary.Write(miscForestFile, binary.BigEndian, f.numLeaves)
+	err := writeMiscFile(miscForestFile, f.numLeaves, f.rows, f.hasher.Type())
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(miscForestFile, binary.BigEndian, f.rows)
+	// the forest file gets its checksums before it's closed
+	err = sealForestFile(f.data)
 	if err != nil {
 		return err
 	}
 
+	// the CowForest's manifest gets committed on close
+	f.StopCompactor()
+	if cow, ok := f.data.(*cowForest); ok {
+		cow.manifest.numLeaves = f.numLeaves
+	}
 	f.data.close()
+	err = f.positionMap.Saved(f.numLeaves)
+	if err != nil {
+		return err
+	}
+	f.positionMap.Close()
 
 	return nil
 }
@@ -672,6 +960,15 @@ func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
 		if err != nil {
 			return fmt.Errorf("WriteForest write %s", err.Error())
 		}
+		sums, err := forestChecksums(
+			bytes.NewReader(ramForest.m), int64(len(ramForest.m)))
+		if err != nil {
+			return fmt.Errorf("WriteForest %s", err.Error())
+		}
+		err = writeForestFooter(dumpFile, int64(len(ramForest.m)), sums)
+		if err != nil {
+			return fmt.Errorf("WriteForest %s", err.Error())
+		}
 	}
 
 	return nil
@@ -679,6 +976,13 @@ func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
 
 // GetRoots returns all the roots of all the trees in the accumulator.
 func (f *Forest) GetRoots() []Hash {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.getRoots()
+}
+
+// getRoots is GetRoots without locking.
+func (f *Forest) getRoots() []Hash {
 	positionList := NewPositionList()
 	defer positionList.Free()
 
@@ -686,23 +990,65 @@ func (f *Forest) GetRoots() []Hash {
 	roots := make([]Hash, len(positionList.list))
 
 	for i, _ := range roots {
-		roots[i] = f.data.read(positionList.list[i])
+		roots[i] = f.read(positionList.list[i])
 	}
 
 	return roots
 }
 
-// Stats returns the current forest statics as a string. This includes
-// number of total leaves, historic hashes, length of the position map,
-// and the size of the forest
-func (f *Forest) Stats() string {
-	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
-		f.numLeaves, f.historicHashes, len(f.positionMap), f.data.size())
-	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
-		f.timeInHash.Seconds(), f.timeRem.Seconds(), f.timeMST.Seconds(),
-		f.timeInProve.Seconds())
+// ForestStats are the statistics of a Forest at one point in time
+type ForestStats struct {
+	// NumLeaves is how many leaves there are now
+	NumLeaves uint64
 
-	return s
+	// Rows is how many rows the forest has, not counting the leaves
+	Rows uint8
+
+	// HashesEver is how many hashes the forest has computed
+	HashesEver uint64
+
+	// PositionMapLength is how many leaves are in the position map
+	PositionMapLength uint64
+
+	// Size is how many positions the forest has room for
+	Size uint64
+
+	// TimeInHash is how long rehashing took, TimeRem how long removing
+	// took, TimeMST how much of TimeRem moving subtrees took, and
+	// TimeInProve and TimeInVerify how long proving and verifying took.
+	TimeInHash, TimeRem, TimeMST, TimeInProve, TimeInVerify time.Duration
+}
+
+// String returns the stats the way they're printed while building proofs
+func (s ForestStats) String() string {
+	str := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
+		s.NumLeaves, s.HashesEver, s.PositionMapLength, s.Size)
+	str += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
+		s.TimeInHash.Seconds(), s.TimeRem.Seconds(), s.TimeMST.Seconds(),
+		s.TimeInProve.Seconds())
+
+	return str
+}
+
+// Stats returns the current forest statistics. This includes number of
+// total leaves, historic hashes, length of the position map, the size of
+// the forest and how long it's spent hashing, removing and proving.
+func (f *Forest) Stats() ForestStats {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return ForestStats{
+		NumLeaves:         f.numLeaves,
+		Rows:              f.rows,
+		HashesEver:        f.historicHashes,
+		PositionMapLength: f.positionMap.Len(),
+		Size:              f.data.size(),
+		TimeInHash:        f.timeInHash,
+		TimeRem:           f.timeRem,
+		TimeMST:           f.timeMST,
+		TimeInProve:       f.timeInProve,
+		TimeInVerify:      f.timeInVerify,
+	}
 }
 
 // ToString prints out the whole thing.  Only viable for small forests
@@ -712,7 +1058,7 @@ func (f *Forest) ToString() string {
 	// tree rows should be 6 or less
 	if fh > 6 {
 		s := fmt.Sprintf("can't print %d leaves. roots:\n", f.numLeaves)
-		roots := f.GetRoots()
+		roots := f.getRoots()
 		for i, r := range roots {
 			s += fmt.Sprintf("\t%d %x\n", i, r.Mini())
 		}
@@ -728,7 +1074,7 @@ func (f *Forest) ToString() string {
 			var valstring string
 			ok := f.data.size() >= uint64(pos)
 			if ok {
-				val := f.data.read(uint64(pos))
+				val := f.read(uint64(pos))
 				if val != empty {
 					valstring = fmt.Sprintf("%x", val[:2])
 				}
@@ -767,7 +1113,7 @@ func (f *Forest) ToString() string {
 
 // FindLeaf finds a leave from the positionMap and returns a bool
 func (f *Forest) FindLeaf(leaf Hash) bool {
-	_, found := f.positionMap[leaf.Mini()]
+	_, found := f.positionMap.Get(leaf.Mini())
 	return found
 }
 
@@ -785,28 +1131,34 @@ func (f *Forest) AssertEqual(compareForest *Forest) error {
 
 	// Preliminary check of the position map element count before looping
 	// through all the elements in the map.
-	if len(f.positionMap) != len(compareForest.positionMap) {
+	if f.positionMap.Len() != compareForest.positionMap.Len() {
 		err := fmt.Errorf("position maps sizes aren't equal"+
-			"forest: %d, compared forest : %d\n", len(f.positionMap),
-			len(compareForest.positionMap))
+			"forest: %d, compared forest : %d\n", f.positionMap.Len(),
+			compareForest.positionMap.Len())
 		return err
 	}
 
 	// Make sure that the two maps are equal.
-	for key, val := range f.positionMap {
-		compVal, ok := compareForest.positionMap[key]
+	var err error
+	f.positionMap.ForEach(func(key MiniHash, val uint64) {
+		if err != nil {
+			return
+		}
+		compVal, ok := compareForest.positionMap.Get(key)
 		if !ok {
-			err := fmt.Errorf("miniHash %s doesn't exist in the the compared forest",
+			err = fmt.Errorf("miniHash %s doesn't exist in the the compared forest",
 				hex.EncodeToString(key[:]))
-			return err
+			return
 		}
 
 		if val != compVal {
-			err := fmt.Errorf("miniHash %s returned position %d for "+
+			err = fmt.Errorf("miniHash %s returned position %d for "+
 				"forest but %d for the compared forest", hex.EncodeToString(key[:]),
 				val, compVal)
-			return err
 		}
+	})
+	if err != nil {
+		return err
 	}
 
 	// Each forest needs its own position tracking as they may differ in the
@@ -849,7 +1201,7 @@ func (f *Forest) AssertEqual(compareForest *Forest) error {
 		// Loop through all the elements in the current row.
 		for i := uint8(0); i < elementCountAtRow; i++ {
 			// Read the hashes at the position from each of the forests.
-			hash := f.data.read(uint64(fPos))
+			hash := f.read(uint64(fPos))
 			compareHash := compareForest.data.read(uint64(compPos))
 
 			// If the read hashes are not the same, return error.
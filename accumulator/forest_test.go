@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"testing/quick"
 )
@@ -49,6 +50,43 @@ func TestForestAddDel(t *testing.T) {
 	}
 }
 
+func TestForestStats(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := f.Stats()
+	if s.NumLeaves != f.numLeaves || s.Rows != f.rows ||
+		s.PositionMapLength != f.positionMap.Len() ||
+		s.Size != f.data.size() {
+
+		t.Fatalf("stats %#v but forest has %d leaves %d rows %d in the "+
+			"position map and size %d", s, f.numLeaves, f.rows,
+			f.positionMap.Len(), f.data.size())
+	}
+	if s.HashesEver == 0 || s.TimeInHash == 0 || s.TimeRem == 0 ||
+		s.TimeInProve == 0 {
+
+		t.Fatalf("stats %#v didn't count the hashing and proving", s)
+	}
+	if !strings.HasPrefix(s.String(), fmt.Sprintf(
+		"numleaves: %d hashesever: %d", f.numLeaves, s.HashesEver)) {
+
+		t.Fatalf("stats string %q", s.String())
+	}
+}
+
 func TestCowForestAddDelComp(t *testing.T) {
 	// Function for writing logs.
 	writeLog := func(cowF, memF *Forest) {
@@ -271,7 +309,8 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 		return err
 	}
 	// check block proof.  Note this doesn't delete anything, just proves inclusion
-	_, _, err = verifyBatchProof(leavesToProve, bp, f.GetRoots(), f.numLeaves, nil)
+	_, _, err = verifyBatchProof(leavesToProve, bp, f.GetRoots(), f.numLeaves,
+		f.hasher, nil)
 	if err != nil {
 		return fmt.Errorf("VerifyBatchProof failed. Error: %s", err.Error())
 	}
@@ -348,7 +387,8 @@ func TestSmallRandomForests(t *testing.T) {
 		deletions := make([]int, len(leavesToDeleteSet))
 		i = 0
 		for leafTxo, _ := range leavesToDeleteSet {
-			deletions[i] = int(f.positionMap[leafTxo.Mini()])
+			pos, _ := f.positionMap.Get(leafTxo.Mini())
+			deletions[i] = int(pos)
 			i++
 		}
 		sort.Ints(deletions)
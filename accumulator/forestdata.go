@@ -1,16 +1,17 @@
 package accumulator
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+
+	"github.com/golang/snappy"
 )
 
 // leafSize is a [32]byte hash (sha256).
@@ -129,8 +130,43 @@ const nodesPerTreeBlock = (2 << treeBlockRows) - 1
 // Number of nodes that a treeTable holds
 const nodesPerTreeTable = nodesPerTreeBlock * treeBlockPerTable
 
-// Number of bytes that a treetable takes up. 2 for metadata
-const bytesPerTable = (nodesPerTreeTable * leafSize) + 2
+// Number of bytes that a treetable takes up. 2 for metadata and 4 for the
+// checksum
+const bytesPerTable = (nodesPerTreeTable * leafSize) + 2 + 4
+
+// manifestsKept is how many manifests a CowForest keeps on disk, along with
+// the treeTables they point to.  If the newest one is bad after a crash the
+// forest rolls back to an older one.
+const manifestsKept = 3
+
+// TableCompression is how a CowForest compresses its treeTables on disk.
+// The empty subtrees in a treeTable are all zero hashes, so they compress
+// well.
+type TableCompression uint8
+
+const (
+	// NoCompression writes treeTables as they are.  It's the default.
+	NoCompression TableCompression = iota
+	// SnappyCompression compresses each treeTable with snappy.
+	SnappyCompression
+)
+
+// String returns the name of the compression
+func (c TableCompression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	}
+	return fmt.Sprintf("unknown compression %d", uint8(c))
+}
+
+// compressedTableMarker goes where the treeBlockCount of a treeTable file
+// is and says that the table is compressed.  The compression follows it,
+// then the compressed table and the checksum.  There are never this many
+// treeBlocks in a table.
+const compressedTableMarker = 0xffff
 
 // extension for the forest files on disk. Stands for, "Utreexo Forest
 // On Disk
@@ -157,8 +193,31 @@ type metadata struct {
 	fBasePath string
 
 	// staleFiles are the files that are not part of the latest forest state
-	// these should be cleaned up.
-	staleFiles []uint64
+	// these should be cleaned up once no manifest on disk points to them.
+	staleFiles []staleFile
+
+	// committedFileNum is the fileNum when the last manifest was committed.
+	// Tables with a higher fileNum aren't in any manifest on disk, so they
+	// can be written over.
+	committedFileNum uint64
+
+	// unsynced are the tables flushed since the last commit.  They get
+	// synced before the next manifest is committed.
+	unsynced []uint64
+
+	// backgroundClean is true while the compactor is running.  It removes
+	// the stale files instead of clean.
+	backgroundClean bool
+
+	// compacted is what the compactor has done since the forest was loaded
+	compacted compactStats
+}
+
+// staleFile is a treeTable file that's been replaced by a new one.  The
+// manifests up to manifestNum may still point to it.
+type staleFile struct {
+	fileNum     uint64
+	manifestNum uint64
 }
 
 // manifest is the structure saved on disk for loading the current
@@ -188,28 +247,66 @@ type manifest struct {
 	// location holds the on-disk fileNum for the treeTables. 1st array
 	// holds the treeBlockRow info and the seoncd holds the offset
 	location [][]uint64
+
+	// hashType is the hash function the forest was built with
+	hashType HashType
+
+	// numLeaves is the number of leaves in the forest at currentBlockHeight
+	numLeaves uint64
+
+	// legacy is true for manifests written before they had numLeaves and a
+	// checksum
+	legacy bool
+
+	// compression is what the treeTables written from now on are
+	// compressed with.  The ones already on disk may be compressed
+	// differently; each says how it's compressed.
+	compression TableCompression
+}
+
+// manifestHashTypeMarker goes where the size of a location row would be and
+// says that the hash type follows.  Location rows are read until EOF, so
+// this lets the hash type come after them while manifests written before
+// there was a hash type (which are all sha512_256) still load.
+const manifestHashTypeMarker = 0xffffffff
+
+// manifestChecksummed is set in the forestRows byte of manifests that end
+// with numLeaves and a checksum, so that one cut short can't pass for a
+// legacy manifest.  forestRows never gets near it.
+const manifestChecksummed = 0x80
+
+// manifestCompressed is set in the forestRows byte of manifests that have
+// the treeTable compression after the hash type.  Manifests without it are
+// NoCompression.
+const manifestCompressed = 0x40
+
+// manifestFName returns the file name of the manifest with the given number
+func manifestFName(manifestNum uint64) string {
+	return fmt.Sprintf("MANIFEST-%06d", manifestNum)
 }
 
-// commit creates a new manifest version and commits it and removes the old manifest
-// The commit is atomic in that only when the commit was successful, the
-// old manifest is removed.
+// commit creates a new manifest version and commits it and removes the
+// oldest manifest.  The commit is atomic in that only when the commit was
+// successful, the oldest manifest is removed.  The last manifestsKept
+// manifests stay on disk to roll back to.
 func (m *manifest) commit(basePath string) error {
 	manifestNum := m.currentManifestNum + 1
-	fName := fmt.Sprintf("MANIFEST-%06d", manifestNum)
+	fName := manifestFName(manifestNum)
 	fPath := filepath.Join(basePath, fName)
 
 	// Create new manifest on disk
-	fNewManifest, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR, 0666)
-	defer fNewManifest.Close()
+	fNewManifest, err := os.OpenFile(
+		fPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
+	defer fNewManifest.Close()
 
 	// This is the bytes to be written
 	var buf []byte
 
 	// 1. Append forestRows
-	buf = append(buf, byte(m.forestRows))
+	buf = append(buf, byte(m.forestRows)|manifestChecksummed|manifestCompressed)
 
 	if verbose {
 		fmt.Println("buf len1 ", len(buf))
@@ -271,6 +368,22 @@ func (m *manifest) commit(basePath string) error {
 		buf = append(buf, rowBytes...)
 	}
 
+	// 6. Append the hash type
+	var marker [4]byte
+	binary.LittleEndian.PutUint32(marker[:], manifestHashTypeMarker)
+	buf = append(buf, marker[:]...)
+	buf = append(buf, byte(m.hashType))
+	buf = append(buf, byte(m.compression))
+
+	// 7. Append numLeaves and the checksum of everything before it
+	var numLeaves [8]byte
+	binary.LittleEndian.PutUint64(numLeaves[:], m.numLeaves)
+	buf = append(buf, numLeaves[:]...)
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(
+		checksum[:], crc32.Checksum(buf, crcTable))
+	buf = append(buf, checksum[:]...)
+
 	if verbose {
 		fmt.Println(len(buf))
 	}
@@ -279,26 +392,37 @@ func (m *manifest) commit(basePath string) error {
 	if err != nil {
 		return err
 	}
+	err = fNewManifest.Sync()
+	if err != nil {
+		return err
+	}
 
 	// Overwrite the current manifest number in CURRENT
 	curFileName := filepath.Join(basePath, "CURRENT")
-	fCurrent, err := os.OpenFile(curFileName, os.O_CREATE|os.O_WRONLY, 0666)
-	defer fCurrent.Close()
+	fCurrent, err := os.OpenFile(
+		curFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
+	defer fCurrent.Close()
 	fNameByteArray := []byte(fName)
 	_, err = fCurrent.WriteAt(fNameByteArray, 0)
 	if err != nil {
 		return err
 	}
+	err = fCurrent.Sync()
+	if err != nil {
+		return err
+	}
+	m.currentManifestNum = manifestNum
+	m.legacy = false
 
-	if m.currentManifestNum > 0 {
-		// Remove old manifest
-		fOldName := fmt.Sprintf("MANIFEST-%06d", m.currentManifestNum)
-		OldFPath := filepath.Join(basePath, fOldName)
+	if manifestNum > manifestsKept {
+		// Remove the oldest manifest
+		OldFPath := filepath.Join(
+			basePath, manifestFName(manifestNum-manifestsKept))
 		err = os.Remove(OldFPath)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			e := fmt.Errorf("ErrOldManifestNotRemoved")
 			return e
 		}
@@ -307,51 +431,30 @@ func (m *manifest) commit(basePath string) error {
 	return nil
 }
 
-// load loades the manifest from the disk
-func (m *manifest) load(path string) error {
-	curFileName := filepath.Join(path, "CURRENT")
-
-	curFile, err := os.OpenFile(curFileName, os.O_RDONLY, 0666)
-	defer curFile.Close()
-	if err != nil {
-		return err
-	}
-
-	manifestBytes, err := ioutil.ReadAll(curFile)
+// load loads manifest number manifestNum from the disk.  It's an
+// ErrorCorruptManifest if the checksum doesn't match or it's cut short.
+func (m *manifest) load(path string, manifestNum uint64) error {
+	maniFilePath := filepath.Join(path, manifestFName(manifestNum))
+	maniBytes, err := ioutil.ReadFile(maniFilePath)
 	if err != nil {
 		return err
 	}
 
-	maniFName := string(manifestBytes[:])
-
-	maniFilePath := filepath.Join(path, maniFName)
-
-	maniNumString := strings.Replace(
-		maniFName, "MANIFEST-", "", -1)
-
 	// set manifest num
-	m.currentManifestNum, err = strconv.ParseUint(
-		maniNumString, 10, 64)
-	if err != nil {
-		return err
-	}
-
-	maniFile, err := os.Open(maniFilePath)
-	defer maniFile.Close()
-	if err != nil {
-		return err
-	}
+	m.currentManifestNum = manifestNum
 
 	// 45 bytes are all that's needed to load except for the locations
-	buf := make([]byte, 45)
-
-	_, err = maniFile.Read(buf)
-	if err != nil {
-		return err
+	if len(maniBytes) < 45 {
+		return fmt.Errorf("%s, %s is %d bytes", errorCorruptManifest(),
+			maniFilePath, len(maniBytes))
 	}
+	buf := maniBytes[:45]
+	maniFile := bytes.NewReader(maniBytes[45:])
 
 	// 1. Read forestRows
-	m.forestRows = uint8(buf[0])
+	m.forestRows = uint8(buf[0]) &^ (manifestChecksummed | manifestCompressed)
+	m.legacy = buf[0]&manifestChecksummed == 0
+	hasCompression := buf[0]&manifestCompressed != 0
 
 	if verbose {
 		fmt.Println("forestRows:", m.forestRows)
@@ -378,27 +481,62 @@ func (m *manifest) load(path string) error {
 	}
 
 	var treeBlockRow int
+	// manifests without a hash type are sha512_256
+	m.hashType = SHA512_256
 	// 5. Append locations
 	for {
 		sizeBuf := make([]byte, 4)
 
-		_, err := maniFile.Read(sizeBuf)
+		_, err := io.ReadFull(maniFile, sizeBuf)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return fmt.Errorf("%s, %s: %s", errorCorruptManifest(),
+				maniFilePath, err.Error())
 		}
-		m.location = append(m.location, []uint64{})
 
 		rowSize := binary.LittleEndian.Uint32(sizeBuf)
 
+		// 6. Read the hash type, which is always after the locations
+		if rowSize == manifestHashTypeMarker {
+			var hashType [1]byte
+			_, err = io.ReadFull(maniFile, hashType[:])
+			if err != nil {
+				return fmt.Errorf("%s, %s: %s", errorCorruptManifest(),
+					maniFilePath, err.Error())
+			}
+			m.hashType = HashType(hashType[0])
+
+			// the compression comes right after it
+			if hasCompression {
+				var compression [1]byte
+				_, err = io.ReadFull(maniFile, compression[:])
+				if err != nil {
+					return fmt.Errorf("%s, %s: %s", errorCorruptManifest(),
+						maniFilePath, err.Error())
+				}
+				m.compression = TableCompression(compression[0])
+				if m.compression > SnappyCompression {
+					return fmt.Errorf("%s, %s: %s", errorCorruptManifest(),
+						maniFilePath, m.compression.String())
+				}
+			}
+			break
+		}
+		m.location = append(m.location, []uint64{})
+
 		if verbose {
 			fmt.Println("rowsize", rowSize)
 		}
+		if uint64(rowSize)*binary.MaxVarintLen64 > uint64(maniFile.Len()) {
+			return fmt.Errorf("%s, %s row %d has %d tables but only %d "+
+				"bytes left", errorCorruptManifest(), maniFilePath,
+				treeBlockRow, rowSize, maniFile.Len())
+		}
 		rowBytes := make([]byte, rowSize*binary.MaxVarintLen64)
 
-		_, err = maniFile.Read(rowBytes)
+		_, err = io.ReadFull(maniFile, rowBytes)
 		if err != nil {
 			return err
 		}
@@ -415,6 +553,29 @@ func (m *manifest) load(path string) error {
 		fmt.Println(m.location)
 	}
 
+	// 7. Read numLeaves and check the checksum
+	if m.legacy {
+		// written before manifests had numLeaves and a checksum
+		if maniFile.Len() != 0 {
+			return fmt.Errorf("%s, %s has %d extra bytes at the end",
+				errorCorruptManifest(), maniFilePath, maniFile.Len())
+		}
+		return nil
+	}
+	if maniFile.Len() != 12 {
+		return fmt.Errorf("%s, %s has %d bytes after the locations, "+
+			"expected 12", errorCorruptManifest(), maniFilePath,
+			maniFile.Len())
+	}
+	var tail [12]byte
+	maniFile.Read(tail[:])
+	m.numLeaves = binary.LittleEndian.Uint64(tail[:8])
+	checksum := binary.LittleEndian.Uint32(tail[8:])
+	if crc32.Checksum(maniBytes[:len(maniBytes)-4], crcTable) != checksum {
+		return fmt.Errorf("%s, %s checksum doesn't match",
+			errorCorruptManifest(), maniFilePath)
+	}
+
 	return nil
 }
 
@@ -593,9 +754,10 @@ func (tt *treeTable) serialize(buf *[]byte) {
 
 	// Append two bytes to save space for the treeBlockCount
 	*buf = append(*buf, []byte{0, 0}...)
-	for _, tb := range tt.memTreeBlocks {
+	for _, tb := range tt.memTreeBlocks[:tt.treeBlockCount()] {
+		// a missing treeBlock before the last one is all empty
 		if tb == nil {
-			break
+			tb = new(treeBlock)
 		}
 
 		tbBuf = tbBuf[:0]
@@ -613,6 +775,17 @@ func (tt *treeTable) serialize(buf *[]byte) {
 	return
 }
 
+// treeBlockCount returns how many treeBlocks the table has, up to and
+// including the last one that's there
+func (tt *treeTable) treeBlockCount() int {
+	for i := len(tt.memTreeBlocks) - 1; i >= 0; i-- {
+		if tt.memTreeBlocks[i] != nil {
+			return i + 1
+		}
+	}
+	return 0
+}
+
 // given a fileNum on disk, deserialize that table
 func deserializeTreeTable(treeSlice io.Reader) (*treeTable, error) {
 	tt := new(treeTable)
@@ -711,11 +884,10 @@ func initialize(path string, maxTreeTableCache int) (*cowForest, error) {
 	return &cow, nil
 }
 
-// loads an existing cowForest
+// loads an existing cowForest.  If the newest manifest or any of its
+// treeTables is bad, it rolls back to the newest manifest that's good.
 func loadCowForest(path string, maxTreeTableCache int) (*cowForest, error) {
-	maniToLoad := new(manifest)
-
-	err := maniToLoad.load(path)
+	maniToLoad, older, err := recoverManifest(path)
 	if err != nil {
 		return nil, err
 	}
@@ -730,9 +902,15 @@ func loadCowForest(path string, maxTreeTableCache int) (*cowForest, error) {
 		manifest: *maniToLoad,
 		meta:     m,
 	}
+	cow.meta.committedFileNum = maniToLoad.fileNum
 
 	cow.cachedTreeTables = make(map[uint64]*cachedTreeTable)
 
+	err = cow.findStaleFiles(older)
+	if err != nil {
+		return nil, err
+	}
+
 	return &cow, nil
 }
 func (cow *cowForest) searchCache(location uint64) (*cachedTreeTable, bool) {
@@ -835,7 +1013,7 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 	// check if it exists in memory
 	table, found := cow.searchCache(location)
 
-	// if not found in memory, load then update the fileNum
+	// if not found in memory, load it
 	if !found {
 		// Load the treeTable onto memory. This maps the table to the location
 		table, err = cow.load(location)
@@ -843,7 +1021,10 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 			// TODO better to return err
 			panic(err)
 		}
-
+	}
+	// a table that a manifest on disk points to is never written over.
+	// Update the fileNum so it gets written to a new file.
+	if location <= cow.meta.committedFileNum {
 		cow.updateTableNum(table,
 			treeBlockRow, treeTableOffset, location)
 	}
@@ -1005,8 +1186,10 @@ func (cow *cowForest) updateTableNum(table *cachedTreeTable,
 	delete(cow.cachedTreeTables, location)
 
 	// add file to be cleaned up
-	cow.meta.staleFiles = append(
-		cow.meta.staleFiles, location)
+	cow.meta.staleFiles = append(cow.meta.staleFiles, staleFile{
+		fileNum:     location,
+		manifestNum: cow.manifest.currentManifestNum,
+	})
 }
 
 // Load will load the existing forest from the disk given a fileNumber
@@ -1020,8 +1203,7 @@ func (cow *cowForest) load(fileNum uint64) (*cachedTreeTable, error) {
 	if verbose {
 		fmt.Println("FILE LOADED: ", cow.getTreeTableFName(fileNum))
 	}
-	f, err := os.Open(cow.getTreeTableFName(fileNum))
-	defer f.Close()
+	buf, err := ioutil.ReadFile(cow.getTreeTableFName(fileNum))
 	if err != nil {
 		// If the error returned is of no files existing, then the manifest
 		// is corrupt
@@ -1034,12 +1216,10 @@ func (cow *cowForest) load(fileNum uint64) (*cachedTreeTable, error) {
 		}
 		return nil, err
 	}
-	// 2 bytes for metadata
-	buf := bufio.NewReaderSize(f, bytesPerTable)
-
-	tt, err := deserializeTreeTable(buf)
+	tt, err := decodeTreeTable(buf)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %s",
+			cow.getTreeTableFName(fileNum), err.Error())
 	}
 
 	ctt := cachedTreeTable{
@@ -1055,8 +1235,13 @@ func (cow *cowForest) load(fileNum uint64) (*cachedTreeTable, error) {
 
 // Returns the treeTable name on the disk
 func (cow *cowForest) getTreeTableFName(fileNum uint64) string {
+	return treeTableFName(cow.meta.fBasePath, fileNum)
+}
+
+// treeTableFName returns the name of treeTable fileNum in the directory path
+func treeTableFName(path string, fileNum uint64) string {
 	stringLoc := fmt.Sprintf("%09d", fileNum)
-	return filepath.Join(cow.meta.fBasePath, stringLoc) + extension
+	return filepath.Join(path, stringLoc) + extension
 }
 
 // Checks if a flush is needed. True if flush is needed, false
@@ -1065,14 +1250,16 @@ func (cow *cowForest) isFlushNeeded() bool {
 	return len(cow.cachedTreeTables) > cow.meta.maxCachedTreeTables
 }
 
-// flushes first commits the state of the cowForest, cleans up the stale
-// files, then purges cachedTreeTables
+// flushes first writes the changed treeTables to disk, cleans up the
+// stale files, then purges cachedTreeTables.  It doesn't commit a manifest
+// as a flush can happen halfway through a Modify; the forest on disk stays
+// at the last commit.
 func (cow *cowForest) flush() error {
-	// commit current forest
-	err := cow.commit()
+	err := cow.writeTables(false)
 	if err != nil {
-		fmt.Printf("cowForest close error:\n%s\n"+
-			"Previously saved forest not overwritten", err)
+		// the tables can't be purged without being written
+		// TODO better to return err
+		panic(err)
 	}
 
 	err = cow.clean()
@@ -1095,82 +1282,236 @@ func (cow *cowForest) flush() error {
 		tableCount = len(cow.cachedTreeTables)
 	}
 
-	// replace manifest with the new one
-	newMani := new(manifest)
-
-	err = newMani.load(cow.meta.fBasePath)
-	if err != nil {
-		return err
-	}
-
-	cow.manifest = *newMani
-
 	return nil
 }
 
-// Saves the given treeTable to the disk with the given filepath
-func saveTreeTableToDisk(treeTable *treeTable, fName string) error {
+// Saves the given treeTable to the disk with the given filepath, compressed
+// with compression.  The table is followed by its checksum.  With sync it's
+// synced before returning; a table has to be synced before a manifest
+// points to it.
+func saveTreeTableToDisk(treeTable *treeTable, fName string, sync bool,
+	compression TableCompression) error {
+
 	buf := make([]byte, 0, bytesPerTable)
 	treeTable.serialize(&buf)
 
+	if compression != NoCompression {
+		compressed, err := compressTreeTable(buf, compression)
+		if err != nil {
+			return err
+		}
+		buf = buf[:3]
+		binary.LittleEndian.PutUint16(buf[0:2], compressedTableMarker)
+		buf[2] = byte(compression)
+		buf = append(buf, compressed...)
+	}
+
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(
+		checksum[:], crc32.Checksum(buf, crcTable))
+	buf = append(buf, checksum[:]...)
+
 	// actual writing to file
 	// calculate the file name
-	f, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR, 0666)
+	f, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	_, err = f.Write(buf)
 	if err != nil {
 		return err
 	}
+	if !sync {
+		return nil
+	}
 
-	f.Close()
+	return f.Sync()
+}
 
-	return nil
+// syncFile syncs a file that was written earlier
+func syncFile(fName string) error {
+	f, err := os.OpenFile(fName, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
-// commit makes writes to the disk and sets the forest to point to the new
-// treeBlocks. The new forest state is commited to disk only when commit is called
-func (cow *cowForest) commit() error {
-	var err error
+// checkTreeTable checks that buf is a whole treeTable file, and that the
+// checksum matches if it has one.  Tables written before they had checksums
+// only get their length checked.  Compressed tables always have a
+// checksum; they're checked before they're decompressed.
+func checkTreeTable(buf []byte) error {
+	if len(buf) < 2 {
+		return fmt.Errorf("treeTable torn, only %d bytes", len(buf))
+	}
+	treeBlockCount := binary.LittleEndian.Uint16(buf[0:2])
+	if treeBlockCount == compressedTableMarker {
+		// the marker, the compression and the checksum
+		if len(buf) < 2+1+4 {
+			return fmt.Errorf("compressed treeTable torn, only %d bytes",
+				len(buf))
+		}
+		checksum := binary.LittleEndian.Uint32(buf[len(buf)-4:])
+		if crc32.Checksum(buf[:len(buf)-4], crcTable) != checksum {
+			return fmt.Errorf("treeTable checksum doesn't match")
+		}
+		return nil
+	}
+	tableLen := 2 + int(treeBlockCount)*nodesPerTreeBlock*leafSize
+
+	switch len(buf) {
+	case tableLen:
+		return nil
+	case tableLen + 4:
+		checksum := binary.LittleEndian.Uint32(buf[tableLen:])
+		if crc32.Checksum(buf[:tableLen], crcTable) != checksum {
+			return fmt.Errorf("treeTable checksum doesn't match")
+		}
+		return nil
+	}
+	return fmt.Errorf("treeTable torn, %d treeBlocks but %d bytes",
+		treeBlockCount, len(buf))
+}
+
+// decodeTreeTable checks a treeTable file read from disk and decompresses
+// and deserializes it
+func decodeTreeTable(buf []byte) (*treeTable, error) {
+	err := checkTreeTable(buf)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(buf[0:2]) == compressedTableMarker {
+		buf, err = decompressTreeTable(
+			buf[3:len(buf)-4], TableCompression(buf[2]))
+		if err != nil {
+			return nil, err
+		}
+		// the decompressed table has no checksum
+		err = checkTreeTable(buf)
+		if err != nil ||
+			binary.LittleEndian.Uint16(buf[0:2]) == compressedTableMarker {
+			return nil, fmt.Errorf("decompressed treeTable is bad")
+		}
+	}
+	return deserializeTreeTable(bytes.NewReader(buf))
+}
+
+// compressTreeTable compresses a serialized treeTable
+func compressTreeTable(buf []byte, compression TableCompression) (
+	[]byte, error) {
+
+	switch compression {
+	case SnappyCompression:
+		return snappy.Encode(nil, buf), nil
+	}
+	return nil, fmt.Errorf("can't compress treeTable: %s",
+		compression.String())
+}
+
+// decompressTreeTable decompresses a serialized treeTable
+func decompressTreeTable(buf []byte, compression TableCompression) (
+	[]byte, error) {
+
+	switch compression {
+	case SnappyCompression:
+		return snappy.Decode(nil, buf)
+	}
+	return nil, fmt.Errorf("can't decompress treeTable: %s",
+		compression.String())
+}
+
+// writeTables writes the dirty treeTables to disk.  With sync, they and
+// the tables written since the last commit are synced.
+func (cow *cowForest) writeTables(sync bool) error {
 	for fileNum, cachedTreeTable := range cow.cachedTreeTables {
 		// only write the files that are dirty
 		if cachedTreeTable.dirty {
-			err = saveTreeTableToDisk(
-				cachedTreeTable.treeTable, cow.getTreeTableFName(fileNum))
+			err := saveTreeTableToDisk(cachedTreeTable.treeTable,
+				cow.getTreeTableFName(fileNum), sync,
+				cow.manifest.compression)
 			if err != nil {
 				return err
 			}
+			cachedTreeTable.dirty = false
+			if !sync {
+				cow.meta.unsynced = append(cow.meta.unsynced, fileNum)
+			}
+		}
+	}
+	if !sync {
+		return nil
+	}
+
+	for _, fileNum := range cow.meta.unsynced {
+		err := syncFile(cow.getTreeTableFName(fileNum))
+		// tables that went stale since were removed
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
+	cow.meta.unsynced = cow.meta.unsynced[:0]
+	return nil
+}
+
+// commit makes writes to the disk and sets the forest to point to the new
+// treeBlocks. The new forest state is commited to disk only when commit is called
+func (cow *cowForest) commit() error {
+	err := cow.writeTables(true)
+	if err != nil {
+		return err
+	}
 
 	err = cow.manifest.commit(cow.meta.fBasePath)
 	if err != nil {
 		// maybe if it couldn't commit then it should panic?
 		return err
 	}
+	cow.meta.committedFileNum = cow.manifest.fileNum
 
 	return nil
 }
 
-// Clean removes all the stale treeTables from the disk and resets staleFiles field
+// Clean removes the stale treeTables that no manifest on disk points to
+// anymore, and keeps the rest in staleFiles for later.  While the compactor
+// is running it removes them instead.
 func (cow *cowForest) clean() error {
-	for _, fileNum := range cow.meta.staleFiles {
+	if cow.meta.backgroundClean {
+		return nil
+	}
+	for _, fileNum := range cow.takeRemovable() {
 		if verbose {
 			fmt.Printf("CLEANING UP file %d\n", fileNum)
 		}
 		err := os.Remove(cow.getTreeTableFName(fileNum))
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 
-	// empty staleFiles
-	cow.meta.staleFiles = cow.meta.staleFiles[:0]
-
 	return nil
 }
 
+// takeRemovable takes the stale treeTables that no manifest on disk points
+// to anymore out of staleFiles and returns their fileNums
+func (cow *cowForest) takeRemovable() []uint64 {
+	var keep []staleFile
+	var remove []uint64
+	for _, stale := range cow.meta.staleFiles {
+		// a manifest that's still on disk may point to it
+		if stale.manifestNum+manifestsKept > cow.manifest.currentManifestNum {
+			keep = append(keep, stale)
+			continue
+		}
+		remove = append(remove, stale.fileNum)
+	}
+	cow.meta.staleFiles = keep
+
+	return remove
+}
+
 type diskForestData struct {
 	file *os.File
 }
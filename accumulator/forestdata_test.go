@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"testing/quick"
@@ -119,6 +121,137 @@ func TestTreeTableSerialize(t *testing.T) {
 
 }
 
+func TestTreeTableCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "treetablecompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// half the treeBlocks have hashes, the rest are empty like the bottom
+	// row after a remap
+	tt := newTreeTable()
+	for n := 0; n < 1000; n++ {
+		tt.memTreeBlocks[n] = new(treeBlock)
+		if n < 500 {
+			for i := range tt.memTreeBlocks[n].leaves {
+				tt.memTreeBlocks[n].leaves[i] = createRandomHash(int64(n))
+			}
+		}
+	}
+	var want []byte
+	tt.serialize(&want)
+
+	for _, compression := range []TableCompression{
+		NoCompression, SnappyCompression} {
+
+		fName := filepath.Join(dir, compression.String())
+		err = saveTreeTableToDisk(tt, fName, false, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(fName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compression != NoCompression && len(buf) >= len(want) {
+			t.Fatalf("%s table is %d bytes, uncompressed it's %d",
+				compression.String(), len(buf), len(want))
+		}
+
+		decoded, err := decodeTreeTable(buf)
+		if err != nil {
+			t.Fatalf("%s: %s", compression.String(), err.Error())
+		}
+		var got []byte
+		decoded.serialize(&got)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s table differs after decoding", compression.String())
+		}
+
+		buf[len(buf)/2] ^= 0x01
+		_, err = decodeTreeTable(buf)
+		if err == nil {
+			t.Fatalf("%s table with a flipped bit decoded",
+				compression.String())
+		}
+	}
+}
+
+// TestCowForestCompression switches a CowForest to snappy halfway through,
+// so the restored forest has both kinds of treeTables
+func TestCowForestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowcompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cowDir := filepath.Join(dir, "cow")
+
+	f := NewForest(CowForest, nil, cowDir, 4)
+	ram := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	for height := int32(1); height <= 60; height++ {
+		if height == 30 {
+			err = f.SetCowCompression(SnappyCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		adds, _, delHashes := sc.NextBlock(100)
+		bp, err := ram.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ram.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height%10 == 0 {
+			err = f.Checkpoint(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreForest(miscFile, nil, false, false, false,
+		cowDir, 4, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.CowCompression() != SnappyCompression {
+		t.Fatalf("restored forest has %s compression, expected snappy",
+			restored.CowCompression().String())
+	}
+	if !reflect.DeepEqual(restored.GetRoots(), ram.GetRoots()) {
+		t.Fatal("restored roots differ")
+	}
+	report, err := restored.Audit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatal(report.String())
+	}
+}
+
 // creates a pseudo-random hash from a given int64 source
 func createRandomHash(i int64) [32]byte {
 	rand := rand.New(rand.NewSource(i))
@@ -168,3 +301,126 @@ func TestCowForestWrite(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkForestData_Ram(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		return NewForest(RamForest, nil, "", 0)
+	}, b)
+}
+
+func BenchmarkForestData_Disk(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return NewForest(DiskForest, forestFile, "", 0)
+	}, b)
+}
+
+func BenchmarkForestData_Cache(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return NewForest(CacheForest, forestFile, "", 0)
+	}, b)
+}
+
+func BenchmarkForestData_Cow(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		return NewForest(CowForest, nil, filepath.Join(dir, "cow"), 500)
+	}, b)
+}
+
+func BenchmarkForestData_CowSnappy(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		f := NewForest(CowForest, nil, filepath.Join(dir, "cow"), 500)
+		err := f.SetCowCompression(SnappyCompression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return f
+	}, b)
+}
+
+func BenchmarkCowDiskSize_None(b *testing.B) {
+	benchmarkCowDiskSize(NoCompression, b)
+}
+
+func BenchmarkCowDiskSize_Snappy(b *testing.B) {
+	benchmarkCowDiskSize(SnappyCompression, b)
+}
+
+// benchmarkCowDiskSize times building and checkpointing a CowForest with
+// the given compression, and logs how big its treeTables are on disk
+func benchmarkCowDiskSize(compression TableCompression, b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "benchcowsize")
+		if err != nil {
+			b.Fatal(err)
+		}
+		f := NewForest(CowForest, nil, filepath.Join(dir, "cow"), 500)
+		err = f.SetCowCompression(compression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sc := newSimChain(0x3f)
+		b.StartTimer()
+		for blk := int32(1); blk <= 100; blk++ {
+			adds, _, delHashes := sc.NextBlock(1000)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = f.Checkpoint(100)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		usage, err := f.CowDiskUsage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Logf("%s: %d leaves, %d treeTables %d bytes", compression.String(),
+			f.numLeaves, usage.LiveTables, usage.LiveBytes)
+		f.data.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// benchmarkForestData times proving and modifying a forest made by
+// newForest in a new directory dir, to compare the ForestData backends.
+func benchmarkForestData(newForest func(dir string) *Forest, b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "benchforestdata")
+		if err != nil {
+			b.Fatal(err)
+		}
+		f := newForest(dir)
+		sc := newSimChain(0x3f)
+		b.StartTimer()
+		for blk := 0; blk < 100; blk++ {
+			adds, _, delHashes := sc.NextBlock(1000)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		f.data.close()
+		os.RemoveAll(dir)
+	}
+}
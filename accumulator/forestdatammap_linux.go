@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package accumulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ********************************************* forest in mmapped file
+
+// mmapForestData keeps the forest in the same flat file as diskForestData,
+// but memory-maps the file so that reads and writes are copies instead of
+// a syscall for every node.  The kernel decides what's in ram.
+type mmapForestData struct {
+	file *os.File
+	m    []byte
+}
+
+// newMmapForestData maps all of the given forest file.  The file can be
+// empty; resize maps it once it has something in it.
+func newMmapForestData(file *os.File) (ForestData, error) {
+	d := &mmapForestData{file: file}
+	s, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.Size() > 0 {
+		err = d.mmap(s.Size())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// mmap maps the first size bytes of the file
+func (d *mmapForestData) mmap(size int64) error {
+	m, err := syscall.Mmap(int(d.file.Fd()), 0, int(size),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap forest: %s", err.Error())
+	}
+	d.m = m
+	return nil
+}
+
+// munmap unmaps the file, writing it out first
+func (d *mmapForestData) munmap() error {
+	if d.m == nil {
+		return nil
+	}
+	err := d.flush()
+	if err != nil {
+		return err
+	}
+	err = syscall.Munmap(d.m)
+	if err != nil {
+		return fmt.Errorf("munmap forest: %s", err.Error())
+	}
+	d.m = nil
+	return nil
+}
+
+// flush waits until everything written to the map is on disk
+func (d *mmapForestData) flush() error {
+	if len(d.m) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&d.m[0])), uintptr(len(d.m)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("msync forest: %s", errno.Error())
+	}
+	return nil
+}
+
+// forestFile flushes the map and gives back the file
+func (d *mmapForestData) forestFile() (*os.File, error) {
+	return d.file, d.flush()
+}
+
+// read from the map.  Don't go out of bounds.
+func (d *mmapForestData) read(pos uint64) (h Hash) {
+	pos <<= 5
+	copy(h[:], d.m[pos:pos+leafSize])
+	return
+}
+
+// write to the map.  Don't go out of bounds.
+func (d *mmapForestData) write(pos uint64, h Hash) {
+	pos <<= 5
+	copy(d.m[pos:pos+leafSize], h[:])
+}
+
+// swapHash swaps 2 hashes.  Don't go out of bounds.
+func (d *mmapForestData) swapHash(a, b uint64) {
+	d.swapHashRange(a, b, 1)
+}
+
+// swapHashRange swaps 2 continuous ranges of hashes.  Don't go out of
+// bounds.
+func (d *mmapForestData) swapHashRange(a, b, w uint64) {
+	a <<= 5
+	b <<= 5
+	w <<= 5
+	temp := make([]byte, w)
+	copy(temp, d.m[a:a+w])
+	copy(d.m[a:a+w], d.m[b:b+w])
+	copy(d.m[b:b+w], temp)
+}
+
+// size gives you the size of the forest
+func (d *mmapForestData) size() uint64 {
+	return uint64(len(d.m) / leafSize)
+}
+
+// resize grows the file and maps it again.  It never gets smaller; a file
+// from a diskForestData can be bigger than it needs to be already.
+func (d *mmapForestData) resize(newSize uint64) {
+	if newSize <= d.size() {
+		return
+	}
+	err := d.munmap()
+	if err != nil {
+		panic(err)
+	}
+	err = d.file.Truncate(int64(newSize * leafSize))
+	if err != nil {
+		panic(err)
+	}
+	err = d.mmap(int64(newSize * leafSize))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (d *mmapForestData) close() {
+	err := d.munmap()
+	if err != nil {
+		fmt.Printf("mmapForestData close error: %s\n", err.Error())
+	}
+	err = d.file.Close()
+	if err != nil {
+		fmt.Printf("mmapForestData close error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMmapForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmapforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := NewForest(MmapForest, forestFile, "", 0)
+	ram := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x3f)
+	for b := 0; b < 200; b++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		for _, f := range []*Forest{mf, ram} {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b%20 == 0 {
+			err = mf.AssertEqual(ram)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+		}
+	}
+	roots := ram.GetRoots()
+	if !reflect.DeepEqual(mf.GetRoots(), roots) {
+		t.Fatal("roots differ")
+	}
+
+	// the file gets written out on close, and any of the flat forest types
+	// can restore it
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mf.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mmap restore takes the checksums off the file until it's closed,
+	// so it goes last
+	for _, mmap := range []bool{false, true} {
+		_, err = miscFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forestFile, err = os.OpenFile(
+			filepath.Join(dir, "forestfile.dat"), os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreForest(
+			miscFile, forestFile, !mmap, false, mmap, "", 0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = restored.AssertEqual(ram)
+		if err != nil {
+			t.Fatalf("mmap %v restore: %s", mmap, err.Error())
+		}
+		if !reflect.DeepEqual(restored.GetRoots(), roots) {
+			t.Fatalf("mmap %v restore: roots differ", mmap)
+		}
+		forestFile.Close()
+	}
+}
+
+func BenchmarkForestData_Mmap(b *testing.B) {
+	benchmarkForestData(func(dir string) *Forest {
+		forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return NewForest(MmapForest, forestFile, "", 0)
+	}, b)
+}
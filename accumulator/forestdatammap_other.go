@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package accumulator
+
+import (
+	"fmt"
+	"os"
+)
+
+// newMmapForestData is only on linux for now
+func newMmapForestData(file *os.File) (ForestData, error) {
+	return nil, fmt.Errorf("MmapForest is only supported on linux")
+}
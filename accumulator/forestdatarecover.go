@@ -0,0 +1,173 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Recovering a CowForest after a crash
+//
+// Every commit writes a new manifest and the last manifestsKept of them stay
+// on disk, along with every treeTable they point to; treeTables a manifest
+// points to are never written over.  A crash can leave the newest manifest
+// or the treeTables written just before it torn, so on load the manifests
+// are tried newest first and the first one that's whole and has all of its
+// treeTables whole is used.
+
+// listManifests returns the numbers of the manifests in path, newest first
+func listManifests(path string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(path, "MANIFEST-*"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, name := range names {
+		num, err := strconv.ParseUint(
+			strings.TrimPrefix(filepath.Base(name), "MANIFEST-"), 10, 64)
+		if err != nil {
+			// not a manifest
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(a, b int) bool { return nums[a] > nums[b] })
+	return nums, nil
+}
+
+// recoverManifest returns the newest manifest in path that loads and
+// whose treeTables are all there and whole, along with the older manifests
+// that load, newest first.  The newer manifests that are bad are removed.
+func recoverManifest(path string) (*manifest, []*manifest, error) {
+	nums, err := listManifests(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nums) == 0 {
+		return nil, nil, fmt.Errorf("no manifest in %s", path)
+	}
+
+	// nil for the ones that don't load
+	manifests := make([]*manifest, len(nums))
+	for i, num := range nums {
+		m := new(manifest)
+		err = m.load(path, num)
+		if err != nil {
+			fmt.Printf("can't load manifest %d: %s\n", num, err.Error())
+			continue
+		}
+		manifests[i] = m
+	}
+
+	for i, m := range manifests {
+		if m == nil {
+			continue
+		}
+		var older []*manifest
+		for _, o := range manifests[i+1:] {
+			if o != nil {
+				older = append(older, o)
+			}
+		}
+		err = checkManifestTables(path, m, older)
+		if err != nil {
+			fmt.Printf("manifest %d is bad: %s\n", m.currentManifestNum,
+				err.Error())
+			continue
+		}
+
+		if i > 0 {
+			fmt.Printf("CowForest rolled back to manifest %d at block %d\n",
+				m.currentManifestNum, m.currentBlockHeight)
+			for _, num := range nums[:i] {
+				err = os.Remove(filepath.Join(path, manifestFName(num)))
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		return m, older, nil
+	}
+
+	return nil, nil, fmt.Errorf("%s, no manifest in %s can be loaded",
+		errorCorruptManifest(), path)
+}
+
+// checkManifestTables checks that all the treeTables m points to are on
+// disk.  The ones written since the older manifests are read through and
+// checked against their checksums, as those are the ones a crash could
+// have torn.
+func checkManifestTables(path string, m *manifest, older []*manifest) error {
+	var prevFileNum uint64
+	if len(older) > 0 {
+		prevFileNum = older[0].fileNum
+	}
+	for _, row := range m.location {
+		for _, fileNum := range row {
+			fName := treeTableFName(path, fileNum)
+			if fileNum <= prevFileNum {
+				_, err := os.Stat(fName)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			buf, err := ioutil.ReadFile(fName)
+			if err != nil {
+				return err
+			}
+			err = checkTreeTable(buf)
+			if err != nil {
+				return fmt.Errorf("%s: %s", fName, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// findStaleFiles goes through the treeTable files in the cowForest's
+// directory.  The ones only the older manifests point to go in staleFiles,
+// and the ones no manifest points to are removed; they're left over from
+// before a crash.
+func (cow *cowForest) findStaleFiles(older []*manifest) error {
+	// the newest manifest that points to each file
+	pointedTo := make(map[uint64]uint64)
+	for i := len(older) - 1; i >= 0; i-- {
+		for _, row := range older[i].location {
+			for _, fileNum := range row {
+				pointedTo[fileNum] = older[i].currentManifestNum
+			}
+		}
+	}
+	for _, row := range cow.manifest.location {
+		for _, fileNum := range row {
+			pointedTo[fileNum] = cow.manifest.currentManifestNum
+		}
+	}
+
+	tables, err := listTreeTables(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
+	for fileNum, name := range tables {
+		manifestNum, ok := pointedTo[fileNum]
+		if !ok {
+			err = os.Remove(name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if manifestNum != cow.manifest.currentManifestNum {
+			cow.meta.staleFiles = append(cow.meta.staleFiles, staleFile{
+				fileNum:     fileNum,
+				manifestNum: manifestNum,
+			})
+		}
+	}
+	return nil
+}
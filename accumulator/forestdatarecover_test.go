@@ -0,0 +1,184 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCowForestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowrecover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cowDir := filepath.Join(dir, "cow")
+
+	// a tiny cache so that tables get flushed between checkpoints too
+	f := NewForest(CowForest, nil, cowDir, 4)
+	sc := newSimChain(0x07)
+	roots := make(map[int32][]Hash)
+	for height := int32(1); height <= 105; height++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height%20 == 0 {
+			err = f.Checkpoint(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots[height] = f.GetRoots()
+			err = checkCowFiles(cowDir)
+			if err != nil {
+				t.Fatalf("height %d: %s", height, err.Error())
+			}
+		}
+	}
+
+	// f is left without closing, as if the program crashed at 105.  The
+	// forest file is from a clean exit at block 0.
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewForest(RamForest, nil, "", 0).WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(wantHeight int32) *Forest {
+		_, err := miscFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreForest(miscFile, nil, false, false, false,
+			cowDir, 1, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		height, ok := restored.CheckpointHeight()
+		if !ok || height != wantHeight {
+			t.Fatalf("restored to block %d %v, expected %d",
+				height, ok, wantHeight)
+		}
+		if !reflect.DeepEqual(restored.GetRoots(), roots[wantHeight]) {
+			t.Fatalf("roots at block %d differ", wantHeight)
+		}
+		report, err := restored.Audit(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("block %d %s", wantHeight, report.String())
+		}
+		err = checkCowFiles(cowDir)
+		if err != nil {
+			t.Fatalf("block %d %s", wantHeight, err.Error())
+		}
+		return restored
+	}
+	restore(100)
+
+	// cut the newest manifest short
+	nums, err := listManifests(cowDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nums) != manifestsKept {
+		t.Fatalf("%d manifests on disk, expected %d", len(nums), manifestsKept)
+	}
+	newest := filepath.Join(cowDir, manifestFName(nums[0]))
+	info, err := os.Stat(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(newest, info.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore(80)
+
+	// tear a table that only the newest manifest points to
+	m, older, err := recoverManifest(cowDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var torn uint64
+	for _, row := range m.location {
+		for _, fileNum := range row {
+			if fileNum > older[0].fileNum {
+				torn = fileNum
+			}
+		}
+	}
+	if torn == 0 {
+		t.Fatal("no table written since the previous manifest")
+	}
+	tableFile, err := os.OpenFile(treeTableFName(cowDir, torn), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tableFile.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableFile.Close()
+	restored := restore(60)
+
+	// the forest keeps going from the checkpoint it rolled back to
+	_, err = restored.Modify([]Leaf{{Hash: Hash{0x01}}, {Hash: Hash{0x02}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots[61] = restored.GetRoots()
+	err = restored.Checkpoint(61)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore(61)
+}
+
+// checkCowFiles checks that the treeTable files in a CowForest directory
+// are the ones the manifests on disk point to, and no others
+func checkCowFiles(path string) error {
+	nums, err := listManifests(path)
+	if err != nil {
+		return err
+	}
+	pointedTo := make(map[string]bool)
+	for _, num := range nums {
+		m := new(manifest)
+		err = m.load(path, num)
+		if err != nil {
+			return err
+		}
+		for _, row := range m.location {
+			for _, fileNum := range row {
+				pointedTo[treeTableFName(path, fileNum)] = true
+			}
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(path, "*"+extension))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !pointedTo[name] {
+			return fmt.Errorf("%s isn't in a manifest", name)
+		}
+		delete(pointedTo, name)
+	}
+	for name := range pointedTo {
+		return fmt.Errorf("%s is in a manifest but isn't there", name)
+	}
+	return nil
+}
@@ -14,12 +14,14 @@ type Proof struct {
 
 // Prove :
 func (f *Forest) Prove(wanted Hash) (Proof, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	starttime := time.Now()
 
 	var pr Proof
 	var empty [32]byte
 	// first look up where the hash is
-	pos, ok := f.positionMap[wanted.Mini()]
+	pos, ok := f.leafPosition(wanted.Mini())
 	if !ok {
 		return pr, fmt.Errorf("hash %x not found", wanted)
 	}
@@ -33,7 +35,7 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 	// build empty proof branch slice of siblings
 	// not full rows -- need to figure out which subtree it's in!
 	pr.Siblings = make([]Hash, detectSubTreeRows(pos, f.numLeaves, f.rows))
-	pr.Payload = f.data.read(pos)
+	pr.Payload = f.read(pos)
 	if pr.Payload != wanted {
 		return pr, fmt.Errorf(
 			"prove: forest and position map conflict. want %x got %x at pos %d",
@@ -45,7 +47,7 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 	// go up and populate the siblings
 	for h, _ := range pr.Siblings {
 
-		pr.Siblings[h] = f.data.read(pos ^ 1)
+		pr.Siblings[h] = f.read(pos ^ 1)
 		if pr.Siblings[h] == empty {
 			fmt.Print(f.ToString())
 			return pr, fmt.Errorf(
@@ -96,11 +98,11 @@ func (f *Forest) Verify(p Proof) bool {
 		// detect current row parity
 		if 1<<uint(h)&p.Position == 0 {
 			//			fmt.Printf("compute %04x %04x -> ", n[:4], sib[:4])
-			n = parentHash(n, sib)
+			n = f.hasher.Parent(n, sib)
 			//			fmt.Printf("%04x\n", n[:4])
 		} else {
 			//			fmt.Printf("compute %04x %04x -> ", sib[:4], n[:4])
-			n = parentHash(sib, n)
+			n = f.hasher.Parent(sib, n)
 			//			fmt.Printf("%04x\n", n[:4])
 		}
 	}
@@ -111,7 +113,7 @@ func (f *Forest) Verify(p Proof) bool {
 		fmt.Printf("ERROR don't have root at %d\n", subTreeRootPos)
 		return false
 	}
-	subRoot := f.data.read(subTreeRootPos)
+	subRoot := f.read(subTreeRootPos)
 
 	if n != subRoot {
 		fmt.Printf("got %04x subroot %04x\n", n[:4], subRoot[:4])
@@ -136,6 +138,8 @@ func (f *Forest) VerifyMany(ps []Proof) bool {
 // NOTE: The order in which the hashes are given matter when verifying
 // (aka permutation matters).
 func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	starttime := time.Now()
 	var bp BatchProof
 	// skip everything if empty (should this be an error?
@@ -154,7 +158,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	bp.Targets = make([]uint64, len(hs))
 
 	for i, wanted := range hs {
-		pos, ok := f.positionMap[wanted.Mini()]
+		pos, ok := f.leafPosition(wanted.Mini())
 		if !ok {
 			fmt.Print(f.ToString())
 			return bp, fmt.Errorf("hash %x not found", wanted)
@@ -162,9 +166,9 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 		// should never happen
 		if pos > f.numLeaves {
-			for m, p := range f.positionMap {
+			f.positionMap.ForEach(func(m MiniHash, p uint64) {
 				fmt.Printf("%x @%d\t", m[:4], p)
-			}
+			})
 			return bp, fmt.Errorf(
 				"ProveBatch: got leaf position %d but only %d leaves exist",
 				pos, f.numLeaves)
@@ -187,7 +191,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 	bp.Proof = make([]Hash, len(proofPositions.list))
 	for i, proofPos := range proofPositions.list {
-		bp.Proof[i] = f.data.read(proofPos)
+		bp.Proof[i] = f.read(proofPos)
 	}
 
 	if verbose {
@@ -201,6 +205,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 // VerifyBatchProof is just a wrapper around verifyBatchProof
 func (f *Forest) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
-	_, _, err := verifyBatchProof(toProve, bp, f.GetRoots(), f.numLeaves, nil)
+	_, _, err := verifyBatchProof(toProve, bp, f.GetRoots(), f.numLeaves,
+		f.hasher, nil)
 	return err
 }
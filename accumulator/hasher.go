@@ -1,5 +1,13 @@
 package accumulator
 
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"sync"
+	"time"
+)
+
 // hashableNode is the data needed to perform a hash
 type hashableNode struct {
 	sib, dest *polNode
@@ -8,11 +16,218 @@ type hashableNode struct {
 
 // hashRow calculates new hashes for all the positions passed in
 func (f *Forest) hashRow(dirtpositions []uint64) error {
-	for _, hp := range dirtpositions {
-		l := f.data.read(child(hp, f.rows))
-		r := f.data.read(child(hp, f.rows) | 1)
-		f.data.write(hp, parentHash(l, r))
+	starttime := time.Now()
+	jobs := make([]parentJob, len(dirtpositions))
+	for i, hp := range dirtpositions {
+		jobs[i].pos = hp
+		jobs[i].l = f.read(child(hp, f.rows))
+		jobs[i].r = f.read(child(hp, f.rows) | 1)
+	}
+	hashParents(f.hasher, jobs, f.hashWorkers)
+	for _, j := range jobs {
+		f.write(j.pos, j.par)
+	}
+	f.historicHashes += uint64(len(jobs))
+	f.timeInHash += time.Since(starttime)
+
+	return nil
+}
+
+// minParallelJobs is the fewest parents in a row that get split up among
+// workers.  Below this starting the goroutines costs more than the hashing.
+const minParallelJobs = 64
+
+// parentJob is a parent at pos that needs to be hashed from its children
+// l and r.  par is the resulting hash.
+type parentJob struct {
+	pos  uint64
+	l, r Hash
+	par  Hash
+}
+
+// hashParents hashes all the jobs, splitting them up among workers
+// goroutines.  All the parents in a row only depend on the row below so
+// they can be hashed in any order; the forest data itself is only read and
+// written on the calling goroutine so ForestData doesn't need to be safe
+// for concurrent use.
+func hashParents(h Hasher, jobs []parentJob, workers int) {
+	if workers < 2 || len(jobs) < minParallelJobs {
+		for i := range jobs {
+			jobs[i].par = h.Parent(jobs[i].l, jobs[i].r)
+		}
+		return
+	}
+
+	chunk := (len(jobs) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(jobs); start += chunk {
+		end := start + chunk
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+		wg.Add(1)
+		go func(js []parentJob) {
+			defer wg.Done()
+			for i := range js {
+				js[i].par = h.Parent(js[i].l, js[i].r)
+			}
+		}(jobs[start:end])
+	}
+	wg.Wait()
+}
+
+// HashType identifies a Hasher.  It's saved along with forests and pollards
+// so that they don't get restored with a different hash function than the
+// one they were built with.
+type HashType uint8
+
+const (
+	// SHA512_256 is sha512/256.  It's the default, and what all forests and
+	// pollards made before the hash function was selectable use.
+	SHA512_256 HashType = iota
+	// SHA256 is plain single sha256.
+	SHA256
+	// TaggedSHA256 is sha256 with a BIP340 style tag prefix, with different
+	// tags for leaves and parents.  Leaves and parents can't be confused
+	// for each other this way.
+	TaggedSHA256
+)
+
+// String returns the name of the hash type
+func (t HashType) String() string {
+	switch t {
+	case SHA512_256:
+		return "sha512_256"
+	case SHA256:
+		return "sha256"
+	case TaggedSHA256:
+		return "taggedsha256"
+	}
+	return fmt.Sprintf("unknown hash type %d", uint8(t))
+}
+
+// Hasher is the hash function for the accumulator.  It's picked when a
+// Forest or Pollard is made and can't be changed after.
+type Hasher interface {
+	// Type returns the HashType that gets saved to disk
+	Type() HashType
+
+	// Parent returns the merkle parent of the left and right children.
+	// It may be called from many goroutines at once.
+	Parent(l, r Hash) Hash
+
+	// Leaf hashes data into something that can be added to the accumulator
+	Leaf(data []byte) Hash
+}
+
+// DefaultHasher is what's used when no Hasher is given
+var DefaultHasher Hasher = sha512_256Hasher{}
+
+// NewHasher returns the Hasher for the given HashType
+func NewHasher(t HashType) (Hasher, error) {
+	switch t {
+	case SHA512_256:
+		return sha512_256Hasher{}, nil
+	case SHA256:
+		return sha256Hasher{}, nil
+	case TaggedSHA256:
+		return newTaggedHasher("UtreexoLeaf", "UtreexoParent"), nil
+	}
+	return nil, fmt.Errorf("NewHasher: %s", t.String())
+}
+
+// checkChildren panics on empty children.  Hashing an empty node is always
+// a bug somewhere else.
+func checkChildren(l, r Hash) {
+	// TODO So far no committing to height.
+	if l == empty || r == empty {
+		panic("got an empty leaf here. ")
 	}
+}
+
+type sha512_256Hasher struct{}
+
+func (sha512_256Hasher) Type() HashType { return SHA512_256 }
+
+func (sha512_256Hasher) Parent(l, r Hash) Hash {
+	checkChildren(l, r)
+	h := sha512.New512_256()
+	h.Write(l[:])
+	h.Write(r[:])
+
+	// What h.Sum returns is always 32 bytes but since h.Sum is an interface that
+	// returns a slice of bytes, Go doesn't know this requires slice -> array
+	// copying.
+	rh := Hash{}
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+func (sha512_256Hasher) Leaf(data []byte) Hash {
+	return sha512.Sum512_256(data)
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Type() HashType { return SHA256 }
+
+func (sha256Hasher) Parent(l, r Hash) Hash {
+	checkChildren(l, r)
+	var buf [64]byte
+	copy(buf[:32], l[:])
+	copy(buf[32:], r[:])
+	return sha256.Sum256(buf[:])
+}
+
+func (sha256Hasher) Leaf(data []byte) Hash {
+	return sha256.Sum256(data)
+}
+
+// taggedHasher is sha256(sha256(tag) || sha256(tag) || data) like in BIP340.
+// The tag hashes are computed once when the hasher is made.
+type taggedHasher struct {
+	leafTag, parentTag [64]byte
+}
+
+func newTaggedHasher(leafTag, parentTag string) taggedHasher {
+	var t taggedHasher
+	lt := sha256.Sum256([]byte(leafTag))
+	pt := sha256.Sum256([]byte(parentTag))
+	copy(t.leafTag[:32], lt[:])
+	copy(t.leafTag[32:], lt[:])
+	copy(t.parentTag[:32], pt[:])
+	copy(t.parentTag[32:], pt[:])
+	return t
+}
 
+func (taggedHasher) Type() HashType { return TaggedSHA256 }
+
+func (t taggedHasher) Parent(l, r Hash) Hash {
+	checkChildren(l, r)
+	h := sha256.New()
+	h.Write(t.parentTag[:])
+	h.Write(l[:])
+	h.Write(r[:])
+	rh := Hash{}
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+func (t taggedHasher) Leaf(data []byte) Hash {
+	h := sha256.New()
+	h.Write(t.leafTag[:])
+	h.Write(data)
+	rh := Hash{}
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+// checkHashType returns an error if a forest or pollard saved with the
+// HashType saved is being restored with the Hasher want.
+func checkHashType(saved HashType, want Hasher) error {
+	if saved != want.Type() {
+		return fmt.Errorf("hash mismatch: saved with %s but restoring with %s",
+			saved.String(), want.Type().String())
+	}
 	return nil
 }
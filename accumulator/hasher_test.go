@@ -0,0 +1,277 @@
+package accumulator
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultHasherUnchanged(t *testing.T) {
+	// forests made before the hash was selectable must still verify
+	l, r := Hash{1}, Hash{2}
+	want := sha512.Sum512_256(append(l[:], r[:]...))
+	if DefaultHasher.Parent(l, r) != want {
+		t.Fatal("default parent hash isn't sha512_256")
+	}
+}
+
+func TestHashersForestPollard(t *testing.T) {
+	for _, ht := range []HashType{SHA512_256, SHA256, TaggedSHA256} {
+		hasher, err := NewHasher(ht)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = hasherForestPollard(hasher, 100)
+		if err != nil {
+			t.Fatalf("%s: %s", ht.String(), err.Error())
+		}
+	}
+}
+
+// hasherForestPollard runs a forest and a pollard with the given hasher and
+// checks that their roots match
+func hasherForestPollard(hasher Hasher, blocks int32) error {
+	f := NewForestWithHasher(RamForest, nil, "", 0, hasher)
+	p := NewPollard(hasher)
+
+	sc := newSimChain(0x07)
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sc.NextBlock(5)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(f.GetRoots(), p.GetRoots()) {
+			return fmt.Errorf("block %d roots differ", b)
+		}
+	}
+	return nil
+}
+
+func TestHashersDiffer(t *testing.T) {
+	l, r := Hash{1}, Hash{2}
+	seen := make(map[Hash]HashType)
+	for _, ht := range []HashType{SHA512_256, SHA256, TaggedSHA256} {
+		hasher, err := NewHasher(ht)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := hasher.Parent(l, r)
+		if prev, ok := seen[h]; ok {
+			t.Fatalf("%s and %s give the same parent", prev, ht)
+		}
+		seen[h] = ht
+	}
+
+	// tagged leaves and parents of the same bytes shouldn't collide
+	tagged, _ := NewHasher(TaggedSHA256)
+	if tagged.Leaf(append(l[:], r[:]...)) == tagged.Parent(l, r) {
+		t.Fatal("tagged leaf and parent hashes are the same")
+	}
+}
+
+func TestRestoreForestHashMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hasher, _ := NewHasher(SHA256)
+	f := NewForestWithHasher(RamForest, nil, "", 0, hasher)
+	sc := newSimChain(0x07)
+	for b := 0; b < 10; b++ {
+		adds, _, _ := sc.NextBlock(5)
+		_, err = f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	miscPath := filepath.Join(dir, "misc")
+	forestPath := filepath.Join(dir, "forest")
+	miscFile, err := os.Create(miscPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile, err := os.Create(forestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile.Close()
+	miscFile.Close()
+
+	restore := func(h Hasher) (*Forest, error) {
+		miscFile, err := os.Open(miscPath)
+		if err != nil {
+			return nil, err
+		}
+		defer miscFile.Close()
+		forestFile, err := os.Open(forestPath)
+		if err != nil {
+			return nil, err
+		}
+		defer forestFile.Close()
+		return RestoreForest(miscFile, forestFile, true, false, false, "", 0, nil, h)
+	}
+
+	_, err = restore(DefaultHasher)
+	if err == nil {
+		t.Fatal("restored a sha256 forest as sha512_256")
+	}
+
+	// nil takes whatever it was saved with
+	f2, err := restore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.GetRoots(), f2.GetRoots()) {
+		t.Fatal("roots differ after restore")
+	}
+}
+
+func TestPollardSerializeHashType(t *testing.T) {
+	hasher, _ := NewHasher(TaggedSHA256)
+	p := NewPollard(hasher)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(7)
+	_, err := p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wrong Pollard
+	err = wrong.Deserialize(b)
+	if err == nil {
+		t.Fatal("deserialized a tagged pollard as sha512_256")
+	}
+
+	right := NewPollard(hasher)
+	err = right.Deserialize(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.GetRoots(), right.GetRoots()) {
+		t.Fatal("roots differ after deserialize")
+	}
+
+	// pollards saved without a hash type are sha512_256
+	var legacy bytes.Buffer
+	binary.Write(&legacy, binary.BigEndian, p.numLeaves)
+	for _, r := range p.GetRoots() {
+		legacy.Write(r[:])
+	}
+	var old Pollard
+	err = old.Deserialize(legacy.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.GetRoots(), old.GetRoots()) {
+		t.Fatal("roots differ after deserializing a legacy pollard")
+	}
+}
+
+func TestParallelRehash(t *testing.T) {
+	serial := NewForest(RamForest, nil, "", 0)
+	par := NewForest(RamForest, nil, "", 0)
+	par.SetHashWorkers(8)
+
+	sc := newSimChain(0xff)
+	for b := int32(0); b < 200; b++ {
+		adds, durations, delHashes := sc.NextBlock(500)
+		bp, err := serial.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, err := serial.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := par.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(serial.GetRoots(), par.GetRoots()) {
+			t.Fatalf("block %d roots differ after modify", b)
+		}
+
+		// undo every so often to go through reHash too
+		if b%7 != 6 {
+			continue
+		}
+		err = serial.Undo(*ub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = par.Undo(*pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc.BackOne(adds, durations, delHashes)
+		if !reflect.DeepEqual(serial.GetRoots(), par.GetRoots()) {
+			t.Fatalf("block %d roots differ after undo", b)
+		}
+	}
+	if serial.historicHashes != par.historicHashes {
+		t.Fatalf("serial did %d hashes, parallel did %d",
+			serial.historicHashes, par.historicHashes)
+	}
+}
+
+func BenchmarkRehash_Serial(b *testing.B)   { benchmarkRehash(1, b) }
+func BenchmarkRehash_Workers4(b *testing.B) { benchmarkRehash(4, b) }
+func BenchmarkRehash_Workers8(b *testing.B) { benchmarkRehash(8, b) }
+
+// benchmarkRehash times Modify on a forest with big blocks, which is mostly
+// hashing.  Proving the deletions isn't counted.
+func benchmarkRehash(workers int, b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f := NewForest(RamForest, nil, "", 0)
+		f.SetHashWorkers(workers)
+		sc := newSimChain(0x3f)
+		for blk := 0; blk < 50; blk++ {
+			adds, _, delHashes := sc.NextBlock(2000)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			_, err = f.Modify(adds, bp.Targets)
+			b.StopTimer()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
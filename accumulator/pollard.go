@@ -37,49 +37,139 @@ type Pollard struct {
 	// 00  01  02  03
 	roots []*polNode
 
-	// Lookahead is the threshold that sets which leaves should be cached.
-	// TODO not currently implemented yet.
-	Lookahead int32
+	// Policy decides which leaves get remembered.  If it's nil, the
+	// Remember flag of each added Leaf is used as is.  Full pollards
+	// remember everything and don't use it.
+	Policy RememberPolicy
+
+	// MaxNodes caps how many polNodes the pollard keeps.  At the end of
+	// every Modify, remembered leaves are evicted in the order the Policy
+	// gives, or oldest first without one, until it's under the cap.  0
+	// means no cap.  Full pollards don't use it.
+	MaxNodes uint64
+
+	// nodeCount is how many polNodes the pollard has.  It's kept up to
+	// date as nodes are made and dropped so that evict doesn't have to
+	// walk the pollard to count them.
+	nodeCount int64
 
 	// positionMap is maps hashes to positions.
 	// It is only used for fullPollard.
 	positionMap map[MiniHash]uint64
 
+	// hasher is the hash function for the pollard. nil means DefaultHasher
+	// so that a zero value Pollard is still usable.
+	hasher Hasher
+
 	// Below are for keeping statistics.
 	// hashesEver is all the hashes that have ever been performed.
 	// rememberEver is all the nodes that have ever been cached.
 	// currentRemember is all the nodes that are currently being cached.
 	// overWire is all the leaves that have been received over the network
 	hashesEver, rememberEver, currentRemember, overWire uint64
+
+	// rememberStats is how well Policy is doing
+	rememberStats RememberStats
+
+	// undo is the undo record being filled in by the Modify currently
+	// running.  It's nil outside of Modify.
+	undo *PollardUndo
+}
+
+// NewPollard returns an empty Pollard that uses the given hash function.
+func NewPollard(hasher Hasher) Pollard {
+	var p Pollard
+	p.hasher = hasher
+	return p
+}
+
+// getHasher returns the hash function of the pollard
+func (p *Pollard) getHasher() Hasher {
+	if p.hasher == nil {
+		return DefaultHasher
+	}
+	return p.hasher
 }
 
-// Modify deletes then adds elements to the accumulator.
-func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) error {
+// Modify deletes then adds elements to the accumulator.  The returned
+// PollardUndo can be given to Undo to revert this Modify.
+func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) (*PollardUndo, error) {
 	dels := make([]uint64, len(delsUn))
 	copy(dels, delsUn)
 	sortUint64s(dels)
 
+	p.undo = p.newUndo()
+	defer func() { p.undo = nil }()
+
 	err := p.rem2(dels)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = p.add(adds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if p.Policy != nil && p.positionMap == nil {
+		p.forget(p.Policy.Forget(), &p.rememberStats.Forgotten)
+	}
+	p.evict()
+
+	return p.undo, nil
 }
 
-// Stats returns the current pollard statistics as a string.
-func (p *Pollard) Stats() string {
-	s := fmt.Sprintf("pol nl %d roots %d he %d re %d ow %d cr %d count %d \n",
-		p.numLeaves, len(p.roots), p.hashesEver, p.rememberEver, p.overWire, p.currentRemember, p.GetTotalCount())
-	return s
+// PollardStats are the statistics of a Pollard at one point in time
+type PollardStats struct {
+	// NumLeaves is how many leaves there are now
+	NumLeaves uint64
+
+	// Roots is how many roots there are now
+	Roots int
+
+	// HashesEver is how many hashes the pollard has computed,
+	// RememberEver how many nodes it's ever remembered and OverWire how
+	// many leaves it's been sent over the network.
+	HashesEver, RememberEver, OverWire uint64
+
+	// CurrentRemember is how many nodes are remembered now
+	CurrentRemember uint64
+
+	// Nodes is how many polNodes the pollard has, and MaxNodes the cap on
+	// them, 0 if there isn't one
+	Nodes    int64
+	MaxNodes uint64
+
+	// Remember are the stats for the pollard's RememberPolicy
+	Remember RememberStats
+}
+
+// String returns the stats the way the csn prints them
+func (s PollardStats) String() string {
+	return fmt.Sprintf("pol nl %d roots %d he %d re %d ow %d cr %d count %d "+
+		"max %d ev %d hit %.3f cachedhits %d \n",
+		s.NumLeaves, s.Roots, s.HashesEver, s.RememberEver, s.OverWire,
+		s.CurrentRemember, s.Nodes, s.MaxNodes, s.Remember.Evicted,
+		s.Remember.HitRate(), s.Remember.CachedHashHits)
 }
 
-// GetTotalCount returns the count of all the polNodes in the pollard.
+// Stats returns the current pollard statistics.
+func (p *Pollard) Stats() PollardStats {
+	return PollardStats{
+		NumLeaves:       p.numLeaves,
+		Roots:           len(p.roots),
+		HashesEver:      p.hashesEver,
+		RememberEver:    p.rememberEver,
+		OverWire:        p.overWire,
+		CurrentRemember: p.currentRemember,
+		Nodes:           p.nodeCount,
+		MaxNodes:        p.MaxNodes,
+		Remember:        p.RememberStats(),
+	}
+}
+
+// GetTotalCount returns the count of all the polNodes in the pollard.  It
+// goes through the whole pollard; Stats has the same count without that.
 func (p *Pollard) GetTotalCount() int64 {
 	var size int64
 	for _, root := range p.roots {
@@ -112,12 +202,16 @@ func (p *Pollard) add(adds []Leaf) error {
 	// pretty sub-optimal, but we're not doing multi-thread yet
 
 	for _, a := range adds {
-		if a.Remember {
+		remember := a.Remember
+		if p.Policy != nil && p.positionMap == nil {
+			remember = p.Policy.Remember(a.Hash, a.TTL)
+		}
+		if remember {
 			p.rememberEver++
 			p.currentRemember++
 		}
 
-		err := p.addOne(a.Hash, a.Remember)
+		err := p.addOne(a.Hash, remember)
 		if err != nil {
 			return err
 		}
@@ -161,8 +255,10 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	n := new(polNode)
 	n.data = add
 	n.remember = remember
+	p.nodeCount++
 
 	if p.positionMap != nil {
+		p.touchPos(add.Mini())
 		p.positionMap[add.Mini()] = p.numLeaves
 
 		// Always remember everything for full pollard.
@@ -174,15 +270,18 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	var h uint8
 	for ; (p.numLeaves>>h)&1 == 1; h++ {
 		// grab, pop, swap, hash, new
+		// (leftRoot gets its nieces swapped so save it for undo first)
+		p.touch(p.roots[len(p.roots)-1])
 		leftRoot := p.roots[len(p.roots)-1]                        // grab
 		p.roots = p.roots[:len(p.roots)-1]                         // pop
 		leftRoot.niece, n.niece = n.niece, leftRoot.niece          // swap
-		nHash := parentHash(leftRoot.data, n.data)                 // hash
+		nHash := p.getHasher().Parent(leftRoot.data, n.data)       // hash
 		n = &polNode{data: nHash, niece: [2]*polNode{leftRoot, n}} // new
 		n.remember = remember
 		p.hashesEver++
+		p.nodeCount++
 
-		n.prune()
+		p.nodeCount -= n.prune()
 	}
 
 	// the new roots are all the 1 bits above where we got to, and nothing below where
@@ -217,7 +316,9 @@ func (p *Pollard) rem2(dels []uint64) error {
 
 	if p.positionMap != nil { // if fulpol, remove hashes from posMap
 		for _, delpos := range dels {
-			delete(p.positionMap, p.read(delpos).Mini())
+			m := p.read(delpos).Mini()
+			p.touchPos(m)
+			delete(p.positionMap, m)
 		}
 	}
 
@@ -235,13 +336,21 @@ func (p *Pollard) rem2(dels []uint64) error {
 				del, ErrorStrings[ErrorNoPollardNode])
 		}
 
+		p.touch(n)
 		if n.remember == true {
 			p.currentRemember--
 			n.remember = false
+			p.rememberStats.Hits++
+		} else {
+			p.rememberStats.Misses++
+		}
+		if p.Policy != nil && p.positionMap == nil {
+			p.Policy.Deleted(n.data)
 		}
 		// This likely does nothing since the leaf nieces are never set.
 		// Just putting it here since the cost of putting this in is
 		// basically nothing.
+		p.nodeCount -= getCount(n.niece[0]) + getCount(n.niece[1])
 		n.niece[0], n.niece[1] = nil, nil
 	}
 
@@ -308,8 +417,10 @@ func (p *Pollard) rem2(dels []uint64) error {
 				// supposed to exist.
 				continue
 			}
-			hn.dest.data = hn.sib.auntOp()
-			hn.sib.prune()
+			p.touch(hn.dest)
+			p.touch(hn.sib)
+			hn.dest.data = hn.sib.auntOp(p.getHasher())
+			p.nodeCount -= hn.sib.prune()
 		}
 	}
 
@@ -319,6 +430,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 	// set new roots
 	getRootsForwards(nextNumLeaves, ph, &positionList.list)
 	nextRoots := make([]*polNode, len(positionList.list))
+	nextSibs := make([]*polNode, len(positionList.list))
 	for i, _ := range nextRoots {
 		rootPos := len(positionList.list) - (i + 1)
 		nt, ntsib, _, err := p.grabPos(positionList.list[rootPos])
@@ -328,14 +440,20 @@ func (p *Pollard) rem2(dels []uint64) error {
 		if nt == nil {
 			return fmt.Errorf("want root %d at %d but nil", i, positionList.list[i])
 		}
-		if ntsib == nil {
+		nextRoots[i], nextSibs[i] = nt, ntsib
+	}
+	// the paths to the smaller roots go through the bigger ones, so the
+	// nodes are only changed once all the roots are grabbed
+	p.nodeCount -= droppedByRoots(p.roots, nextRoots, nextSibs)
+	for i, nt := range nextRoots {
+		p.touch(nt)
+		if nextSibs[i] == nil {
 			// when turning a node into a root, it's "nieces" are really children,
 			// so should become it's sibling's nieces.
 			nt.chop()
 		} else {
-			nt.niece = ntsib.niece
+			nt.niece = nextSibs[i].niece
 		}
-		nextRoots[i] = nt
 	}
 	p.numLeaves = nextNumLeaves
 	reversePolNodeSlice(nextRoots)
@@ -365,8 +483,11 @@ func (p *Pollard) swapNodes(s arrow, row uint8) (*hashableNode, error) {
 		run := uint64(1 << row)
 		// happens before the actual swap, so swapping a and b
 		for i := uint64(0); i < run; i++ {
-			p.positionMap[p.read(a+i).Mini()] = b + i
-			p.positionMap[p.read(b+i).Mini()] = a + i
+			am, bm := p.read(a+i).Mini(), p.read(b+i).Mini()
+			p.touchPos(am)
+			p.touchPos(bm)
+			p.positionMap[am] = b + i
+			p.positionMap[bm] = a + i
 		}
 	}
 
@@ -394,6 +515,10 @@ func (p *Pollard) swapNodes(s arrow, row uint8) (*hashableNode, error) {
 
 	bhn.position = parent(s.to, p.rows())
 	// do the actual swap here
+	p.touch(a)
+	p.touch(asib)
+	p.touch(b)
+	p.touch(bsib)
 	err = polSwap(a, asib, b, bsib)
 	if err != nil {
 		return nil, err
@@ -470,7 +595,9 @@ func (p *Pollard) grabPos(
 
 		// if a sib doesn't exist, need to create it and hook it in
 		if n.niece[lrSib] == nil {
+			p.touch(n)
 			n.niece[lrSib] = &polNode{}
+			p.nodeCount++
 		}
 		n, nsib = n.niece[lr], n.niece[lrSib]
 		if n == nil {
@@ -496,7 +623,7 @@ func (p *Pollard) grabPos(
 // For debugging and seeing what pollard is doing since there's already
 // a good toString method for  forest.
 func (p *Pollard) toFull() (*Forest, error) {
-	ff := NewForest(RamForest, nil, "", 0)
+	ff := NewForestWithHasher(RamForest, nil, "", 0, p.getHasher())
 	ff.rows = p.rows()
 	ff.numLeaves = p.numLeaves
 	ff.data = new(ramForestData)
@@ -19,7 +19,7 @@ func TestPollardNoSiblingFound(t *testing.T) {
 	}
 	adds[6].Remember = false
 
-	err := p.Modify(adds, nil)
+	_, err := p.Modify(adds, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,14 +38,14 @@ func TestPollardNoSiblingFound(t *testing.T) {
 	newAdds[1].Remember = true
 
 	dels := []uint64{2, 3, 4}
-	err = p.Modify(newAdds, dels)
+	_, err = p.Modify(newAdds, dels)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Then cause the error by deleting 1,3,4,5
 	newDels := []uint64{1, 3, 4, 5}
-	err = p.Modify(nil, newDels)
+	_, err = p.Modify(nil, newDels)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -139,9 +139,9 @@ func pollardRandomRemember(blocks int32) error {
 		err = f.sanity()
 		if err != nil {
 			fmt.Printf("frs broke %s", f.ToString())
-			for h, p := range f.positionMap {
+			f.positionMap.ForEach(func(h MiniHash, p uint64) {
 				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			})
 			return err
 		}
 		err = f.PosMapSanity()
@@ -151,7 +151,7 @@ func pollardRandomRemember(blocks int32) error {
 		}
 
 		// apply adds / dels to pollard
-		err = p.Modify(adds, bp.Targets)
+		_, err = p.Modify(adds, bp.Targets)
 		if err != nil {
 			return err
 		}
@@ -303,7 +303,7 @@ func TestPollardIngestMultiBlockProof(t *testing.T) {
 			}
 
 			// Apply adds and dels to the pollard.
-			err = p.Modify(loopAdd, bp.Targets)
+			_, err = p.Modify(loopAdd, bp.Targets)
 			if err != nil {
 				t.Fatal(fmt.Errorf("Pollard modify failed. Error: %s",
 					err.Error()))
@@ -436,7 +436,7 @@ func TestCache(t *testing.T) {
 			t.Fatal("IngestBatchProof failed", err)
 		}
 
-		err = p.Modify(adds, proof.Targets)
+		_, err = p.Modify(adds, proof.Targets)
 		if err != nil {
 			t.Fatal("Modify failed", err)
 		}
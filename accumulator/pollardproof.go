@@ -11,9 +11,15 @@ import (
 // The hashes being verified should be in the same order as they were
 // proven.
 func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
+	bp, err := p.fillProof(bp)
+	if err != nil {
+		return err
+	}
+
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
-	_, _, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+	_, _, err = verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+		p.getHasher(),
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
@@ -35,13 +41,25 @@ func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 // targets in the block proof. If rememberAll is true, pollard will mark all the
 // proofs given in the batchproof to be remembered.
 //
+// Proof hashes that are empty were left out by the bridge (see ClientModel)
+// and get filled in from the pollard.
+//
 // NOTE: The order in which the hashes are given matter (aka permutation matters).
 // The hashes being verified should be in the same order as they were
 // proven.
 func (p *Pollard) IngestBatchProof(toProve []Hash, bp BatchProof, rememberAll bool) error {
+	if p.Policy != nil {
+		p.countCached(bp)
+	}
+	bp, err := p.fillProof(bp)
+	if err != nil {
+		return fmt.Errorf("Pollard IngestBatchProof: %s", err.Error())
+	}
+
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
 	trees, roots, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+		p.getHasher(),
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
@@ -77,10 +95,61 @@ func (p *Pollard) IngestBatchProof(toProve []Hash, bp BatchProof, rememberAll bo
 		nodesAllocated += populate(rows, root.Pos, p.roots[(len(p.roots)-rootIdxBackwards)-1],
 			&trees[len(p.roots)-rootIdxBackwards-1], rememberAll)
 	}
+	p.nodeCount += int64(nodesAllocated)
 
 	return nil
 }
 
+// cachedProof returns the pollard's hash at each of bp's proof positions,
+// or empty where the pollard doesn't have it.
+func (p *Pollard) cachedProof(bp BatchProof) []Hash {
+	if len(bp.Targets) == 0 {
+		return nil
+	}
+	targets := make([]uint64, len(bp.Targets))
+	copy(targets, bp.Targets)
+	sortUint64s(targets)
+
+	proofPositions := NewPositionList()
+	defer proofPositions.Free()
+	ProofPositions(targets, p.numLeaves, p.rows(), &proofPositions.list)
+
+	cached := make([]Hash, len(proofPositions.list))
+	for i, pos := range proofPositions.list {
+		n, _, _, err := p.readPos(pos)
+		if err == nil && n != nil {
+			cached[i] = n.data
+		}
+	}
+	return cached
+}
+
+// fillProof returns bp with its empty proof hashes filled in from the
+// pollard.  bp itself isn't changed.
+func (p *Pollard) fillProof(bp BatchProof) (BatchProof, error) {
+	if bp.numOmitted() == 0 {
+		return bp, nil
+	}
+	cached := p.cachedProof(bp)
+	if len(cached) != len(bp.Proof) {
+		return bp, fmt.Errorf("fillProof: %d proof hashes but %d proof positions",
+			len(bp.Proof), len(cached))
+	}
+
+	filled := BatchProof{Targets: bp.Targets, Proof: make([]Hash, len(bp.Proof))}
+	for i, h := range bp.Proof {
+		if h == empty {
+			if cached[i] == empty {
+				return bp, fmt.Errorf("fillProof: proof hash %d left out "+
+					"but not in pollard", i)
+			}
+			h = cached[i]
+		}
+		filled.Proof[i] = h
+	}
+	return filled, nil
+}
+
 // nodesToFollow returns the positions of the nodes for the branch you want to go to,
 // that are needed to populate all of the given trees.
 //
@@ -198,14 +267,15 @@ type polNodeAndPos struct {
 
 // nextNodes returns a slice of nodes on the row below the curBranch that need
 // to be followed to populate every miniTree in the given slice of trees. The
-// nodes returned are in ascending order.
+// nodes returned are in ascending order, along with how many polNodes were
+// allocated for them.
 //
 // curNodes and trees (by parent pos for trees) passed to this function MUST be
 // in ascending order. curNodes also must not start at the root.
-func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTree) []*polNodeAndPos {
+func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTree) ([]*polNodeAndPos, int) {
 	// No nextNodes if there's no more trees to be populated
 	if len(trees) == 0 {
-		return []*polNodeAndPos{}
+		return []*polNodeAndPos{}, 0
 	}
 
 	// curBranch+1 as we want to go one row below. Branch is "how far down are we from
@@ -220,6 +290,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 	// branchLen: 3  00  01  02  03  04  05  06  07
 	nextNodes := nodesToFollow(trees, curBranch+1, rows)
 	nextCurNodes := make([]*polNodeAndPos, 0, len(nextNodes))
+	nodesAllocated := 0
 
 	// Both curNodes and nextNodes are in ascending order. We keep an index for both
 	// and increment nextNodesIdx as we process each nextNode. Since both are in ascending
@@ -270,6 +341,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 				// for now
 				if curNode.node.niece[0] == nil {
 					curNode.node.niece[0] = &polNode{}
+					nodesAllocated++
 				}
 				nextCurNodes = append(nextCurNodes,
 					&polNodeAndPos{curNode.node.niece[0], lNiecePos})
@@ -280,6 +352,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 				// for now.
 				if curNode.node.niece[1] == nil {
 					curNode.node.niece[1] = &polNode{}
+					nodesAllocated++
 				}
 				nextCurNodes = append(nextCurNodes,
 					&polNodeAndPos{curNode.node.niece[1], rNiecePos})
@@ -292,7 +365,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 		}
 	}
 
-	return nextCurNodes
+	return nextCurNodes, nodesAllocated
 }
 
 // Given a single miniTree and a single aunt (aka sibling of the miniTree.parent),
@@ -414,7 +487,8 @@ func populate(rows uint8, pos uint64, root *polNode, trees *[]miniTree, remember
 			curNodeIdx--
 		}
 
-		nextCurNodes := nextNodes(uint8(curBranchLen), rows, curNodes, *trees)
+		nextCurNodes, allocated := nextNodes(uint8(curBranchLen), rows, curNodes, *trees)
+		nodesAllocated += allocated
 		curNodes = nextCurNodes
 	}
 
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
@@ -16,8 +17,8 @@ type polNode struct {
 }
 
 // auntOp returns the hash of a nodes nieces. crashes if you call on nil nieces.
-func (n *polNode) auntOp() Hash {
-	return parentHash(n.niece[0].data, n.niece[1].data)
+func (n *polNode) auntOp(h Hasher) Hash {
+	return h.Parent(n.niece[0].data, n.niece[1].data)
 }
 
 // auntable tells you if you can call auntOp on a node
@@ -65,6 +66,7 @@ func (p *Pollard) PruneAll() {
 	for _, root := range p.roots {
 		root.chop()
 	}
+	p.nodeCount = int64(len(p.roots))
 }
 
 // NumLeaves returns the number of leaves that the accumulator has.
@@ -72,16 +74,20 @@ func (p *Pollard) NumLeaves() uint64 {
 	return p.numLeaves
 }
 
-// prune prunes deadend children.
+// prune prunes deadend children and returns how many it pruned.
 // don't prune at the bottom; use leaf prune instead at row 1
-func (n *polNode) prune() {
+func (n *polNode) prune() int64 {
+	var pruned int64
 	remember := n.niece[0].remember || n.niece[1].remember
 	if n.niece[0].deadEnd() && !remember {
 		n.niece[0] = nil
+		pruned++
 	}
 	if n.niece[1].deadEnd() && !remember {
 		n.niece[1] = nil
+		pruned++
 	}
+	return pruned
 }
 
 // getCount returns the count of all the nieces below it and itself.
@@ -92,6 +98,40 @@ func getCount(n *polNode) int64 {
 	return (getCount(n.niece[0]) + 1 + getCount(n.niece[1]))
 }
 
+// droppedByRoots returns how many of the polNodes under roots nothing will
+// point to once nextRoots are the roots, each taking the nieces of the
+// sibling in nextSibs as its children, or none if the sibling is nil.  It
+// only goes through the nodes that get dropped.
+func droppedByRoots(roots, nextRoots, nextSibs []*polNode) int64 {
+	isRoot := make(map[*polNode]bool, len(nextRoots))
+	kept := make(map[*polNode]bool, 2*len(nextRoots))
+	for i, nt := range nextRoots {
+		isRoot[nt] = true
+		if nextSibs[i] != nil {
+			kept[nextSibs[i].niece[0]] = true
+			kept[nextSibs[i].niece[1]] = true
+		}
+	}
+	var dropped func(n *polNode) int64
+	dropped = func(n *polNode) int64 {
+		if n == nil || kept[n] {
+			return 0
+		}
+		// a new root stays, but what it points to now is dropped unless
+		// it's kept as children
+		count := dropped(n.niece[0]) + dropped(n.niece[1])
+		if !isRoot[n] {
+			count++
+		}
+		return count
+	}
+	var count int64
+	for _, root := range roots {
+		count += dropped(root)
+	}
+	return count
+}
+
 // polSwap swaps the contents of two polNodes & leaves pointers to them intact
 // need their siblings so that the siblings' nieces can swap.
 // for a root, just say the root's sibling is itself and it should work.
@@ -116,98 +156,322 @@ func (p *Pollard) rootHashesForward() []Hash {
 }
 
 //  ------------------ pollard serialization
-// currently saving /restoring pollard to disk only does the roots.
-// so you lose all the caching
-// TODO have the option to save restore sparse pollards.  Could use the same
-// idea as verifyBatchProof
 
-// current serialization is just 8byte numleaves, followed by all the hashes
-// (in small to big order)
+// Pollards are saved with a header (see fileformat.go) and end with a crc32
+// of everything before it.  Version 2, which is what's written now, is
+//
+// [8 numleaves] [1 hash type] [8 hashesEver] [8 rememberEver] [8 overWire]
+// [8 each of the RememberStats hits, misses, forgotten, evicted, proof
+// hashes and cached hashes] [8 MaxNodes] [the policy, see appendPolicy]
+// [the nodes of each tree, tallest first]
+//
+// where a node is a flags byte, its hash unless it's empty, and then the
+// nieces it has, left first.  So everything the pollard remembers comes
+// back when it's restored.
+//
+// Version 1 is 8 byte numleaves, 1 byte of hash type and the root hashes.
+// Pollards saved before there was a header are 8 byte numleaves, the root
+// hashes, and 1 byte of hash type that even older pollards don't have;
+// those are sha512_256.
+
+// pollardFormatVersion is the version of the pollard serialization
+const pollardFormatVersion uint32 = 2
+
+// flags of a serialized polNode
+const (
+	polNodeLeftNiece  = 1 << 0
+	polNodeRightNiece = 1 << 1
+	polNodeRemember   = 1 << 2
+	polNodeEmpty      = 1 << 3
+)
 
-// WritePollard writes the numLeaves field and only the roots into the given writer.
-// Cached leaves are not included in the writer
+// WritePollard writes the pollard, including everything it remembers, into
+// the given writer.
 func (p *Pollard) WritePollard(w io.Writer) error {
-	var err error
-	err = binary.Write(w, binary.BigEndian, p.numLeaves)
+	b, err := p.Serialize()
 	if err != nil {
 		return err
 	}
-	for _, t := range p.roots {
-		_, err = w.Write(t.data[:])
-		if err != nil {
-			return err
-		}
+	_, err = w.Write(b)
+	return err
+}
+
+// readHashType reads the hash type at the end of a serialized pollard
+// without a header and checks that it's the same as what the pollard uses.
+func (p *Pollard) readHashType(r io.Reader) error {
+	var hashType [1]byte
+	_, err := io.ReadFull(r, hashType[:])
+	if err == io.EOF {
+		// saved before there was a hash type
+		hashType[0] = byte(SHA512_256)
+	} else if err != nil {
+		return err
 	}
-	return nil
+	return checkHashType(HashType(hashType[0]), p.getHasher())
 }
 
-// RestorePollard restores the pollard from the given reader
+// RestorePollard restores the pollard from the given reader.  It reads
+// every version WritePollard has written.  If the pollard already has a
+// Policy or MaxNodes they're kept, otherwise they're what was saved.
 func (p *Pollard) RestorePollard(r io.Reader) error {
-	err := binary.Read(r, binary.BigEndian, &p.numLeaves)
+	err := p.restore(r)
+	if err != nil {
+		return fmt.Errorf("RestorePollard: %s", err.Error())
+	}
+	fmt.Printf("%d leaves %d roots ", p.numLeaves, len(p.roots))
+	return nil
+}
+
+// errorPollardCutShort is for a serialized pollard that ends too soon
+func errorPollardCutShort() error {
+	return fmt.Errorf("%s: cut short", ErrorCorruptPollard.Error())
+}
+
+// restore reads a serialized pollard, with or without a header
+func (p *Pollard) restore(r io.Reader) error {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:4])
+	if err != nil {
+		return fmt.Errorf("%s: %s", ErrorCorruptPollard.Error(), err.Error())
+	}
+	if !bytes.Equal(header[:4], pollardFileMagic[:]) {
+		return p.restoreLegacy(io.MultiReader(bytes.NewReader(header[:4]), r))
+	}
+	_, err = io.ReadFull(r, header[4:])
+	if err != nil {
+		return errorPollardCutShort()
+	}
+	crc := crc32.New(crcTable)
+	crc.Write(header[:])
+
+	// everything read from here on goes into the checksum
+	tr := io.TeeReader(r, crc)
+	version := binary.BigEndian.Uint32(header[4:])
+	switch version {
+	case 1:
+		err = p.restoreV1(tr)
+	case 2:
+		err = p.restoreV2(tr)
+	default:
+		return fmt.Errorf("pollard format version %d, only know up to %d",
+			version, pollardFormatVersion)
+	}
 	if err != nil {
 		return err
 	}
 
-	p.roots = make([]*polNode, numRoots(p.numLeaves))
-	fmt.Printf("%d leaves %d roots ", p.numLeaves, len(p.roots))
-	for i, _ := range p.roots {
-		p.roots[i] = new(polNode)
-		bytesRead, err := r.Read(p.roots[i].data[:])
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
-			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
-			return s
-		}
+	var sum [4]byte
+	_, err = io.ReadFull(r, sum[:])
+	if err != nil {
+		return errorPollardCutShort()
+	}
+	if crc.Sum32() != binary.BigEndian.Uint32(sum[:]) {
+		return fmt.Errorf("%s: checksum doesn't match",
+			ErrorCorruptPollard.Error())
 	}
 	return nil
 }
 
-// Serialize serializes the numLeaves field and only the roots into a byte slice.
-// Cached leaves are not included in the byte slice
-func (p *Pollard) Serialize() ([]byte, error) {
-	size := 8 + len(p.roots) // 8 for uint64 numLeaves
-	serialized := make([]byte, 0, size)
+// restoreV1 reads the roots of a version 1 pollard
+func (p *Pollard) restoreV1(r io.Reader) error {
+	var header [8 + 1]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return errorPollardCutShort()
+	}
+	numLeaves := binary.BigEndian.Uint64(header[0:8])
+	err = checkHashType(HashType(header[8]), p.getHasher())
+	if err != nil {
+		return err
+	}
 
-	buf := bytes.NewBuffer(serialized)
+	roots := make([]*polNode, numRoots(numLeaves))
+	for i := range roots {
+		roots[i] = new(polNode)
+		_, err = io.ReadFull(r, roots[i].data[:])
+		if err != nil {
+			return errorPollardCutShort()
+		}
+	}
+	p.numLeaves = numLeaves
+	p.roots = roots
+	p.nodeCount = int64(len(roots))
+	return nil
+}
 
-	err := binary.Write(buf, binary.BigEndian, p.numLeaves)
+// restoreV2 reads a version 2 pollard, with its counters, policy and
+// everything it remembers.
+func (p *Pollard) restoreV2(r io.Reader) error {
+	var header [8 + 1 + 10*8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return errorPollardCutShort()
+	}
+	numLeaves := binary.BigEndian.Uint64(header[0:8])
+	err = checkHashType(HashType(header[8]), p.getHasher())
+	if err != nil {
+		return err
+	}
+	var counts [10]uint64
+	for i := range counts {
+		counts[i] = binary.BigEndian.Uint64(header[9+i*8:])
+	}
+	policy, err := readPolicy(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, t := range p.roots {
-		_, err = buf.Write(t.data[:])
+	// roots are ordered tallest first
+	roots := make([]*polNode, numRoots(numLeaves))
+	i := 0
+	for h := uint8(63); i < len(roots); h-- {
+		if (numLeaves>>h)&1 == 0 {
+			continue
+		}
+		roots[i], err = readPolNode(r, h)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		i++
 	}
 
-	return buf.Bytes(), nil
+	p.numLeaves = numLeaves
+	p.roots = roots
+	p.hashesEver, p.rememberEver, p.overWire = counts[0], counts[1], counts[2]
+	p.rememberStats = RememberStats{
+		Hits:           counts[3],
+		Misses:         counts[4],
+		Forgotten:      counts[5],
+		Evicted:        counts[6],
+		ProofHashes:    counts[7],
+		CachedHashHits: counts[8],
+	}
+	if p.MaxNodes == 0 {
+		p.MaxNodes = counts[9]
+	}
+	if p.Policy == nil {
+		p.Policy = policy
+	}
+	p.currentRemember = uint64(len(p.rememberedLeaves()))
+	p.nodeCount = p.GetTotalCount()
+	return nil
 }
 
-// Deserialize decodes the bytes into a Pollard
-func (p *Pollard) Deserialize(serialized []byte) error {
-	reader := bytes.NewReader(serialized)
-
-	err := binary.Read(reader, binary.BigEndian, &p.numLeaves)
+// restoreLegacy reads a pollard saved before there was a header
+func (p *Pollard) restoreLegacy(r io.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &p.numLeaves)
 	if err != nil {
 		return err
 	}
-	fmt.Println(p.numLeaves)
 
 	p.roots = make([]*polNode, numRoots(p.numLeaves))
-
 	for i, _ := range p.roots {
 		p.roots[i] = new(polNode)
-		bytesRead, err := reader.Read(p.roots[i].data[:])
-
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
+		bytesRead, err := io.ReadFull(r, p.roots[i].data[:])
+		if err != nil {
 			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
 			return s
 		}
 	}
+	p.nodeCount = int64(len(p.roots))
+	return p.readHashType(r)
+}
+
+// appendPolNode appends n and everything under it
+func appendPolNode(buf []byte, n *polNode) []byte {
+	var flags byte
+	if n.niece[0] != nil {
+		flags |= polNodeLeftNiece
+	}
+	if n.niece[1] != nil {
+		flags |= polNodeRightNiece
+	}
+	if n.remember {
+		flags |= polNodeRemember
+	}
+	if n.data == empty {
+		flags |= polNodeEmpty
+	}
+	buf = append(buf, flags)
+	if n.data != empty {
+		buf = append(buf, n.data[:]...)
+	}
+	for _, niece := range n.niece {
+		if niece != nil {
+			buf = appendPolNode(buf, niece)
+		}
+	}
+	return buf
+}
+
+// readPolNode reads a node saved by appendPolNode that's at the given row.
+// Its nieces are a row below it.
+func readPolNode(r io.Reader, row uint8) (*polNode, error) {
+	var flags [1]byte
+	_, err := io.ReadFull(r, flags[:])
+	if err != nil {
+		return nil, errorPollardCutShort()
+	}
+	nieces := flags[0] & (polNodeLeftNiece | polNodeRightNiece)
+	if flags[0]&^(nieces|polNodeRemember|polNodeEmpty) != 0 ||
+		(row == 0 && nieces != 0) {
 
+		return nil, fmt.Errorf("%s: bad node flags %x at row %d",
+			ErrorCorruptPollard.Error(), flags[0], row)
+	}
+
+	n := &polNode{remember: flags[0]&polNodeRemember != 0}
+	if flags[0]&polNodeEmpty == 0 {
+		_, err = io.ReadFull(r, n.data[:])
+		if err != nil {
+			return nil, errorPollardCutShort()
+		}
+	}
+	for i, bit := range []byte{polNodeLeftNiece, polNodeRightNiece} {
+		if flags[0]&bit == 0 {
+			continue
+		}
+		n.niece[i], err = readPolNode(r, row-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Serialize serializes the pollard, including everything it remembers, into
+// a byte slice.
+func (p *Pollard) Serialize() ([]byte, error) {
+	buf := make([]byte, 0, len(pollardFileMagic)+4+8+1+10*8+1+
+		int(p.nodeCount)*(1+32)+4)
+
+	buf = append(buf, pollardFileMagic[:]...)
+	buf = appendUint32(buf, pollardFormatVersion)
+	buf = appendUint64(buf, p.numLeaves)
+	buf = append(buf, byte(p.getHasher().Type()))
+	rs := p.rememberStats
+	for _, count := range []uint64{p.hashesEver, p.rememberEver, p.overWire,
+		rs.Hits, rs.Misses, rs.Forgotten, rs.Evicted, rs.ProofHashes,
+		rs.CachedHashHits, p.MaxNodes} {
+
+		buf = appendUint64(buf, count)
+	}
+	buf = appendPolicy(buf, p.Policy)
+	for _, root := range p.roots {
+		buf = appendPolNode(buf, root)
+	}
+	buf = appendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	return buf, nil
+}
+
+// Deserialize decodes the bytes into a Pollard.  Like RestorePollard it
+// keeps the Policy and MaxNodes the pollard already has.
+func (p *Pollard) Deserialize(serialized []byte) error {
+	err := p.restore(bytes.NewReader(serialized))
+	if err != nil {
+		return fmt.Errorf("Pollard Deserialize: %s", err.Error())
+	}
 	return nil
 }
 
@@ -2,6 +2,9 @@ package accumulator
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
 	"testing"
 )
 
@@ -38,3 +41,134 @@ func TestPollardSerializeDeserialize(t *testing.T) {
 		t.Fatal("Bytes Unequal")
 	}
 }
+
+// TestPollardSerializeCache checks that a restored pollard remembers what
+// the saved one did and carries on the same way.
+func TestPollardSerializeCache(t *testing.T) {
+	policies := []RememberPolicy{
+		&TTLPolicy{Window: 8}, NewLRUPolicy(50), NewWalletPolicy(), nil}
+	for _, policy := range policies {
+		f := NewForest(RamForest, nil, "", 0)
+		p := new(Pollard)
+		var q *Pollard
+		p.Policy = policy
+		p.MaxNodes = 400
+		wallet, _ := policy.(*WalletPolicy)
+
+		sc := newSimChain(0x0f)
+		for b := int32(0); b < 150; b++ {
+			adds, durations, delHashes := sc.NextBlock(8)
+			for i := range adds {
+				adds[i].TTL = durations[i]
+				adds[i].Remember = i%2 == 0
+				if wallet != nil && i%3 == 0 {
+					wallet.Watch(adds[i].Hash)
+				}
+			}
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pols := []*Pollard{p}
+			if q != nil {
+				pols = append(pols, q)
+			}
+			for _, pol := range pols {
+				err = pol.IngestBatchProof(delHashes, bp, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = pol.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if b == 100 {
+				ser, err := p.Serialize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				q = new(Pollard)
+				err = q.Deserialize(ser)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if policy == nil && q.Policy != nil ||
+					policy != nil && q.Policy.String() != policy.String() {
+
+					t.Fatalf("%v restored as %v", policy, q.Policy)
+				}
+				if wallet != nil {
+					// the wallet gets told about watched leaves from
+					// outside, so both have to hear about them
+					wallet = nil
+				}
+			}
+			if q == nil {
+				continue
+			}
+			err = checkRemembered(q)
+			if err != nil {
+				t.Fatalf("%v block %d %s", policy, b, err.Error())
+			}
+			if !reflect.DeepEqual(p.GetRoots(), q.GetRoots()) {
+				t.Fatalf("%v block %d roots differ", policy, b)
+			}
+			if p.Stats() != q.Stats() ||
+				p.RememberStats() != q.RememberStats() {
+				t.Fatalf("%v block %d stats differ\n%s%s",
+					policy, b, p.Stats(), q.Stats())
+			}
+			pb, _ := p.Serialize()
+			qb, _ := q.Serialize()
+			if !bytes.Equal(pb, qb) {
+				t.Fatalf("%v block %d pollards differ", policy, b)
+			}
+		}
+	}
+}
+
+// TestPollardReadV1 checks that pollards saved as version 1, with only the
+// roots, can still be read.
+func TestPollardReadV1(t *testing.T) {
+	var p Pollard
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(13)
+	for i := range adds {
+		adds[i].Remember = true
+	}
+	_, err := p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := append([]byte{}, pollardFileMagic[:]...)
+	v1 = appendUint32(v1, 1)
+	v1 = appendUint64(v1, p.numLeaves)
+	v1 = append(v1, byte(SHA512_256))
+	for _, r := range p.GetRoots() {
+		v1 = append(v1, r[:]...)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(v1, crcTable))
+	v1 = append(v1, sum[:]...)
+
+	var q Pollard
+	err = q.Deserialize(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.GetRoots(), q.GetRoots()) {
+		t.Fatal("roots differ")
+	}
+	if q.GetTotalCount() != int64(len(q.roots)) || q.currentRemember != 0 {
+		t.Fatalf("version 1 pollard has %d nodes %d remembered",
+			q.GetTotalCount(), q.currentRemember)
+	}
+}
@@ -0,0 +1,316 @@
+package accumulator
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PositionMap is where a Forest keeps the position of each leaf.  It's in
+// ram by default; NewLevelDBPositionMap keeps it on disk instead, which a
+// bridge node on mainnet will want as there's a lot of leaves.  Other
+// stores can be used by implementing it and passing it to UsePositionMap.
+type PositionMap interface {
+	// Get returns the position of the leaf, and false if it isn't there
+	Get(m MiniHash) (uint64, bool)
+
+	// Put sets the position of the leaf
+	Put(m MiniHash, pos uint64)
+
+	// Delete removes the leaf
+	Delete(m MiniHash)
+
+	// Len returns how many leaves there are
+	Len() uint64
+
+	// ForEach calls fn for every leaf, in no particular order
+	ForEach(fn func(m MiniHash, pos uint64))
+
+	// Commit writes out the changes since the last commit.  The forest
+	// commits at the end of every Modify and Undo.
+	Commit() error
+
+	// Close commits and closes the map for stopping
+	Close()
+
+	// Clear removes all the leaves, along with any changes not yet
+	// committed, and commits that.
+	Clear() error
+
+	// Saved commits and records that the map goes with the forest as it's
+	// being saved, with numLeaves leaves.  The next Commit that changes
+	// anything takes that back.
+	Saved(numLeaves uint64) error
+
+	// SavedWith returns the numLeaves of the forest the map was saved
+	// with, and false if it wasn't saved or has changed since.
+	SavedWith() (uint64, bool)
+}
+
+// ********************************************* position map in ram
+
+// ramPositionMap is the position map as a go map
+type ramPositionMap map[MiniHash]uint64
+
+func newRamPositionMap() ramPositionMap {
+	return make(ramPositionMap)
+}
+
+func (r ramPositionMap) Get(m MiniHash) (uint64, bool) {
+	pos, ok := r[m]
+	return pos, ok
+}
+
+func (r ramPositionMap) Put(m MiniHash, pos uint64) {
+	r[m] = pos
+}
+
+func (r ramPositionMap) Delete(m MiniHash) {
+	delete(r, m)
+}
+
+func (r ramPositionMap) Len() uint64 {
+	return uint64(len(r))
+}
+
+func (r ramPositionMap) ForEach(fn func(m MiniHash, pos uint64)) {
+	for m, pos := range r {
+		fn(m, pos)
+	}
+}
+
+func (r ramPositionMap) Commit() error {
+	// nothing to do here for a ram position map
+	return nil
+}
+
+func (r ramPositionMap) Close() {}
+
+func (r ramPositionMap) Clear() error {
+	for m := range r {
+		delete(r, m)
+	}
+	return nil
+}
+
+func (r ramPositionMap) Saved(_ uint64) error {
+	// a ram position map isn't saved
+	return nil
+}
+
+func (r ramPositionMap) SavedWith() (uint64, bool) {
+	return 0, false
+}
+
+// ********************************************* position map in leveldb
+
+// Keys in the leveldb position map.  Leaves are posMapLeafPrefix followed
+// by the MiniHash, with the position as an 8 byte big endian value.  The
+// leaf count is at posMapCountKey.  The numLeaves of the forest the map was
+// saved with is at posMapSavedKey; it's deleted along with the first
+// changes after that.
+const posMapLeafPrefix = 'p'
+
+var posMapCountKey = []byte{'n'}
+var posMapSavedKey = []byte{'s'}
+
+// posMapBatchSize is how many leaves clear deletes in one leveldb batch, and
+// how many leaves a forest puts in between commits when it rebuilds the map,
+// so that neither holds the whole map in ram.
+const posMapBatchSize = 100000
+
+// levelDBPositionMap keeps the position map in a leveldb database.  Changes
+// are held in ram until commit, so a block's worth of changes goes to the
+// database in one batch.
+type levelDBPositionMap struct {
+	db *leveldb.DB
+
+	// count is the number of leaves, including the pending changes
+	count uint64
+
+	// pending is the changes since the last commit
+	pending map[MiniHash]undoPos
+}
+
+// NewLevelDBPositionMap opens the leveldb position map at path, creating it
+// if it isn't there.
+func NewLevelDBPositionMap(path string) (PositionMap, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NewLevelDBPositionMap: %s", err.Error())
+	}
+	l := &levelDBPositionMap{db: db, pending: make(map[MiniHash]undoPos)}
+
+	countBytes, err := db.Get(posMapCountKey, nil)
+	switch err {
+	case nil:
+		l.count = binary.BigEndian.Uint64(countBytes)
+	case leveldb.ErrNotFound:
+	default:
+		db.Close()
+		return nil, fmt.Errorf("NewLevelDBPositionMap: %s", err.Error())
+	}
+	return l, nil
+}
+
+func posMapKey(m MiniHash) []byte {
+	return append([]byte{posMapLeafPrefix}, m[:]...)
+}
+
+func (l *levelDBPositionMap) Get(m MiniHash) (uint64, bool) {
+	up, ok := l.pending[m]
+	if ok {
+		return up.pos, up.exists
+	}
+	v, err := l.db.Get(posMapKey(m), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false
+	}
+	if err != nil {
+		// TODO better to return err
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
+func (l *levelDBPositionMap) Put(m MiniHash, pos uint64) {
+	_, exists := l.Get(m)
+	if !exists {
+		l.count++
+	}
+	l.pending[m] = undoPos{pos: pos, exists: true}
+}
+
+func (l *levelDBPositionMap) Delete(m MiniHash) {
+	_, exists := l.Get(m)
+	if exists {
+		l.count--
+	}
+	l.pending[m] = undoPos{}
+}
+
+func (l *levelDBPositionMap) Len() uint64 {
+	return l.count
+}
+
+func (l *levelDBPositionMap) ForEach(fn func(m MiniHash, pos uint64)) {
+	iter := l.db.NewIterator(util.BytesPrefix([]byte{posMapLeafPrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var m MiniHash
+		copy(m[:], iter.Key()[1:])
+		if _, ok := l.pending[m]; ok {
+			continue
+		}
+		fn(m, binary.BigEndian.Uint64(iter.Value()))
+	}
+	for m, up := range l.pending {
+		if up.exists {
+			fn(m, up.pos)
+		}
+	}
+}
+
+func (l *levelDBPositionMap) Commit() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	var buf [8]byte
+	for m, up := range l.pending {
+		if up.exists {
+			binary.BigEndian.PutUint64(buf[:], up.pos)
+			batch.Put(posMapKey(m), buf[:])
+		} else {
+			batch.Delete(posMapKey(m))
+		}
+	}
+	binary.BigEndian.PutUint64(buf[:], l.count)
+	batch.Put(posMapCountKey, buf[:])
+	batch.Delete(posMapSavedKey)
+
+	err := l.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("position map commit: %s", err.Error())
+	}
+	l.pending = make(map[MiniHash]undoPos)
+	return nil
+}
+
+func (l *levelDBPositionMap) Clear() error {
+	l.pending = make(map[MiniHash]undoPos)
+	l.count = 0
+
+	// the saved mark and the count go first, so that if this stops half
+	// way the map isn't mistaken for a good one
+	batch := new(leveldb.Batch)
+	var buf [8]byte
+	batch.Put(posMapCountKey, buf[:])
+	batch.Delete(posMapSavedKey)
+	err := l.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("position map clear: %s", err.Error())
+	}
+
+	iter := l.db.NewIterator(util.BytesPrefix([]byte{posMapLeafPrefix}), nil)
+	defer iter.Release()
+	batch.Reset()
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		if batch.Len() < posMapBatchSize {
+			continue
+		}
+		err = l.db.Write(batch, nil)
+		if err != nil {
+			return fmt.Errorf("position map clear: %s", err.Error())
+		}
+		batch.Reset()
+	}
+	err = iter.Error()
+	if err != nil {
+		return fmt.Errorf("position map clear: %s", err.Error())
+	}
+	err = l.db.Write(batch, nil)
+	if err != nil {
+		return fmt.Errorf("position map clear: %s", err.Error())
+	}
+	return nil
+}
+
+func (l *levelDBPositionMap) Saved(numLeaves uint64) error {
+	err := l.Commit()
+	if err != nil {
+		return err
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], numLeaves)
+	err = l.db.Put(posMapSavedKey, buf[:], nil)
+	if err != nil {
+		return fmt.Errorf("position map save: %s", err.Error())
+	}
+	return nil
+}
+
+func (l *levelDBPositionMap) SavedWith() (uint64, bool) {
+	if len(l.pending) != 0 {
+		return 0, false
+	}
+	v, err := l.db.Get(posMapSavedKey, nil)
+	if err != nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
+func (l *levelDBPositionMap) Close() {
+	err := l.Commit()
+	if err != nil {
+		fmt.Printf("levelDBPositionMap close error: %s\n", err.Error())
+	}
+	err = l.db.Close()
+	if err != nil {
+		fmt.Printf("levelDBPositionMap close error: %s\n", err.Error())
+	}
+}
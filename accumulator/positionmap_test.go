@@ -0,0 +1,158 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLevelDBPositionMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbposmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	posMapPath := filepath.Join(dir, "posmap")
+
+	positionMap, err := NewLevelDBPositionMap(posMapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForest(RamForest, nil, "", 0)
+	err = f.UsePositionMap(positionMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ram := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x1f)
+	for b := 0; b < 200; b++ {
+		adds, durations, delHashes := sc.NextBlock(50)
+		var ubs []*UndoBlock
+		for _, forest := range []*Forest{f, ram} {
+			bp, err := forest.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ub, err := forest.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ubs = append(ubs, ub)
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+
+		if b%5 == 4 {
+			for i, forest := range []*Forest{f, ram} {
+				err = forest.Undo(*ubs[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sc.BackOne(adds, durations, delHashes)
+		}
+		if b%20 == 0 {
+			err = f.AssertEqual(ram)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+		}
+	}
+
+	// the position map gets saved with the forest and is used as it is
+	// when restoring
+	forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forestFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positionMap, err = NewLevelDBPositionMap(posMapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if positionMap.Len() != ram.numLeaves {
+		t.Fatalf("saved position map has %d leaves, expected %d",
+			positionMap.Len(), ram.numLeaves)
+	}
+	restored, err := RestoreForest(miscFile, forestFile, true, false, false,
+		"", 0, positionMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.positionMap != positionMap {
+		t.Fatal("restored forest didn't use the saved position map")
+	}
+	err = restored.AssertEqual(ram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.GetRoots(), ram.GetRoots()) {
+		t.Fatal("roots differ")
+	}
+
+	// a block goes into the position map but the forest isn't saved, like
+	// after a crash, so the map is ahead and gets rebuilt
+	adds, _, delHashes := sc.NextBlock(50)
+	bp, err := restored.ProveBatch(delHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restored.Modify(adds, bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.positionMap.Close()
+
+	positionMap, err = NewLevelDBPositionMap(posMapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := positionMap.SavedWith(); ok {
+		t.Fatal("position map changed since it was saved but says it's saved")
+	}
+	for _, file := range []*os.File{miscFile, forestFile} {
+		_, err = file.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	restored, err = RestoreForest(miscFile, forestFile, true, false, false,
+		"", 0, positionMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restored.PosMapSanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.positionMap.Len() != ram.numLeaves {
+		t.Fatalf("rebuilt position map has %d leaves, expected %d",
+			restored.positionMap.Len(), ram.numLeaves)
+	}
+	restored.positionMap.Close()
+}
@@ -0,0 +1,270 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// ProofTracker keeps the proofs for a set of leaves up to date as blocks
+// come in, so that a wallet doesn't have to go back to a bridge node for
+// proofs of its own utxos.  It only needs the adds, the deletions and the
+// block's BatchProof; no Forest.
+//
+// Underneath it's a Pollard that only remembers the tracked leaves, so the
+// proofs for them are always in the pollard.
+type ProofTracker struct {
+	pollard Pollard
+
+	// watch is the pollard's policy, which keeps the tracked leaves
+	// remembered
+	watch *WalletPolicy
+
+	// tracked is all the leaves being tracked, both ones in the
+	// accumulator and ones added with Track that haven't shown up yet
+	tracked map[MiniHash]Hash
+}
+
+// NewProofTracker returns a ProofTracker for the accumulator with the given
+// roots and numLeaves.  The roots are in the same order as Forest.GetRoots
+// returns them.  leaves and bp are the leaves to start out tracking and a
+// proof for them at those roots.  A nil hasher means DefaultHasher.
+func NewProofTracker(roots []Hash, numLeaves uint64, leaves []Hash,
+	bp BatchProof, hasher Hasher) (*ProofTracker, error) {
+
+	if len(roots) != int(numRoots(numLeaves)) {
+		return nil, fmt.Errorf("NewProofTracker: %d roots but %d leaves",
+			len(roots), numLeaves)
+	}
+	// with only 1 leaf, the proof is empty (see Forest.ProveBatch)
+	if numLeaves > 1 && len(bp.Targets) != len(leaves) {
+		return nil, fmt.Errorf("NewProofTracker: %d leaves but %d targets",
+			len(leaves), len(bp.Targets))
+	}
+
+	pt := &ProofTracker{
+		pollard: NewPollard(hasher),
+		watch:   NewWalletPolicy(),
+		tracked: make(map[MiniHash]Hash),
+	}
+	pt.pollard.Policy = pt.watch
+	pt.pollard.numLeaves = numLeaves
+	pt.pollard.roots = make([]*polNode, len(roots))
+	for i, root := range roots {
+		pt.pollard.roots[i] = &polNode{data: root}
+	}
+	pt.pollard.nodeCount = int64(len(roots))
+
+	err := pt.pollard.IngestBatchProof(leaves, bp, false)
+	if err != nil {
+		return nil, fmt.Errorf("NewProofTracker: %s", err.Error())
+	}
+	for i, leaf := range leaves {
+		pt.watch.Watch(leaf)
+		pt.tracked[leaf.Mini()] = leaf
+		var pos uint64
+		if numLeaves > 1 {
+			pos = bp.Targets[i]
+		}
+		err = pt.pollard.rememberPath(pos)
+		if err != nil {
+			return nil, fmt.Errorf("NewProofTracker: %s", err.Error())
+		}
+	}
+
+	return pt, nil
+}
+
+// Track starts tracking a leaf that hasn't been added yet.  It needs to be
+// called before the Update with the leaf in its adds.
+func (pt *ProofTracker) Track(leaf Hash) {
+	pt.watch.Watch(leaf)
+	pt.tracked[leaf.Mini()] = leaf
+}
+
+// Untrack stops tracking a leaf.  Its proof gets pruned on the next Update.
+func (pt *ProofTracker) Untrack(leaf Hash) {
+	pt.watch.Unwatch(leaf)
+	delete(pt.tracked, leaf.Mini())
+}
+
+// Update moves the tracked proofs forward one block.  bp is the block's
+// proof for delHashes, the leaves it deletes, and adds are the leaves it
+// adds.  Tracked leaves that get deleted stop being tracked.
+func (pt *ProofTracker) Update(
+	adds []Leaf, bp BatchProof, delHashes []Hash) error {
+
+	err := pt.pollard.IngestBatchProof(delHashes, bp, false)
+	if err != nil {
+		return fmt.Errorf("ProofTracker Update: %s", err.Error())
+	}
+	_, err = pt.pollard.Modify(adds, bp.Targets)
+	if err != nil {
+		return fmt.Errorf("ProofTracker Update: %s", err.Error())
+	}
+	for _, del := range delHashes {
+		delete(pt.tracked, del.Mini())
+	}
+
+	return nil
+}
+
+// Prove returns a proof for the given tracked leaves at the current roots.
+func (pt *ProofTracker) Prove(leaves []Hash) (BatchProof, error) {
+	var bp BatchProof
+	if len(leaves) == 0 {
+		return bp, nil
+	}
+	for _, leaf := range leaves {
+		if _, ok := pt.tracked[leaf.Mini()]; !ok {
+			return bp, fmt.Errorf("ProofTracker Prove: %x not tracked", leaf)
+		}
+	}
+
+	// Same as Forest.ProveBatch, with 1 leaf the leaf is the proof.
+	if pt.pollard.numLeaves <= 1 {
+		return bp, nil
+	}
+
+	positions := pt.pollard.leafPositions(pt.tracked)
+	bp.Targets = make([]uint64, len(leaves))
+	for i, leaf := range leaves {
+		pos, ok := positions[leaf.Mini()]
+		if !ok {
+			return bp, fmt.Errorf("ProofTracker Prove: %x not in accumulator",
+				leaf)
+		}
+		bp.Targets[i] = pos
+	}
+
+	sortedTargets := make([]uint64, len(bp.Targets))
+	copy(sortedTargets, bp.Targets)
+	sortUint64s(sortedTargets)
+
+	proofPositions := NewPositionList()
+	defer proofPositions.Free()
+	ProofPositions(sortedTargets, pt.pollard.numLeaves, pt.pollard.rows(),
+		&proofPositions.list)
+
+	bp.Proof = make([]Hash, len(proofPositions.list))
+	for i, pos := range proofPositions.list {
+		n, _, _, err := pt.pollard.readPos(pos)
+		if err != nil {
+			return bp, fmt.Errorf("ProofTracker Prove: %s", err.Error())
+		}
+		if n == nil || n.data == empty {
+			return bp, fmt.Errorf("ProofTracker Prove: missing proof at %d",
+				pos)
+		}
+		bp.Proof[i] = n.data
+	}
+
+	return bp, nil
+}
+
+// Tracked returns all the tracked leaves that are in the accumulator.
+func (pt *ProofTracker) Tracked() []Hash {
+	positions := pt.pollard.leafPositions(pt.tracked)
+	leaves := make([]Hash, 0, len(positions))
+	for m := range positions {
+		leaves = append(leaves, pt.tracked[m])
+	}
+	return leaves
+}
+
+// Roots returns the current roots, in the same order as Forest.GetRoots.
+func (pt *ProofTracker) Roots() []Hash {
+	return pt.pollard.rootHashesForward()
+}
+
+// NumLeaves returns the number of leaves in the accumulator.
+func (pt *ProofTracker) NumLeaves() uint64 {
+	return pt.pollard.numLeaves
+}
+
+// rememberPath marks the leaf at pos and all the nodes above it as
+// remembered so that pruning keeps its proof around.  The proof needs to
+// be ingested already.
+func (p *Pollard) rememberPath(pos uint64) error {
+	rows := p.rows()
+	n, _, _, err := p.readPos(pos)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return fmt.Errorf("rememberPath: no leaf at %d", pos)
+	}
+	if !n.remember {
+		n.remember = true
+		p.rememberEver++
+		p.currentRemember++
+	}
+
+	for row := uint8(0); ; row++ {
+		if p.numLeaves&(1<<row) != 0 &&
+			pos == rootPosition(p.numLeaves, row, rows) {
+			return nil
+		}
+		pos = parent(pos, rows)
+		n, _, _, err = p.readPos(pos)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			return fmt.Errorf("rememberPath: no node at %d", pos)
+		}
+		n.remember = true
+	}
+}
+
+// leafPositions returns the positions of all the leaves in want that are
+// in the pollard.
+func (p *Pollard) leafPositions(want map[MiniHash]Hash) map[MiniHash]uint64 {
+	found := make(map[MiniHash]uint64, len(want))
+	rows := p.rows()
+
+	// roots are ordered tallest first
+	i := 0
+	for h := uint8(63); i < len(p.roots); h-- {
+		if (p.numLeaves>>h)&1 == 0 {
+			continue
+		}
+		root := p.roots[i]
+		i++
+		rootPos := rootPosition(p.numLeaves, h, rows)
+		if h == 0 {
+			if _, ok := want[root.data.Mini()]; ok {
+				found[root.data.Mini()] = rootPos
+			}
+			continue
+		}
+		p.findLeaves(root.niece[0], root.niece[1], child(rootPos, rows),
+			h-1, rows, want, found)
+	}
+	return found
+}
+
+// findLeaves finds the leaves in want under the siblings l and r, which
+// are at row h with l at position lpos.  Like forgetBelow, l's children
+// hang off of r and r's children hang off of l.
+func (p *Pollard) findLeaves(l, r *polNode, lpos uint64, h, rows uint8,
+	want map[MiniHash]Hash, found map[MiniHash]uint64) {
+
+	if h == 0 {
+		for i, n := range []*polNode{l, r} {
+			if n == nil {
+				continue
+			}
+			if _, ok := want[n.data.Mini()]; ok {
+				found[n.data.Mini()] = lpos | uint64(i)
+			}
+		}
+		return
+	}
+	if r != nil {
+		p.findLeaves(r.niece[0], r.niece[1], child(lpos, rows),
+			h-1, rows, want, found)
+	}
+	if l != nil {
+		p.findLeaves(l.niece[0], l.niece[1], child(lpos|1, rows),
+			h-1, rows, want, found)
+	}
+}
@@ -0,0 +1,112 @@
+package accumulator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProofTracker(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x1f)
+
+	// build up a forest to start tracking from
+	for b := 0; b < 20; b++ {
+		adds, _, delHashes := sc.NextBlock(16)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// track every 7th leaf there is now
+	var held []Hash
+	for pos := uint64(0); pos < f.numLeaves; pos += 7 {
+		held = append(held, f.data.read(pos))
+	}
+	hbp, err := f.ProveBatch(held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := NewProofTracker(f.GetRoots(), f.numLeaves, held, hbp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(16)
+		// pick up a couple of the new leaves too
+		pt.Track(adds[0].Hash)
+		pt.Track(adds[5].Hash)
+		if b%10 == 9 {
+			tracked := pt.Tracked()
+			pt.Untrack(tracked[0])
+		}
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pt.Update(adds, bp, delHashes)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		if !reflect.DeepEqual(f.GetRoots(), pt.Roots()) {
+			t.Fatalf("block %d roots differ", b)
+		}
+
+		tracked := pt.Tracked()
+		if len(tracked) == 0 {
+			t.Fatalf("block %d nothing tracked", b)
+		}
+		tbp, err := pt.Prove(tracked)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		err = f.VerifyBatchProof(tracked, tbp)
+		if err != nil {
+			t.Fatalf("block %d tracked proof doesn't verify: %s", b, err.Error())
+		}
+		fbp, err := f.ProveBatch(tracked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fbp, tbp) {
+			t.Fatalf("block %d tracker and forest proofs differ", b)
+		}
+	}
+
+	// the pollard should stay small since it only keeps tracked proofs
+	if pt.pollard.GetTotalCount() >= int64(f.numLeaves) {
+		t.Fatalf("tracker has %d nodes for %d leaves",
+			pt.pollard.GetTotalCount(), f.numLeaves)
+	}
+}
+
+func TestProofTrackerNotTracked(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := []Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}, {Hash: Hash{3}}}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := f.ProveBatch([]Hash{{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := NewProofTracker(f.GetRoots(), f.numLeaves, []Hash{{1}}, bp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pt.Prove([]Hash{{2}})
+	if err == nil {
+		t.Fatal("proved a leaf that isn't tracked")
+	}
+}
@@ -0,0 +1,560 @@
+package accumulator
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// RememberPolicy decides which leaves a Pollard remembers (caches).  Leaves
+// that are remembered keep their proofs in the pollard, so when they're
+// spent those proof hashes don't need to come over the wire again.
+//
+// The pollard asks the policy about every leaf it adds, tells it about
+// every leaf that gets deleted, and at the end of every Modify asks which
+// remembered leaves should be forgotten and pruned.  When the pollard is
+// over MaxNodes, the policy picks which remembered leaves are evicted and
+// is told about each one.  Policies aren't rolled back by Pollard.Undo.
+type RememberPolicy interface {
+	// Remember returns whether a leaf being added should be remembered.
+	// ttl is how many blocks later the leaf gets spent, with 0 meaning
+	// it's not known to ever be spent.
+	Remember(leaf Hash, ttl int32) bool
+
+	// Deleted tells the policy that a leaf got deleted from the pollard.
+	Deleted(leaf Hash)
+
+	// Forget returns the remembered leaves that should now be pruned from
+	// the pollard.
+	Forget() []Hash
+
+	// EvictOrder is given the remembered leaves, oldest first, when the
+	// pollard is over MaxNodes.  It returns the ones that can be evicted,
+	// least valuable first.  Leaves left out are kept.
+	EvictOrder(leaves []Hash) []Hash
+
+	// Evicted tells the policy that a remembered leaf was pruned to keep
+	// the pollard under MaxNodes.
+	Evicted(leaf Hash)
+
+	// String returns the name of the policy for stats
+	String() string
+}
+
+// TTLPolicy remembers leaves that will be spent within Window blocks of
+// being added.  This needs the TTLs the bridge node sends with each block.
+type TTLPolicy struct {
+	Window int32
+}
+
+// Remember returns true if the leaf gets spent within the window
+func (t *TTLPolicy) Remember(_ Hash, ttl int32) bool {
+	return ttl != 0 && ttl < t.Window
+}
+
+// Deleted does nothing; leaves only stay remembered until they're spent.
+func (t *TTLPolicy) Deleted(_ Hash) {}
+
+// Forget never forgets anything early
+func (t *TTLPolicy) Forget() []Hash { return nil }
+
+// EvictOrder evicts the oldest leaves first.  They've been remembered the
+// longest, so they're the closest to the end of their window and the
+// least likely to still be spent within it.
+func (t *TTLPolicy) EvictOrder(leaves []Hash) []Hash { return leaves }
+
+// Evicted does nothing; the TTLPolicy doesn't keep track of leaves.
+func (t *TTLPolicy) Evicted(_ Hash) {}
+
+func (t *TTLPolicy) String() string {
+	return fmt.Sprintf("ttl(%d)", t.Window)
+}
+
+// LRUPolicy remembers every leaf added but holds on to at most Max of them.
+// Once there are more than Max, the least recently added ones are forgotten.
+type LRUPolicy struct {
+	max uint64
+
+	// order is the remembered leaves, most recently added at the front
+	order *list.List
+
+	// leaves maps remembered leaves to where they are in order
+	leaves map[MiniHash]*list.Element
+
+	// forget is the leaves pushed out of order since the last Forget
+	forget []Hash
+}
+
+// NewLRUPolicy returns a LRUPolicy that remembers up to max leaves
+func NewLRUPolicy(max uint64) *LRUPolicy {
+	return &LRUPolicy{
+		max:    max,
+		order:  list.New(),
+		leaves: make(map[MiniHash]*list.Element),
+	}
+}
+
+// Remember always returns true, pushing out the oldest leaf if it's full.
+func (l *LRUPolicy) Remember(leaf Hash, _ int32) bool {
+	if l.max == 0 {
+		return false
+	}
+	if uint64(l.order.Len()) >= l.max {
+		oldest := l.order.Back()
+		old := l.order.Remove(oldest).(Hash)
+		delete(l.leaves, old.Mini())
+		l.forget = append(l.forget, old)
+	}
+	l.leaves[leaf.Mini()] = l.order.PushFront(leaf)
+	return true
+}
+
+// Deleted frees up the spot of a leaf that got spent
+func (l *LRUPolicy) Deleted(leaf Hash) {
+	e, ok := l.leaves[leaf.Mini()]
+	if !ok {
+		return
+	}
+	l.order.Remove(e)
+	delete(l.leaves, leaf.Mini())
+}
+
+// Forget returns the leaves pushed out since the last call
+func (l *LRUPolicy) Forget() []Hash {
+	forget := l.forget
+	l.forget = nil
+	return forget
+}
+
+// EvictOrder evicts the least recently added leaves first.  Leaves the
+// policy didn't remember, such as ones remembered before it was set, go
+// before all of them.
+func (l *LRUPolicy) EvictOrder(leaves []Hash) []Hash {
+	remembered := make(map[MiniHash]bool, len(leaves))
+	order := make([]Hash, 0, len(leaves))
+	for _, leaf := range leaves {
+		remembered[leaf.Mini()] = true
+		if _, ok := l.leaves[leaf.Mini()]; !ok {
+			order = append(order, leaf)
+		}
+	}
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		leaf := e.Value.(Hash)
+		if remembered[leaf.Mini()] {
+			order = append(order, leaf)
+		}
+	}
+	return order
+}
+
+// Evicted frees up the spot of an evicted leaf, like Deleted
+func (l *LRUPolicy) Evicted(leaf Hash) {
+	l.Deleted(leaf)
+}
+
+func (l *LRUPolicy) String() string {
+	return fmt.Sprintf("lru(%d)", l.max)
+}
+
+// WalletPolicy only remembers leaves that are being watched, such as the
+// utxos of a wallet.  Watch has to be called before the leaf is added.
+type WalletPolicy struct {
+	watched map[MiniHash]bool
+
+	// forget is the leaves unwatched since the last Forget
+	forget []Hash
+}
+
+// NewWalletPolicy returns a WalletPolicy watching nothing
+func NewWalletPolicy() *WalletPolicy {
+	return &WalletPolicy{watched: make(map[MiniHash]bool)}
+}
+
+// Watch makes the leaf get remembered when it's added
+func (w *WalletPolicy) Watch(leaf Hash) {
+	w.watched[leaf.Mini()] = true
+}
+
+// Unwatch stops remembering a leaf.  If it's already in the pollard, it's
+// pruned at the end of the next Modify.
+func (w *WalletPolicy) Unwatch(leaf Hash) {
+	if !w.watched[leaf.Mini()] {
+		return
+	}
+	delete(w.watched, leaf.Mini())
+	w.forget = append(w.forget, leaf)
+}
+
+// Remember returns true if the leaf is watched
+func (w *WalletPolicy) Remember(leaf Hash, _ int32) bool {
+	return w.watched[leaf.Mini()]
+}
+
+// Deleted stops watching a spent leaf
+func (w *WalletPolicy) Deleted(leaf Hash) {
+	delete(w.watched, leaf.Mini())
+}
+
+// Forget returns the leaves unwatched since the last call
+func (w *WalletPolicy) Forget() []Hash {
+	forget := w.forget
+	w.forget = nil
+	return forget
+}
+
+// EvictOrder never evicts watched leaves.  Any others, like ones
+// remembered before the policy was set, go oldest first.
+func (w *WalletPolicy) EvictOrder(leaves []Hash) []Hash {
+	var order []Hash
+	for _, leaf := range leaves {
+		if !w.watched[leaf.Mini()] {
+			order = append(order, leaf)
+		}
+	}
+	return order
+}
+
+// Evicted does nothing; only leaves that aren't watched are evicted.
+func (w *WalletPolicy) Evicted(_ Hash) {}
+
+func (w *WalletPolicy) String() string {
+	return fmt.Sprintf("wallet(%d)", len(w.watched))
+}
+
+// The policies a pollard knows how to save
+const (
+	policyNone byte = iota
+	policyTTL
+	policyLRU
+	policyWallet
+)
+
+// appendPolicy appends what kind of policy it is and its parameters.  The
+// LRU and wallet policies also keep which leaves they're remembering or
+// watching, so they carry on where they left off.  Policies from outside
+// this package are saved as no policy.
+func appendPolicy(buf []byte, policy RememberPolicy) []byte {
+	switch pol := policy.(type) {
+	case *TTLPolicy:
+		buf = append(buf, policyTTL)
+		buf = appendUint32(buf, uint32(pol.Window))
+	case *LRUPolicy:
+		buf = append(buf, policyLRU)
+		buf = appendUint64(buf, pol.max)
+		buf = appendUint32(buf, uint32(pol.order.Len()))
+		// oldest first
+		for e := pol.order.Back(); e != nil; e = e.Prev() {
+			leaf := e.Value.(Hash)
+			buf = append(buf, leaf[:]...)
+		}
+	case *WalletPolicy:
+		buf = append(buf, policyWallet)
+		watched := make([]MiniHash, 0, len(pol.watched))
+		for m := range pol.watched {
+			watched = append(watched, m)
+		}
+		sort.Slice(watched, func(a, b int) bool {
+			return bytes.Compare(watched[a][:], watched[b][:]) < 0
+		})
+		buf = appendUint32(buf, uint32(len(watched)))
+		for _, m := range watched {
+			buf = append(buf, m[:]...)
+		}
+	default:
+		buf = append(buf, policyNone)
+	}
+	return buf
+}
+
+// readPolicy reads a policy saved by appendPolicy.  It's nil if there
+// wasn't one.
+func readPolicy(r io.Reader) (RememberPolicy, error) {
+	var kind [1]byte
+	_, err := io.ReadFull(r, kind[:])
+	if err != nil {
+		return nil, errorPollardCutShort()
+	}
+	switch kind[0] {
+	case policyNone:
+		return nil, nil
+	case policyTTL:
+		var window int32
+		err = binary.Read(r, binary.BigEndian, &window)
+		if err != nil {
+			return nil, errorPollardCutShort()
+		}
+		return &TTLPolicy{Window: window}, nil
+	case policyLRU:
+		var max uint64
+		var count uint32
+		err = binary.Read(r, binary.BigEndian, &max)
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &count)
+		}
+		if err != nil {
+			return nil, errorPollardCutShort()
+		}
+		lru := NewLRUPolicy(max)
+		for ; count > 0; count-- {
+			var leaf Hash
+			_, err = io.ReadFull(r, leaf[:])
+			if err != nil {
+				return nil, errorPollardCutShort()
+			}
+			lru.leaves[leaf.Mini()] = lru.order.PushFront(leaf)
+		}
+		return lru, nil
+	case policyWallet:
+		var count uint32
+		err = binary.Read(r, binary.BigEndian, &count)
+		if err != nil {
+			return nil, errorPollardCutShort()
+		}
+		wallet := NewWalletPolicy()
+		for ; count > 0; count-- {
+			var m MiniHash
+			_, err = io.ReadFull(r, m[:])
+			if err != nil {
+				return nil, errorPollardCutShort()
+			}
+			wallet.watched[m] = true
+		}
+		return wallet, nil
+	}
+	return nil, fmt.Errorf("%s: unknown policy %d",
+		ErrorCorruptPollard.Error(), kind[0])
+}
+
+// RememberStats is how well a pollard's RememberPolicy is doing.
+type RememberStats struct {
+	// Policy is the name of the RememberPolicy, "" if there isn't one
+	Policy string
+
+	// Hits is how many deleted leaves were remembered
+	Hits uint64
+
+	// Misses is how many deleted leaves were not remembered
+	Misses uint64
+
+	// Forgotten is how many remembered leaves the policy dropped before
+	// they got deleted
+	Forgotten uint64
+
+	// Evicted is how many remembered leaves were dropped to keep the
+	// pollard under MaxNodes
+	Evicted uint64
+
+	// ProofHashes is how many proof hashes came in with batch proofs, and
+	// CachedHashHits is how many of those the pollard already had.  The
+	// hits only save bandwidth if the proofs are trimmed of them with
+	// ProveBatchTrimmed.  These are only counted when the pollard has a
+	// Policy since it's a bit of extra work for every proof.
+	ProofHashes, CachedHashHits uint64
+}
+
+// HitRate returns the fraction of deleted leaves that were remembered
+func (s RememberStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// RememberStats returns the stats for the pollard's RememberPolicy
+func (p *Pollard) RememberStats() RememberStats {
+	s := p.rememberStats
+	if p.Policy != nil {
+		s.Policy = p.Policy.String()
+	}
+	return s
+}
+
+// countCached adds the proof hashes of bp to the stats, along with how
+// many of them the pollard already has.  Call it before the proof is
+// ingested.
+func (p *Pollard) countCached(bp BatchProof) {
+	p.rememberStats.ProofHashes += uint64(len(bp.Proof))
+	for _, h := range p.cachedProof(bp) {
+		if h != empty {
+			p.rememberStats.CachedHashHits++
+		}
+	}
+}
+
+// forget stops remembering the given leaves and prunes everything that
+// was only there for them.  count is the stat to add the leaves that were
+// remembered to.
+func (p *Pollard) forget(leaves []Hash, count *uint64) {
+	if len(leaves) == 0 {
+		return
+	}
+	forget := make(map[MiniHash]bool, len(leaves))
+	for _, l := range leaves {
+		forget[l.Mini()] = true
+	}
+
+	// roots are ordered tallest first
+	i := 0
+	for h := uint8(63); i < len(p.roots); h-- {
+		if (p.numLeaves>>h)&1 == 0 {
+			continue
+		}
+		root := p.roots[i]
+		i++
+		if h == 0 {
+			p.forgetLeaf(root, forget, count)
+			continue
+		}
+		lrem, rrem := p.forgetBelow(
+			root.niece[0], root.niece[1], h-1, forget, count)
+		p.pruneNieces(root, lrem || rrem)
+	}
+}
+
+// forgetBelow forgets leaves under the siblings l and r, which are at row
+// h.  It returns whether anything under l and under r is still remembered,
+// and sets that as their remember flag.  Since a node points to its nieces,
+// l's children hang off of r and r's children hang off of l.
+func (p *Pollard) forgetBelow(l, r *polNode, h uint8,
+	forget map[MiniHash]bool, count *uint64) (lrem, rrem bool) {
+
+	if h == 0 {
+		return p.forgetLeaf(l, forget, count), p.forgetLeaf(r, forget, count)
+	}
+	if r != nil {
+		a, b := p.forgetBelow(r.niece[0], r.niece[1], h-1, forget, count)
+		lrem = a || b
+		p.pruneNieces(r, lrem)
+	}
+	if l != nil {
+		a, b := p.forgetBelow(l.niece[0], l.niece[1], h-1, forget, count)
+		rrem = a || b
+		p.pruneNieces(l, rrem)
+	}
+	p.setRemember(l, lrem)
+	p.setRemember(r, rrem)
+	return
+}
+
+// forgetLeaf stops remembering n if it's in forget, and returns whether
+// it's still remembered.
+func (p *Pollard) forgetLeaf(n *polNode, forget map[MiniHash]bool,
+	count *uint64) bool {
+
+	if n == nil {
+		return false
+	}
+	if n.remember && forget[n.data.Mini()] {
+		p.touch(n)
+		n.remember = false
+		p.currentRemember--
+		*count++
+	}
+	return n.remember
+}
+
+// pruneNieces drops the dead end nieces of n if nothing under them is
+// remembered.  Like prune, but ok with nil nieces.
+func (p *Pollard) pruneNieces(n *polNode, remember bool) {
+	if remember {
+		return
+	}
+	for i := range n.niece {
+		if n.niece[i] != nil && n.niece[i].deadEnd() {
+			p.touch(n)
+			n.niece[i] = nil
+			p.nodeCount--
+		}
+	}
+}
+
+// setRemember sets the remember flag of an internal node
+func (p *Pollard) setRemember(n *polNode, remember bool) {
+	if n == nil || n.remember == remember {
+		return
+	}
+	p.touch(n)
+	n.remember = remember
+}
+
+// evict forgets remembered leaves until the pollard has at most MaxNodes
+// polNodes or there's nothing left to forget.  The Policy orders the
+// leaves and can keep some.  Without one they go oldest first: the leaves
+// on the left of the forest are the oldest, and old leaves are the least
+// likely to be spent soon, so their proofs are the least valuable to keep.
+// The roots are always kept.
+func (p *Pollard) evict() {
+	if p.MaxNodes == 0 || p.positionMap != nil {
+		return
+	}
+	count := uint64(p.nodeCount)
+	if count <= p.MaxNodes {
+		return
+	}
+	leaves := p.rememberedLeaves()
+	if p.Policy != nil {
+		leaves = p.Policy.EvictOrder(leaves)
+	}
+	for count > p.MaxNodes && len(leaves) > 0 {
+		// guess how many leaves to forget from how many nodes each one
+		// holds on to, and go again if that wasn't enough
+		n := uint64(len(leaves))*(count-p.MaxNodes)/count + 1
+		if n > uint64(len(leaves)) {
+			n = uint64(len(leaves))
+		}
+		p.forget(leaves[:n], &p.rememberStats.Evicted)
+		if p.Policy != nil {
+			for _, leaf := range leaves[:n] {
+				p.Policy.Evicted(leaf)
+			}
+		}
+		leaves = leaves[n:]
+		count = uint64(p.nodeCount)
+	}
+}
+
+// rememberedLeaves returns the remembered leaves from left to right
+func (p *Pollard) rememberedLeaves() []Hash {
+	var leaves []Hash
+	// roots are ordered tallest first
+	i := 0
+	for h := uint8(63); i < len(p.roots); h-- {
+		if (p.numLeaves>>h)&1 == 0 {
+			continue
+		}
+		root := p.roots[i]
+		i++
+		if h == 0 {
+			if root.remember {
+				leaves = append(leaves, root.data)
+			}
+			continue
+		}
+		leaves = rememberedBelow(root.niece[0], root.niece[1], h-1, leaves)
+	}
+	return leaves
+}
+
+// rememberedBelow appends the remembered leaves under the siblings l and r,
+// which are at row h, from left to right.
+func rememberedBelow(l, r *polNode, h uint8, leaves []Hash) []Hash {
+	if h == 0 {
+		for _, n := range []*polNode{l, r} {
+			if n != nil && n.remember {
+				leaves = append(leaves, n.data)
+			}
+		}
+		return leaves
+	}
+	// l's children hang off of r
+	if r != nil {
+		leaves = rememberedBelow(r.niece[0], r.niece[1], h-1, leaves)
+	}
+	if l != nil {
+		leaves = rememberedBelow(l.niece[0], l.niece[1], h-1, leaves)
+	}
+	return leaves
+}
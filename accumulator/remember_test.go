@@ -0,0 +1,351 @@
+package accumulator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRememberPolicies(t *testing.T) {
+	policies := []func() RememberPolicy{
+		func() RememberPolicy { return &TTLPolicy{Window: 8} },
+		func() RememberPolicy { return NewLRUPolicy(50) },
+		func() RememberPolicy { return NewWalletPolicy() },
+	}
+	for _, newPolicy := range policies {
+		policy := newPolicy()
+		err := policyForestPollard(policy, 200)
+		if err != nil {
+			t.Fatalf("%s: %s", policy.String(), err.Error())
+		}
+	}
+}
+
+// policyForestPollard runs a pollard with a RememberPolicy next to a forest,
+// checking that the roots match and that the remembered leaves are what the
+// pollard thinks they are.
+func policyForestPollard(policy RememberPolicy, blocks int32) error {
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+	p.Policy = policy
+	wallet, _ := policy.(*WalletPolicy)
+
+	sc := newSimChain(0x0f)
+	for b := int32(0); b < blocks; b++ {
+		adds, durations, delHashes := sc.NextBlock(8)
+		for i := range adds {
+			adds[i].TTL = durations[i]
+			if wallet != nil && i%3 == 0 {
+				wallet.Watch(adds[i].Hash)
+			}
+		}
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(f.GetRoots(), p.rootHashesForward()) {
+			return fmt.Errorf("block %d roots differ", b)
+		}
+		err = checkRemembered(&p)
+		if err != nil {
+			return fmt.Errorf("block %d %s", b, err.Error())
+		}
+		if wallet != nil && b%10 == 9 {
+			// drop a few watched leaves from the last block
+			wallet.Unwatch(adds[0].Hash)
+		}
+	}
+
+	rs := p.RememberStats()
+	if rs.Policy != policy.String() {
+		return fmt.Errorf("stats for %s, expected %s", rs.Policy, policy.String())
+	}
+	if rs.Hits == 0 || rs.Misses == 0 {
+		return fmt.Errorf("expected hits and misses, got %d hits %d misses",
+			rs.Hits, rs.Misses)
+	}
+	if rs.CachedHashHits == 0 || rs.CachedHashHits > rs.ProofHashes {
+		return fmt.Errorf("%d cached of %d proof hashes",
+			rs.CachedHashHits, rs.ProofHashes)
+	}
+	return nil
+}
+
+// checkRemembered checks that the pollard's counts of remembered leaves and
+// of nodes are right, and that every remembered leaf is there along with
+// its proof.
+func checkRemembered(p *Pollard) error {
+	if p.nodeCount != p.GetTotalCount() {
+		return fmt.Errorf("%d nodes but nodeCount is %d",
+			p.GetTotalCount(), p.nodeCount)
+	}
+	var remembered uint64
+	for pos := uint64(0); pos < p.numLeaves; pos++ {
+		n, _, _, err := p.readPos(pos)
+		if err != nil {
+			return err
+		}
+		if n == nil || !n.remember {
+			continue
+		}
+		remembered++
+		if n.data == empty {
+			return fmt.Errorf("remembered leaf at %d is empty", pos)
+		}
+		var proofPositions []uint64
+		ProofPositions([]uint64{pos}, p.numLeaves, p.rows(), &proofPositions)
+		for _, ppos := range proofPositions {
+			pn, _, _, err := p.readPos(ppos)
+			if err != nil {
+				return err
+			}
+			if pn == nil || pn.data == empty {
+				return fmt.Errorf("remembered leaf at %d missing proof at %d",
+					pos, ppos)
+			}
+		}
+	}
+	if remembered != p.currentRemember {
+		return fmt.Errorf("%d leaves remembered but currentRemember is %d",
+			remembered, p.currentRemember)
+	}
+	return nil
+}
+
+func TestLRUPolicyForgets(t *testing.T) {
+	var all, lru Pollard
+	lru.Policy = NewLRUPolicy(10)
+
+	adds := make([]Leaf, 500)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i)
+		adds[i].Hash[1] = uint8(i >> 8)
+		adds[i].Hash[3] = 0xff
+		adds[i].Remember = true
+	}
+	for i := 0; i < len(adds); i += 50 {
+		_, err := all.Modify(adds[i:i+50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = lru.Modify(adds[i:i+50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(all.rootHashesForward(), lru.rootHashesForward()) {
+		t.Fatal("roots differ")
+	}
+	if lru.currentRemember != 10 {
+		t.Fatalf("lru remembers %d leaves, expected 10", lru.currentRemember)
+	}
+	err := checkRemembered(&lru)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lru.GetTotalCount() >= all.GetTotalCount()/4 {
+		t.Fatalf("lru pollard has %d nodes, remember all has %d",
+			lru.GetTotalCount(), all.GetTotalCount())
+	}
+	if lru.RememberStats().Forgotten != 490 {
+		t.Fatalf("forgot %d leaves, expected 490",
+			lru.RememberStats().Forgotten)
+	}
+
+	// forgetting gets undone along with the rest of the Modify
+	count := lru.GetTotalCount()
+	undo, err := lru.Modify(adds[:50], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lru.Undo(undo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lru.GetTotalCount() != count {
+		t.Fatalf("%d nodes after undo, expected %d", lru.GetTotalCount(), count)
+	}
+	err = checkRemembered(&lru)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollardMaxNodes(t *testing.T) {
+	// remembering everything that comes in with proofs
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+	p.MaxNodes = 300
+	sc := newSimChain(0x0f)
+	for b := int32(0); b < 200; b++ {
+		adds, _, delHashes := sc.NextBlock(8)
+		for i := range adds {
+			adds[i].Remember = true
+		}
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.IngestBatchProof(delHashes, bp, true)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(f.GetRoots(), p.rootHashesForward()) {
+			t.Fatalf("block %d roots differ", b)
+		}
+		if uint64(p.GetTotalCount()) > p.MaxNodes {
+			t.Fatalf("block %d: %d nodes, max %d",
+				b, p.GetTotalCount(), p.MaxNodes)
+		}
+		err = checkRemembered(&p)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+	}
+	if p.RememberStats().Evicted == 0 {
+		t.Fatal("nothing evicted")
+	}
+
+	// with only adds, what's left remembered is the newest leaves
+	var q Pollard
+	q.MaxNodes = 100
+	adds := make([]Leaf, 500)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i)
+		adds[i].Hash[1] = uint8(i >> 8)
+		adds[i].Hash[3] = 0xff
+		adds[i].Remember = true
+	}
+	for i := 0; i < len(adds); i += 50 {
+		_, err := q.Modify(adds[i:i+50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uint64(q.GetTotalCount()) > q.MaxNodes || q.currentRemember == 0 {
+		t.Fatalf("%d nodes %d remembered, max %d",
+			q.GetTotalCount(), q.currentRemember, q.MaxNodes)
+	}
+	for pos := uint64(0); pos < q.numLeaves; pos++ {
+		n, _, _, err := q.readPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remembered := n != nil && n.remember
+		newest := pos >= q.numLeaves-q.currentRemember
+		if remembered != newest {
+			t.Fatalf("leaf %d remembered %v, %d newest are remembered",
+				pos, remembered, q.currentRemember)
+		}
+	}
+	err := checkRemembered(&q)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyEvictOrder(t *testing.T) {
+	adds := make([]Leaf, 500)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i)
+		adds[i].Hash[1] = uint8(i >> 8)
+		adds[i].Hash[3] = 0xff
+	}
+
+	// the wallet's watched leaves are kept while the others are evicted
+	wallet := NewWalletPolicy()
+	var w Pollard
+	w.Policy = wallet
+	w.MaxNodes = 200
+	for i := 0; i < len(adds); i += 100 {
+		wallet.Watch(adds[i].Hash)
+	}
+	for i := 0; i < len(adds); i += 50 {
+		_, err := w.Modify(adds[i:i+50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.RememberStats().Evicted != 0 {
+		t.Fatalf("evicted %d leaves with only watched ones remembered",
+			w.RememberStats().Evicted)
+	}
+
+	// leaves remembered before the policy was set get evicted, watched
+	// ones don't
+	for i := range adds {
+		adds[i].Remember = true
+	}
+	var p Pollard
+	_, err := p.Modify(adds[:250], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Policy = wallet
+	p.MaxNodes = 200
+	_, err = p.Modify(adds[250:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RememberStats().Evicted == 0 {
+		t.Fatal("nothing evicted")
+	}
+	for i := 0; i < len(adds); i += 100 {
+		n, _, _, err := p.readPos(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == nil || !n.remember {
+			t.Fatalf("watched leaf %d was evicted", i)
+		}
+	}
+	err = checkRemembered(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lru policy is told what was evicted
+	lru := NewLRUPolicy(400)
+	var l Pollard
+	l.Policy = lru
+	l.MaxNodes = 100
+	for i := 0; i < len(adds); i += 50 {
+		_, err := l.Modify(adds[i:i+50], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uint64(l.GetTotalCount()) > l.MaxNodes || l.RememberStats().Evicted == 0 {
+		t.Fatalf("%d nodes %d evicted, max %d", l.GetTotalCount(),
+			l.RememberStats().Evicted, l.MaxNodes)
+	}
+	if uint64(lru.order.Len()) != l.currentRemember ||
+		len(lru.leaves) != lru.order.Len() {
+		t.Fatalf("lru tracks %d leaves, pollard remembers %d",
+			lru.order.Len(), l.currentRemember)
+	}
+	err = checkRemembered(&l)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,292 @@
+package accumulator
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ForestSnapshot is a read only view of a Forest as it was when Snapshot
+// was called.  The forest can keep getting modified and the snapshot will
+// still give proofs at the height it was taken.  It's copy-on-write: the
+// snapshot only holds on to the hashes that have changed since it was
+// taken, so taking one is cheap but it grows as the forest moves on.
+//
+// Snapshots can be used from any goroutine.  They don't wait for Modify to
+// finish a block: a snapshot only locks the forest's data for each hash it
+// reads, the same as Modify does for each hash it changes.  Release a
+// snapshot when done with it, or the forest keeps saving hashes for it.
+type ForestSnapshot struct {
+	live *Forest
+
+	// mtx is held by Release, and for reading by everything else, so a
+	// snapshot isn't released while it's being read
+	mtx sync.RWMutex
+
+	// forest is a read only forest that reads through data
+	forest *Forest
+	data   *snapshotData
+}
+
+// snapshotData is ForestData that reads a live forest, but with the hashes
+// that the live forest has changed since the snapshot saved on the side.
+type snapshotData struct {
+	live *Forest
+
+	// rows of the forest when the snapshot was taken.  Positions here are
+	// for this many rows; the live forest may have more by now.
+	rows uint8
+
+	// saved is the old hashes at positions the live forest has changed
+	saved map[uint64]Hash
+
+	// positions is the old position map entries the live forest has
+	// changed
+	positions map[MiniHash]undoPos
+
+	released bool
+}
+
+// Snapshot returns a ForestSnapshot of the forest as it is now.
+func (f *Forest) Snapshot() *ForestSnapshot {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+
+	d := &snapshotData{
+		live:      f,
+		rows:      f.rows,
+		saved:     make(map[uint64]Hash),
+		positions: make(map[MiniHash]undoPos),
+	}
+	f.snapshots = append(f.snapshots, d)
+
+	sf := new(Forest)
+	sf.numLeaves = f.numLeaves
+	sf.rows = f.rows
+	sf.hasher = f.hasher
+	sf.data = d
+
+	return &ForestSnapshot{live: f, forest: sf, data: d}
+}
+
+// Release stops the forest from saving hashes for the snapshot.  The
+// snapshot can't be used after.
+func (s *ForestSnapshot) Release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.live.dataMtx.Lock()
+	defer s.live.dataMtx.Unlock()
+
+	if s.data.released {
+		return
+	}
+	s.data.released = true
+	for i, d := range s.live.snapshots {
+		if d == s.data {
+			s.live.snapshots = append(
+				s.live.snapshots[:i], s.live.snapshots[i+1:]...)
+			break
+		}
+	}
+	s.data.saved = nil
+	s.data.positions = nil
+}
+
+// ProveBatch is Forest.ProveBatch at the height of the snapshot
+func (s *ForestSnapshot) ProveBatch(hs []Hash) (BatchProof, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.data.released {
+		return BatchProof{}, fmt.Errorf("ProveBatch on released snapshot")
+	}
+	return s.forest.ProveBatch(hs)
+}
+
+// Prove is Forest.Prove at the height of the snapshot
+func (s *ForestSnapshot) Prove(wanted Hash) (Proof, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.data.released {
+		return Proof{}, fmt.Errorf("Prove on released snapshot")
+	}
+	return s.forest.Prove(wanted)
+}
+
+// GetRoots returns the roots at the height of the snapshot
+func (s *ForestSnapshot) GetRoots() []Hash {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.forest.GetRoots()
+}
+
+// NumLeaves returns the number of leaves at the height of the snapshot
+func (s *ForestSnapshot) NumLeaves() uint64 {
+	return s.forest.numLeaves
+}
+
+// VerifyBatchProof is Forest.VerifyBatchProof at the height of the snapshot
+func (s *ForestSnapshot) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
+	_, _, err := verifyBatchProof(toProve, bp, s.GetRoots(), s.forest.numLeaves,
+		s.forest.hasher, nil)
+	return err
+}
+
+// leafPosition returns where a leaf is, using the position map or the
+// snapshot's view of it.
+func (f *Forest) leafPosition(m MiniHash) (uint64, bool) {
+	if d, ok := f.data.(*snapshotData); ok {
+		return d.position(m)
+	}
+	return f.positionMap.Get(m)
+}
+
+// read is how the forest reads its data while snapshots may be reading it
+// too.  Some ForestData, like the CowForest's, change their caches on read.
+func (f *Forest) read(pos uint64) Hash {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	return f.data.read(pos)
+}
+
+// write, swapHash, swapHashRange, setPos and delPos are how Modify and Undo
+// change the forest.  They save the old values for snapshots first.
+
+func (f *Forest) write(pos uint64, h Hash) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	f.saveForSnapshots(pos, 1)
+	f.data.write(pos, h)
+}
+
+func (f *Forest) swapHash(a, b uint64) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	f.saveForSnapshots(a, 1)
+	f.saveForSnapshots(b, 1)
+	f.data.swapHash(a, b)
+}
+
+func (f *Forest) swapHashRange(a, b, w uint64) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	f.saveForSnapshots(a, w)
+	f.saveForSnapshots(b, w)
+	f.data.swapHashRange(a, b, w)
+}
+
+func (f *Forest) setPos(m MiniHash, pos uint64) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	f.savePosForSnapshots(m)
+	f.positionMap.Put(m, pos)
+}
+
+func (f *Forest) delPos(m MiniHash) {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	f.savePosForSnapshots(m)
+	f.positionMap.Delete(m)
+}
+
+// commitPositions commits the position map at the end of Modify and Undo
+func (f *Forest) commitPositions() error {
+	f.dataMtx.Lock()
+	defer f.dataMtx.Unlock()
+	return f.positionMap.Commit()
+}
+
+// saveForSnapshots saves the w hashes starting at pos for every snapshot
+// that hasn't saved them yet.
+func (f *Forest) saveForSnapshots(pos, w uint64) {
+	for _, d := range f.snapshots {
+		for i := uint64(0); i < w; i++ {
+			d.save(pos + i)
+		}
+	}
+}
+
+// savePosForSnapshots is saveForSnapshots for the position map.
+func (f *Forest) savePosForSnapshots(m MiniHash) {
+	for _, d := range f.snapshots {
+		_, ok := d.positions[m]
+		if !ok {
+			pos, exists := f.positionMap.Get(m)
+			d.positions[m] = undoPos{pos: pos, exists: exists}
+		}
+	}
+}
+
+// save saves the hash at the live position pos if it isn't saved already
+func (d *snapshotData) save(pos uint64) {
+	spos, ok := translatePos(pos, d.live.rows, d.rows)
+	if !ok {
+		return
+	}
+	_, ok = d.saved[spos]
+	if !ok {
+		d.saved[spos] = d.live.data.read(pos)
+	}
+}
+
+// position returns where a leaf was when the snapshot was taken
+func (d *snapshotData) position(m MiniHash) (uint64, bool) {
+	d.live.dataMtx.Lock()
+	defer d.live.dataMtx.Unlock()
+	up, ok := d.positions[m]
+	if ok {
+		return up.pos, up.exists
+	}
+	return d.live.positionMap.Get(m)
+}
+
+// translatePos returns the position in a forest with toRows rows that is
+// at the same row and offset as pos in a forest with fromRows rows.  The
+// bool is false if there's no such position.
+func translatePos(pos uint64, fromRows, toRows uint8) (uint64, bool) {
+	if fromRows == toRows {
+		return pos, true
+	}
+	row := detectRow(pos, fromRows)
+	if row > toRows {
+		return 0, false
+	}
+	offset := pos - parentMany(0, row, fromRows)
+	if offset >= 1<<(toRows-row) {
+		return 0, false
+	}
+	return parentMany(0, row, toRows) + offset, true
+}
+
+func (d *snapshotData) read(pos uint64) Hash {
+	d.live.dataMtx.Lock()
+	defer d.live.dataMtx.Unlock()
+	h, ok := d.saved[pos]
+	if ok {
+		return h
+	}
+	lpos, _ := translatePos(pos, d.rows, d.live.rows)
+	return d.live.data.read(lpos)
+}
+
+func (d *snapshotData) write(pos uint64, h Hash) {
+	panic("write to forest snapshot")
+}
+
+func (d *snapshotData) swapHash(a, b uint64) {
+	panic("swapHash on forest snapshot")
+}
+
+func (d *snapshotData) swapHashRange(a, b, w uint64) {
+	panic("swapHashRange on forest snapshot")
+}
+
+func (d *snapshotData) size() uint64 {
+	return (2 << d.rows) - 1
+}
+
+func (d *snapshotData) resize(newSize uint64) {
+	panic("resize on forest snapshot")
+}
+
+func (d *snapshotData) close() {}
@@ -0,0 +1,217 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForestSnapshot(t *testing.T) {
+	err := forestSnapshot(NewForest(RamForest, nil, "", 0))
+	if err != nil {
+		t.Fatal("ram:", err)
+	}
+
+	cowDir, err := ioutil.TempDir("", "snapshotcow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cowDir)
+	err = forestSnapshot(NewForest(CowForest, nil, cowDir, 100))
+	if err != nil {
+		t.Fatal("cow:", err)
+	}
+}
+
+// forestSnapshot takes a snapshot of f partway through a simChain and
+// checks that the snapshot gives the same proofs as f did at that point,
+// while f grows past a few reMaps.
+func forestSnapshot(f *Forest) error {
+	sc := newSimChain(0x3f)
+	for b := 0; b < 20; b++ {
+		adds, _, delHashes := sc.NextBlock(20)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+	}
+
+	var leaves []Hash
+	for pos := uint64(0); pos < f.numLeaves; pos++ {
+		leaves = append(leaves, f.data.read(pos))
+	}
+	wantProof, err := f.ProveBatch(leaves)
+	if err != nil {
+		return err
+	}
+	wantSingle, err := f.Prove(leaves[3])
+	if err != nil {
+		return err
+	}
+	wantRoots := f.GetRoots()
+	snapRows := f.rows
+
+	snap := f.Snapshot()
+	defer snap.Release()
+
+	for b := 0; b < 60; b++ {
+		adds, _, delHashes := sc.NextBlock(40)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+
+		if !reflect.DeepEqual(snap.GetRoots(), wantRoots) {
+			return fmt.Errorf("block %d snapshot roots changed", b)
+		}
+		gotProof, err := snap.ProveBatch(leaves)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(gotProof, wantProof) {
+			return fmt.Errorf("block %d snapshot batch proof changed", b)
+		}
+		err = snap.VerifyBatchProof(leaves, gotProof)
+		if err != nil {
+			return err
+		}
+		gotSingle, err := snap.Prove(leaves[3])
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(gotSingle, wantSingle) {
+			return fmt.Errorf("block %d snapshot proof changed", b)
+		}
+	}
+	if f.rows == snapRows {
+		return fmt.Errorf("forest didn't reMap after the snapshot")
+	}
+	return nil
+}
+
+func TestForestSnapshotConcurrent(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x1f)
+	for b := 0; b < 10; b++ {
+		adds, _, delHashes := sc.NextBlock(50)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaves := []Hash{f.data.read(0), f.data.read(7), f.data.read(100)}
+	want, err := f.ProveBatch(leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := f.Snapshot()
+	defer snap.Release()
+
+	// keep modifying while other goroutines prove from the snapshot
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				got, err := snap.ProveBatch(leaves)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(got, want) {
+					errs <- fmt.Errorf("snapshot proof changed")
+					return
+				}
+			}
+		}()
+	}
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(50)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestForestSnapshotRelease(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	_, err := f.Modify([]Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := f.Snapshot()
+	snap.Release()
+	if len(f.snapshots) != 0 {
+		t.Fatal("released snapshot still in forest")
+	}
+	_, err = snap.ProveBatch([]Hash{{1}})
+	if err == nil {
+		t.Fatal("released snapshot still gives proofs")
+	}
+}
+
+// TestForestSnapshotDuringModify checks that a snapshot can prove while the
+// forest's lock is held, like it is for the whole of a Modify
+func TestForestSnapshotDuringModify(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x1f)
+	adds, _, _ := sc.NextBlock(50)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := f.Snapshot()
+	defer snap.Release()
+
+	f.mtx.Lock()
+	proved := make(chan error)
+	go func() {
+		_, err := snap.ProveBatch([]Hash{adds[3].Hash})
+		proved <- err
+	}()
+	select {
+	case err = <-proved:
+	case <-time.After(10 * time.Second):
+		err = fmt.Errorf("snapshot waited for the forest's lock")
+	}
+	f.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
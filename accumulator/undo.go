@@ -129,6 +129,9 @@ func (u *UndoBlock) Deserialize(r io.Reader) error {
 
 // Undo reverts a Modify() with the given undoBlock.
 func (f *Forest) Undo(ub UndoBlock) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	prevAdds := uint64(ub.numAdds)
 	prevDels := uint64(len(ub.hashes))
 	// how many leaves were there at the last block?
@@ -141,7 +144,7 @@ func (f *Forest) Undo(ub UndoBlock) error {
 
 	// remove everything between prevNumLeaves and numLeaves from positionMap
 	for p := f.numLeaves; p < f.numLeaves+prevAdds; p++ {
-		delete(f.positionMap, f.data.read(p).Mini())
+		f.delPos(f.read(p).Mini())
 	}
 
 	// also add everything past numleaves and prevnumleaves to dirt
@@ -155,13 +158,13 @@ func (f *Forest) Undo(ub UndoBlock) error {
 		if h == empty {
 			return fmt.Errorf("hash %d in undoblock is empty", i)
 		}
-		f.data.write(f.numLeaves+uint64(i), h)
+		f.write(f.numLeaves+uint64(i), h)
 		dirt = append(dirt, f.numLeaves+uint64(i))
 	}
 
 	// go through swaps in reverse order
 	for i, a := range leafMoves {
-		f.data.swapHash(a.from, a.to)
+		f.swapHash(a.from, a.to)
 		dirt[2*i] = a.to       // this is wrong, it way over hashes
 		dirt[(2*i)+1] = a.from // also should be parents
 	}
@@ -169,19 +172,19 @@ func (f *Forest) Undo(ub UndoBlock) error {
 	// update positionMap.  The stuff we do want has been moved in to the forest,
 	// the stuff we don't want has been moved to the right past the edge
 	for p := f.numLeaves; p < prevNumLeaves; p++ {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.setPos(f.read(p).Mini(), p)
 	}
 	for _, p := range ub.positions {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.setPos(f.read(p).Mini(), p)
 	}
 	for _, d := range dirt {
 		// everything that moved needs to have its position updated in the map
 		// TODO does it..?
-		m := f.data.read(d).Mini()
-		oldpos := f.positionMap[m]
+		m := f.read(d).Mini()
+		oldpos, _ := f.positionMap.Get(m)
 		if oldpos != d {
-			delete(f.positionMap, m)
-			f.positionMap[m] = d
+			f.delPos(m)
+			f.setPos(m, d)
 		}
 	}
 
@@ -193,7 +196,7 @@ func (f *Forest) Undo(ub UndoBlock) error {
 		return err
 	}
 
-	return nil
+	return f.commitPositions()
 }
 
 // BuildUndoData makes an undoBlock from the same data that you'd give to Modify
@@ -206,7 +209,7 @@ func (f *Forest) BuildUndoData(numadds uint64, dels []uint64) *UndoBlock {
 
 	// populate all the hashes from the left edge of the forest
 	for i, _ := range ub.positions {
-		ub.hashes[i] = f.data.read(f.numLeaves + uint64(i))
+		ub.hashes[i] = f.read(f.numLeaves + uint64(i))
 		if ub.hashes[i] == empty {
 			fmt.Printf("warning, wrote empty hash for position %d\n",
 				ub.positions[i])
@@ -215,3 +218,105 @@ func (f *Forest) BuildUndoData(numadds uint64, dels []uint64) *UndoBlock {
 
 	return ub
 }
+
+// PollardUndo is all the data needed to undo a Pollard.Modify().  Unlike
+// UndoBlock it isn't serializable: the pollard can't recompute hashes it has
+// forgotten, so instead of the deleted leaves it holds the previous contents
+// of every polNode the Modify changed.  It's only good for the Pollard that
+// produced it, and undos have to be done in reverse order of the Modifies.
+type PollardUndo struct {
+	numLeaves       uint64
+	currentRemember uint64
+
+	// roots before the Modify.  A copy; Modify reuses the roots slice
+	roots []*polNode
+
+	// nodes maps every polNode changed during Modify to what it was before
+	nodes map[*polNode]polNode
+
+	// positionMap entries changed during Modify.  Only for full pollards
+	positions map[MiniHash]undoPos
+}
+
+// undoPos is a positionMap entry as it was before a Modify.  If exists is
+// false the hash wasn't in the positionMap.
+type undoPos struct {
+	pos    uint64
+	exists bool
+}
+
+// newUndo starts an undo record for the current state of the pollard.
+func (p *Pollard) newUndo() *PollardUndo {
+	u := &PollardUndo{
+		numLeaves:       p.numLeaves,
+		currentRemember: p.currentRemember,
+		roots:           make([]*polNode, len(p.roots)),
+		nodes:           make(map[*polNode]polNode),
+	}
+	copy(u.roots, p.roots)
+	if p.positionMap != nil {
+		u.positions = make(map[MiniHash]undoPos)
+	}
+	return u
+}
+
+// touch saves what n is before it gets changed.  Only the first touch during
+// a Modify is saved, as that's the pre-Modify state.  Does nothing outside
+// of Modify.
+func (p *Pollard) touch(n *polNode) {
+	if p.undo == nil || n == nil {
+		return
+	}
+	_, ok := p.undo.nodes[n]
+	if !ok {
+		p.undo.nodes[n] = *n
+	}
+}
+
+// touchPos is touch for positionMap entries.
+func (p *Pollard) touchPos(m MiniHash) {
+	if p.undo == nil || p.undo.positions == nil {
+		return
+	}
+	_, ok := p.undo.positions[m]
+	if !ok {
+		pos, exists := p.positionMap[m]
+		p.undo.positions[m] = undoPos{pos: pos, exists: exists}
+	}
+}
+
+// Undo reverts a Modify() with the PollardUndo it returned.  Roots, numLeaves
+// and all the remembered nodes go back to how they were right before that
+// Modify.  To undo several blocks, give Undo the PollardUndos starting from
+// the most recent.
+func (p *Pollard) Undo(u *PollardUndo) error {
+	if u == nil {
+		return fmt.Errorf("Pollard Undo: nil undo record")
+	}
+	if p.undo != nil {
+		return fmt.Errorf("Pollard Undo: called during Modify")
+	}
+
+	// nodes made during the Modify don't need to be cleaned up; once their
+	// parents are restored nothing points to them anymore.
+	for n, prev := range u.nodes {
+		*n = prev
+	}
+	for m, up := range u.positions {
+		if up.exists {
+			p.positionMap[m] = up.pos
+		} else {
+			delete(p.positionMap, m)
+		}
+	}
+
+	p.roots = make([]*polNode, len(u.roots))
+	copy(p.roots, u.roots)
+	p.numLeaves = u.numLeaves
+	p.currentRemember = u.currentRemember
+	// nodes made by proofs ingested after the Modify can still hang off
+	// of nodes it didn't touch, so they're counted again
+	p.nodeCount = p.GetTotalCount()
+
+	return nil
+}
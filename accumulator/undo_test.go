@@ -168,9 +168,9 @@ func undoOnceRandom(blocks int32) error {
 			fmt.Print(f.ToString())
 			fmt.Print(sc.ttlString())
 
-			for h, p := range f.positionMap {
+			f.positionMap.ForEach(func(h MiniHash, p uint64) {
 				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			})
 		}
 		err = f.PosMapSanity()
 		if err != nil {
@@ -188,9 +188,9 @@ func undoOnceRandom(blocks int32) error {
 			}
 			if verbose {
 				fmt.Print("\n post undo map: ")
-				for h, p := range f.positionMap {
+				f.positionMap.ForEach(func(h MiniHash, p uint64) {
 					fmt.Printf("%x@%d ", h[:4], p)
-				}
+				})
 			}
 			sc.BackOne(adds, durations, delHashes)
 			afterRoot := f.GetRoots()
@@ -261,9 +261,9 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 	for i, h := range undoneTops {
 		fmt.Printf("undoneTops %d %x\n", i, h)
 	}
-	for h, p := range f.positionMap {
+	f.positionMap.ForEach(func(h MiniHash, p uint64) {
 		fmt.Printf("%x@%d ", h[:4], p)
-	}
+	})
 	fmt.Printf("tops: ")
 	for i, _ := range beforeTops {
 		fmt.Printf("pre %04x post %04x ", beforeTops[i][:4], undoneTops[i][:4])
@@ -290,3 +290,108 @@ func undoTestSimChain() error {
 	fmt.Printf(sc.ttlString())
 	return nil
 }
+
+func TestPollardUndoRandom(t *testing.T) {
+	for z := int64(0); z < 100; z++ {
+		rand.Seed(z)
+		err := pollardUndoOnceRandom(30, 1)
+		if err != nil {
+			fmt.Printf("rand seed %d\n", z)
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPollardUndoReorg(t *testing.T) {
+	for z := int64(0); z < 30; z++ {
+		rand.Seed(z)
+		// roll back 4 blocks at a time
+		err := pollardUndoOnceRandom(60, 4)
+		if err != nil {
+			fmt.Printf("rand seed %d\n", z)
+			t.Fatal(err)
+		}
+	}
+}
+
+// pollardUndoOnceRandom runs a forest and a pollard side by side and every
+// so often undoes the last depth blocks on both.  After every undo the
+// pollard has to have the same roots as the forest, and whatever leaves it
+// remembers have to match the forest.
+func pollardUndoOnceRandom(blocks int32, depth int) error {
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+
+	sc := newSimChain(0x07)
+	sc.lookahead = 4
+
+	type simBlock struct {
+		adds      []Leaf
+		durations []int32
+		delHashes []Hash
+		forestUb  *UndoBlock
+		polUndo   *PollardUndo
+	}
+	var chain []simBlock
+
+	for b := int32(0); b < blocks; b++ {
+		adds, durations, delHashes := sc.NextBlock(rand.Uint32() & 0x03)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			return err
+		}
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		pu, err := p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = checkRemembered(&p)
+		if err != nil {
+			return fmt.Errorf("block %d %s", sc.blockHeight, err.Error())
+		}
+		chain = append(chain,
+			simBlock{adds, durations, delHashes, ub, pu})
+
+		if b%5 != 4 || len(chain) < depth {
+			continue
+		}
+
+		for i := 0; i < depth; i++ {
+			sb := chain[len(chain)-1]
+			chain = chain[:len(chain)-1]
+
+			err = f.Undo(*sb.forestUb)
+			if err != nil {
+				return err
+			}
+			err = p.Undo(sb.polUndo)
+			if err != nil {
+				return err
+			}
+			sc.BackOne(sb.adds, sb.durations, sb.delHashes)
+
+			if !reflect.DeepEqual(f.GetRoots(), p.rootHashesForward()) {
+				return fmt.Errorf("block %d undo roots mismatch\n%s\n%s",
+					sc.blockHeight, f.ToString(), p.ToString())
+			}
+			if !p.equalToForestIfThere(f) {
+				return fmt.Errorf("block %d undo leaves mismatch",
+					sc.blockHeight)
+			}
+			err = checkRemembered(&p)
+			if err != nil {
+				return fmt.Errorf("block %d undo %s", sc.blockHeight, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,531 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+/*
+The api serves what's in the flat files and the forest over HTTP, for tools
+and wallets that don't speak the ublock protocol:
+
+/udata/{height or block hash}  the UData for the block
+/roots/{height}                the number of leaves and roots after the block
+/proof/{txid}:{vout}           a proof for the output at the height the
+                               forest is at.  ?height=h says it was made in
+                               block h, otherwise it's looked up in the last
+                               apiFindDepth blocks.
+/status                        how far the bridgenode has gotten
+
+Everything is JSON, or with ?format=binary, what Serialize writes.  Binary
+udata is UData.Serialize, binary roots are the 8 byte number of leaves then
+the roots, and a binary proof is the 4 byte height it's at then
+BatchProof.Serialize.  The status is only JSON.
+*/
+
+// tipForest is the forest the api proves outputs with, and the height of the
+// last block added to it.  It's held while blocks are added or undone.
+type tipForest struct {
+	mtx    sync.RWMutex
+	forest *accumulator.Forest
+	height int32
+}
+
+// apiHandler has what the api reads from.  Blocks are read from the flat
+// files and the roots file only once all the flat file workers have written
+// them, and the proofs come from the forest.
+type apiHandler struct {
+	cfg      *Config
+	source   BlockSource
+	progress *flatFileProgress
+	tip      *tipForest
+
+	// findDepth is how many blocks back from the tip /proof looks for an
+	// output without ?height
+	findDepth int32
+}
+
+// apiFindDepth is how many blocks /proof looks through for an output when
+// it isn't told the height.  Each is a search of the txid file, so looking
+// through the whole chain for an output that isn't there would tie up the
+// bridgenode.
+const apiFindDepth = 1000
+
+// apiServer serves the api on cfg.apiPort
+func apiServer(cfg *Config, source BlockSource,
+	progress *flatFileProgress, tip *tipForest) {
+
+	api := &apiHandler{cfg: cfg, source: source, progress: progress, tip: tip,
+		findDepth: apiFindDepth}
+	listenAddr := net.JoinHostPort("", cfg.apiPort)
+	fmt.Printf("serving the api on %s\n", listenAddr)
+	fmt.Printf("%v", http.ListenAndServe(listenAddr, api.mux()))
+}
+
+func (a *apiHandler) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/udata/", a.udata)
+	mux.HandleFunc("/roots/", a.roots)
+	mux.HandleFunc("/proof/", a.proof)
+	mux.HandleFunc("/status", a.status)
+	return mux
+}
+
+// apiLeaf is a LeafData in JSON
+type apiLeaf struct {
+	TxHash   string `json:"txid"`
+	Index    uint32 `json:"vout"`
+	Height   int32  `json:"height"`
+	Coinbase bool   `json:"coinbase"`
+	Amt      int64  `json:"amount"`
+	PkScript string `json:"pkscript"`
+}
+
+// apiBatchProof is a BatchProof in JSON
+type apiBatchProof struct {
+	Targets []uint64 `json:"targets"`
+	Proof   []string `json:"proof"`
+}
+
+type apiUData struct {
+	Height   int32         `json:"height"`
+	AccProof apiBatchProof `json:"accproof"`
+	Stxos    []apiLeaf     `json:"stxos"`
+	TxoTTLs  []int32       `json:"ttls"`
+}
+
+type apiRoots struct {
+	Height    int32    `json:"height"`
+	NumLeaves uint64   `json:"numleaves"`
+	Roots     []string `json:"roots"`
+}
+
+type apiProof struct {
+	// the height of the forest the output's proven in
+	Height    int32         `json:"height"`
+	NumLeaves uint64        `json:"numleaves"`
+	Roots     []string      `json:"roots"`
+	Leaf      apiLeaf       `json:"leaf"`
+	LeafHash  string        `json:"leafhash"`
+	Proof     apiBatchProof `json:"proof"`
+}
+
+type apiStatus struct {
+	// blocks in the flat files, and in the forest
+	Height       int32 `json:"height"`
+	ForestHeight int32 `json:"forestheight"`
+	// the last block the block source has
+	TipHeight int32 `json:"tipheight"`
+	Following bool  `json:"following"`
+	Synced    bool  `json:"synced"`
+}
+
+func leafJSON(l btcacc.LeafData) apiLeaf {
+	return apiLeaf{
+		TxHash:   chainhash.Hash(l.TxHash).String(),
+		Index:    l.Index,
+		Height:   l.Height,
+		Coinbase: l.Coinbase,
+		Amt:      l.Amt,
+		PkScript: hex.EncodeToString(l.PkScript),
+	}
+}
+
+func batchProofJSON(bp accumulator.BatchProof) apiBatchProof {
+	return apiBatchProof{Targets: bp.Targets, Proof: hashesJSON(bp.Proof)}
+}
+
+func hashesJSON(hashes []accumulator.Hash) []string {
+	s := make([]string, len(hashes))
+	for i, h := range hashes {
+		s[i] = hex.EncodeToString(h[:])
+	}
+	return s
+}
+
+// udata serves /udata/{height or block hash}
+func (a *apiHandler) udata(w http.ResponseWriter, r *http.Request) {
+	binaryFormat, ok := apiFormat(w, r)
+	if !ok {
+		return
+	}
+	block := strings.TrimPrefix(r.URL.Path, "/udata/")
+	var height int32
+	if len(block) == 2*chainhash.HashSize {
+		hash, err := chainhash.NewHashFromStr(block)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		height, err = a.source.BlockHeight(*hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		var err error
+		height, err = parseHeight(block)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// there's no udata for block 0
+	if height == 0 || !a.progress.readLockWritten(height) {
+		http.Error(w, fmt.Sprintf("block %d isn't built", height),
+			http.StatusNotFound)
+		return
+	}
+	udb, err := GetUDataBytesFromFile(a.cfg.UtreeDir.ProofDir, height)
+	a.progress.readUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if binaryFormat {
+		writeBinary(w, udb)
+		return
+	}
+	var ud btcacc.UData
+	err = ud.Deserialize(bytes.NewReader(udb))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := apiUData{
+		Height:   ud.Height,
+		AccProof: batchProofJSON(ud.AccProof),
+		Stxos:    make([]apiLeaf, len(ud.Stxos)),
+		TxoTTLs:  ud.TxoTTLs,
+	}
+	for i, l := range ud.Stxos {
+		resp.Stxos[i] = leafJSON(l)
+	}
+	writeJSON(w, resp)
+}
+
+// roots serves /roots/{height}
+func (a *apiHandler) roots(w http.ResponseWriter, r *http.Request) {
+	binaryFormat, ok := apiFormat(w, r)
+	if !ok {
+		return
+	}
+	height, err := parseHeight(strings.TrimPrefix(r.URL.Path, "/roots/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.progress.readLockWritten(height) {
+		http.Error(w, fmt.Sprintf("block %d isn't built", height),
+			http.StatusNotFound)
+		return
+	}
+	numLeaves, roots, err := readRoots(a.cfg.UtreeDir.RootsDir, height)
+	a.progress.readUnlock()
+	if err != nil {
+		// bridgenodes that built blocks before there was a roots file don't
+		// have them
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if binaryFormat {
+		buf := make([]byte, 8+32*len(roots))
+		binary.BigEndian.PutUint64(buf, numLeaves)
+		for i, root := range roots {
+			copy(buf[8+32*i:], root[:])
+		}
+		writeBinary(w, buf)
+		return
+	}
+	writeJSON(w, apiRoots{
+		Height:    height,
+		NumLeaves: numLeaves,
+		Roots:     hashesJSON(roots),
+	})
+}
+
+// proof serves /proof/{txid}:{vout}.  The output's leaf comes from the
+// block that made it, which is found in the txid file if it's in the last
+// findDepth blocks, unless ?height=h says it's block h.  The leaf is proven if it's still in the forest.
+// Blocks are read before the forest is locked, since with -rpc reading one
+// is a call to bitcoind.
+func (a *apiHandler) proof(w http.ResponseWriter, r *http.Request) {
+	binaryFormat, ok := apiFormat(w, r)
+	if !ok {
+		return
+	}
+	op, err := parseOutPoint(strings.TrimPrefix(r.URL.Path, "/proof/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var height int32
+	if r.URL.Query().Get("height") != "" {
+		height, err = parseHeight(r.URL.Query().Get("height"))
+		if err != nil {
+			http.Error(w, "height of the block the output is in: "+
+				err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a.tip.mtx.RLock()
+	tipHeight := a.tip.height
+	a.tip.mtx.RUnlock()
+
+	var leaf btcacc.LeafData
+	if height != 0 {
+		if height > tipHeight {
+			http.Error(w, fmt.Sprintf("block %d isn't in the forest", height),
+				http.StatusNotFound)
+			return
+		}
+		blocks, _, err := a.source.Blocks(height, 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		leaf, ok = outputLeaf(&blocks[0], op, height)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no output %s in block %d", op, height),
+				http.StatusNotFound)
+			return
+		}
+	} else {
+		leaf, ok, err = a.findOutput(op, tipHeight, a.findDepth)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("no output %s in the last %d blocks, "+
+				"?height=h can say which block it's in", op, a.findDepth),
+				http.StatusNotFound)
+			return
+		}
+	}
+
+	// the forest can't change while the proof is made
+	a.tip.mtx.RLock()
+	defer a.tip.mtx.RUnlock()
+	forest := a.tip.forest
+	hash := leaf.LeafHash()
+	// spent, or never added because it's unspendable
+	if !forest.FindLeaf(hash) {
+		http.Error(w, fmt.Sprintf("%s isn't in the forest", op),
+			http.StatusNotFound)
+		return
+	}
+	bp, err := forest.ProveBatch([]accumulator.Hash{hash})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if binaryFormat {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, a.tip.height)
+		err = bp.Serialize(&buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeBinary(w, buf.Bytes())
+		return
+	}
+	writeJSON(w, apiProof{
+		Height:    a.tip.height,
+		NumLeaves: forest.Stats().NumLeaves,
+		Roots:     hashesJSON(forest.GetRoots()),
+		Leaf:      leafJSON(leaf),
+		LeafHash:  hex.EncodeToString(hash[:]),
+		Proof:     batchProofJSON(bp),
+	})
+}
+
+// status serves /status
+func (a *apiHandler) status(w http.ResponseWriter, r *http.Request) {
+	a.tip.mtx.RLock()
+	forestHeight := a.tip.height
+	a.tip.mtx.RUnlock()
+
+	tipHeight, err := a.source.TipHeight()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	height := a.progress.height()
+	writeJSON(w, apiStatus{
+		Height:       height,
+		ForestHeight: forestHeight,
+		TipHeight:    tipHeight,
+		Following:    a.cfg.follow,
+		Synced:       height >= tipHeight,
+	})
+}
+
+// outputLeaf makes the leaf for output op of the block at height, the same
+// way BlockToAddLeaves does.  It's false if the block doesn't have it.
+func outputLeaf(blk *wire.MsgBlock, op wire.OutPoint, height int32) (
+	btcacc.LeafData, bool) {
+
+	for i, tx := range blk.Transactions {
+		if tx.TxHash() != op.Hash {
+			continue
+		}
+		if op.Index >= uint32(len(tx.TxOut)) {
+			break
+		}
+		out := tx.TxOut[op.Index]
+		return btcacc.LeafData{
+			TxHash:   btcacc.Hash(op.Hash),
+			Index:    op.Index,
+			Height:   height,
+			Coinbase: i == 0,
+			Amt:      out.Value,
+			PkScript: out.PkScript,
+		}, true
+	}
+	return btcacc.LeafData{}, false
+}
+
+// apiFormat is true if the response should be binary instead of JSON.  It's
+// not ok if the format isn't one of them, and then the error is written.
+func apiFormat(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return false, true
+	case "binary":
+		return true, true
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format),
+			http.StatusBadRequest)
+		return false, false
+	}
+}
+
+// findOutput finds the block that made op's transaction, out of the depth
+// blocks up to maxHeight, and returns op's leaf.  The txid file has the
+// first 6 bytes of the txids each block makes, sorted, like lookupTTLs
+// reads it, so each block is a binary search, newest first.  Blocks with a
+// txid that only starts the same get skipped.  It returns false if there's
+// no such output in those blocks.
+func (a *apiHandler) findOutput(op wire.OutPoint, maxHeight, depth int32) (
+	btcacc.LeafData, bool, error) {
+
+	txidFile, err := os.Open(a.cfg.UtreeDir.TtlDir.txidFile)
+	if err != nil {
+		return btcacc.LeafData{}, false, err
+	}
+	defer txidFile.Close()
+	info, err := txidFile.Stat()
+	if err != nil {
+		return btcacc.LeafData{}, false, err
+	}
+	offsets, err := ioutil.ReadFile(a.cfg.UtreeDir.TtlDir.txidOffsetFile)
+	if err != nil {
+		return btcacc.LeafData{}, false, err
+	}
+	// blocks in the offset file might not be in the txid file yet
+	if int32(len(offsets)/8) < maxHeight {
+		maxHeight = int32(len(offsets) / 8)
+	}
+
+	minHeight := maxHeight - depth + 1
+	if minHeight < 1 {
+		minHeight = 1
+	}
+
+	var prefix [6]byte
+	copy(prefix[:], op.Hash[:6])
+	end := info.Size() / 8
+	for height := maxHeight; height >= minHeight; height-- {
+		// block height's txids go from its offset to the next block's
+		start := int64(binary.BigEndian.Uint64(offsets[(height-1)*8:]))
+		if int64(len(offsets)) > int64(height)*8 {
+			end = int64(binary.BigEndian.Uint64(offsets[height*8:]))
+		}
+		width := int(end - start)
+		pos := sort.Search(
+			width, searchReaderFunc(int(start), prefix, txidFile))
+		if pos == width {
+			continue
+		}
+		var found [6]byte
+		_, err = txidFile.ReadAt(found[:], (start+int64(pos))*8)
+		if err != nil {
+			return btcacc.LeafData{}, false, err
+		}
+		if found != prefix {
+			continue
+		}
+		blocks, _, err := a.source.Blocks(height, 1)
+		if err != nil {
+			return btcacc.LeafData{}, false, err
+		}
+		leaf, ok := outputLeaf(&blocks[0], op, height)
+		if ok {
+			return leaf, true, nil
+		}
+	}
+	return btcacc.LeafData{}, false, nil
+}
+
+func parseHeight(s string) (int32, error) {
+	height, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || height < 0 {
+		return 0, fmt.Errorf("bad block height %q", s)
+	}
+	return int32(height), nil
+}
+
+// parseOutPoint parses txid:vout
+func parseOutPoint(s string) (wire.OutPoint, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return wire.OutPoint{}, fmt.Errorf("outpoint %q isn't txid:vout", s)
+	}
+	txid, err := chainhash.NewHashFromStr(parts[0])
+	if err != nil {
+		return wire.OutPoint{}, fmt.Errorf("txid %q: %s", parts[0], err.Error())
+	}
+	vout, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return wire.OutPoint{}, fmt.Errorf("vout %q: %s", parts[1], err.Error())
+	}
+	return wire.OutPoint{Hash: *txid, Index: uint32(vout)}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Printf("api write %s\n", err.Error())
+	}
+}
+
+func writeBinary(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err := w.Write(b)
+	if err != nil {
+		fmt.Printf("api write %s\n", err.Error())
+	}
+}
@@ -0,0 +1,313 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// memSource gives back blocks 1 and on from memory
+type memSource []*wire.MsgBlock
+
+func (s memSource) TipHeight() (int32, error) {
+	return int32(len(s)), nil
+}
+
+func (s memSource) Blocks(height, count int32) (
+	[]wire.MsgBlock, []RevBlock, error) {
+
+	if height < 1 || height+count-1 > int32(len(s)) {
+		return nil, nil, fmt.Errorf("no blocks %d to %d",
+			height, height+count-1)
+	}
+	blocks := make([]wire.MsgBlock, count)
+	for i := range blocks {
+		blocks[i] = *s[height-1+int32(i)]
+	}
+	return blocks, make([]RevBlock, count), nil
+}
+
+func (s memSource) BlockBytes(height int32) ([]byte, error) {
+	var buf bytes.Buffer
+	err := s[height-1].Serialize(&buf)
+	return buf.Bytes(), err
+}
+
+func (s memSource) BlockHeight(hash chainhash.Hash) (int32, error) {
+	for i, b := range s {
+		if b.BlockHash() == hash {
+			return int32(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("no block %s", hash)
+}
+
+// apiGet gets path from the server and decodes the JSON into v, if it's
+// given, after checking the status
+func apiGet(t *testing.T, server *httptest.Server, path string,
+	status int, v interface{}) []byte {
+
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s gave %d %s, expected %d",
+			path, resp.StatusCode, body, status)
+	}
+	if v != nil {
+		err = json.Unmarshal(body, v)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err.Error())
+		}
+	}
+	return body
+}
+
+// TestAPI builds 3 blocks, the last of which spends block 1's coinbase, and
+// gets their udata, roots and proofs from the api
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var source memSource
+	prev := *chaincfg.RegressionNetParams.GenesisHash
+	for h := byte(1); h <= 3; h++ {
+		blk := coinbaseBlock(prev, h)
+		source = append(source, blk)
+		prev = blk.BlockHash()
+	}
+	spent := wire.OutPoint{Hash: source[0].Transactions[0].TxHash()}
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(wire.NewTxIn(&spent, nil, nil))
+	spend.AddTxOut(wire.NewTxOut(49e8, []byte{0x51}))
+	source[2].AddTransaction(spend)
+
+	proofChan := make(chan btcacc.UData, 10)
+	fileWait := new(sync.WaitGroup)
+	go flatFileWorkerProof(
+		proofChan, utreeDir, fileWait, newFlatFileProgress(0))
+	roots, err := openRootsFile(utreeDir.RootsDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roots.close()
+
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	allRoots := [][]accumulator.Hash{nil}
+	for i, blk := range source {
+		height := int32(i + 1)
+		var dels []btcacc.LeafData
+		if height == 3 {
+			del, ok := outputLeaf(source[0], spent, 1)
+			if !ok {
+				t.Fatal("no leaf for block 1's coinbase")
+			}
+			dels = append(dels, del)
+		}
+		outCount := uint32(len(blk.Transactions))
+		adds := uwire.BlockToAddLeaves(
+			btcutil.NewBlock(blk), nil, nil, height, outCount)
+		ud, err := btcacc.GenUData(dels, forest, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud.TxoTTLs = make([]int32, outCount)
+		fileWait.Add(1)
+		proofChan <- ud
+		_, err = forest.Modify(adds, ud.AccProof.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = roots.write(
+			height, forest.Stats().NumLeaves, forest.GetRoots())
+		if err != nil {
+			t.Fatal(err)
+		}
+		allRoots = append(allRoots, forest.GetRoots())
+	}
+	fileWait.Wait()
+	close(proofChan)
+
+	// the txid files, for finding which block made an output
+	txidFile, err := os.Create(utreeDir.TtlDir.txidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txidFile.Close()
+	txidOffsetFile, err := os.Create(utreeDir.TtlDir.txidOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txidOffsetFile.Close()
+	writeChan := make(chan ttlWriteBlock, len(source))
+	goChan := make(chan bool, len(source))
+	go TxidSortWriterWorker(writeChan, goChan, 0, txidFile, txidOffsetFile)
+	for i, blk := range source {
+		wb := ttlWriteBlock{createHeight: int32(i + 1)}
+		var outputs uint16
+		for _, tx := range blk.Transactions {
+			txid := tx.TxHash()
+			wb.mTxids = append(wb.mTxids,
+				miniTx{txid: &txid, startsAt: outputs})
+			outputs += uint16(len(tx.TxOut))
+		}
+		writeChan <- wb
+	}
+	close(writeChan)
+	for range goChan {
+	}
+
+	api := &apiHandler{
+		cfg:      &Config{UtreeDir: utreeDir},
+		source:   source,
+		progress: newFlatFileProgress(3),
+		tip:      &tipForest{forest: forest, height: 3},
+
+		findDepth: apiFindDepth,
+	}
+	server := httptest.NewServer(api.mux())
+	defer server.Close()
+
+	var status apiStatus
+	apiGet(t, server, "/status", http.StatusOK, &status)
+	if status.Height != 3 || status.ForestHeight != 3 || !status.Synced {
+		t.Fatalf("status %+v, expected synced at 3", status)
+	}
+
+	// udata by height and by hash, in both formats
+	var ud apiUData
+	apiGet(t, server, "/udata/3", http.StatusOK, &ud)
+	if ud.Height != 3 || len(ud.Stxos) != 1 ||
+		ud.Stxos[0].TxHash != spent.Hash.String() || !ud.Stxos[0].Coinbase {
+		t.Fatalf("block 3's udata %+v, expected it to spend %s",
+			ud, spent.Hash)
+	}
+	var byHash apiUData
+	apiGet(t, server, "/udata/"+source[2].BlockHash().String(),
+		http.StatusOK, &byHash)
+	if !reflect.DeepEqual(ud, byHash) {
+		t.Fatalf("udata by hash %+v, by height %+v", byHash, ud)
+	}
+	udb := apiGet(t, server, "/udata/3?format=binary", http.StatusOK, nil)
+	want, err := GetUDataBytesFromFile(utreeDir.ProofDir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(udb, want) {
+		t.Fatalf("binary udata %x, expected %x", udb, want)
+	}
+	apiGet(t, server, "/udata/4", http.StatusNotFound, nil)
+	apiGet(t, server, "/udata/3?format=xml", http.StatusBadRequest, nil)
+
+	// roots after block 2, in both formats
+	var r apiRoots
+	apiGet(t, server, "/roots/2", http.StatusOK, &r)
+	if r.NumLeaves != 2 ||
+		!reflect.DeepEqual(r.Roots, hashesJSON(allRoots[2])) {
+		t.Fatalf("roots after block 2 %+v, expected %x", r, allRoots[2])
+	}
+	rb := apiGet(t, server, "/roots/2?format=binary", http.StatusOK, nil)
+	if len(rb) != 8+32*len(allRoots[2]) ||
+		binary.BigEndian.Uint64(rb) != 2 {
+		t.Fatalf("binary roots after block 2 %x", rb)
+	}
+	apiGet(t, server, "/roots/4", http.StatusNotFound, nil)
+	apiGet(t, server, "/roots/two", http.StatusBadRequest, nil)
+
+	// block 2's coinbase is proven at the tip, with or without saying
+	// which block it's in
+	cb := source[1].Transactions[0].TxHash()
+	var p apiProof
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0", cb), http.StatusOK, &p)
+	var withHeight apiProof
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0?height=2", cb),
+		http.StatusOK, &withHeight)
+	if !reflect.DeepEqual(p, withHeight) {
+		t.Fatalf("proof %+v, with the height %+v", p, withHeight)
+	}
+	leaf, _ := outputLeaf(source[1], wire.OutPoint{Hash: cb}, 2)
+	hash := leaf.LeafHash()
+	bp := accumulator.BatchProof{Targets: p.Proof.Targets}
+	for _, s := range p.Proof.Proof {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h accumulator.Hash
+		copy(h[:], b)
+		bp.Proof = append(bp.Proof, h)
+	}
+	_, err = accumulator.VerifyBatchProof(allRoots[3], p.NumLeaves,
+		[]accumulator.Hash{hash}, bp)
+	if err != nil {
+		t.Fatalf("proof for block 2's coinbase: %s", err.Error())
+	}
+	if p.Height != 3 || p.Leaf.Height != 2 || !p.Leaf.Coinbase {
+		t.Fatalf("proof %+v, expected block 2's coinbase at 3", p)
+	}
+	pb := apiGet(t, server, fmt.Sprintf("/proof/%s:0?format=binary", cb),
+		http.StatusOK, nil)
+	var binaryProof accumulator.BatchProof
+	err = binaryProof.Deserialize(bytes.NewReader(pb[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(pb) != 3 ||
+		!reflect.DeepEqual(binaryProof.Targets, bp.Targets) {
+		t.Fatalf("binary proof %x, expected %+v at 3", pb, bp)
+	}
+
+	// spent, not there, in no block, and a bad height
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0", spent.Hash),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:1", cb),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0?height=1", cb),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0?height=4", cb),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0", chainhash.Hash{1}),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0?height=two", cb),
+		http.StatusBadRequest, nil)
+
+	// without the height, only the last findDepth blocks are looked at
+	api.findDepth = 1
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0", cb),
+		http.StatusNotFound, nil)
+	apiGet(t, server, fmt.Sprintf("/proof/%s:0?height=2", cb),
+		http.StatusOK, nil)
+}
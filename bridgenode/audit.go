@@ -0,0 +1,104 @@
+package bridgenode
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// AuditForest checks the saved forest in the bridgenode directory with
+// Forest.Audit and prints what it finds.  With cfg.repair the forest is
+// repaired and saved again.  It returns an error if the forest is bad and
+// wasn't repaired.
+func AuditForest(cfg *Config) error {
+	if !checkForestExists(cfg) {
+		return fmt.Errorf("AuditForest: no %s forest in %s",
+			forestTypeNames[cfg.forestType], cfg.UtreeDir.ForestDir.base)
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return fmt.Errorf("AuditForest: %s", err.Error())
+	}
+	forest, err := restoreForest(cfg)
+	if err == accumulator.ErrorUnsealedForest {
+		// the bridgenode stopped without closing the forest
+		fmt.Println(err.Error())
+		if !cfg.repair {
+			return fmt.Errorf("AuditForest: forest file has no " +
+				"checksums. Run with -repair to check it and put them back")
+		}
+		err = resealForestFile(cfg)
+		if err == nil {
+			forest, err = restoreForest(cfg)
+		}
+	}
+	if cerr, ok := err.(*accumulator.ForestChecksumError); ok {
+		fmt.Println(cerr.Error())
+		for _, block := range cerr.BadBlocks {
+			first, last := cerr.Positions(block)
+			fmt.Printf("bad block %d: positions %d to %d\n",
+				block, first, last)
+		}
+		if !cfg.repair {
+			return fmt.Errorf("AuditForest: forest file failed its " +
+				"checksums. Run with -repair to rebuild it from the leaves")
+		}
+		// take the forest file as it is and let the audit repair it
+		err = resealForestFile(cfg)
+		if err == nil {
+			forest, err = restoreForest(cfg)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("AuditForest: %s", err.Error())
+	}
+
+	fmt.Printf("auditing %s forest at height %d\n",
+		forestTypeNames[cfg.forestType], height)
+
+	report, err := forest.Audit(cfg.repair)
+	if report != nil {
+		fmt.Print(report.String())
+	}
+	if err != nil {
+		return fmt.Errorf("AuditForest: %s", err.Error())
+	}
+
+	if !report.Repaired {
+		// restoring takes the checksums off a forest file that's worked on
+		// in place, and closing the forest puts them back
+		err = writeMiscForestFile(forest, cfg)
+		if err != nil {
+			return fmt.Errorf("AuditForest: %s", err.Error())
+		}
+		if !report.OK() {
+			return fmt.Errorf("AuditForest: forest failed audit. " +
+				"Run with -repair to rebuild it from the leaves")
+		}
+		return nil
+	}
+
+	err = saveBridgeNodeData(forest, height, cfg)
+	if err != nil {
+		return fmt.Errorf("AuditForest: %s", err.Error())
+	}
+	return nil
+}
+
+// resealForestFile writes new checksums for the forest file so that a forest
+// that failed them, or doesn't have any, can be restored and repaired.
+func resealForestFile(cfg *Config) error {
+	miscForestFile, err := os.Open(cfg.UtreeDir.ForestDir.miscForestFile)
+	if err != nil {
+		return err
+	}
+	defer miscForestFile.Close()
+	forestFile, err := os.OpenFile(
+		cfg.UtreeDir.ForestDir.forestFile, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer forestFile.Close()
+	return accumulator.ResealForestFile(miscForestFile, forestFile)
+}
@@ -0,0 +1,88 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestAuditForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		UtreeDir:   initUtreeDir(dir),
+		forestType: diskForest,
+		audit:      true,
+	}
+	err = makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forest, err := createForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adds := make([]accumulator.Leaf, 1000)
+	for i := range adds {
+		adds[i].Hash[0] = byte(i)
+		adds[i].Hash[1] = byte(i >> 8)
+		adds[i].Hash[2] = 0xaa
+	}
+	_, err = forest.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := forest.GetRoots()
+	err = saveBridgeNodeData(forest, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AuditForest(cfg)
+	if err != nil {
+		t.Fatalf("good forest failed audit: %s", err.Error())
+	}
+
+	// 1000 leaves is 10 rows, so the row above the leaves starts at 1024
+	forestFile, err := os.OpenFile(
+		cfg.UtreeDir.ForestDir.forestFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forestFile.WriteAt(bytes.Repeat([]byte{0xff}, 32), (1024+5)*32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile.Close()
+
+	err = AuditForest(cfg)
+	if err == nil {
+		t.Fatal("bad forest passed audit")
+	}
+	cfg.repair = true
+	err = AuditForest(cfg)
+	if err != nil {
+		t.Fatalf("repair failed: %s", err.Error())
+	}
+	cfg.repair = false
+	err = AuditForest(cfg)
+	if err != nil {
+		t.Fatalf("repaired forest failed audit: %s", err.Error())
+	}
+
+	repaired, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repaired.GetRoots(), roots) {
+		t.Fatal("repaired forest has different roots")
+	}
+}
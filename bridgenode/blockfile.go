@@ -0,0 +1,119 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// xorKeyFileName is where bitcoind 28.0 and later keep the key they XOR the
+// blk and rev files with, in the blocks directory.  Byte i of a file is
+// XORed with byte i%8 of the key.
+const xorKeyFileName = "xor.dat"
+
+// blkFilePath is where bitcoind keeps blk file fileNum
+func blkFilePath(blockDir string, fileNum uint32) string {
+	return filepath.Join(blockDir, fmt.Sprintf("blk%05d.dat", fileNum))
+}
+
+// revFilePath is where bitcoind keeps rev file fileNum
+func revFilePath(blockDir string, fileNum uint32) string {
+	return filepath.Join(blockDir, fmt.Sprintf("rev%05d.dat", fileNum))
+}
+
+// readXorKey reads the key the files in blockDir are obfuscated with.  It
+// gives back nil if they aren't, either because there's no xor.dat or
+// because the key is all zeros.
+func readXorKey(blockDir string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filepath.Join(blockDir, xorKeyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 8 {
+		return nil, fmt.Errorf("%s is %d bytes, expected 8",
+			xorKeyFileName, len(key))
+	}
+	if bytes.Equal(key, make([]byte, 8)) {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// blockFile is a blk or rev file, read with the obfuscation taken off.
+// Reads and seeks work like they do on the os.File.
+type blockFile struct {
+	file *os.File
+	key  []byte
+
+	// where Read reads from next
+	pos int64
+}
+
+// openBlkFile opens blk file fileNum in blockDir
+func openBlkFile(blockDir string, fileNum uint32) (*blockFile, error) {
+	return openBlockFile(blockDir, blkFilePath(blockDir, fileNum))
+}
+
+// openRevFile opens rev file fileNum in blockDir
+func openRevFile(blockDir string, fileNum uint32) (*blockFile, error) {
+	return openBlockFile(blockDir, revFilePath(blockDir, fileNum))
+}
+
+// openBlockFile opens the file at path, with the key in blockDir's xor.dat
+// if there is one
+func openBlockFile(blockDir, path string) (*blockFile, error) {
+	key, err := readXorKey(blockDir)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &blockFile{file: file, key: key}, nil
+}
+
+func (f *blockFile) Read(b []byte) (int, error) {
+	n, err := f.file.Read(b)
+	f.unXor(b[:n], f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *blockFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.file.ReadAt(b, off)
+	f.unXor(b[:n], off)
+	return n, err
+}
+
+func (f *blockFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.file.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *blockFile) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
+
+func (f *blockFile) Close() error {
+	return f.file.Close()
+}
+
+// unXor takes the key off of b, which was read from off in the file
+func (f *blockFile) unXor(b []byte, off int64) {
+	if f.key == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= f.key[(off+int64(i))%int64(len(f.key))]
+	}
+}
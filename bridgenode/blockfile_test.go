@@ -0,0 +1,286 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// writeObfuscated writes b to path XORed with key, the way bitcoind does
+// with -blocksxor
+func writeObfuscated(t *testing.T, path string, b, key []byte) {
+	t.Helper()
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ key[i%len(key)]
+	}
+	err := ioutil.WriteFile(path, out, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// coinbaseBlock is a block with just a coinbase, on top of prev
+func coinbaseBlock(prev chainhash.Hash, height byte) *wire.MsgBlock {
+	blk := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   1,
+		PrevBlock: prev,
+		Timestamp: time.Unix(1600000000+int64(height), 0),
+		Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+	})
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex), []byte{1, height, 0}, nil))
+	tx.AddTxOut(wire.NewTxOut(50e8, []byte{0x51}))
+	blk.AddTransaction(tx)
+	return blk
+}
+
+// TestBlockFileXor reads blocks out of obfuscated blk and rev files with
+// each of the readers that use them
+func TestBlockFileXor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgexor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte{0x3a, 0x91, 0x07, 0xee, 0x5c, 0x00, 0xd4, 0x68}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFileName), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blocks 1 and 2 in blk00000.dat, each after the magic and size, and
+	// their empty rev blocks in rev00000.dat with a checksum after
+	var blk, rev, offsets bytes.Buffer
+	var blocks []*wire.MsgBlock
+	undoPos := make(map[[32]byte]uint32)
+	prev := chaincfg.RegressionNetParams.GenesisHash
+	for h := byte(1); h <= 2; h++ {
+		b := coinbaseBlock(*prev, h)
+		blocks = append(blocks, b)
+		hash := b.BlockHash()
+		prev = &hash
+
+		offset := uint32(blk.Len())
+		binary.Write(&blk, binary.LittleEndian,
+			uint32(chaincfg.RegressionNetParams.Net))
+		binary.Write(&blk, binary.LittleEndian, uint32(b.SerializeSize()))
+		b.Serialize(&blk)
+
+		binary.Write(&rev, binary.LittleEndian,
+			uint32(chaincfg.RegressionNetParams.Net))
+		binary.Write(&rev, binary.LittleEndian, uint32(1))
+		undoPos[hash] = uint32(rev.Len())
+		rev.WriteByte(0)
+		rev.Write(make([]byte, 32))
+
+		binary.Write(&offsets, binary.BigEndian, uint32(0))
+		binary.Write(&offsets, binary.BigEndian, offset)
+		binary.Write(&offsets, binary.BigEndian, undoPos[hash])
+	}
+	writeObfuscated(t, blkFilePath(dir, 0), blk.Bytes(), key)
+	writeObfuscated(t, revFilePath(dir, 0), rev.Bytes(), key)
+	offsetFileName := filepath.Join(dir, "offsetfile.dat")
+	err = ioutil.WriteFile(offsetFileName, offsets.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// building the offsetfile
+	headers, err := readRawHeadersFromFile(
+		bufio.NewReader(nil), dir, 0, undoPos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("read %d headers, expected 2", len(headers))
+	}
+	for i, h := range headers {
+		if h.CurrentHeaderHash != blocks[i].BlockHash() {
+			t.Fatalf("header %d is %x, expected %s",
+				i, h.CurrentHeaderHash, blocks[i].BlockHash())
+		}
+	}
+
+	// reading blocks for the proofs
+	offsetFile, err := os.Open(offsetFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	read, revs, err := GetRawBlocksFromDisk(1, 2, offsetFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || len(revs) != 2 {
+		t.Fatalf("read %d blocks and %d revs, expected 2",
+			len(read), len(revs))
+	}
+	for i := range read {
+		if read[i].BlockHash() != blocks[i].BlockHash() {
+			t.Fatalf("block %d is %s, expected %s",
+				i+1, read[i].BlockHash(), blocks[i].BlockHash())
+		}
+	}
+
+	// serving blocks
+	blockBytes, err := GetBlockBytesFromFile(2, offsetFileName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	blocks[1].Serialize(&want)
+	if !bytes.Equal(blockBytes, want.Bytes()) {
+		t.Fatalf("block 2 is %x, expected %x", blockBytes, want.Bytes())
+	}
+
+	// looking blocks up by hash
+	source := &flatFileSource{
+		offsetFile: offsetFileName,
+		blockDir:   dir,
+		index:      &headerIndex{heights: make(map[chainhash.Hash]int32)},
+	}
+	for i, b := range blocks {
+		height, err := source.BlockHeight(b.BlockHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != int32(i+1) {
+			t.Fatalf("block %d is at height %d", i+1, height)
+		}
+	}
+	// block 2 cut off the offsetfile in a reorg
+	err = ioutil.WriteFile(offsetFileName, offsets.Bytes()[:12], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.BlockHeight(blocks[1].BlockHash())
+	if err == nil {
+		t.Fatal("found block 2 after it was cut off the offsetfile")
+	}
+
+	// following the tip
+	follower := &tipFollower{
+		cfg: &Config{
+			params:   chaincfg.RegressionNetParams,
+			BlockDir: dir,
+		},
+		seen:    make(map[util.Hash]bool),
+		waiting: make(map[util.Hash]followBlock),
+	}
+	end, err := follower.readBlockFile(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != uint32(blk.Len()) || len(follower.waiting) != 2 {
+		t.Fatalf("followed %d blocks up to %d, expected 2 up to %d",
+			len(follower.waiting), end, blk.Len())
+	}
+}
+
+func TestReadXorKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgexor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, xorKeyFileName)
+	for _, c := range []struct {
+		key   []byte
+		write bool
+		isNil bool
+		fail  bool
+	}{
+		// older bitcoind doesn't write xor.dat
+		{write: false, isNil: true},
+		// -blocksxor=0 writes zeros
+		{key: make([]byte, 8), write: true, isNil: true},
+		{key: []byte{1, 2, 3, 4, 5, 6, 7, 8}, write: true},
+		{key: []byte{1, 2, 3, 4}, write: true, fail: true},
+	} {
+		os.Remove(keyFile)
+		if c.write {
+			err = ioutil.WriteFile(keyFile, c.key, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		key, err := readXorKey(dir)
+		if c.fail {
+			if err == nil {
+				t.Fatalf("no error for key %x", c.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.isNil != (key == nil) ||
+			(key != nil && !bytes.Equal(key, c.key)) {
+			t.Fatalf("read key %x from %x", key, c.key)
+		}
+	}
+}
+
+// TestBlockFileSeek reads from places in the file that aren't at a multiple
+// of the key's length
+func TestBlockFileSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgexor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte{0xff, 1, 2, 3, 4, 5, 6, 7}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFileName), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	writeObfuscated(t, blkFilePath(dir, 3), plain, key)
+
+	f, err := openBlkFile(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 10)
+	_, err = f.Seek(13, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []int{13, 23} {
+		_, err = f.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, plain[start:start+10]) {
+			t.Fatalf("read %x at %d, expected %x", b, start,
+				plain[start:start+10])
+		}
+	}
+	_, err = f.ReadAt(b, 61)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, plain[61:71]) {
+		t.Fatalf("read %x at 61, expected %x", b, plain[61:71])
+	}
+}
@@ -0,0 +1,216 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// BlockSource is where the bridgenode gets blocks, and the rev data that
+// says what the outputs they spend were.
+type BlockSource interface {
+	// TipHeight is the height of the last block it has
+	TipHeight() (int32, error)
+
+	// Blocks gives back the blocks from height on and their rev data, at
+	// most count of them.  It can give back fewer, but at least one if
+	// height isn't past the tip.
+	Blocks(height, count int32) ([]wire.MsgBlock, []RevBlock, error)
+
+	// BlockBytes gives back the serialized block at height
+	BlockBytes(height int32) ([]byte, error)
+
+	// BlockHeight is the height of the block with the hash, which has to be
+	// in the best chain
+	BlockHeight(hash chainhash.Hash) (int32, error)
+}
+
+// blockSource gives back the BlockSource the config says to use: bitcoind's
+// JSON-RPC with -rpc, otherwise its blk and rev files.
+func (cfg *Config) blockSource() (BlockSource, error) {
+	if cfg.rpcAddr != "" {
+		return newRPCSource(cfg)
+	}
+	return newFlatFileSource(cfg), nil
+}
+
+// flatFileSource reads blocks from bitcoind's blk and rev files, which it
+// finds with the offsetfile.  bitcoind has to be stopped while the
+// offsetfile is built, as that reads its block index.
+type flatFileSource struct {
+	offsetFile string
+	heightFile string
+	blockDir   string
+
+	index *headerIndex
+}
+
+// headerIndex has the heights of the blocks in the offsetfile by their
+// hashes.  It's filled in as it's needed.
+type headerIndex struct {
+	mtx     sync.Mutex
+	heights map[chainhash.Hash]int32
+
+	// the last block indexed
+	height int32
+	tip    chainhash.Hash
+}
+
+func newFlatFileSource(cfg *Config) *flatFileSource {
+	return &flatFileSource{
+		offsetFile: cfg.UtreeDir.OffsetDir.OffsetFile,
+		heightFile: cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile,
+		blockDir:   cfg.BlockDir,
+		index:      &headerIndex{heights: make(map[chainhash.Hash]int32)},
+	}
+}
+
+// TipHeight is the last block in the offsetfile
+func (s *flatFileSource) TipHeight() (int32, error) {
+	f, err := os.Open(s.heightFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var height int32
+	err = binary.Read(f, binary.BigEndian, &height)
+	return height, err
+}
+
+// Blocks reads blocks from one blk file at a time
+func (s *flatFileSource) Blocks(height, count int32) (
+	[]wire.MsgBlock, []RevBlock, error) {
+
+	offsetFile, err := os.Open(s.offsetFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer offsetFile.Close()
+
+	blocks, revs, err := GetRawBlocksFromDisk(
+		height, count, offsetFile, s.blockDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blocks) == 0 && count > 0 {
+		return nil, nil, fmt.Errorf("block %d not in the offsetfile", height)
+	}
+	return blocks, revs, nil
+}
+
+func (s *flatFileSource) BlockBytes(height int32) ([]byte, error) {
+	return GetBlockBytesFromFile(height, s.offsetFile, s.blockDir)
+}
+
+// BlockHeight looks the block up in the index, after indexing the blocks
+// added to the offsetfile since it was last used
+func (s *flatFileSource) BlockHeight(hash chainhash.Hash) (int32, error) {
+	s.index.mtx.Lock()
+	defer s.index.mtx.Unlock()
+
+	err := s.updateIndex()
+	if err != nil {
+		return 0, err
+	}
+	height, ok := s.index.heights[hash]
+	if !ok {
+		return 0, fmt.Errorf("block %s not in the offsetfile", hash)
+	}
+	return height, nil
+}
+
+// updateIndex indexes the blocks after the last one indexed.  If that block
+// isn't in the offsetfile anymore because bitcoind switched branches, it
+// indexes them all again.
+func (s *flatFileSource) updateIndex() error {
+	idx := s.index
+	if idx.height > 0 {
+		hashes, err := s.headerHashes(idx.height)
+		if err != nil {
+			return err
+		}
+		if len(hashes) > 0 && hashes[0] == idx.tip {
+			idx.add(idx.height+1, hashes[1:])
+			return nil
+		}
+		idx.heights = make(map[chainhash.Hash]int32)
+		idx.height = 0
+	}
+	hashes, err := s.headerHashes(1)
+	if err != nil {
+		return err
+	}
+	idx.add(1, hashes)
+	return nil
+}
+
+// add puts the hashes of the blocks from height on in the index
+func (idx *headerIndex) add(height int32, hashes []chainhash.Hash) {
+	for i, hash := range hashes {
+		idx.heights[hash] = height + int32(i)
+	}
+	if len(hashes) > 0 {
+		idx.height = height + int32(len(hashes)) - 1
+		idx.tip = hashes[len(hashes)-1]
+	}
+}
+
+// headerHashes reads the headers of the blocks in the offsetfile from height
+// on and gives back their hashes
+func (s *flatFileSource) headerHashes(height int32) ([]chainhash.Hash, error) {
+	offsetFile, err := os.Open(s.offsetFile)
+	if err != nil {
+		return nil, err
+	}
+	defer offsetFile.Close()
+	_, err = offsetFile.Seek(int64(height-1)*12, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []chainhash.Hash
+	var blockFile *blockFile
+	var fileNum uint32
+	defer func() {
+		if blockFile != nil {
+			blockFile.Close()
+		}
+	}()
+	for {
+		// 12 bytes per block: blk file, offset in it, and rev offset
+		var rec [12]byte
+		_, err = io.ReadFull(offsetFile, rec[:])
+		if err == io.EOF {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		num := binary.BigEndian.Uint32(rec[0:4])
+		if blockFile == nil || num != fileNum {
+			if blockFile != nil {
+				blockFile.Close()
+			}
+			blockFile, err = openBlkFile(s.blockDir, num)
+			if err != nil {
+				return nil, err
+			}
+			fileNum = num
+		}
+
+		// skip the magic and size
+		var header [80]byte
+		_, err = blockFile.ReadAt(
+			header[:], int64(binary.BigEndian.Uint32(rec[4:8]))+8)
+		if err != nil {
+			return nil, fmt.Errorf("block %d header: %s",
+				height+int32(len(hashes)), err.Error())
+		}
+		hashes = append(hashes, chainhash.DoubleHashH(header[:]))
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 var HelpMsg = `
@@ -18,10 +20,13 @@ The bridgenode server generates proofs and serves to the CSN node.
 OPTIONS:
   -net=mainnet                 configure whether to use mainnet. Optional.
   -net=regtest                 configure whether to use regtest. Optional.
-  -forest                      select forest type to use (ram, cow, cache, disk). 
+  -forest                      select forest type to use (ram, cow, cache, disk, mmap). 
   Defaults to disk
   -net=signet                 configure whether to use signet. Optional.
-  -forest                      select forest type to use (ram, cow, cache, disk). Defaults to disk
+  -forest                      select forest type to use (ram, cow, cache, disk, mmap). Defaults to disk
+  -posmap                      where to keep the leaf positions (ram, leveldb). Defaults to ram
+  -cowcompress                 compress the cow forest's tables (none, snappy).
+                               Defaults to what the saved forest uses
 
   -datadir="path/to/directory" set a custom DATADIR.
                                Defaults to the Bitcoin Core DATADIR path
@@ -31,6 +36,22 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
   -serve		       immediately serve whatever data is built
+  -follow                      keep building proofs for the blocks bitcoind
+                               adds, and serve them as they're built
+  -rpc=127.0.0.1:8332          get blocks from bitcoind's JSON-RPC instead of
+                               its blk and rev files. Needs bitcoind 23.0+
+  -rpcuser, -rpcpass           log in to the JSON-RPC with these. Defaults to
+                               the .cookie file in the DATADIR
+  -api=port                    also serve proofs, roots and the sync status
+                               over HTTP, as JSON or binary
+  -audit                       check the saved forest for bad hashes and
+                               position map entries, then exit
+  -repair                      with -audit, rebuild the bad parts of the
+                               forest from the leaves and save it
+
+SUBCOMMANDS:
+  convert -forest=cow -to=ram  convert the saved forest from one forest type
+                               to another, then exit
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -44,17 +65,39 @@ var (
 	bridgeDirCmd = argCmd.String("bridgedir", "",
 		`Set a custom bridgenode datadir. Usage: "-bridgedir='path/to/directory"`)
 	forestTypeCmd = argCmd.String("forest", "disk",
-		`Set a forest type to use (cow, ram, disk, cache). Usage: "-forest=cow"`)
+		`Set a forest type to use (cow, ram, disk, cache, mmap). Usage: "-forest=cow"`)
+	posMapCmd = argCmd.String("posmap", "ram",
+		`where to keep the forest's leaf positions (ram, leveldb). Usage: "-posmap=leveldb"`)
+	auditCmd = argCmd.Bool("audit", false,
+		`check the saved forest and exit instead of building proofs`)
+	repairCmd = argCmd.Bool("repair", false,
+		`with -audit, repair the saved forest from its leaves`)
+	convertToCmd = argCmd.String("to", "",
+		`forest type to convert to with the convert subcommand. Usage: "-to=ram"`)
 	quitAfterCmd = argCmd.Int("quitafter", -1,
 		`quit generating proofs after the given block height. (meant for testing)`)
 	cowMaxCache = argCmd.Int("cowmaxcache", 4000,
 		`how much memory to use in MB for the copy-on-write forest`)
+	cowCompressCmd = argCmd.String("cowcompress", "",
+		`compress the copy-on-write forest's tables (none, snappy). Usage: "-cowcompress=snappy"`)
+	hashWorkersCmd = argCmd.Int("hashworkers", runtime.NumCPU(),
+		`how many goroutines hash each forest row. 1 hashes on one goroutine`)
 	memTTL = argCmd.Bool("memttl", false,
 		`keep the ttls in memory instead of on disk. Uses lots of ram.`)
 	serve = argCmd.Bool("serve", false,
 		`immediately start server without building or checking proof data`)
 	noServeCmd = argCmd.Bool("noserve", false,
 		`don't serve proofs after finishing generating them`)
+	followCmd = argCmd.Bool("follow", false,
+		`keep building proofs for new blocks from bitcoind, serving them as they're built`)
+	rpcCmd = argCmd.String("rpc", "",
+		`get blocks from bitcoind's JSON-RPC at host:port. Usage: '-rpc=127.0.0.1:18443'`)
+	rpcUserCmd = argCmd.String("rpcuser", "",
+		`user for the JSON-RPC. Defaults to the .cookie file`)
+	rpcPassCmd = argCmd.String("rpcpass", "",
+		`password for the JSON-RPC. Defaults to the .cookie file`)
+	apiCmd = argCmd.String("api", "",
+		`serve the HTTP api for proofs and roots on this port. Usage: '-api=8339'`)
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
@@ -62,7 +105,8 @@ var (
 	memProfCmd = argCmd.String("memprof", "",
 		`Enable pprof heap profiling. Usage: 'memprof='path/to/file'`)
 	profServerCmd = argCmd.String("profserver", "",
-		`Enable pprof server. Usage: 'profserver='port'`)
+		`Enable pprof server, with Prometheus metrics at /metrics. `+
+			`Usage: 'profserver='port'`)
 )
 
 // utreexo home directory
@@ -75,6 +119,7 @@ type forestDir struct {
 	forestLastSyncedBlockHeightFile string
 	cowForestCurFile                string
 	cowForestDir                    string
+	posMapDir                       string
 }
 
 type proofDir struct {
@@ -88,6 +133,7 @@ type offsetDir struct {
 	base                      string
 	OffsetFile                string
 	lastIndexOffsetHeightFile string
+	rpcHashFile               string
 }
 
 type undoDir struct {
@@ -95,10 +141,17 @@ type undoDir struct {
 	undoFile   string
 	offsetFile string
 }
-type ttlDir struct {
+type rootsDir struct {
 	base       string
-	ttlsetFile string
-	OffsetFile string
+	rootsFile  string
+	offsetFile string
+}
+type ttlDir struct {
+	base           string
+	ttlsetFile     string
+	OffsetFile     string
+	txidFile       string
+	txidOffsetFile string
 }
 
 // All your utreexo bridgenode file paths in a nice and convinent struct
@@ -108,6 +161,7 @@ type utreeDir struct {
 	ForestDir forestDir
 	TtlDir    ttlDir
 	UndoDir   undoDir
+	RootsDir  rootsDir
 }
 
 // init an utreeDir with a selected basepath. Has all the names for the forest
@@ -118,6 +172,7 @@ func initUtreeDir(basePath string) utreeDir {
 		OffsetFile: filepath.Join(offBase, "offsetfile.dat"),
 		lastIndexOffsetHeightFile: filepath.Join(offBase,
 			"lastindexoffsetheightfile.dat"),
+		rpcHashFile: filepath.Join(offBase, "rpcblockhashes.dat"),
 	}
 
 	proofBase := filepath.Join(basePath, "proofdata")
@@ -138,12 +193,15 @@ func initUtreeDir(basePath string) utreeDir {
 			"forestlastsyncedheight.dat"),
 		cowForestDir:     cowDir,
 		cowForestCurFile: filepath.Join(cowDir, "CURRENT"),
+		posMapDir:        filepath.Join(forestBase, "posmap"),
 	}
 	ttlBase := filepath.Join(basePath, "ttldata")
 	ttl := ttlDir{
-		base:       ttlBase,
-		ttlsetFile: filepath.Join(ttlBase, "ttldata.dat"),
-		OffsetFile: filepath.Join(ttlBase, "offsetfile.dat"),
+		base:           ttlBase,
+		ttlsetFile:     filepath.Join(ttlBase, "ttldata.dat"),
+		OffsetFile:     filepath.Join(ttlBase, "offsetfile.dat"),
+		txidFile:       filepath.Join(ttlBase, "txidFile"),
+		txidOffsetFile: filepath.Join(ttlBase, "txidOffsetFile"),
 	}
 	undoBase := filepath.Join(basePath, "undoblockdata")
 	undo := undoDir{
@@ -151,6 +209,12 @@ func initUtreeDir(basePath string) utreeDir {
 		undoFile:   filepath.Join(undoBase, "undo.dat"),
 		offsetFile: filepath.Join(undoBase, "offset.dat"),
 	}
+	rootsBase := filepath.Join(basePath, "rootsdata")
+	roots := rootsDir{
+		base:       rootsBase,
+		rootsFile:  filepath.Join(rootsBase, "roots.dat"),
+		offsetFile: filepath.Join(rootsBase, "offset.dat"),
+	}
 
 	return utreeDir{
 		OffsetDir: off,
@@ -158,6 +222,7 @@ func initUtreeDir(basePath string) utreeDir {
 		ForestDir: forest,
 		TtlDir:    ttl,
 		UndoDir:   undo,
+		RootsDir:  roots,
 	}
 }
 
@@ -181,15 +246,19 @@ func makePaths(dir utreeDir) error {
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.UndoDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
+	}
+	err = os.MkdirAll(dir.RootsDir.base, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	return nil
 }
@@ -209,6 +278,9 @@ const (
 
 	// keeps the entire forest in ram. doable if theres lots of ram (30GB+)
 	ramForest
+
+	// the diskForest file, but memory-mapped. linux only
+	mmapForest
 )
 
 // all the configs for utreexoserver
@@ -226,12 +298,32 @@ type Config struct {
 	// type of the forest we're using
 	forestType forestType
 
+	// keep the position map in leveldb instead of ram
+	diskPosMap bool
+
+	// convert the forest to convertTo instead of building proofs
+	convert   bool
+	convertTo forestType
+
+	// audit the forest instead of building proofs, and repair it if it's
+	// bad
+	audit  bool
+	repair bool
+
 	// quitAfter syncing to this block height
 	quitAfter int32
 
 	// how much cache to allow for cowforest
 	cowMaxCache int
 
+	// what to compress the cowforest's tables with from now on.  Only if
+	// setCowCompression; otherwise it's left as the forest has it.
+	cowCompression    accumulator.TableCompression
+	setCowCompression bool
+
+	// how many goroutines hash each forest row
+	hashWorkers int
+
 	// keep ttls in memory
 	memTTL bool
 
@@ -241,6 +333,17 @@ type Config struct {
 	// don't serve after generating proofs
 	noServe bool
 
+	// after getting to the tip, keep building proofs for the blocks
+	// bitcoind writes, and serve while building
+	follow bool
+
+	// get blocks from bitcoind's JSON-RPC at rpcAddr instead of reading
+	// its blk and rev files
+	rpcAddr, rpcUser, rpcPass string
+
+	// serve the HTTP api on this port along with the blocks
+	apiPort string
+
 	// enable tracing
 	TraceProf string
 
@@ -250,16 +353,20 @@ type Config struct {
 	// enable memory profiling
 	MemProf string
 
-	// enable profiling http server
+	// enable profiling http server, which also serves /metrics
 	ProfServer string
 }
 
 // Parse parses the command line arguments and inits the server Config
 func Parse(args []string) (*Config, error) {
-	argCmd.Parse(args)
-
 	cfg := Config{}
 
+	if len(args) > 0 && args[0] == "convert" {
+		cfg.convert = true
+		args = args[1:]
+	}
+	argCmd.Parse(args)
+
 	var dataDir string
 
 	// set dataDir
@@ -318,24 +425,88 @@ func Parse(args []string) (*Config, error) {
 	cfg.TraceProf = *traceCmd
 	cfg.ProfServer = *profServerCmd
 	cfg.memTTL = *memTTL
+	cfg.hashWorkers = *hashWorkersCmd
 
-	switch *forestTypeCmd {
-	case "disk":
-		cfg.forestType = diskForest
-	case "cache":
-		cfg.forestType = cacheForest
-	case "cow":
-		cfg.forestType = cowForest
-		cfg.cowMaxCache = *cowMaxCache
+	cfg.forestType, err = parseForestType(*forestTypeCmd)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.convert {
+		cfg.convertTo, err = parseForestType(*convertToCmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch *posMapCmd {
 	case "ram":
-		cfg.forestType = ramForest
+	case "leveldb":
+		cfg.diskPosMap = true
 	default:
-		return nil, errWrongForestType(*forestTypeCmd)
+		return nil, errWrongPosMap(*posMapCmd)
+	}
+	if cfg.forestType == cowForest || (cfg.convert && cfg.convertTo == cowForest) {
+		cfg.cowMaxCache = *cowMaxCache
+	}
+	switch *cowCompressCmd {
+	case "":
+	case "none":
+		cfg.cowCompression = accumulator.NoCompression
+		cfg.setCowCompression = true
+	case "snappy":
+		cfg.cowCompression = accumulator.SnappyCompression
+		cfg.setCowCompression = true
+	default:
+		return nil, errWrongCompress(*cowCompressCmd)
+	}
+
+	cfg.audit = *auditCmd
+	cfg.repair = *repairCmd
+	if cfg.repair && !cfg.audit {
+		return nil, fmt.Errorf("-repair only works with -audit")
 	}
 
 	cfg.quitAfter = int32(*quitAfterCmd)
 	cfg.noServe = *noServeCmd
 	cfg.serve = *serve
+	cfg.follow = *followCmd
+	if cfg.follow && cfg.serve {
+		return nil, fmt.Errorf("-follow builds proofs so it can't be used with -serve")
+	}
+	if cfg.follow && cfg.quitAfter > 0 {
+		return nil, fmt.Errorf("-follow doesn't quit so it can't be used with -quitafter")
+	}
+	cfg.rpcAddr = *rpcCmd
+	cfg.rpcUser = *rpcUserCmd
+	cfg.rpcPass = *rpcPassCmd
+	if cfg.follow && cfg.rpcAddr != "" {
+		return nil, fmt.Errorf("-follow reads the blk files bitcoind writes " +
+			"so it can't be used with -rpc")
+	}
+	if cfg.rpcPass != "" && cfg.rpcUser == "" {
+		return nil, fmt.Errorf("-rpcpass needs -rpcuser")
+	}
+	cfg.apiPort = *apiCmd
+	if cfg.apiPort != "" && cfg.noServe {
+		return nil, fmt.Errorf("-api serves along with the blocks so it " +
+			"can't be used with -noserve")
+	}
 
 	return &cfg, nil
 }
+
+// parseForestType returns the forestType for the -forest and -to flags
+func parseForestType(fType string) (forestType, error) {
+	switch fType {
+	case "disk":
+		return diskForest, nil
+	case "cache":
+		return cacheForest, nil
+	case "cow":
+		return cowForest, nil
+	case "ram":
+		return ramForest, nil
+	case "mmap":
+		return mmapForest, nil
+	}
+	return 0, errWrongForestType(fType)
+}
@@ -0,0 +1,87 @@
+package bridgenode
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// forestTypeNames are the -forest flag values for each forestType
+var forestTypeNames = map[forestType]string{
+	diskForest:  "disk",
+	cacheForest: "cache",
+	cowForest:   "cow",
+	ramForest:   "ram",
+	mmapForest:  "mmap",
+}
+
+// ConvertForest converts the saved forest of type cfg.forestType into a
+// forest of type cfg.convertTo.  The old forest is left as it is, so it's
+// up to the user to delete it afterwards.  ram, disk, cache and mmap
+// forests all use the same forest file so there's nothing to convert
+// between them.
+func ConvertForest(cfg *Config) error {
+	from := forestTypeNames[cfg.forestType]
+	to := forestTypeNames[cfg.convertTo]
+	if (cfg.forestType == cowForest) == (cfg.convertTo == cowForest) {
+		return fmt.Errorf("ConvertForest: %s and %s forests use the same "+
+			"files, nothing to convert", from, to)
+	}
+	if !checkForestExists(cfg) {
+		return fmt.Errorf("ConvertForest: no %s forest to convert", from)
+	}
+
+	toCfg := *cfg
+	toCfg.forestType = cfg.convertTo
+	if checkForestExists(&toCfg) {
+		return fmt.Errorf("ConvertForest: there's already a %s forest in %s. "+
+			"Remove it to convert", to, cfg.UtreeDir.ForestDir.base)
+	}
+
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return fmt.Errorf("ConvertForest: %s", err.Error())
+	}
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		return fmt.Errorf("ConvertForest: %s", err.Error())
+	}
+
+	fmt.Printf("converting %s forest at height %d to %s\n", from, height, to)
+
+	var converted *accumulator.Forest
+	switch cfg.convertTo {
+	case cowForest:
+		converted, err = accumulator.ConvertForest(forest,
+			accumulator.CowForest, nil,
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
+	case ramForest:
+		// saveBridgeNodeData writes it to the forest file
+		converted, err = accumulator.ConvertForest(forest,
+			accumulator.RamForest, nil, "", 0)
+	default:
+		// disk, cache and mmap forests are the same on disk; write
+		// straight to the forest file
+		var forestFile *os.File
+		forestFile, err = os.OpenFile(cfg.UtreeDir.ForestDir.forestFile,
+			os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return fmt.Errorf("ConvertForest: %s", err.Error())
+		}
+		converted, err = accumulator.ConvertForest(forest,
+			accumulator.DiskForest, forestFile, "", 0)
+	}
+	if err != nil {
+		return fmt.Errorf("ConvertForest: %s", err.Error())
+	}
+
+	err = saveBridgeNodeData(converted, height, &toCfg)
+	if err != nil {
+		return fmt.Errorf("ConvertForest: %s", err.Error())
+	}
+	fmt.Printf("converted %s forest to %s. Run with -forest=%s from now on\n",
+		from, to, to)
+
+	return nil
+}
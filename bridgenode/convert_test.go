@@ -0,0 +1,95 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestConvertForest(t *testing.T) {
+	for _, types := range [][2]forestType{
+		{cowForest, ramForest},
+		{diskForest, cowForest},
+	} {
+		err := convertForestFiles(types[0], types[1])
+		if err != nil {
+			t.Fatalf("%s to %s: %s", forestTypeNames[types[0]],
+				forestTypeNames[types[1]], err.Error())
+		}
+	}
+}
+
+// convertForestFiles saves a forest of type from, converts it and checks
+// that the forest restored as type to is the same.
+func convertForestFiles(from, to forestType) error {
+	dir, err := ioutil.TempDir("", "bridgeconvert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		UtreeDir:    initUtreeDir(dir),
+		forestType:  from,
+		cowMaxCache: 100,
+		convert:     true,
+		convertTo:   to,
+	}
+	err = makePaths(cfg.UtreeDir)
+	if err != nil {
+		return err
+	}
+
+	forest, err := createForest(cfg)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 1000; i += 100 {
+		adds := make([]accumulator.Leaf, 100)
+		for j := range adds {
+			adds[j].Hash[0] = byte(i + j)
+			adds[j].Hash[1] = byte((i + j) >> 8)
+			adds[j].Hash[2] = 0xcc
+		}
+		_, err = forest.Modify(adds, nil)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = forest.Modify(nil, []uint64{3, 50, 400, 999})
+	if err != nil {
+		return err
+	}
+	roots := forest.GetRoots()
+	err = saveBridgeNodeData(forest, 10, cfg)
+	if err != nil {
+		return err
+	}
+
+	err = ConvertForest(cfg)
+	if err != nil {
+		return err
+	}
+
+	toCfg := *cfg
+	toCfg.forestType = to
+	converted, err := restoreForest(&toCfg)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(converted.GetRoots(), roots) {
+		return fmt.Errorf("roots differ after converting")
+	}
+	height, err := restoreHeight(&toCfg)
+	if err != nil {
+		return err
+	}
+	if height != 10 {
+		return fmt.Errorf("height %d after converting, expected 10", height)
+	}
+	return nil
+}
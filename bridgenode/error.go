@@ -8,6 +8,8 @@ import (
 var (
 	ErrNoDataDir       = errors.New("No bitcoind datadir")
 	ErrWrongForestType = errors.New("Invalid forest type of")
+	ErrWrongPosMap     = errors.New("Invalid position map type of")
+	ErrWrongCompress   = errors.New("Invalid cow compression of")
 	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
 	ErrBuildProofs     = errors.New("BuildProofs error")
 	ErrArchiveServer   = errors.New("ArchiveServer error")
@@ -22,6 +24,14 @@ func errWrongForestType(fType string) error {
 	return fmt.Errorf("%s: %s", ErrWrongForestType, fType)
 }
 
+func errWrongPosMap(pType string) error {
+	return fmt.Errorf("%s: %s", ErrWrongPosMap, pType)
+}
+
+func errWrongCompress(cType string) error {
+	return fmt.Errorf("%s: %s", ErrWrongCompress, cType)
+}
+
 func errInvalidNetwork(nType string) error {
 	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
 }
@@ -53,14 +53,159 @@ type flatFileState struct {
 	finishedHeight        int32
 	currentOffset         int64
 	fileWait              *sync.WaitGroup
+
+	// progress and worker say how far this worker has written
+	progress *flatFileProgress
+	worker   int
+}
+
+// the flat file workers, for flatFileProgress
+const (
+	proofWorker = iota
+	undoWorker
+	ttlWorker
+	numFlatFileWorkers
+)
+
+// flatFileProgress is the height each flat file worker has written up to.
+// The forest is only checkpointed at heights that are written to all the
+// flat files, so that they can be rolled back to it.
+//
+// When following the tip, the flat files get rolled back after a reorg
+// while blocks are being served from them.  Servers hold files for reading
+// while they read a block, and the roll back holds it while it cuts the
+// files back.
+type flatFileProgress struct {
+	cond    *sync.Cond
+	written [numFlatFileWorkers]int32
+
+	// forks are the heights the flat files got rolled back to, oldest
+	// first
+	forks []int32
+	files sync.RWMutex
+}
+
+// newFlatFileProgress starts all the workers at height
+func newFlatFileProgress(height int32) *flatFileProgress {
+	p := &flatFileProgress{cond: sync.NewCond(new(sync.Mutex))}
+	for i := range p.written {
+		p.written[i] = height
+	}
+	return p
+}
+
+// done says that worker has written up to height
+func (p *flatFileProgress) done(worker int, height int32) {
+	p.cond.L.Lock()
+	p.written[worker] = height
+	p.cond.L.Unlock()
+	p.cond.Broadcast()
+}
+
+// height is the height all the workers have written up to
+func (p *flatFileProgress) height() int32 {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	height := p.written[0]
+	for _, written := range p.written[1:] {
+		if written < height {
+			height = written
+		}
+	}
+	return height
+}
+
+// wait waits until all the workers have written up to height
+func (p *flatFileProgress) wait(height int32) {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	for {
+		behind := false
+		for _, written := range p.written {
+			if written < height {
+				behind = true
+			}
+		}
+		if !behind {
+			return
+		}
+		p.cond.Wait()
+	}
+}
+
+// readLock waits until all the workers have written up to height, then
+// holds the files for reading so they don't get rolled back while a block
+// is read from them.  It gives back how many times they've been rolled back.
+func (p *flatFileProgress) readLock(height int32) int {
+	for {
+		p.wait(height)
+		p.files.RLock()
+		// the files can't be rolled back while they're held, but they could
+		// have been before
+		if p.height() >= height {
+			p.cond.L.Lock()
+			defer p.cond.L.Unlock()
+			return len(p.forks)
+		}
+		p.files.RUnlock()
+	}
+}
+
+// readLockWritten holds the files for reading like readLock if all the
+// workers have written up to height, but doesn't wait for them if they
+// haven't.  Then it's false and the files aren't held.
+func (p *flatFileProgress) readLockWritten(height int32) bool {
+	p.files.RLock()
+	if p.height() >= height {
+		return true
+	}
+	p.files.RUnlock()
+	return false
+}
+
+func (p *flatFileProgress) readUnlock() {
+	p.files.RUnlock()
+}
+
+// startRollBack waits for readers to be done with the files and holds them
+// until endRollBack.  All the workers are set back to height.
+func (p *flatFileProgress) startRollBack(height int32) {
+	p.files.Lock()
+	p.cond.L.Lock()
+	for i := range p.written {
+		p.written[i] = height
+	}
+	p.forks = append(p.forks, height)
+	p.cond.L.Unlock()
+}
+
+func (p *flatFileProgress) endRollBack() {
+	p.files.Unlock()
+}
+
+// forksSince is the lowest height the files got rolled back to, leaving
+// out the first n roll backs.  It's false if there weren't any more.
+func (p *flatFileProgress) forksSince(n int) (int32, bool) {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	if n >= len(p.forks) {
+		return 0, false
+	}
+	fork := p.forks[n]
+	for _, f := range p.forks[n+1:] {
+		if f < fork {
+			fork = f
+		}
+	}
+	return fork, true
 }
 
 func flatFileWorkerProof(
 	proofChan chan btcacc.UData,
 	utreeDir utreeDir,
-	fileWait *sync.WaitGroup) {
+	fileWait *sync.WaitGroup, progress *flatFileProgress) {
 
-	var pf flatFileState
+	pf := flatFileState{progress: progress, worker: proofWorker}
 	var err error
 
 	pf.offsetFile, err = os.OpenFile(
@@ -82,21 +227,21 @@ func flatFileWorkerProof(
 		panic(err)
 	}
 
-	for {
-		ud := <-proofChan
+	for ud := range proofChan {
 		err = pf.writeProofBlock(ud)
 		if err != nil {
 			panic(err)
 		}
 	}
+	pf.close()
 }
 
 func flatFileWorkerUndo(
 	undoChan chan accumulator.UndoBlock,
 	utreeDir utreeDir,
-	fileWait *sync.WaitGroup) {
+	fileWait *sync.WaitGroup, progress *flatFileProgress) {
 
-	var uf flatFileState
+	uf := flatFileState{progress: progress, worker: undoWorker}
 	var err error
 
 	uf.offsetFile, err = os.OpenFile(
@@ -117,24 +262,22 @@ func flatFileWorkerUndo(
 	if err != nil {
 		panic(err)
 	}
-	for {
-		undo := <-undoChan
+	for undo := range undoChan {
 		err = uf.writeUndoBlock(undo)
 		if err != nil {
 			panic(err)
 		}
-
 	}
-
+	uf.close()
 }
 
 func flatFileWorkerTTL(
 	ttlResultChan chan ttlResultBlock,
 	numOutputsChan chan allocNSkipTTL,
 	utreeDir utreeDir,
-	fileWait *sync.WaitGroup) {
+	fileWait *sync.WaitGroup, progress *flatFileProgress) {
 
-	var tf flatFileState
+	tf := flatFileState{progress: progress, worker: ttlWorker}
 	var err error
 
 	tf.offsetFile, err = os.OpenFile(
@@ -154,10 +297,19 @@ func flatFileWorkerTTL(
 	if err != nil {
 		panic(err)
 	}
+	// the ttl offset file has where each block's ttls end, so resuming,
+	// ffInit puts where block h starts at heightOffsets[h-1].  Move them up
+	// one to where they go for new blocks.
+	if len(tf.heightOffsets) == int(tf.finishedHeight) {
+		tf.heightOffsets = append([]int64{0}, tf.heightOffsets...)
+	}
 
 	for {
 		// expand TTL file by 4 byte for every utxo in this block
-		allocNSkip := <-numOutputsChan
+		allocNSkip, open := <-numOutputsChan
+		if !open {
+			break
+		}
 		numOutputs := allocNSkip.totalOut
 		// fmt.Printf("h %d %d utxos truncating from %d to %d\n",
 		// len(tf.heightOffsets), size,
@@ -189,8 +341,22 @@ func flatFileWorkerTTL(
 		if err != nil {
 			panic(err)
 		}
+		tf.progress.done(tf.worker, tf.finishedHeight)
+		tf.fileWait.Done()
 	}
+	tf.close()
+}
 
+// close closes the files once the worker's channel is closed
+func (ff *flatFileState) close() {
+	err := ff.offsetFile.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = ff.proofFile.Close()
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (ff *flatFileState) ffInit() error {
@@ -290,6 +456,7 @@ func (uf *flatFileState) writeUndoBlock(ub accumulator.UndoBlock) error {
 
 	uf.currentOffset = uf.currentOffset + int64(undoSize) + 8
 	uf.finishedHeight++
+	uf.progress.done(uf.worker, uf.finishedHeight)
 
 	uf.fileWait.Done()
 
@@ -358,6 +525,7 @@ func (pf *flatFileState) writeProofBlock(ud btcacc.UData) error {
 			ud.Height, pf.finishedHeight)
 	}
 
+	pf.progress.done(pf.worker, pf.finishedHeight)
 	pf.fileWait.Done()
 	return nil
 }
@@ -408,6 +576,8 @@ func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 
 		// first, read the data there to make sure it's empty.
 		// If there's something already there, we messed up & should panic.
+		// The same ttl can already be there if the flat files were rolled
+		// back to an earlier block after a crash.
 		// TODO once everything works great can remove this
 
 		n, err := tf.proofFile.ReadAt(readEmpty[:], loc)
@@ -422,7 +592,7 @@ func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 				loc, s.Size(), err.Error())
 		}
 
-		if readEmpty != expectedEmpty {
+		if readEmpty != expectedEmpty && readEmpty != ttlArr {
 			return fmt.Errorf("writeTTLs Wanted to overwrite byte %d with %x "+
 				"but %x was already there. desth %d createh %d idxinblk %d",
 				loc, ttlArr, readEmpty, ttlRes.destroyHeight,
@@ -443,6 +613,5 @@ func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 
 	// increment height by 1
 	tf.finishedHeight = tf.finishedHeight + 1
-	tf.fileWait.Done()
 	return nil
 }
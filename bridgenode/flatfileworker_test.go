@@ -0,0 +1,68 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestFlatFileWorkerTTLResume writes ttls into blocks written before the
+// worker was restarted, as happens after rolling back to a fork
+func TestFlatFileWorkerTTLResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgettl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runs a worker for blocks from height on, with how many outputs each
+	// has and what it spends
+	run := func(height int32, outputs []uint32, spends [][]ttlResult) {
+		t.Helper()
+		ttlResultChan := make(chan ttlResultBlock, 10)
+		skipChan := make(chan allocNSkipTTL, 10)
+		fileWait := new(sync.WaitGroup)
+		progress := newFlatFileProgress(height)
+		go flatFileWorkerTTL(
+			ttlResultChan, skipChan, utreeDir, fileWait, progress)
+		for i := range outputs {
+			fileWait.Add(1)
+			skipChan <- allocNSkipTTL{totalOut: outputs[i]}
+			ttlResultChan <- ttlResultBlock{
+				destroyHeight: height + 1 + int32(i), results: spends[i]}
+		}
+		fileWait.Wait()
+		close(skipChan)
+	}
+
+	// blocks 1 and 2 with 2 and 3 outputs, then block 3 spending the 2nd
+	// output of 1 and the 3rd of 2
+	run(0, []uint32{2, 3}, [][]ttlResult{nil, nil})
+	run(2, []uint32{1}, [][]ttlResult{{
+		{createHeight: 1, indexWithinBlock: 1},
+		{createHeight: 2, indexWithinBlock: 2},
+	}})
+
+	ttls, err := ioutil.ReadFile(utreeDir.TtlDir.ttlsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0, 2, 0, 0, 1, 0}
+	if len(ttls) != len(want)*4 {
+		t.Fatalf("ttl file is %d bytes, expected %d", len(ttls), len(want)*4)
+	}
+	for i, ttl := range want {
+		got := binary.BigEndian.Uint32(ttls[i*4:])
+		if got != ttl {
+			t.Fatalf("ttl %d is %d, expected %d", i, got, ttl)
+		}
+	}
+}
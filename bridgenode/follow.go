@@ -0,0 +1,431 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// followPollInterval is how often the bridgenode looks for new blocks from
+// bitcoind when following the tip
+const followPollInterval = 10 * time.Second
+
+// tipFollower extends the offsetfile as bitcoind writes new blocks to the
+// blk and rev files.  bitcoind keeps running, so it only looks at what's
+// been added since it last looked, and only reads the block index entries
+// of the new blocks.
+//
+// A block can go in the offsetfile once the index says its rev data is
+// written, which bitcoind does when it connects the block and flushes the
+// index.  The index doesn't say which blocks are on the best chain; a block
+// bitcoind disconnected in a reorg keeps its rev data.  So like bitcoind,
+// the follower goes with the branch that has the most work.  When that's a
+// branch off of a block before the tip, the blocks after the fork have to
+// be rolled back before switchBranch puts the branch in the offsetfile.
+// Blocks that never get connected, like stale forks bitcoind didn't switch
+// to, just sit in waiting.
+type tipFollower struct {
+	cfg *Config
+
+	// tip and height are the last block in the offsetfile
+	tip    util.Hash
+	height int32
+
+	// fileNum and offset are where to look for new blocks in the blk files
+	fileNum uint32
+	offset  uint32
+
+	// waiting are the blocks bitcoind hasn't written rev data for yet
+	waiting map[util.Hash]followBlock
+	// connected are the blocks with rev data that aren't in the offsetfile
+	connected map[util.Hash]followBlock
+	// seen are all the blocks it's found
+	seen map[util.Hash]bool
+
+	// fork and branch are the branch extend found to switch to after the
+	// blocks after fork are rolled back
+	fork   int32
+	branch []followBlock
+}
+
+// followBlock is a block the follower found in the blk files
+type followBlock struct {
+	RawHeaderData
+	// height is from the block index
+	height int32
+	// work is what the target in the header says the block took
+	work *big.Int
+}
+
+// newFollowBlock reads the hashes and work from a block's 80 byte header
+func newFollowBlock(fileNum, offset uint32, header []byte) followBlock {
+	var b followBlock
+	binary.BigEndian.PutUint32(b.FileNum[:], fileNum)
+	binary.BigEndian.PutUint32(b.Offset[:], offset)
+	copy(b.Prevhash[:], header[4:36])
+	b.CurrentHeaderHash = headerHash(header)
+	b.work = blockchain.CalcWork(binary.LittleEndian.Uint32(header[72:76]))
+	return b
+}
+
+// newTipFollower starts following from the block at height, which has to
+// be the last one in the offsetfile
+func newTipFollower(cfg *Config, height int32) (*tipFollower, error) {
+	f := &tipFollower{
+		cfg:       cfg,
+		height:    height,
+		waiting:   make(map[util.Hash]followBlock),
+		connected: make(map[util.Hash]followBlock),
+		seen:      make(map[util.Hash]bool),
+	}
+	b, err := f.chainBlock(height)
+	if err != nil {
+		return nil, fmt.Errorf("newTipFollower: %s", err.Error())
+	}
+	f.tip = b.CurrentHeaderHash
+	f.fileNum = binary.BigEndian.Uint32(b.FileNum[:])
+	f.offset = binary.BigEndian.Uint32(b.Offset[:])
+	f.seen[f.tip] = true
+	return f, nil
+}
+
+// extend adds the blocks bitcoind has written since the last call to the
+// offsetfile, and returns the new height of the last block in it.  If
+// bitcoind switched to a branch off of an earlier block, it returns the
+// height of that block and true instead, and leaves the offsetfile as it is.
+func (f *tipFollower) extend() (int32, bool, error) {
+	err := f.readNewHeaders()
+	if err != nil {
+		return f.height, false, err
+	}
+	if len(f.waiting) != 0 {
+		err = f.checkUndo()
+		if err != nil {
+			return f.height, false, err
+		}
+	}
+
+	fork, branch, err := f.bestBranch()
+	if err != nil || branch == nil {
+		return f.height, false, err
+	}
+	if fork < f.height {
+		f.fork, f.branch = fork, branch
+		return fork, true, nil
+	}
+	err = f.writeBranch(fork, branch)
+	return f.height, false, err
+}
+
+// switchBranch puts the branch extend found in the offsetfile in place of
+// the blocks after the fork, once they've been rolled back, and returns
+// the new height.  The blocks it replaces go back to being connected, as
+// bitcoind could switch back to them.
+func (f *tipFollower) switchBranch() (int32, error) {
+	if f.branch == nil {
+		return f.height, fmt.Errorf("switchBranch: no branch to switch to")
+	}
+	for h := f.fork + 1; h <= f.height; h++ {
+		b, err := f.chainBlock(h)
+		if err != nil {
+			return f.height, err
+		}
+		f.connected[b.CurrentHeaderHash] = b
+	}
+	err := f.writeBranch(f.fork, f.branch)
+	if err != nil {
+		return f.height, err
+	}
+	f.branch = nil
+	return f.height, nil
+}
+
+// bestBranch finds the branch of connected blocks with the most work over
+// the blocks in the offsetfile it would replace.  It gives back the height
+// of the block in the offsetfile it comes off of and the branch after it,
+// or no branch if none has more work than the offsetfile.  Ties go to the
+// offsetfile, which bitcoind saw first.
+func (f *tipFollower) bestBranch() (int32, []followBlock, error) {
+	var bestFork int32
+	var best []followBlock
+	bestWork := new(big.Int)
+
+	// work in the offsetfile after each fork
+	chainWork := make(map[int32]*big.Int)
+	for _, b := range f.connected {
+		branch := []followBlock{b}
+		work := new(big.Int).Set(b.work)
+		var fork int32
+		for {
+			first := branch[0]
+			inChain, err := f.inChain(first.Prevhash, first.height-1)
+			if err != nil {
+				return 0, nil, err
+			}
+			if inChain {
+				fork = first.height - 1
+				break
+			}
+			parent, ok := f.connected[first.Prevhash]
+			if !ok {
+				// comes off of a block bitcoind never connected
+				branch = nil
+				break
+			}
+			branch = append([]followBlock{parent}, branch...)
+			work.Add(work, parent.work)
+		}
+		if branch == nil {
+			continue
+		}
+
+		replaced, ok := chainWork[fork]
+		if !ok {
+			var err error
+			replaced, err = f.workAfter(fork)
+			if err != nil {
+				return 0, nil, err
+			}
+			chainWork[fork] = replaced
+		}
+		work.Sub(work, replaced)
+		cmp := work.Cmp(bestWork)
+		if cmp > 0 || (cmp == 0 && best != nil && fork > bestFork) {
+			bestFork, best, bestWork = fork, branch, work
+		}
+	}
+	return bestFork, best, nil
+}
+
+// inChain says if the block at height in the offsetfile is hash
+func (f *tipFollower) inChain(hash util.Hash, height int32) (bool, error) {
+	if height < 1 || height > f.height {
+		return false, nil
+	}
+	if height == f.height {
+		return hash == f.tip, nil
+	}
+	b, err := f.chainBlock(height)
+	if err != nil {
+		return false, err
+	}
+	return b.CurrentHeaderHash == hash, nil
+}
+
+// workAfter adds up the work of the blocks after height in the offsetfile
+func (f *tipFollower) workAfter(height int32) (*big.Int, error) {
+	work := new(big.Int)
+	for h := height + 1; h <= f.height; h++ {
+		b, err := f.chainBlock(h)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, b.work)
+	}
+	return work, nil
+}
+
+// chainBlock reads the block at height in the offsetfile from the offsetfile
+// and its header from the blk file
+func (f *tipFollower) chainBlock(height int32) (followBlock, error) {
+	offsetFile, err := os.Open(f.cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return followBlock{}, err
+	}
+	defer offsetFile.Close()
+
+	// 12 bytes per block, starting at block 1
+	var rec [12]byte
+	_, err = offsetFile.ReadAt(rec[:], int64(height-1)*12)
+	if err != nil {
+		return followBlock{}, fmt.Errorf("block %d offset: %s",
+			height, err.Error())
+	}
+	fileNum := binary.BigEndian.Uint32(rec[0:4])
+	offset := binary.BigEndian.Uint32(rec[4:8])
+
+	blockFile, err := openBlkFile(f.cfg.BlockDir, fileNum)
+	if err != nil {
+		return followBlock{}, err
+	}
+	defer blockFile.Close()
+
+	// skip the magic and size
+	var header [80]byte
+	_, err = blockFile.ReadAt(header[:], int64(offset)+8)
+	if err != nil {
+		return followBlock{}, fmt.Errorf("block %d header: %s",
+			height, err.Error())
+	}
+
+	b := newFollowBlock(fileNum, offset, header[:])
+	b.height = height
+	b.UndoPos = binary.BigEndian.Uint32(rec[8:12])
+	return b, nil
+}
+
+// readNewHeaders reads the headers of the blocks after f.offset in the blk
+// files, moving on to the next blk file once bitcoind has started it.
+func (f *tipFollower) readNewHeaders() error {
+	for {
+		next, err := f.readBlockFile(f.fileNum, f.offset)
+		if err != nil {
+			return err
+		}
+		f.offset = next
+		if !util.HasAccess(blkFilePath(f.cfg.BlockDir, f.fileNum+1)) {
+			return nil
+		}
+		// bitcoind is done with this file once it's started the next one,
+		// but it might have finished a block in it since it was read
+		_, err = f.readBlockFile(f.fileNum, f.offset)
+		if err != nil {
+			return err
+		}
+		f.fileNum++
+		f.offset = 0
+	}
+}
+
+// readBlockFile reads the headers of the blocks in a blk file from offset
+// on and gives back the offset it got up to.  It stops at the end of the
+// file, at the zeros bitcoind allocates ahead of the blocks, and at a
+// block that isn't all written yet.
+func (f *tipFollower) readBlockFile(fileNum, offset uint32) (uint32, error) {
+	file, err := openBlkFile(f.cfg.BlockDir, fileNum)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+
+	var buf [88]byte // magic, size, and the 80 byte header
+	for int64(offset)+88 <= stat.Size() {
+		_, err = file.ReadAt(buf[:], int64(offset))
+		if err != nil {
+			return offset, err
+		}
+		if binary.LittleEndian.Uint32(buf[:4]) != uint32(f.cfg.params.Net) {
+			break
+		}
+		size := binary.LittleEndian.Uint32(buf[4:8])
+		end := int64(offset) + 8 + int64(size)
+		if end > stat.Size() {
+			break
+		}
+
+		b := newFollowBlock(fileNum, offset, buf[8:8+80])
+		if !f.seen[b.CurrentHeaderHash] {
+			f.seen[b.CurrentHeaderHash] = true
+			f.waiting[b.CurrentHeaderHash] = b
+		}
+		offset = uint32(end)
+	}
+	return offset, nil
+}
+
+// checkUndo looks up the waiting blocks in bitcoind's block index, and
+// moves the ones that have rev data to connected.  Blocks bitcoind found
+// to be invalid are dropped.  The index is opened each
+// time since a read only leveldb doesn't see what's written after it's
+// opened.
+func (f *tipFollower) checkUndo() error {
+	lvdb, err := OpenIndexFile(f.cfg.BlockDir)
+	if err != nil {
+		return err
+	}
+	defer lvdb.Close()
+
+	for hash, b := range f.waiting {
+		val, err := lvdb.Get(append([]byte{0x62}, hash[:]...), nil)
+		if err == leveldb.ErrNotFound {
+			// not in the index yet
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cbIdx := ReadCBlockFileIndex(bytes.NewReader(val))
+		if cbIdx.Status&BlockFailedMask != 0 {
+			delete(f.waiting, hash)
+			continue
+		}
+		if cbIdx.Status&BlockHaveUndo == 0 {
+			continue
+		}
+		b.UndoPos = cbIdx.UndoPos
+		b.height = cbIdx.Height
+		delete(f.waiting, hash)
+		f.connected[hash] = b
+	}
+	return nil
+}
+
+// writeBranch puts the branch in the offsetfile after the block at fork,
+// cutting off whatever was after it, then writes the new last height.
+func (f *tipFollower) writeBranch(fork int32, branch []followBlock) error {
+	var offsets []byte
+	for _, b := range branch {
+		offsets = append(offsets, b.FileNum[:]...)
+		offsets = append(offsets, b.Offset[:]...)
+		offsets = appendUint32(offsets, b.UndoPos)
+	}
+	height := fork + int32(len(branch))
+
+	offsetFile, err := os.OpenFile(
+		f.cfg.UtreeDir.OffsetDir.OffsetFile, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	_, err = offsetFile.WriteAt(offsets, int64(fork)*12)
+	if err != nil {
+		return err
+	}
+	// the new branch can be shorter
+	err = offsetFile.Truncate(int64(height) * 12)
+	if err != nil {
+		return err
+	}
+
+	heightFile, err := os.OpenFile(
+		f.cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer heightFile.Close()
+	err = binary.Write(heightFile, binary.BigEndian, height)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range branch {
+		delete(f.connected, b.CurrentHeaderHash)
+	}
+	f.tip, f.height = branch[len(branch)-1].CurrentHeaderHash, height
+	return nil
+}
+
+// headerHash is the double sha256 of an 80 byte block header
+func headerHash(header []byte) util.Hash {
+	first := sha256.Sum256(header)
+	return sha256.Sum256(first[:])
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var x [4]byte
+	binary.BigEndian.PutUint32(x[:], v)
+	return append(b, x[:]...)
+}
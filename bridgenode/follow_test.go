@@ -0,0 +1,275 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// testBlock is a block with an 80 byte header and some junk after it, as
+// bitcoind writes it to a blk file.  They all have the same work.
+func testBlock(prev util.Hash, nonce uint32) ([]byte, util.Hash) {
+	header := make([]byte, 80)
+	copy(header[4:36], prev[:])
+	binary.LittleEndian.PutUint32(header[72:],
+		chaincfg.RegressionNetParams.PowLimitBits)
+	binary.LittleEndian.PutUint32(header[76:], nonce)
+
+	b := make([]byte, 8, 8+80+20)
+	binary.LittleEndian.PutUint32(b[0:4],
+		uint32(chaincfg.RegressionNetParams.Net))
+	binary.LittleEndian.PutUint32(b[4:8], 80+20)
+	b = append(b, header...)
+	b = append(b, make([]byte, 20)...)
+	return b, headerHash(header)
+}
+
+// appendToFile appends b to the file and gives back where it went
+func appendToFile(t *testing.T, name string, b []byte) uint32 {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(stat.Size())
+}
+
+// indexBlocks puts the blocks in the block index at their heights, with
+// height*10 as their undo positions
+func indexBlocks(t *testing.T, blockDir string, heights map[util.Hash]int32) {
+	lvdb, err := leveldb.OpenFile(filepath.Join(blockDir, "index"),
+		&opt.Options{Compression: opt.NoCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lvdb.Close()
+	for hash, height := range heights {
+		// version, height, status, txs, file, data pos, undo pos, all
+		// small enough to be one byte varints
+		val := []byte{1, byte(height), byte(BlockHaveData | BlockHaveUndo),
+			1, 0, 0, byte(height * 10)}
+		err = lvdb.Put(append([]byte{0x62}, hash[:]...), val, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTipFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgefollow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{
+		BlockDir: filepath.Join(dir, "blocks"),
+		UtreeDir: initUtreeDir(filepath.Join(dir, "utreexo")),
+		params:   chaincfg.RegressionNetParams,
+	}
+	err = makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(cfg.BlockDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk0 := blkFilePath(cfg.BlockDir, 0)
+	blk1 := blkFilePath(cfg.BlockDir, 1)
+
+	// blocks 1 to 3 are in the offsetfile already
+	var hashes []util.Hash
+	var offsets []byte
+	var prev util.Hash
+	for h := 1; h <= 3; h++ {
+		b, hash := testBlock(prev, uint32(h))
+		offset := appendToFile(t, blk0, b)
+		offsets = appendUint32(offsets, 0)
+		offsets = appendUint32(offsets, offset)
+		offsets = appendUint32(offsets, uint32(h))
+		hashes = append(hashes, hash)
+		prev = hash
+	}
+	err = ioutil.WriteFile(cfg.UtreeDir.OffsetDir.OffsetFile, offsets, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile,
+		[]byte{0, 0, 0, 3}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexBlocks(t, cfg.BlockDir, nil)
+
+	follower, err := newTipFollower(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follower.tip != hashes[2] {
+		t.Fatalf("tip %x but block 3 is %x", follower.tip, hashes[2])
+	}
+
+	// where each block should end up in the offsetfile, from block 1
+	want := make(map[int32][3]uint32)
+	for h := int32(1); h <= 3; h++ {
+		want[h] = [3]uint32{0, binary.BigEndian.Uint32(offsets[h*12-8:]),
+			uint32(h)}
+	}
+	checkOffsets := func(height int32) {
+		t.Helper()
+		got, err := ioutil.ReadFile(cfg.UtreeDir.OffsetDir.OffsetFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != int(height)*12 {
+			t.Fatalf("offsetfile has %d bytes for %d blocks", len(got), height)
+		}
+		for h := int32(1); h <= height; h++ {
+			rec := [3]uint32{binary.BigEndian.Uint32(got[h*12-12:]),
+				binary.BigEndian.Uint32(got[h*12-8:]),
+				binary.BigEndian.Uint32(got[h*12-4:])}
+			if rec != want[h] {
+				t.Fatalf("block %d offsets %v, expected %v", h, rec, want[h])
+			}
+		}
+		last, err := restoreLastIndexOffsetHeight(cfg.UtreeDir.OffsetDir,
+			make(chan bool, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != height {
+			t.Fatalf("last offset height %d, expected %d", last, height)
+		}
+	}
+	check := func(wantHeight int32) {
+		t.Helper()
+		height, reorg, err := follower.extend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reorg {
+			t.Fatalf("switched branches at %d", height)
+		}
+		if height != wantHeight {
+			t.Fatalf("followed to %d, expected %d", height, wantHeight)
+		}
+		checkOffsets(height)
+	}
+	// checkSwitch expects a branch off of fork, which it switches to
+	checkSwitch := func(fork, wantHeight int32) {
+		t.Helper()
+		height, reorg, err := follower.extend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reorg || height != fork {
+			t.Fatalf("extend gave %d %v, expected a switch at %d",
+				height, reorg, fork)
+		}
+		// nothing changes until the blocks after the fork are rolled back
+		info, err := os.Stat(cfg.UtreeDir.OffsetDir.OffsetFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(follower.height)*12 {
+			t.Fatalf("offsetfile is %d bytes before switching from %d",
+				info.Size(), follower.height)
+		}
+		height, err = follower.switchBranch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != wantHeight {
+			t.Fatalf("switched to %d, expected %d", height, wantHeight)
+		}
+	}
+	check(3)
+
+	// 4 and 5, and a stale 4 that never gets rev data, then the zeros
+	// bitcoind allocates ahead
+	b4, hash4 := testBlock(hashes[2], 4)
+	stale, _ := testBlock(hashes[2], 44)
+	b5, hash5 := testBlock(hash4, 5)
+	appendToFile(t, blk0, stale)
+	want[4] = [3]uint32{0, appendToFile(t, blk0, b4), 40}
+	want[5] = [3]uint32{0, appendToFile(t, blk0, b5), 50}
+	appendToFile(t, blk0, make([]byte, 1000))
+
+	// no rev data yet
+	check(3)
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{hash4: 4, hash5: 5})
+	check(5)
+
+	// the next file has 7 before 6, and 8 which doesn't have rev data yet
+	b6, hash6 := testBlock(hash5, 6)
+	b7, hash7 := testBlock(hash6, 7)
+	b8, hash8 := testBlock(hash7, 8)
+	want[7] = [3]uint32{1, appendToFile(t, blk1, b7), 70}
+	want[6] = [3]uint32{1, appendToFile(t, blk1, b6), 60}
+	want[8] = [3]uint32{1, appendToFile(t, blk1, b8), 80}
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{hash6: 6, hash7: 7})
+	check(7)
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{hash8: 8})
+	check(8)
+
+	// 9 is only partly written
+	b9, hash9 := testBlock(hash8, 9)
+	want[9] = [3]uint32{1, appendToFile(t, blk1, b9[:100]), 90}
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{hash9: 9})
+	check(8)
+	appendToFile(t, blk1, b9[100:])
+	check(9)
+
+	// a 9 off of 8 has as much work as 9, so it stays on 9
+	other9, otherHash9 := testBlock(hash8, 99)
+	appendToFile(t, blk1, other9)
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{otherHash9: 9})
+	check(9)
+
+	// a branch off of 7 up to 10 has more
+	oldWant := want
+	want = make(map[int32][3]uint32)
+	for h := int32(1); h <= 7; h++ {
+		want[h] = oldWant[h]
+	}
+	branch := make(map[util.Hash]int32)
+	prev = hash7
+	for h := int32(8); h <= 10; h++ {
+		b, hash := testBlock(prev, uint32(h*100))
+		want[h] = [3]uint32{1, appendToFile(t, blk1, b), uint32(h * 10)}
+		branch[hash] = h
+		prev = hash
+	}
+	indexBlocks(t, cfg.BlockDir, branch)
+	checkSwitch(7, 10)
+	checkOffsets(10)
+
+	// going back to the first branch once it's longer
+	b10, hash10 := testBlock(hash9, 10)
+	b11, hash11 := testBlock(hash10, 11)
+	for h := int32(8); h <= 9; h++ {
+		want[h] = oldWant[h]
+	}
+	want[10] = [3]uint32{1, appendToFile(t, blk1, b10), 100}
+	want[11] = [3]uint32{1, appendToFile(t, blk1, b11), 110}
+	indexBlocks(t, cfg.BlockDir, map[util.Hash]int32{hash10: 10, hash11: 11})
+	checkSwitch(7, 11)
+	checkOffsets(11)
+	check(11)
+}
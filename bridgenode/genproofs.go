@@ -62,6 +62,15 @@ buffer clears out.
 
 */
 
+// cowCheckpointInterval is how many blocks go by between CowForest
+// checkpoints.  After a crash, building proofs starts again from the last
+// one.
+const cowCheckpointInterval = 1000
+
+// cowCompactInterval is how often the CowForest compactor removes and
+// rewrites treeTables in the background
+const cowCompactInterval = time.Minute
+
 // build the bridge node / proofs
 func BuildProofs(cfg *Config, sig chan bool) error {
 	// Channel to alert the tell the main loop it's ok to exit
@@ -77,8 +86,15 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	// Handle user interruptions
 	go stopBuildProofs(cfg, sig, offsetFinished, haltRequest, haltAccept)
 
+	// blk and rev files, or bitcoind's JSON-RPC with -rpc
+	source, err := cfg.blockSource()
+	if err != nil {
+		return err
+	}
+
 	// Init forest and variables. Resumes if the data directory exists
-	forest, finishedHeight, err := InitBridgeNodeState(cfg, offsetFinished)
+	forest, finishedHeight, err := InitBridgeNodeState(
+		cfg, source, offsetFinished)
 	if err != nil {
 		err := fmt.Errorf("initialization error: %s.  If your .blk and .dat "+
 			"files are not in %s, specify alternate path with -datadir\n.",
@@ -87,6 +103,104 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	}
 
 	fmt.Printf("Starting forest: %s\n", forest.ToString())
+	metrics.setForest(forest, finishedHeight)
+
+	if cfg.forestType == cowForest {
+		err = forest.StartCompactor(cowCompactInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	progress := newFlatFileProgress(finishedHeight)
+	tip := &tipForest{forest: forest, height: finishedHeight}
+
+	// follow the tip from the last block in the offsetfile
+	var follower *tipFollower
+	if cfg.follow {
+		follower, err = newTipFollower(cfg, cfg.quitAfter)
+		if err != nil {
+			return err
+		}
+	}
+
+	// serve the blocks while they're built.  Stopping is up to
+	// stopBuildProofs, so the server doesn't get halted.
+	if cfg.follow && !cfg.noServe {
+		go blockServer(progress, cfg, source, nil, nil)
+		if cfg.apiPort != "" {
+			go apiServer(cfg, source, progress, tip)
+		}
+	}
+
+	fmt.Println("Building Proofs and ttls...")
+
+	// build until stopped, or when following the tip, until bitcoind
+	// switches branches.  Then roll back to the fork and build the new
+	// branch.
+	for {
+		var fork int32
+		var reorg bool
+		finishedHeight, fork, reorg, err = buildProofsRun(cfg, source,
+			tip, finishedHeight, progress, follower, haltRequest)
+		if err != nil {
+			return err
+		}
+		if !reorg {
+			break
+		}
+		// the api can't prove anything while the forest is rolled back
+		tip.mtx.Lock()
+		err = reorgBridge(cfg, forest, follower, progress,
+			finishedHeight, fork)
+		tip.height = fork
+		tip.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+		finishedHeight = fork
+	}
+
+	if cfg.forestType == cowForest {
+		usage, err := forest.CowDiskUsage()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("CowForest disk usage: %s", usage.String())
+	}
+
+	// the forest gets closed when it's saved
+	metrics.setForest(nil, finishedHeight)
+
+	// Save the current state so genproofs can be resumed
+	err = saveBridgeNodeData(forest, finishedHeight, cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Done writing. Height %d Forest: %s",
+		finishedHeight, forest.ToString())
+
+	// Tell stopBuildProofs that it's ok to exit
+	haltAccept <- true
+	return nil
+}
+
+// buildProofsRun runs the pipeline from the block after finishedHeight until
+// the reader stops, and gives back the height it got to.  If it stopped
+// because bitcoind switched branches, it also gives back the height of the
+// fork and true.
+func buildProofsRun(cfg *Config, source BlockSource,
+	tip *tipForest, finishedHeight int32,
+	progress *flatFileProgress, follower *tipFollower,
+	haltRequest chan bool) (int32, int32, bool, error) {
+
+	forest := tip.forest
+	roots, err := openRootsFile(cfg.UtreeDir.RootsDir, finishedHeight)
+	if err != nil {
+		return finishedHeight, 0, false, err
+	}
+	defer roots.close()
 
 	// BlockAndRevReader will push blocks into here
 	blockAndRevProofChan := make(chan blockAndRev, 10) // blocks for accumulator
@@ -95,24 +209,24 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	proofChan := make(chan btcacc.UData, 10)           // to flat writer
 	undoChan := make(chan accumulator.UndoBlock, 10)   // to undoblock writer
 	skipChan := make(chan allocNSkipTTL, 10)           // empty leaves for TTLs
+	reorgChan := make(chan int32, 1)                   // fork from the reader
 
 	fileWait := new(sync.WaitGroup)
 
-	// Reads block asynchronously from .dat files
+	// Reads block asynchronously from the source
 	// Reads util the lastIndexOffsetHeight
 
 	go BlockAndRevReader(
-		blockAndRevProofChan, blockAndRevTTLChan,
-		haltRequest, fileWait, cfg, finishedHeight)
+		blockAndRevProofChan, blockAndRevTTLChan, haltRequest, fileWait,
+		cfg, source, finishedHeight, follower, reorgChan)
 
-	go flatFileWorkerProof(proofChan, cfg.UtreeDir, fileWait)
-	go flatFileWorkerUndo(undoChan, cfg.UtreeDir, fileWait)
-	go flatFileWorkerTTL(ttlResultChan, skipChan, cfg.UtreeDir, fileWait)
+	go flatFileWorkerProof(proofChan, cfg.UtreeDir, fileWait, progress)
+	go flatFileWorkerUndo(undoChan, cfg.UtreeDir, fileWait, progress)
+	go flatFileWorkerTTL(
+		ttlResultChan, skipChan, cfg.UtreeDir, fileWait, progress)
 
 	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan, cfg.UtreeDir)
 
-	fmt.Println("Building Proofs and ttls...")
-
 	for {
 		// fmt.Printf("block on blockAndRevProofChan read?\n")
 		// Receive txs from the asynchronous blk*.dat reader
@@ -133,14 +247,14 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		// wants the skiplist to omit proofs
 		blockAdds, delLeaves, err := bnr.toAddDel()
 		if err != nil {
-			return err
+			return finishedHeight, 0, false, err
 		}
 
 		// use the accumulator to get inclusion proofs, and produce a block
 		// proof with all data needed to verify the block
 		ud, err := btcacc.GenUData(delLeaves, forest, bnr.Height)
 		if err != nil {
-			return err
+			return finishedHeight, 0, false, err
 		}
 		// We don't know the TTL values, but know how many spots to allocate
 		ud.TxoTTLs = make([]int32, bnr.outCount)
@@ -149,9 +263,17 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		// send proof udata to channel to be written to disk
 		proofChan <- ud
 
+		tip.mtx.Lock()
 		undoblock, err := forest.Modify(blockAdds, ud.AccProof.Targets)
+		tip.height = bnr.Height
+		tip.mtx.Unlock()
 		if err != nil {
-			return err
+			return finishedHeight, 0, false, err
+		}
+		err = roots.write(
+			bnr.Height, forest.Stats().NumLeaves, forest.GetRoots())
+		if err != nil {
+			return finishedHeight, 0, false, err
 		}
 		undoblock.Height = bnr.Height // set undoBlocks Height
 		// send undoBlock data to undo channel to be written to the disk
@@ -159,28 +281,38 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		undoChan <- *undoblock
 
 		finishedHeight = bnr.Height
+		metrics.setHeight(finishedHeight)
 		if finishedHeight%1000 == 0 {
 			fmt.Printf("Finished block %d of max %d\n",
 				finishedHeight, cfg.quitAfter)
 		}
 
+		// the flat files have to be written up to the checkpoint so that
+		// they can be rolled back to it
+		if cfg.forestType == cowForest &&
+			finishedHeight%cowCheckpointInterval == 0 {
+			progress.wait(finishedHeight)
+			err = forest.Checkpoint(finishedHeight)
+			if err != nil {
+				return finishedHeight, 0, false, err
+			}
+		}
+
 	}
 
-	// Wait for the file workers to finish
+	// Wait for the file workers to finish, then let them go
 	fileWait.Wait()
+	close(proofChan)
+	close(undoChan)
+	close(skipChan)
 
-	// Save the current state so genproofs can be resumed
-	err = saveBridgeNodeData(forest, finishedHeight, cfg)
-	if err != nil {
-		panic(err)
+	// the reader sends the fork before it closes its channels
+	select {
+	case fork := <-reorgChan:
+		return finishedHeight, fork, true, nil
+	default:
+		return finishedHeight, 0, false, nil
 	}
-
-	fmt.Printf("Done writing. Height %d Forest: %s",
-		finishedHeight, forest.ToString())
-
-	// Tell stopBuildProofs that it's ok to exit
-	haltAccept <- true
-	return nil
 }
 
 // stopBuildProofs listens for the signal from the OS and initiates an exit sequence
@@ -0,0 +1,7 @@
+package bridgenode
+
+import "testing"
+
+func BenchmarkBuildProofs_Mmap(b *testing.B) {
+	benchmarkBuildProofs(Config{forestType: mmapForest}, b)
+}
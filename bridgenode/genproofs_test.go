@@ -0,0 +1,231 @@
+package bridgenode
+
+import (
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// To run the BuildProofs benchmarks on real blocks instead of a simulated
+// chain, point them at bitcoind's blocks and at a bridgenode data directory
+// whose offsetdata was built from them:
+//
+//	go test -run - -bench BuildProofs ./bridgenode -args \
+//		-benchblocks=$HOME/.bitcoin/testnet3/blocks \
+//		-benchutreedir=$HOME/utreexo/testnet3 -benchheight=200000
+var (
+	benchBlockDir = flag.String("benchblocks", "",
+		"bitcoind blocks directory for the BuildProofs benchmarks")
+	benchUtreeDir = flag.String("benchutreedir", "",
+		"bridgenode data directory with the offsets of -benchblocks")
+	benchHeight = flag.Int("benchheight", 2000,
+		"how many blocks the BuildProofs benchmarks build")
+)
+
+// simChainSource is a BlockSource of simulated blocks with rev data.  Each
+// block has a coinbase and transactions spending random earlier outputs.
+type simChainSource struct {
+	memSource
+	revs []RevBlock
+}
+
+func (s *simChainSource) Blocks(height, count int32) (
+	[]wire.MsgBlock, []RevBlock, error) {
+
+	blocks, _, err := s.memSource.Blocks(height, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blocks, s.revs[height-1 : height-1+count], nil
+}
+
+// newSimChainSource makes a chain of blocks, each with a coinbase and up to
+// txsPerBlock transactions that spend 1 or 2 earlier outputs into 2 new ones
+func newSimChainSource(blocks, txsPerBlock int) *simChainSource {
+	type unspent struct {
+		op       wire.OutPoint
+		height   int32
+		coinbase bool
+		out      *wire.TxOut
+	}
+	rnd := rand.New(rand.NewSource(1))
+	var utxos []unspent
+	s := new(simChainSource)
+	prev := *chaincfg.RegressionNetParams.GenesisHash
+	for h := int32(1); h <= int32(blocks); h++ {
+		blk := coinbaseBlock(prev, byte(h))
+		// coinbaseBlock only has a byte of height, so make the coinbase
+		// txid unique
+		blk.Transactions[0].TxIn[0].SignatureScript = []byte{
+			4, byte(h), byte(h >> 8), byte(h >> 16), byte(h >> 24)}
+		var rev RevBlock
+		var created []unspent
+		for i := 0; i < txsPerBlock && len(utxos) > 2; i++ {
+			tx := wire.NewMsgTx(1)
+			var undo TxUndo
+			for j := 0; j < 1+rnd.Intn(2); j++ {
+				k := rnd.Intn(len(utxos))
+				spent := utxos[k]
+				utxos[k] = utxos[len(utxos)-1]
+				utxos = utxos[:len(utxos)-1]
+				tx.AddTxIn(wire.NewTxIn(&spent.op, nil, nil))
+				undo.TxIn = append(undo.TxIn, &TxInUndo{
+					Height:   spent.height,
+					PKScript: spent.out.PkScript,
+					Amount:   spent.out.Value,
+					Coinbase: spent.coinbase,
+				})
+			}
+			for j := 0; j < 2; j++ {
+				script := make([]byte, 22)
+				script[0], script[1] = 0x00, 0x14
+				rnd.Read(script[2:])
+				tx.AddTxOut(wire.NewTxOut(int64(1000+rnd.Intn(1e8)), script))
+			}
+			blk.AddTransaction(tx)
+			rev.Txs = append(rev.Txs, &undo)
+		}
+		for i, tx := range blk.Transactions {
+			txid := tx.TxHash()
+			for j, out := range tx.TxOut {
+				created = append(created, unspent{
+					op:       wire.OutPoint{Hash: txid, Index: uint32(j)},
+					height:   h,
+					coinbase: i == 0,
+					out:      out,
+				})
+			}
+		}
+		utxos = append(utxos, created...)
+		s.memSource = append(s.memSource, blk)
+		s.revs = append(s.revs, rev)
+		prev = blk.BlockHash()
+	}
+	return s
+}
+
+// benchmarkBuildProofs times what BuildProofs does for each block, making
+// the udata and modifying the forest, on a forest made from forestCfg.  The
+// blocks are read before the timer starts.
+func benchmarkBuildProofs(forestCfg Config, b *testing.B) {
+	var source BlockSource
+	if *benchBlockDir != "" {
+		source = newFlatFileSource(&Config{
+			BlockDir: *benchBlockDir,
+			UtreeDir: initUtreeDir(*benchUtreeDir),
+		})
+	} else {
+		source = newSimChainSource(*benchHeight, 20)
+	}
+	count := int32(*benchHeight)
+	var bnrs []blockAndRev
+	for height := int32(1); height <= count; {
+		blocks, revs, err := source.Blocks(height, count-height+1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := range blocks {
+			bnr := blockAndRev{
+				Height: height,
+				Blk:    btcutil.NewBlock(&blocks[i]),
+				Rev:    revs[i],
+			}
+			bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+				util.DedupeBlock(bnr.Blk)
+			bnrs = append(bnrs, bnr)
+			height++
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "benchbuildproofs")
+		if err != nil {
+			b.Fatal(err)
+		}
+		cfg := forestCfg
+		cfg.UtreeDir = initUtreeDir(dir)
+		err = makePaths(cfg.UtreeDir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		forest, err := createForest(&cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if cfg.setCowCompression {
+			err = forest.SetCowCompression(cfg.cowCompression)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		for _, bnr := range bnrs {
+			blockAdds, delLeaves, err := bnr.toAddDel()
+			if err != nil {
+				b.Fatal(err)
+			}
+			ud, err := btcacc.GenUData(delLeaves, forest, bnr.Height)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = forest.Modify(blockAdds, ud.AccProof.Targets)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		if cfg.forestType == cowForest {
+			err = forest.Checkpoint(count)
+			if err != nil {
+				b.Fatal(err)
+			}
+			usage, err := forest.CowDiskUsage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Logf("%s: %d blocks, %d treeTables %d bytes",
+				cfg.cowCompression.String(), count,
+				usage.LiveTables, usage.LiveBytes)
+		}
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBuildProofs_Ram(b *testing.B) {
+	benchmarkBuildProofs(Config{forestType: ramForest}, b)
+}
+
+func BenchmarkBuildProofs_Disk(b *testing.B) {
+	benchmarkBuildProofs(Config{forestType: diskForest}, b)
+}
+
+func BenchmarkBuildProofs_Cache(b *testing.B) {
+	benchmarkBuildProofs(Config{forestType: cacheForest}, b)
+}
+
+func BenchmarkBuildProofs_Cow(b *testing.B) {
+	benchmarkBuildProofs(Config{forestType: cowForest, cowMaxCache: 4000}, b)
+}
+
+func BenchmarkBuildProofs_CowSnappy(b *testing.B) {
+	benchmarkBuildProofs(Config{
+		forestType:        cowForest,
+		cowMaxCache:       4000,
+		setCowCompression: true,
+		cowCompression:    accumulator.SnappyCompression,
+	}, b)
+}
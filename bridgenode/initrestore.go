@@ -13,8 +13,8 @@ import (
 // If a chain state is not present, chain is initialized to the genesis
 // returns forest, height, lastIndexOffsetHeight, pOffset and error
 func InitBridgeNodeState(
-	cfg *Config, offsetFinished chan bool) (forest *accumulator.Forest,
-	height int32, err error) {
+	cfg *Config, source BlockSource, offsetFinished chan bool) (
+	forest *accumulator.Forest, height int32, err error) {
 
 	// Default behavior is that the user should delete all offsetdata
 	// if they have new blk*.dat files to sync
@@ -25,7 +25,16 @@ func InitBridgeNodeState(
 	// anew
 	// Check if the offsetfiles for both rev*.dat and blk*.dat are present
 	var knownTipHeight int32
-	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
+	if cfg.rpcAddr != "" {
+		// bitcoind finds the blocks, so there's no offsetfile
+		knownTipHeight, err = source.TipHeight()
+		if err != nil {
+			err = fmt.Errorf("getting the tip from bitcoind: %s", err.Error())
+			return
+		}
+		offsetFinished <- true
+		fmt.Printf("bitcoind tip height %d\n", knownTipHeight)
+	} else if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
 		knownTipHeight, err = restoreLastIndexOffsetHeight(
 			cfg.UtreeDir.OffsetDir, offsetFinished)
 		if err != nil {
@@ -46,6 +55,12 @@ func InitBridgeNodeState(
 	if checkForestExists(cfg) {
 		fmt.Println("Has access to forest, resuming")
 		forest, err = restoreForest(cfg)
+		if err == accumulator.ErrorUnsealedForest {
+			err = fmt.Errorf("restoreForest error: %s. Run with -audit "+
+				"-repair to check the forest and put them back",
+				err.Error())
+			return
+		}
 		if err != nil {
 			err = fmt.Errorf("restoreForest error: %s", err.Error())
 			return
@@ -55,6 +70,18 @@ func InitBridgeNodeState(
 			err = fmt.Errorf("restoreHeight error: %s", err.Error())
 			return
 		}
+		// a CowForest that wasn't closed is back at its last checkpoint, so
+		// the flat files go back there too
+		if cpHeight, ok := forest.CheckpointHeight(); ok && cpHeight != height {
+			fmt.Printf("forest is at checkpoint block %d, not %d\n",
+				cpHeight, height)
+			height = cpHeight
+			err = rollBackFlatFiles(cfg, height)
+			if err != nil {
+				err = fmt.Errorf("rollBackFlatFiles error: %s", err.Error())
+				return
+			}
+		}
 		fmt.Printf("restore height %d\n", height)
 	} else {
 		fmt.Println("Creating new forest")
@@ -66,10 +93,20 @@ func InitBridgeNodeState(
 			return
 		}
 	}
+	forest.SetHashWorkers(cfg.hashWorkers)
+	if cfg.setCowCompression {
+		err = forest.SetCowCompression(cfg.cowCompression)
+		if err != nil {
+			return
+		}
+	}
 
 	if cfg.quitAfter < 1 { // quitafter not assigned, go to tip
 		cfg.quitAfter = knownTipHeight
 	}
+	if cfg.follow { // the tip will move, so it's fine to be at it already
+		return
+	}
 	if cfg.quitAfter > knownTipHeight { // quit after too high, after the end
 		err = fmt.Errorf("Quitafter %d after known tip of %d",
 			cfg.quitAfter, knownTipHeight)
@@ -106,6 +143,11 @@ func saveBridgeNodeData(
 		if err != nil {
 			return err
 		}
+		// so the manifest committed on close has the height
+		err = forest.Checkpoint(height)
+		if err != nil {
+			return err
+		}
 	}
 
 	heightFile, err := os.OpenFile(
@@ -120,17 +162,19 @@ func saveBridgeNodeData(
 	}
 
 	// write other misc forest data
+	return writeMiscForestFile(forest, cfg)
+}
+
+// writeMiscForestFile writes the miscforestfile, which closes the forest
+func writeMiscForestFile(forest *accumulator.Forest, cfg *Config) error {
 	miscForestFile, err := os.OpenFile(
-		cfg.UtreeDir.ForestDir.miscForestFile, os.O_CREATE|os.O_RDWR, 0600)
+		cfg.UtreeDir.ForestDir.miscForestFile,
+		os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
 	if err != nil {
 		return err
 	}
-	err = forest.WriteMiscData(miscForestFile)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	defer miscForestFile.Close()
+	return forest.WriteMiscData(miscForestFile)
 }
 
 // createOffsetData restores the offsetfile needed to index the
@@ -166,11 +210,9 @@ func createForest(cfg *Config) (
 	switch cfg.forestType {
 	case ramForest:
 		forest = accumulator.NewForest(accumulator.RamForest, nil, "", 0)
-		return
 	case cowForest:
 		forest = accumulator.NewForest(accumulator.CowForest, nil,
 			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
-		return
 	default:
 		// Where the forestfile exists
 		forestFile, err := os.OpenFile(
@@ -180,13 +222,25 @@ func createForest(cfg *Config) (
 		}
 
 		// Restores all the forest data
-		if cfg.forestType == cacheForest {
+		switch cfg.forestType {
+		case cacheForest:
 			forest = accumulator.NewForest(accumulator.CacheForest, forestFile, "", 0)
-		} else {
+		case mmapForest:
+			forest = accumulator.NewForest(accumulator.MmapForest, forestFile, "", 0)
+		default:
 			forest = accumulator.NewForest(accumulator.DiskForest, forestFile, "", 0)
 		}
 	}
 
+	if cfg.diskPosMap {
+		var positionMap accumulator.PositionMap
+		positionMap, err = openPositionMap(cfg)
+		if err != nil {
+			return nil, err
+		}
+		err = forest.UsePositionMap(positionMap)
+	}
+
 	return
 }
 
@@ -195,6 +249,11 @@ func createForest(cfg *Config) (
 func restoreForest(cfg *Config) (
 	forest *accumulator.Forest, err error) {
 
+	positionMap, err := openPositionMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	switch cfg.forestType {
 	case cowForest:
 		var miscForestFile *os.File
@@ -205,19 +264,23 @@ func restoreForest(cfg *Config) (
 			return nil, err
 		}
 		forest, err = accumulator.RestoreForest(
-			miscForestFile, nil, false, false,
-			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
+			miscForestFile, nil, false, false, false,
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache,
+			positionMap, accumulator.DefaultHasher)
 
 	default:
 		var (
 			inRam bool
 			cache bool
+			mmap  bool
 		)
 		switch cfg.forestType {
 		case ramForest:
 			inRam = true
 		case cacheForest:
 			cache = true
+		case mmapForest:
+			mmap = true
 		}
 
 		var forestFile *os.File
@@ -236,13 +299,23 @@ func restoreForest(cfg *Config) (
 		}
 
 		forest, err = accumulator.RestoreForest(
-			miscForestFile, forestFile, inRam, cache, "", 0)
+			miscForestFile, forestFile, inRam, cache, mmap, "", 0,
+			positionMap, accumulator.DefaultHasher)
 
 	}
 
 	return
 }
 
+// openPositionMap opens the leveldb position map if -posmap=leveldb was
+// given.  Otherwise it returns nil, which keeps the position map in ram.
+func openPositionMap(cfg *Config) (accumulator.PositionMap, error) {
+	if !cfg.diskPosMap {
+		return nil, nil
+	}
+	return accumulator.NewLevelDBPositionMap(cfg.UtreeDir.ForestDir.posMapDir)
+}
+
 // restoreHeight restores height from util.ForestLastSyncedBlockHeightFileName
 func restoreHeight(cfg *Config) (height int32, err error) {
 	// if there is a heightfile, get the height from that
@@ -0,0 +1,131 @@
+package bridgenode
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// bridgeMetrics is what the bridgenode shows at /metrics on the pprof
+// server.  BuildProofs sets the forest once it's restored, and the height
+// after every block.
+type bridgeMetrics struct {
+	mtx    sync.Mutex
+	forest *accumulator.Forest
+	height int32
+}
+
+var metrics bridgeMetrics
+
+func (m *bridgeMetrics) setForest(forest *accumulator.Forest, height int32) {
+	m.mtx.Lock()
+	m.forest = forest
+	m.height = height
+	m.mtx.Unlock()
+}
+
+func (m *bridgeMetrics) setHeight(height int32) {
+	m.mtx.Lock()
+	m.height = height
+	m.mtx.Unlock()
+}
+
+// metrics gives back the height and the stats of the forest, if there is
+// one yet
+func (m *bridgeMetrics) metrics() []util.Metric {
+	m.mtx.Lock()
+	forest, height := m.forest, m.height
+	m.mtx.Unlock()
+
+	ms := []util.Metric{{
+		Name:  "utreexo_bridgenode_height",
+		Help:  "Height of the last block added to the forest.",
+		Value: float64(height),
+	}}
+	if forest == nil {
+		return ms
+	}
+	ms = append(ms, forestMetrics(forest.Stats())...)
+
+	usage, err := forest.CowDiskUsage()
+	if err == nil {
+		ms = append(ms, cowMetrics(usage)...)
+	}
+	return ms
+}
+
+// forestMetrics turns the forest stats into metrics
+func forestMetrics(s accumulator.ForestStats) []util.Metric {
+	return []util.Metric{
+		{Name: "utreexo_forest_leaves",
+			Help:  "Leaves in the forest.",
+			Value: float64(s.NumLeaves)},
+		{Name: "utreexo_forest_rows",
+			Help:  "Rows in the forest, not counting the leaves.",
+			Value: float64(s.Rows)},
+		{Name: "utreexo_forest_position_map_leaves",
+			Help:  "Leaves in the position map.",
+			Value: float64(s.PositionMapLength)},
+		{Name: "utreexo_forest_size_positions",
+			Help:  "Positions the forest has room for.",
+			Value: float64(s.Size)},
+		{Name: "utreexo_forest_hashes_total",
+			Help:    "Hashes the forest has computed.",
+			Counter: true, Value: float64(s.HashesEver)},
+		{Name: "utreexo_forest_hash_seconds_total",
+			Help:    "Time spent rehashing the forest.",
+			Counter: true, Value: s.TimeInHash.Seconds()},
+		{Name: "utreexo_forest_remove_seconds_total",
+			Help:    "Time spent removing leaves.",
+			Counter: true, Value: s.TimeRem.Seconds()},
+		{Name: "utreexo_forest_move_subtree_seconds_total",
+			Help:    "Time spent moving subtrees while removing leaves.",
+			Counter: true, Value: s.TimeMST.Seconds()},
+		{Name: "utreexo_forest_prove_seconds_total",
+			Help:    "Time spent making proofs.",
+			Counter: true, Value: s.TimeInProve.Seconds()},
+		{Name: "utreexo_forest_verify_seconds_total",
+			Help:    "Time spent verifying proofs.",
+			Counter: true, Value: s.TimeInVerify.Seconds()},
+	}
+}
+
+// cowMetrics turns the disk usage of a CowForest into metrics
+func cowMetrics(u *accumulator.CowDiskUsage) []util.Metric {
+	ms := []util.Metric{
+		{Name: "utreexo_cow_manifest_bytes",
+			Help:  "Size of the CowForest manifests.",
+			Value: float64(u.ManifestBytes)},
+		{Name: "utreexo_cow_compactor_removed_tables_total",
+			Help:    "treeTables the compactor removed.",
+			Counter: true, Value: float64(u.RemovedTables)},
+		{Name: "utreexo_cow_compactor_rewritten_tables_total",
+			Help:    "treeTables the compactor rewrote.",
+			Counter: true, Value: float64(u.RewrittenTables)},
+		{Name: "utreexo_cow_compactor_freed_bytes_total",
+			Help:    "Size of the treeTables the compactor removed.",
+			Counter: true, Value: float64(u.FreedBytes)},
+	}
+	for _, t := range []struct {
+		kind   string
+		tables int
+		bytes  int64
+	}{
+		{"all", u.TreeTables, u.Bytes},
+		{"live", u.LiveTables, u.LiveBytes},
+		{"stale", u.StaleTables, u.StaleBytes},
+	} {
+		ms = append(ms, util.Metric{
+			Name:  fmt.Sprintf("utreexo_cow_%s_tables", t.kind),
+			Help:  fmt.Sprintf("CowForest treeTables on disk (%s).", t.kind),
+			Value: float64(t.tables),
+		}, util.Metric{
+			Name:  fmt.Sprintf("utreexo_cow_%s_bytes", t.kind),
+			Help:  fmt.Sprintf("Size of the CowForest treeTables (%s).", t.kind),
+			Value: float64(t.bytes),
+		})
+	}
+	return ms
+}
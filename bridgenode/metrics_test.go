@@ -0,0 +1,59 @@
+package bridgenode
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	var m bridgeMetrics
+	handler := util.MetricsHandler(m.metrics)
+
+	// before there's a forest it's just the height
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != "# HELP utreexo_bridgenode_height Height of "+
+		"the last block added to the forest.\n"+
+		"# TYPE utreexo_bridgenode_height gauge\n"+
+		"utreexo_bridgenode_height 0\n" {
+
+		t.Fatalf("got metrics\n%s", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != util.PrometheusContentType {
+		t.Fatalf("content type %s", rec.Header().Get("Content-Type"))
+	}
+
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	adds := make([]accumulator.Leaf, 10)
+	for i := range adds {
+		adds[i].Hash[0] = byte(i + 1)
+	}
+	_, err := forest.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setForest(forest, 5)
+	m.setHeight(6)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"utreexo_bridgenode_height 6\n",
+		"# TYPE utreexo_forest_leaves gauge\nutreexo_forest_leaves 10\n",
+		"utreexo_forest_rows 4\n",
+		"utreexo_forest_position_map_leaves 10\n",
+		"# TYPE utreexo_forest_hashes_total counter\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("metrics don't have %q:\n%s", want, rec.Body.String())
+		}
+	}
+	// not a CowForest
+	if strings.Contains(rec.Body.String(), "utreexo_cow") {
+		t.Fatalf("ram forest has cow metrics:\n%s", rec.Body.String())
+	}
+}
@@ -65,9 +65,8 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 
 	defer offsetFile.Close()
 	for fileNum := 0; ; fileNum++ {
-		fileName := fmt.Sprintf("blk%05d.dat", fileNum)
-		filePath := filepath.Join(cfg.BlockDir, fileName)
-		fmt.Printf("Building offsetfile... %s\n", fileName)
+		filePath := blkFilePath(cfg.BlockDir, uint32(fileNum))
+		fmt.Printf("Building offsetfile... %s\n", filepath.Base(filePath))
 
 		_, err := os.Stat(filePath)
 		if os.IsNotExist(err) {
@@ -76,7 +75,7 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 		}
 		// grab headers from the .dat file as RawHeaderData type
 		rawheaders, err :=
-			readRawHeadersFromFile(bufReader, filePath, uint32(fileNum), bufDB)
+			readRawHeadersFromFile(bufReader, cfg.BlockDir, uint32(fileNum), bufDB)
 		if err != nil {
 			panic(err)
 		}
@@ -126,13 +125,13 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 	return lastOffsetHeight, nil
 }
 
-// readRawHeadersFromFile reads only the headers from the given .dat file
+// readRawHeadersFromFile reads only the headers from blk file fileNum
 func readRawHeadersFromFile(
-	bufReader *bufio.Reader, fileDir string,
+	bufReader *bufio.Reader, blockDir string,
 	fileNum uint32, bufMap map[[32]byte]uint32) ([]RawHeaderData, error) {
 	var blockHeaders []RawHeaderData
 
-	f, err := os.Open(fileDir)
+	f, err := openBlkFile(blockDir, fileNum)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,208 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+When following the tip, bitcoind can switch to a branch off of a block the
+bridgenode has already built past.  The blocks after that fork get rolled
+back, newest first, and then the new branch gets built like any other
+blocks:
+
+The ttls the blocks after the fork wrote into the blocks up to it are set
+back to zero, as the new branch can spend those outputs at other heights.
+They're found the same way they were written, from the blocks' rev data
+and the txid file.
+
+The forest undoes each block with the undo block written for it.
+
+The proof, undo, ttl, txid and roots flat files get cut back to the fork,
+and the follower puts the new branch in the offsetfile in place of the old
+one.
+
+The servers hold off reading blocks while all that happens.  Clients that
+got blocks after the fork get told they were disconnected.
+*/
+
+// reorgBridge rolls the forest and the flat files back from height to fork,
+// and puts the branch the follower found in the offsetfile.
+func reorgBridge(cfg *Config, forest *accumulator.Forest,
+	follower *tipFollower, progress *flatFileProgress,
+	height, fork int32) error {
+
+	fmt.Printf("bitcoind switched to a branch off of block %d, "+
+		"rolling back from %d\n", fork, height)
+
+	progress.startRollBack(fork)
+	defer progress.endRollBack()
+
+	err := clearTTLs(cfg, fork, height)
+	if err != nil {
+		return fmt.Errorf("reorg: clearing ttls: %s", err.Error())
+	}
+	err = undoForest(cfg.UtreeDir.UndoDir, forest, fork, height)
+	if err != nil {
+		return fmt.Errorf("reorg: %s", err.Error())
+	}
+	err = rollBackFlatFiles(cfg, fork)
+	if err != nil {
+		return fmt.Errorf("reorg: %s", err.Error())
+	}
+
+	// a checkpoint after the fork would be on the old branch
+	if cfg.forestType == cowForest {
+		err = forest.Checkpoint(fork)
+		if err != nil {
+			return err
+		}
+	}
+	metrics.setHeight(fork)
+
+	newHeight, err := follower.switchBranch()
+	if err != nil {
+		return fmt.Errorf("reorg: %s", err.Error())
+	}
+	fmt.Printf("building the new branch, blocks %d to %d\n",
+		fork+1, newHeight)
+	return nil
+}
+
+// undoForest undoes the blocks after fork, up to height, from the undo
+// file.  The forest has to be at height.
+func undoForest(undoDir undoDir, forest *accumulator.Forest,
+	fork, height int32) error {
+
+	for h := height; h > fork; h-- {
+		ub, err := readUndoBlock(undoDir, h)
+		if err != nil {
+			return err
+		}
+		err = forest.Undo(ub)
+		if err != nil {
+			return fmt.Errorf("undo block %d: %s", h, err.Error())
+		}
+	}
+	return nil
+}
+
+// readUndoBlock reads the undo block for height back from the undo file
+func readUndoBlock(undoDir undoDir, height int32) (
+	ub accumulator.UndoBlock, err error) {
+
+	start, ok, err := readOffset(undoDir.offsetFile, int64(height))
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("no undo block for block %d", height)
+		return
+	}
+
+	undoFile, err := os.Open(undoDir.undoFile)
+	if err != nil {
+		return
+	}
+	defer undoFile.Close()
+
+	var head [8]byte
+	_, err = undoFile.ReadAt(head[:], start)
+	if err != nil {
+		err = fmt.Errorf("undo block %d: %s", height, err.Error())
+		return
+	}
+	if !bytes.Equal(head[:4], []byte{0xaa, 0xff, 0xaa, 0xff}) {
+		err = fmt.Errorf("undo block %d: bad magic %x at %d",
+			height, head[:4], start)
+		return
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(head[4:]))
+	_, err = undoFile.ReadAt(buf, start+8)
+	if err != nil {
+		err = fmt.Errorf("undo block %d: %s", height, err.Error())
+		return
+	}
+
+	err = ub.Deserialize(bytes.NewReader(buf))
+	if err != nil {
+		err = fmt.Errorf("undo block %d: %s", height, err.Error())
+		return
+	}
+	// the height isn't written
+	ub.Height = height
+	return
+}
+
+// clearTTLs zeroes the ttls that the blocks after fork, up to height, wrote
+// into the blocks up to fork.  The blocks have to still be in the offsetfile
+// and the txid file.  It reads the blk files, as -follow can't be used with
+// -rpc.
+func clearTTLs(cfg *Config, fork, height int32) error {
+	source := newFlatFileSource(cfg)
+	txidFile, err := os.Open(cfg.UtreeDir.TtlDir.txidFile)
+	if err != nil {
+		return err
+	}
+	defer txidFile.Close()
+	txidOffsetFile, err := os.Open(cfg.UtreeDir.TtlDir.txidOffsetFile)
+	if err != nil {
+		return err
+	}
+	defer txidOffsetFile.Close()
+	ttlFile, err := os.OpenFile(cfg.UtreeDir.TtlDir.ttlsetFile, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer ttlFile.Close()
+
+	// where the ttls of each block start
+	starts := make(map[int32]int64)
+	var empty [4]byte
+	for h := fork + 1; h <= height; h++ {
+		blocks, revs, err := source.Blocks(h, 1)
+		if err != nil {
+			return err
+		}
+		bnr := blockAndRev{
+			Height: h,
+			Blk:    btcutil.NewBlock(&blocks[0]),
+			Rev:    revs[0],
+		}
+		bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+			util.DedupeBlock(bnr.Blk)
+		_, lub := bnr.splitTTL()
+
+		for _, res := range lookupTTLs(lub, txidFile, txidOffsetFile).results {
+			// the ttls of blocks after the fork get cut off anyway
+			if res.createHeight > fork {
+				continue
+			}
+			start, ok := starts[res.createHeight]
+			if !ok {
+				// block h's ttls start where block h-1's end
+				start, ok, err = readOffset(cfg.UtreeDir.TtlDir.OffsetFile,
+					int64(res.createHeight-1))
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("no ttls for block %d", res.createHeight)
+				}
+				starts[res.createHeight] = start
+			}
+			_, err = ttlFile.WriteAt(
+				empty[:], start+int64(res.indexWithinBlock)*4)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestUndoForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgereorg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	undoChan := make(chan accumulator.UndoBlock, 10)
+	fileWait := new(sync.WaitGroup)
+	progress := newFlatFileProgress(0)
+	go flatFileWorkerUndo(undoChan, utreeDir, fileWait, progress)
+
+	// 5 blocks adding 8 leaves each and deleting a couple, keeping the roots
+	// after each one
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	roots := [][]accumulator.Hash{forest.GetRoots()}
+	var next byte
+	for h := int32(1); h <= 5; h++ {
+		adds := make([]accumulator.Leaf, 8)
+		for i := range adds {
+			next++
+			adds[i].Hash[0] = next
+			adds[i].Hash[1] = byte(h)
+		}
+		var dels []uint64
+		if h > 1 {
+			dels = []uint64{1, uint64(h)}
+		}
+		ub, err := forest.Modify(adds, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub.Height = h
+		fileWait.Add(1)
+		undoChan <- *ub
+		roots = append(roots, forest.GetRoots())
+	}
+	fileWait.Wait()
+	close(undoChan)
+
+	ub, err := readUndoBlock(utreeDir.UndoDir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ub.Height != 4 {
+		t.Fatalf("read undo block for %d, expected 4", ub.Height)
+	}
+
+	err = undoForest(utreeDir.UndoDir, forest, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(forest.GetRoots(), roots[2]) {
+		t.Fatalf("roots after undoing to block 2 %x, expected %x",
+			forest.GetRoots(), roots[2])
+	}
+
+	_, err = readUndoBlock(utreeDir.UndoDir, 6)
+	if err == nil {
+		t.Fatal("read an undo block for block 6")
+	}
+}
+
+func TestFlatFileProgressForks(t *testing.T) {
+	p := newFlatFileProgress(10)
+	if n := p.readLock(10); n != 0 {
+		t.Fatalf("%d roll backs, expected none", n)
+	}
+	p.readUnlock()
+
+	p.startRollBack(7)
+	p.endRollBack()
+	if h := p.height(); h != 7 {
+		t.Fatalf("height %d after rolling back to 7", h)
+	}
+	p.startRollBack(8)
+	p.endRollBack()
+	for w := 0; w < numFlatFileWorkers; w++ {
+		p.done(w, 10)
+	}
+
+	if n := p.readLock(10); n != 2 {
+		t.Fatalf("%d roll backs, expected 2", n)
+	}
+	p.readUnlock()
+	fork, ok := p.forksSince(0)
+	if !ok || fork != 7 {
+		t.Fatalf("lowest fork %d %v, expected 7", fork, ok)
+	}
+	fork, ok = p.forksSince(1)
+	if !ok || fork != 8 {
+		t.Fatalf("lowest fork after the first %d %v, expected 8", fork, ok)
+	}
+	_, ok = p.forksSince(2)
+	if ok {
+		t.Fatal("fork after the last roll back")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/mit-dci/utreexo/util"
 
@@ -47,33 +48,58 @@ type RawHeaderData struct {
 	UndoPos uint32
 }
 
-// BlockAndRevReader is a wrapper around GetRawBlockFromFile so that the process
+// BlockAndRevReader is a wrapper around a BlockSource so that the process
 // can be made into a goroutine. As long as it's running, it keeps sending
 // the entire blocktxs and height to bchan with TxToWrite type.
 // It also puts in the proofs.  This will run on the archive server, and the
 // data will be sent over the network to the CSN.
+// With a follower, it keeps reading blocks as they're added to the
+// offsetfile.  If bitcoind switches to a branch off of an earlier block, it
+// sends that block's height to reorgChan and stops.
 func BlockAndRevReader(
 	aChan, bChan chan blockAndRev, haltRequest chan bool, wg *sync.WaitGroup,
-	cfg *Config, finishedHeight int32) {
+	cfg *Config, source BlockSource, finishedHeight int32,
+	follower *tipFollower, reorgChan chan int32) {
 
 	// finishedHeight is the height we're finsihed reading & sending out.
 
-	var offsetFilePath = cfg.UtreeDir.OffsetDir.OffsetFile
 	stop := false
-	offsetFile, err := os.Open(offsetFilePath)
-	if err != nil {
-		panic(err)
+
+	// endHeight is the last block in the offsetfile.  When following the
+	// tip, the follower adds the blocks bitcoind writes to the offsetfile
+	// and it goes up.
+	endHeight := cfg.quitAfter
+	if follower != nil {
+		endHeight = follower.height
 	}
-	defer offsetFile.Close() // file always closes
 
-	for finishedHeight < cfg.quitAfter && !stop {
+	for !stop {
+		if finishedHeight >= endHeight {
+			if follower == nil {
+				break
+			}
+			select {
+			case stop = <-haltRequest: // receives true from stopBuildProofs()
+				continue
+			case <-time.After(followPollInterval):
+			}
+			height, reorg, err := follower.extend()
+			if err != nil {
+				// bitcoind might be in the middle of writing; try again
+				fmt.Printf("following the tip: %s\n", err.Error())
+			}
+			if reorg {
+				reorgChan <- height
+				break
+			}
+			endHeight = height
+			continue
+		}
 		blocksToRead := int32(1000)
-		if finishedHeight+blocksToRead >= cfg.quitAfter {
-			blocksToRead = cfg.quitAfter - finishedHeight
+		if finishedHeight+blocksToRead >= endHeight {
+			blocksToRead = endHeight - finishedHeight
 		}
-		blocks, revs, err :=
-			GetRawBlocksFromDisk(
-				finishedHeight+1, blocksToRead, offsetFile, cfg.BlockDir)
+		blocks, revs, err := source.Blocks(finishedHeight+1, blocksToRead)
 		if err != nil {
 			fmt.Printf(err.Error())
 			// close(blockChan)
@@ -158,8 +184,7 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	blockFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("blk%05d.dat", datFileNum)))
+	blockFile, err := openBlkFile(blockDir, datFileNum)
 	if err != nil {
 		return
 	}
@@ -173,8 +198,7 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	revFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("rev%05d.dat", datFileNum)))
+	revFile, err := openRevFile(blockDir, datFileNum)
 	if err != nil {
 		return
 	}
@@ -281,9 +305,7 @@ func GetBlockBytesFromFile(
 	}
 	// fmt.Printf("block %d in file %d offset %d\n", height+1, datFile, offset)
 
-	blockFName := fmt.Sprintf("blk%05d.dat", datFile)
-	bDir := filepath.Join(blockDir, blockFName)
-	blockFile, err := os.Open(bDir)
+	blockFile, err := openBlkFile(blockDir, datFile)
 	if err != nil {
 		return
 	}
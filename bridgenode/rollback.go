@@ -0,0 +1,163 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+If the bridgenode stops without saving, the flat files can be ahead of the
+forest, which can only roll back to its last checkpoint.  rollBackFlatFiles
+cuts them back to the checkpoint height so that building proofs can start
+again from there.
+
+The proof and undo offset files have the start of each block's data at
+8*height, with 0 for block 0.  Each block's data starts with 4 magic bytes
+and its 4 byte size.  The ttl offset file has the end of each block's ttls
+at 8*height.  The txid offset file has the start of each block's txids at
+8*(height-1), counted in 8 byte miniTxids.
+
+The ttls of blocks before the checkpoint which were written by blocks after
+it are left; the same ttls get written again as the blocks are built
+again.
+*/
+
+// rollBackFlatFiles cuts the proof, undo, ttl, txid and roots flat files,
+// and the hashes of the blocks read with -rpc, back to height.  It's an
+// error if they don't all go up to height, other than the roots and hash
+// files.
+func rollBackFlatFiles(cfg *Config, height int32) error {
+	err := rollBackBlockFile(cfg.UtreeDir.ProofDir.pOffsetFile,
+		cfg.UtreeDir.ProofDir.pFile, height)
+	if err != nil {
+		return fmt.Errorf("proof file: %s", err.Error())
+	}
+	err = rollBackBlockFile(cfg.UtreeDir.UndoDir.offsetFile,
+		cfg.UtreeDir.UndoDir.undoFile, height)
+	if err != nil {
+		return fmt.Errorf("undo file: %s", err.Error())
+	}
+
+	// the ttl offset after block height is the end of its ttls
+	ttlEnd, ok, err := readOffset(cfg.UtreeDir.TtlDir.OffsetFile, int64(height))
+	if err != nil {
+		return fmt.Errorf("ttl file: %s", err.Error())
+	}
+	if !ok {
+		return fmt.Errorf("ttl file doesn't go up to block %d", height)
+	}
+	err = truncateIfLonger(cfg.UtreeDir.TtlDir.OffsetFile, int64(height+1)*8)
+	if err != nil {
+		return err
+	}
+	err = truncateIfLonger(cfg.UtreeDir.TtlDir.ttlsetFile, ttlEnd)
+	if err != nil {
+		return err
+	}
+
+	// the txid offset of block height+1, if there is one, is where block
+	// height's txids end
+	txidEnd, ok, err := readOffset(
+		cfg.UtreeDir.TtlDir.txidOffsetFile, int64(height))
+	if err != nil {
+		return fmt.Errorf("txid file: %s", err.Error())
+	}
+	if ok {
+		err = truncateIfLonger(cfg.UtreeDir.TtlDir.txidOffsetFile,
+			int64(height)*8)
+		if err != nil {
+			return err
+		}
+		err = truncateIfLonger(cfg.UtreeDir.TtlDir.txidFile, txidEnd*8)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rollBackRootsFile(cfg.UtreeDir.RootsDir, height)
+	if err != nil {
+		return fmt.Errorf("roots file: %s", err.Error())
+	}
+
+	// with -rpc the blocks after height get read from bitcoind's best chain
+	// again
+	if util.HasAccess(cfg.UtreeDir.OffsetDir.rpcHashFile) {
+		err = truncateIfLonger(cfg.UtreeDir.OffsetDir.rpcHashFile,
+			int64(height+1)*chainhash.HashSize)
+		if err != nil {
+			return fmt.Errorf("rpc hash file: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// rollBackBlockFile cuts a proof or undo file and its offset file back to
+// height
+func rollBackBlockFile(offsetFile, dataFile string, height int32) error {
+	start, ok, err := readOffset(offsetFile, int64(height))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("doesn't go up to block %d", height)
+	}
+
+	// there is no block 0
+	var end int64
+	if height > 0 {
+		f, err := os.Open(dataFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var size [4]byte
+		_, err = f.ReadAt(size[:], start+4)
+		if err != nil {
+			return fmt.Errorf("block %d size: %s", height, err.Error())
+		}
+		end = start + 8 + int64(binary.BigEndian.Uint32(size[:]))
+	}
+
+	err = truncateIfLonger(offsetFile, int64(height+1)*8)
+	if err != nil {
+		return err
+	}
+	return truncateIfLonger(dataFile, end)
+}
+
+// readOffset reads the 8 byte offset at index i of an offset file.  It
+// returns false if the file doesn't go that far.
+func readOffset(offsetFile string, i int64) (int64, bool, error) {
+	f, err := os.Open(offsetFile)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	var buf [8]byte
+	n, err := f.ReadAt(buf[:], i*8)
+	if n != 8 {
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		return 0, false, nil
+	}
+	return int64(binary.BigEndian.Uint64(buf[:])), true, nil
+}
+
+// truncateIfLonger cuts the file down to size if it's longer than that
+func truncateIfLonger(fName string, size int64) error {
+	info, err := os.Stat(fName)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= size {
+		return nil
+	}
+	return os.Truncate(fName, size)
+}
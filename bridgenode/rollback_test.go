@@ -0,0 +1,105 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRollBackFlatFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgerollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{UtreeDir: initUtreeDir(dir)}
+	err = makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 blocks, block h has h*10 bytes of proof and undo data, h*4 bytes of
+	// ttls and h txids
+	var blockFile, ttls, txids []byte
+	blockOffsets := make([]byte, 8)
+	ttlOffsets := make([]byte, 8)
+	var txidOffsets []byte
+	blockEnds := []int64{0}
+	for h := 1; h <= 5; h++ {
+		blockOffsets = appendOffset(blockOffsets, int64(len(blockFile)))
+		blockFile = append(blockFile, 0xaa, 0xff, 0xaa, 0xff)
+		blockFile = append(blockFile, 0, 0, 0, byte(h*10))
+		blockFile = append(blockFile, make([]byte, h*10)...)
+		blockEnds = append(blockEnds, int64(len(blockFile)))
+
+		ttls = append(ttls, make([]byte, h*4)...)
+		ttlOffsets = appendOffset(ttlOffsets, int64(len(ttls)))
+
+		txidOffsets = appendOffset(txidOffsets, int64(len(txids)/8))
+		txids = append(txids, make([]byte, h*8)...)
+	}
+
+	files := map[string][]byte{
+		cfg.UtreeDir.ProofDir.pFile:        blockFile,
+		cfg.UtreeDir.ProofDir.pOffsetFile:  blockOffsets,
+		cfg.UtreeDir.UndoDir.undoFile:      blockFile,
+		cfg.UtreeDir.UndoDir.offsetFile:    blockOffsets,
+		cfg.UtreeDir.TtlDir.ttlsetFile:     ttls,
+		cfg.UtreeDir.TtlDir.OffsetFile:     ttlOffsets,
+		cfg.UtreeDir.TtlDir.txidFile:       txids,
+		cfg.UtreeDir.TtlDir.txidOffsetFile: txidOffsets,
+		// the hashes of blocks 0 to 5 read with -rpc
+		cfg.UtreeDir.OffsetDir.rpcHashFile: make([]byte, 6*32),
+	}
+	for name, buf := range files {
+		err = ioutil.WriteFile(name, buf, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = rollBackFlatFiles(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rolling back to the same height again changes nothing
+	err = rollBackFlatFiles(cfg, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSizes := map[string]int64{
+		cfg.UtreeDir.ProofDir.pFile:        blockEnds[3],
+		cfg.UtreeDir.ProofDir.pOffsetFile:  4 * 8,
+		cfg.UtreeDir.UndoDir.undoFile:      blockEnds[3],
+		cfg.UtreeDir.UndoDir.offsetFile:    4 * 8,
+		cfg.UtreeDir.TtlDir.ttlsetFile:     (1 + 2 + 3) * 4,
+		cfg.UtreeDir.TtlDir.OffsetFile:     4 * 8,
+		cfg.UtreeDir.TtlDir.txidFile:       (1 + 2 + 3) * 8,
+		cfg.UtreeDir.TtlDir.txidOffsetFile: 3 * 8,
+		cfg.UtreeDir.OffsetDir.rpcHashFile: 4 * 32,
+	}
+	for name, want := range wantSizes {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != want {
+			t.Fatalf("%s is %d bytes after roll back, expected %d",
+				name, info.Size(), want)
+		}
+	}
+
+	err = rollBackFlatFiles(cfg, 4)
+	if err == nil {
+		t.Fatal("rolled back to block 4 after cutting the files to 3")
+	}
+}
+
+func appendOffset(buf []byte, offset int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(offset))
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,180 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+The roots file has the number of leaves and the roots of the forest after
+each block, so that they can be given out for any height and not just the
+tip.  It's laid out like the undo file: the offset file has where block h's
+roots start at 8*h, and each block's roots are 4 magic bytes and a 4 byte
+size, then the 8 byte number of leaves and the roots.
+
+Bridges that built blocks before there was a roots file start it at the
+height they're at.  The offsets of the blocks before that are all 0xff
+bytes, which is noRoots.
+*/
+
+// noRoots is the offset of blocks whose roots weren't saved
+const noRoots = -1
+
+// rootsFile writes the roots after each block as it's built
+type rootsFile struct {
+	offsetFile, rootsFile *os.File
+	currentOffset         int64
+}
+
+// openRootsFile opens the roots file to write the blocks after height.
+// If it has roots for blocks after height, they're cut off.
+func openRootsFile(dir rootsDir, height int32) (*rootsFile, error) {
+	err := rollBackRootsFile(dir, height)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := new(rootsFile)
+	rf.offsetFile, err = os.OpenFile(
+		dir.offsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rf.rootsFile, err = os.OpenFile(
+		dir.rootsFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		rf.offsetFile.Close()
+		return nil, err
+	}
+
+	rf.currentOffset, err = rf.rootsFile.Seek(0, 2)
+	if err != nil {
+		rf.close()
+		return nil, err
+	}
+
+	// mark the blocks up to height that don't have roots
+	offsetSize, err := rf.offsetFile.Seek(0, 2)
+	if err != nil {
+		rf.close()
+		return nil, err
+	}
+	missing := int64(height+1)*8 - offsetSize
+	if missing > 0 {
+		_, err = rf.offsetFile.Write(
+			bytes.Repeat([]byte{0xff}, int(missing)))
+		if err != nil {
+			rf.close()
+			return nil, err
+		}
+	}
+	return rf, nil
+}
+
+// write writes the roots after block height
+func (rf *rootsFile) write(
+	height int32, numLeaves uint64, roots []accumulator.Hash) error {
+
+	buf := make([]byte, 8+8+32*len(roots))
+	copy(buf, []byte{0xaa, 0xff, 0xaa, 0xff})
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+	binary.BigEndian.PutUint64(buf[8:], numLeaves)
+	for i, root := range roots {
+		copy(buf[16+32*i:], root[:])
+	}
+	_, err := rf.rootsFile.WriteAt(buf, rf.currentOffset)
+	if err != nil {
+		return err
+	}
+
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(rf.currentOffset))
+	_, err = rf.offsetFile.WriteAt(offset[:], int64(height)*8)
+	if err != nil {
+		return err
+	}
+	rf.currentOffset += int64(len(buf))
+	return nil
+}
+
+func (rf *rootsFile) close() {
+	rf.offsetFile.Close()
+	rf.rootsFile.Close()
+}
+
+// readRoots reads the number of leaves and the roots after block height
+func readRoots(dir rootsDir, height int32) (
+	numLeaves uint64, roots []accumulator.Hash, err error) {
+
+	start, ok, err := readOffset(dir.offsetFile, int64(height))
+	if err != nil {
+		return
+	}
+	if !ok || start == noRoots {
+		err = fmt.Errorf("no roots saved for block %d", height)
+		return
+	}
+
+	f, err := os.Open(dir.rootsFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var head [16]byte
+	_, err = f.ReadAt(head[:], start)
+	if err != nil {
+		err = fmt.Errorf("roots for block %d: %s", height, err.Error())
+		return
+	}
+	if !bytes.Equal(head[:4], []byte{0xaa, 0xff, 0xaa, 0xff}) {
+		err = fmt.Errorf("roots for block %d: bad magic %x at %d",
+			height, head[:4], start)
+		return
+	}
+	numLeaves = binary.BigEndian.Uint64(head[8:])
+
+	// the size counts the number of leaves too
+	buf := make([]byte, binary.BigEndian.Uint32(head[4:])-8)
+	_, err = f.ReadAt(buf, start+16)
+	if err != nil {
+		err = fmt.Errorf("roots for block %d: %s", height, err.Error())
+		return
+	}
+	roots = make([]accumulator.Hash, len(buf)/32)
+	for i := range roots {
+		copy(roots[i][:], buf[i*32:])
+	}
+	return
+}
+
+// rollBackRootsFile cuts the roots file back to height.  Unlike the other
+// flat files it can start after block 0, so it doesn't have to go up to
+// height.
+func rollBackRootsFile(dir rootsDir, height int32) error {
+	if !util.HasAccess(dir.offsetFile) {
+		return nil
+	}
+	// where block height+1's roots start is where height's end.  If it
+	// doesn't have any, none of the blocks before it do either.
+	end, ok, err := readOffset(dir.offsetFile, int64(height)+1)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if end == noRoots {
+		end = 0
+	}
+	err = truncateIfLonger(dir.offsetFile, int64(height+1)*8)
+	if err != nil {
+		return err
+	}
+	return truncateIfLonger(dir.rootsFile, end)
+}
@@ -0,0 +1,83 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// TestRootsFile starts a roots file after block 2, cuts it back and writes
+// over the blocks it cut
+func TestRootsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgeroots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(from, to int32, b byte) {
+		t.Helper()
+		rf, err := openRootsFile(utreeDir.RootsDir, from-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rf.close()
+		for h := from; h <= to; h++ {
+			roots := make([]accumulator.Hash, h)
+			for i := range roots {
+				roots[i][0], roots[i][1] = byte(h), b
+			}
+			err = rf.write(h, uint64(h)*10, roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(h int32, b byte) {
+		t.Helper()
+		numLeaves, roots, err := readRoots(utreeDir.RootsDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]accumulator.Hash, h)
+		for i := range want {
+			want[i][0], want[i][1] = byte(h), b
+		}
+		if numLeaves != uint64(h)*10 || !reflect.DeepEqual(roots, want) {
+			t.Fatalf("block %d has %d leaves and roots %x, expected %d "+
+				"and %x", h, numLeaves, roots, h*10, want)
+		}
+	}
+
+	write(3, 6, 0)
+	_, _, err = readRoots(utreeDir.RootsDir, 2)
+	if err == nil {
+		t.Fatal("read roots for block 2, from before the roots file")
+	}
+	check(5, 0)
+
+	// cut back to 4 and build a different 5 and 6
+	write(5, 6, 1)
+	check(4, 0)
+	check(5, 1)
+	check(6, 1)
+
+	err = rollBackRootsFile(utreeDir.RootsDir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(3, 0)
+	_, _, err = readRoots(utreeDir.RootsDir, 4)
+	if err == nil {
+		t.Fatal("read roots for block 4 after rolling back to 3")
+	}
+}
@@ -0,0 +1,395 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// rpcBlocksPerCall is the most blocks rpcSource.Blocks gets at once.  With
+// their prevouts, the replies are several times the size of the blocks.
+const rpcBlocksPerCall = 10
+
+// rpcSource gets blocks from bitcoind over JSON-RPC.  The rev data comes
+// from the prevouts getblock gives with verbosity 3, which bitcoind has
+// since 23.0.  bitcoind can keep running.
+//
+// Since bitcoind can switch branches while it runs, the hash of each block
+// read is saved in the hash file, 32 bytes at 32*height.  Blocks that have
+// a hash saved are always gotten by it, and a block that doesn't have to
+// build on the one before it.
+type rpcSource struct {
+	url        string
+	user, pass string
+	client     *http.Client
+	hashFile   string
+}
+
+// newRPCSource logs in with -rpcuser and -rpcpass, or if they're not
+// given, with the .cookie file bitcoind writes next to the blocks
+// directory.
+func newRPCSource(cfg *Config) (*rpcSource, error) {
+	s := &rpcSource{
+		url:      "http://" + cfg.rpcAddr + "/",
+		user:     cfg.rpcUser,
+		pass:     cfg.rpcPass,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		hashFile: cfg.UtreeDir.OffsetDir.rpcHashFile,
+	}
+	if s.user != "" {
+		return s, nil
+	}
+	cookieFile := filepath.Join(filepath.Dir(cfg.BlockDir), ".cookie")
+	cookie, err := ioutil.ReadFile(cookieFile)
+	if err != nil {
+		return nil, fmt.Errorf("no -rpcuser given and can't read the "+
+			"cookie: %s", err.Error())
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(cookie)), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad cookie in %s", cookieFile)
+	}
+	s.user, s.pass = parts[0], parts[1]
+	return s, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call calls method and decodes what it gives back into result
+func (s *rpcSource) call(
+	method string, result interface{}, params ...interface{}) error {
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(
+		rpcRequest{JSONRPC: "1.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.user, s.pass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("rpc %s: %s", method, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("rpc %s: wrong rpc user or password", method)
+	}
+
+	// bitcoind gives back errors with a json body and a 404 or 500
+	var r rpcResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return fmt.Errorf("rpc %s: %s: %s", method, resp.Status, err.Error())
+	}
+	if r.Error != nil {
+		return fmt.Errorf("rpc %s: %s (code %d)",
+			method, r.Error.Message, r.Error.Code)
+	}
+	err = json.Unmarshal(r.Result, result)
+	if err != nil {
+		return fmt.Errorf("rpc %s: %s", method, err.Error())
+	}
+	return nil
+}
+
+// TipHeight is the height of bitcoind's best block
+func (s *rpcSource) TipHeight() (int32, error) {
+	var height int32
+	err := s.call("getblockcount", &height)
+	return height, err
+}
+
+// savedHash is the hash saved for the block at height.  It's false if
+// there isn't one.
+func (s *rpcSource) savedHash(height int32) (chainhash.Hash, bool, error) {
+	var hash chainhash.Hash
+	f, err := os.Open(s.hashFile)
+	if os.IsNotExist(err) {
+		return hash, false, nil
+	}
+	if err != nil {
+		return hash, false, err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(hash[:], int64(height)*chainhash.HashSize)
+	if err == io.EOF {
+		return hash, false, nil
+	}
+	if err != nil {
+		return hash, false, err
+	}
+	return hash, hash != chainhash.Hash{}, nil
+}
+
+func (s *rpcSource) saveHash(height int32, hash chainhash.Hash) error {
+	f, err := os.OpenFile(s.hashFile, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(hash[:], int64(height)*chainhash.HashSize)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Blocks gets the blocks one at a time, up to rpcBlocksPerCall of them.
+// Blocks that weren't read before are the ones in bitcoind's best chain,
+// and have to build on the block read before them.
+func (s *rpcSource) Blocks(height, count int32) (
+	[]wire.MsgBlock, []RevBlock, error) {
+
+	if count > rpcBlocksPerCall {
+		count = rpcBlocksPerCall
+	}
+	blocks := make([]wire.MsgBlock, 0, count)
+	revs := make([]RevBlock, 0, count)
+	for h := height; h < height+count; h++ {
+		hash, saved, err := s.savedHash(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !saved {
+			var best string
+			err = s.call("getblockhash", &best, h)
+			if err != nil {
+				return nil, nil, err
+			}
+			newHash, err := chainhash.NewHashFromStr(best)
+			if err != nil {
+				return nil, nil, fmt.Errorf("block %d: %s", h, err.Error())
+			}
+			hash = *newHash
+		}
+		var rb rpcBlock
+		err = s.call("getblock", &rb, hash.String(), 3)
+		if err != nil {
+			return nil, nil, err
+		}
+		blk, rev, err := rb.toBlockAndRev()
+		if err != nil {
+			return nil, nil, fmt.Errorf("block %d: %s", h, err.Error())
+		}
+		if !saved {
+			err = s.checkPrev(h, blk.Header.PrevBlock)
+			if err != nil {
+				return nil, nil, err
+			}
+			err = s.saveHash(h, hash)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		blocks = append(blocks, blk)
+		revs = append(revs, rev)
+	}
+	return blocks, revs, nil
+}
+
+// checkPrev checks that the block at height builds on the block read
+// before it, which it doesn't if bitcoind switched branches in between
+func (s *rpcSource) checkPrev(height int32, prev chainhash.Hash) error {
+	// everything builds on the genesis block
+	if height == 1 {
+		return nil
+	}
+	want, saved, err := s.savedHash(height - 1)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return fmt.Errorf("no hash saved for block %d to check block %d "+
+			"against", height-1, height)
+	}
+	if prev != want {
+		return fmt.Errorf("bitcoind's block %d builds on %s, not on block "+
+			"%d %s.  It switched branches, which -rpc can't follow yet",
+			height, prev, height-1, want)
+	}
+	return nil
+}
+
+// BlockBytes gets the block that was read at height with verbosity 0,
+// which is the block in hex
+func (s *rpcSource) BlockBytes(height int32) ([]byte, error) {
+	hash, saved, err := s.savedHash(height)
+	if err != nil {
+		return nil, err
+	}
+	if !saved {
+		return nil, fmt.Errorf("block %d wasn't read from bitcoind", height)
+	}
+	var blockHex string
+	err = s.call("getblock", &blockHex, hash.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(blockHex)
+}
+
+// BlockHeight gets the height from the block's header.  It has to be the
+// block that was read at that height.
+func (s *rpcSource) BlockHeight(hash chainhash.Hash) (int32, error) {
+	var header struct {
+		Height int32 `json:"height"`
+	}
+	err := s.call("getblockheader", &header, hash.String(), true)
+	if err != nil {
+		return 0, err
+	}
+	saved, ok, err := s.savedHash(header.Height)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || saved != hash {
+		return 0, fmt.Errorf("block %s isn't the block %d that was read "+
+			"from bitcoind", hash, header.Height)
+	}
+	return header.Height, nil
+}
+
+// rpcBlock is the part of what getblock gives with verbosity 3 that's
+// needed to make the block and its rev data
+type rpcBlock struct {
+	Hash              string  `json:"hash"`
+	Version           int32   `json:"version"`
+	PreviousBlockHash string  `json:"previousblockhash"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              int64   `json:"time"`
+	Bits              string  `json:"bits"`
+	Nonce             uint32  `json:"nonce"`
+	Tx                []rpcTx `json:"tx"`
+}
+
+type rpcTx struct {
+	Hex string `json:"hex"`
+	Vin []struct {
+		Prevout *struct {
+			Generated    bool    `json:"generated"`
+			Height       int32   `json:"height"`
+			Value        float64 `json:"value"`
+			ScriptPubKey struct {
+				Hex string `json:"hex"`
+			} `json:"scriptPubKey"`
+		} `json:"prevout"`
+	} `json:"vin"`
+}
+
+// toBlockAndRev puts the block back together from its header fields and
+// transactions, and makes the rev data from the prevouts of the inputs
+func (rb *rpcBlock) toBlockAndRev() (wire.MsgBlock, RevBlock, error) {
+	var blk wire.MsgBlock
+	var rev RevBlock
+
+	if len(rb.Tx) == 0 {
+		return blk, rev, fmt.Errorf("no transactions")
+	}
+	// the genesis block has no previous block
+	var prev chainhash.Hash
+	if rb.PreviousBlockHash != "" {
+		p, err := chainhash.NewHashFromStr(rb.PreviousBlockHash)
+		if err != nil {
+			return blk, rev, err
+		}
+		prev = *p
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(rb.MerkleRoot)
+	if err != nil {
+		return blk, rev, err
+	}
+	bits, err := strconv.ParseUint(rb.Bits, 16, 32)
+	if err != nil {
+		return blk, rev, err
+	}
+	blk.Header = wire.BlockHeader{
+		Version:    rb.Version,
+		PrevBlock:  prev,
+		MerkleRoot: *merkleRoot,
+		Timestamp:  time.Unix(rb.Time, 0),
+		Bits:       uint32(bits),
+		Nonce:      rb.Nonce,
+	}
+
+	for i, tx := range rb.Tx {
+		raw, err := hex.DecodeString(tx.Hex)
+		if err != nil {
+			return blk, rev, fmt.Errorf("tx %d: %s", i, err.Error())
+		}
+		var mtx wire.MsgTx
+		err = mtx.Deserialize(bytes.NewReader(raw))
+		if err != nil {
+			return blk, rev, fmt.Errorf("tx %d: %s", i, err.Error())
+		}
+		blk.Transactions = append(blk.Transactions, &mtx)
+
+		// like the rev files, there's nothing for the coinbase
+		if i == 0 {
+			continue
+		}
+		txUndo := new(TxUndo)
+		for j, in := range tx.Vin {
+			if in.Prevout == nil {
+				return blk, rev, fmt.Errorf("tx %d input %d has no prevout. "+
+					"bitcoind needs to be 23.0 or later", i, j)
+			}
+			amount, err := btcutil.NewAmount(in.Prevout.Value)
+			if err != nil {
+				return blk, rev, err
+			}
+			pkScript, err := hex.DecodeString(in.Prevout.ScriptPubKey.Hex)
+			if err != nil {
+				return blk, rev, err
+			}
+			txUndo.TxIn = append(txUndo.TxIn, &TxInUndo{
+				Height:   in.Prevout.Height,
+				PKScript: pkScript,
+				Amount:   int64(amount),
+				Coinbase: in.Prevout.Generated,
+			})
+		}
+		rev.Txs = append(rev.Txs, txUndo)
+	}
+
+	hash := blk.BlockHash()
+	if hash.String() != rb.Hash {
+		return blk, rev, fmt.Errorf("put together block %s but bitcoind "+
+			"said %s", hash.String(), rb.Hash)
+	}
+	rev.Hash = hash
+	return blk, rev, nil
+}
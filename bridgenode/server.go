@@ -13,6 +13,7 @@ import (
 
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 func Start(cfg *Config, sig chan bool) error {
@@ -36,10 +37,18 @@ func Start(cfg *Config, sig chan bool) error {
 			profileRedirect := http.RedirectHandler("/debug/pprof",
 				http.StatusSeeOther)
 			http.Handle("/", profileRedirect)
+			http.Handle("/metrics", util.MetricsHandler(metrics.metrics))
 			fmt.Printf("%v", http.ListenAndServe(listenAddr, nil))
 		}()
 	}
 
+	if cfg.convert {
+		return ConvertForest(cfg)
+	}
+	if cfg.audit {
+		return AuditForest(cfg)
+	}
+
 	// If serve option wasn't given
 	if !cfg.serve {
 		err := BuildProofs(cfg, sig)
@@ -47,6 +56,10 @@ func Start(cfg *Config, sig chan bool) error {
 			return errBuildProofs(err)
 		}
 	}
+	// following the tip, BuildProofs serves the blocks as it builds them
+	if cfg.follow {
+		return nil
+	}
 
 	err := VerifyProofs(cfg)
 	if err != nil {
@@ -74,9 +87,14 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 	// Handle user interruptions
 	go stopServer(sig, haltRequest, haltAccept)
 
-	if !util.HasAccess(cfg.BlockDir) {
+	// with -rpc, the blocks come from bitcoind and not its datadir
+	if cfg.rpcAddr == "" && !util.HasAccess(cfg.BlockDir) {
 		return errNoDataDir(cfg.BlockDir)
 	}
+	source, err := cfg.blockSource()
+	if err != nil {
+		return err
+	}
 
 	// Init forest and variables. Resumes if the data directory exists
 	maxHeight, err := restoreHeight(cfg)
@@ -84,7 +102,19 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 		return err
 	}
 
-	blockServer(maxHeight, cfg, haltRequest, haltAccept)
+	progress := newFlatFileProgress(maxHeight)
+	if cfg.apiPort != "" {
+		// the api proves outputs with the forest, which doesn't change
+		// while serving
+		forest, err := restoreForest(cfg)
+		if err != nil {
+			return err
+		}
+		tip := &tipForest{forest: forest, height: maxHeight}
+		go apiServer(cfg, source, progress, tip)
+	}
+
+	blockServer(progress, cfg, source, haltRequest, haltAccept)
 	return nil
 }
 
@@ -110,9 +140,11 @@ func stopServer(sig, haltRequest, haltAccept chan bool) {
 }
 
 // blockServer listens on a TCP port for incoming connections, then gives
-// ublocks blocks over that connection
-func blockServer(
-	endHeight int32, cfg *Config, haltRequest, haltAccept chan bool) {
+// ublocks blocks over that connection.  It serves the blocks that are
+// written to all the flat files.  When following the tip, that goes up as
+// blocks are built and the connections wait for the blocks they asked for.
+func blockServer(progress *flatFileProgress, cfg *Config, source BlockSource,
+	haltRequest, haltAccept chan bool) {
 
 	// before doing anything... this breaks
 	/*
@@ -137,7 +169,13 @@ func blockServer(
 	*/
 	// --------------
 
-	fmt.Printf("serving up to & including block height %d\n", endHeight)
+	if cfg.follow {
+		fmt.Printf("serving up to block height %d, and new blocks as "+
+			"they're built\n", progress.height())
+	} else {
+		fmt.Printf("serving up to & including block height %d\n",
+			progress.height())
+	}
 	listenAdr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:8338")
 	if err != nil {
 		fmt.Printf(err.Error())
@@ -160,7 +198,8 @@ func blockServer(
 			close(cons)
 			return
 		case con := <-cons:
-			go serveBlocksWorker(cfg.UtreeDir, con, endHeight, cfg.BlockDir)
+			go serveBlocksWorker(cfg.UtreeDir, con, progress, cfg.follow,
+				source)
 		}
 	}
 }
@@ -187,9 +226,11 @@ func acceptConnections(listener *net.TCPListener, cons chan net.Conn) {
 }
 
 // serveBlocksWorker gets height requests from client and sends out the ublock
-// for that height
-func serveBlocksWorker(UtreeDir utreeDir,
-	c net.Conn, endHeight int32, blockDir string) {
+// for that height.  With follow, it waits for blocks that aren't built yet
+// instead of stopping at them, and if blocks it sent get disconnected in a
+// reorg it sends a disconnect notice and goes on from the fork.
+func serveBlocksWorker(UtreeDir utreeDir, c net.Conn,
+	progress *flatFileProgress, follow bool, source BlockSource) {
 	defer c.Close()
 	fmt.Printf("start serving %s\n", c.RemoteAddr().String())
 	var fromHeight, toHeight int32
@@ -212,16 +253,20 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		direction = -1
 	}
 
-	if toHeight > endHeight {
+	endHeight := progress.height()
+	if toHeight > endHeight && !follow {
 		toHeight = endHeight
 	}
 
-	if fromHeight > endHeight {
+	if fromHeight > endHeight && !follow {
 		fmt.Printf("%s wanted %d but have %d\n",
 			c.LocalAddr().String(), fromHeight, endHeight)
 		return
 	}
 
+	// how many times the flat files had been rolled back when the last
+	// block was read
+	forks := -1
 	for curHeight := fromHeight; ; curHeight += direction {
 		if direction == 1 && curHeight > toHeight {
 			// forwards request of height above toHeight
@@ -230,37 +275,40 @@ func serveBlocksWorker(UtreeDir utreeDir,
 			// backwards request of height below toHeight
 			break
 		}
-
-		udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
-		if err != nil {
-			fmt.Printf("pushBlocks GetUDataBytesFromFile %s\n", err.Error())
-			break
+		if follow {
+			n := progress.readLock(curHeight)
+			var fork int32
+			reorged := false
+			if forks != -1 && direction == 1 {
+				fork, reorged = progress.forksSince(forks)
+			}
+			forks = n
+			if reorged && fork < curHeight-1 {
+				// the blocks after fork that were sent are gone
+				progress.readUnlock()
+				fmt.Printf("%s was sent blocks up to %d, disconnected "+
+					"back to %d\n", c.RemoteAddr().String(), curHeight-1, fork)
+				err = writeDisconnect(c, fork)
+				if err != nil {
+					fmt.Printf("pushBlocks disconnect write %s\n", err.Error())
+					break
+				}
+				curHeight = fork
+				continue
+			}
 		}
 
-		// if curHeight == 112 {
-		buf := bytes.NewBuffer(udb)
-		// deserialize to find errors
-		var ud btcacc.UData
-		err = ud.Deserialize(buf)
-		if err != nil {
-			fmt.Printf("serveBlocksWorker h %d deser error %s\n", curHeight, err.Error())
-			fmt.Printf("ttls: %v targets %s\n", ud.TxoTTLs, ud.AccProof.ToString())
-			fmt.Printf("udb: %x\n", udb)
-			break
+		ublock, err := readUBlockBytes(UtreeDir, source, curHeight)
+		if follow {
+			progress.readUnlock()
 		}
-		if len(ud.AccProof.Targets) != 0 {
-			fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
-		}
-
-		blkbytes, err := GetBlockBytesFromFile(
-			curHeight, UtreeDir.OffsetDir.OffsetFile, blockDir)
 		if err != nil {
-			fmt.Printf("pushBlocks GetRawBlockFromFile %s\n", err.Error())
+			fmt.Printf("pushBlocks %s\n", err.Error())
 			break
 		}
 
 		// send
-		_, err = c.Write(append(blkbytes, udb...))
+		_, err = c.Write(ublock)
 		if err != nil {
 			fmt.Printf("pushBlocks blkbytes write %s\n", err.Error())
 			break
@@ -273,6 +321,48 @@ func serveBlocksWorker(UtreeDir utreeDir,
 	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
 }
 
+// readUBlockBytes reads a block and its proof from the flat files the way
+// they go out to clients
+func readUBlockBytes(
+	UtreeDir utreeDir, source BlockSource, curHeight int32) ([]byte, error) {
+
+	udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
+	if err != nil {
+		return nil, fmt.Errorf("GetUDataBytesFromFile %s", err.Error())
+	}
+
+	// if curHeight == 112 {
+	buf := bytes.NewBuffer(udb)
+	// deserialize to find errors
+	var ud btcacc.UData
+	err = ud.Deserialize(buf)
+	if err != nil {
+		fmt.Printf("serveBlocksWorker h %d deser error %s\n", curHeight, err.Error())
+		fmt.Printf("ttls: %v targets %s\n", ud.TxoTTLs, ud.AccProof.ToString())
+		fmt.Printf("udb: %x\n", udb)
+		return nil, err
+	}
+	if len(ud.AccProof.Targets) != 0 {
+		fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
+	}
+
+	blkbytes, err := source.BlockBytes(curHeight)
+	if err != nil {
+		return nil, fmt.Errorf("BlockBytes %s", err.Error())
+	}
+	return append(blkbytes, udb...), nil
+}
+
+// writeDisconnect tells a client that the blocks it got after fork were
+// disconnected
+func writeDisconnect(c net.Conn, fork int32) error {
+	var notice [8]byte
+	binary.LittleEndian.PutUint32(notice[:4], uwire.DisconnectMarker)
+	binary.BigEndian.PutUint32(notice[4:], uint32(fork))
+	_, err := c.Write(notice[:])
+	return err
+}
+
 // GetUDataBytesFromFile reads the proof data from proof.dat and proofoffset.dat
 // and gives the proof & utxo data back.
 // Don't ask for block 0, there is no proof for that.
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"sort"
 )
 
@@ -17,15 +16,13 @@ func BNRTTLSpliter(
 	utdir utreeDir) {
 
 	txidFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
+		utdir.TtlDir.txidFile, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		panic(err)
 	}
 
 	txidOffsetFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidOffsetFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
+		utdir.TtlDir.txidOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		panic(err)
 	}
@@ -62,59 +59,7 @@ func BNRTTLSpliter(
 		// if bnr.Height == 206421 || bnr.Height == 205955 {
 		// fmt.Printf(bnr.toString())
 		// }
-		var lub ttlLookupBlock
-		var wb ttlWriteBlock
-		var inskippos, inputInBlock uint32
-		var outputInBlock uint16
-		var keepSkippingInputs bool
-		inskipMax := uint32(len(bnr.inSkipList))
-
-		lub.destroyHeight = bnr.Height
-		transactions := bnr.Blk.Transactions()
-
-		wb.createHeight = bnr.Height
-		wb.mTxids = make([]miniTx, len(transactions))
-		// fmt.Printf("h %d inskip %v\n", bnr.Height, bnr.inSkipList)
-		keepSkippingInputs = inskipMax > 0 // if none to skip, don't check
-
-		// iterate through the transactions in a block
-		for txInBlock, tx := range transactions {
-			// add txid and skipped position in block
-			wb.mTxids[txInBlock].txid = tx.Hash()
-			wb.mTxids[txInBlock].startsAt = outputInBlock
-			// first add all the outputs in this tx, then range through the
-			// outputs and decrement them if they're on the skiplist
-			mtx := tx.MsgTx()
-			outputInBlock += uint16(len(mtx.TxOut))
-
-			// for all the txins, throw that into the work as well; just a bunch of
-			// outpoints
-			for inputInTx, in := range mtx.TxIn {
-				// fmt.Printf("input in block %d ks %v sl %v isp %d\n",
-				// inputInBlock, keepSkippingInputs, bnr.inSkipList, inskippos)
-				if txInBlock == 0 {
-					inputInBlock++
-					inskippos++
-					keepSkippingInputs = inskippos != inskipMax
-					break // skip coinbase input
-				}
-				if keepSkippingInputs && bnr.inSkipList[inskippos] == inputInBlock {
-					// fmt.Printf(" skipping tx %d input %d (%d in block)\n",
-					// txInBlock, inputInTx, inputInBlock)
-					inskippos++
-					keepSkippingInputs = inskippos != inskipMax
-					inputInBlock++
-					continue
-				}
-				//make new miniIn
-				mI := miniIn{idx: uint16(in.PreviousOutPoint.Index),
-					createHeight: bnr.Rev.Txs[txInBlock-1].TxIn[inputInTx].Height}
-				copy(mI.hashprefix[:], in.PreviousOutPoint.Hash[:6])
-				// append outpoint to slice
-				lub.spentTxos = append(lub.spentTxos, mI)
-				inputInBlock++
-			}
-		}
+		wb, lub := bnr.splitTTL()
 		// done with block, send out split data to the two workers
 		writeBlockChan <- wb
 		lookupChan <- lub
@@ -123,6 +68,65 @@ func BNRTTLSpliter(
 	close(lookupChan)
 }
 
+// splitTTL splits a block into the txids of the transactions it creates,
+// for the txid file, and the outputs it spends, for the ttl lookup
+func (bnr *blockAndRev) splitTTL() (ttlWriteBlock, ttlLookupBlock) {
+	var lub ttlLookupBlock
+	var wb ttlWriteBlock
+	var inskippos, inputInBlock uint32
+	var outputInBlock uint16
+	var keepSkippingInputs bool
+	inskipMax := uint32(len(bnr.inSkipList))
+
+	lub.destroyHeight = bnr.Height
+	transactions := bnr.Blk.Transactions()
+
+	wb.createHeight = bnr.Height
+	wb.mTxids = make([]miniTx, len(transactions))
+	// fmt.Printf("h %d inskip %v\n", bnr.Height, bnr.inSkipList)
+	keepSkippingInputs = inskipMax > 0 // if none to skip, don't check
+
+	// iterate through the transactions in a block
+	for txInBlock, tx := range transactions {
+		// add txid and skipped position in block
+		wb.mTxids[txInBlock].txid = tx.Hash()
+		wb.mTxids[txInBlock].startsAt = outputInBlock
+		// first add all the outputs in this tx, then range through the
+		// outputs and decrement them if they're on the skiplist
+		mtx := tx.MsgTx()
+		outputInBlock += uint16(len(mtx.TxOut))
+
+		// for all the txins, throw that into the work as well; just a bunch of
+		// outpoints
+		for inputInTx, in := range mtx.TxIn {
+			// fmt.Printf("input in block %d ks %v sl %v isp %d\n",
+			// inputInBlock, keepSkippingInputs, bnr.inSkipList, inskippos)
+			if txInBlock == 0 {
+				inputInBlock++
+				inskippos++
+				keepSkippingInputs = inskippos != inskipMax
+				break // skip coinbase input
+			}
+			if keepSkippingInputs && bnr.inSkipList[inskippos] == inputInBlock {
+				// fmt.Printf(" skipping tx %d input %d (%d in block)\n",
+				// txInBlock, inputInTx, inputInBlock)
+				inskippos++
+				keepSkippingInputs = inskippos != inskipMax
+				inputInBlock++
+				continue
+			}
+			//make new miniIn
+			mI := miniIn{idx: uint16(in.PreviousOutPoint.Index),
+				createHeight: bnr.Rev.Txs[txInBlock-1].TxIn[inputInTx].Height}
+			copy(mI.hashprefix[:], in.PreviousOutPoint.Hash[:6])
+			// append outpoint to slice
+			lub.spentTxos = append(lub.spentTxos, mI)
+			inputInBlock++
+		}
+	}
+	return wb, lub
+}
+
 // TxidSortWriterWorker takes miniTxids in, sorts them, and writes them
 // into a flat file (also writes the offsets files.  The offset file
 // doesn't describe byte offsets, but rather 8 byte miniTxids
@@ -151,6 +155,8 @@ func TxidSortWriterWorker(
 		}
 		goChan <- true // tell the TTLLookupWorker to start on the block just done
 	}
+	// the TTLLookupWorker is done once it's looked up the last block
+	close(goChan)
 }
 
 // TODO: if the utxo is coinbase, don't have to look up position in block
@@ -165,82 +171,17 @@ func TxidSortWriterWorker(
 func TTLLookupWorker(
 	lChan chan ttlLookupBlock, ttlResultChan chan ttlResultBlock, goChan chan bool,
 	txidFile, txidOffsetFile *os.File) {
-	var seekHeight int32
-	var heightOffset, nextOffset int64
-	var startOffsetBytes, nextOffsetBytes [8]byte
 
 	for {
-		<-goChan
-		lub, open := <-lChan
+		_, open := <-goChan
 		if !open {
 			break
 		}
-		// build a TTL result block
-		var resultBlock ttlResultBlock
-		resultBlock.destroyHeight = lub.destroyHeight
-		resultBlock.results = make([]ttlResult, len(lub.spentTxos))
-
-		// sort the txins by utxo height; hopefully speeds up search
-		sortMiniIns(lub.spentTxos)
-		for i, stxo := range lub.spentTxos {
-			// fmt.Printf("need txid %x from height %d\n", stxo.hashprefix, stxo.height)
-			if stxo.createHeight != seekHeight { // height change, get byte offsets
-				// subtract 1 from stxo height because this file starts at height 1
-				_, err := txidOffsetFile.ReadAt(
-					startOffsetBytes[:], int64(stxo.createHeight-1)*8)
-				if err != nil {
-					fmt.Printf("tried to read at txidoffset file byte %d  ",
-						(stxo.createHeight-1)*8)
-					panic(err)
-				}
-
-				heightOffset = int64(binary.BigEndian.Uint64(startOffsetBytes[:]))
-
-				// TODO: make sure this is OK.  If we always have a
-				// block after the one we're seeking this will not error.
-
-				_, err = txidOffsetFile.ReadAt(
-					nextOffsetBytes[:], int64(stxo.createHeight)*8)
-				if err != nil {
-					fmt.Printf("tried to read next at %d  ", stxo.createHeight*8)
-					panic(err)
-				}
-				nextOffset = int64(binary.BigEndian.Uint64(nextOffsetBytes[:]))
-				// if nextOffset==heightOffset{}
-				if nextOffset < heightOffset {
-					fmt.Printf("nextOffset %d < start %d byte %d\n",
-						nextOffset, heightOffset, stxo.createHeight*8)
-					panic("bad offset")
-				}
-				seekHeight = stxo.createHeight
-			}
-			if stxo.createHeight == resultBlock.destroyHeight {
-				fmt.Printf("\tXXXXh %d stxo %d trying to write 0 TTL %x:%d.\n",
-					resultBlock.destroyHeight, i, stxo.hashprefix, stxo.idx)
-				if stxo.createHeight > 108 {
-					panic("0 ttl")
-				}
-			}
-
-			resultBlock.results[i].createHeight = stxo.createHeight
-			// fmt.Printf("search for create height %d %x:%d from %d range %d\n",
-			// stxo.createHeight, stxo.hashprefix, stxo.idx,
-			// heightOffset, nextOffset-heightOffset)
-
-			resultBlock.results[i].indexWithinBlock =
-				binSearch(stxo, heightOffset, nextOffset, txidFile)
-
-			// if resultBlock.results[i].indexWithinBlock == 116 {
-			// fmt.Printf("# h %d stxo %x:%d writes ttl value %d to h %d idxinblk %d\n",
-			// lub.destroyHeight, stxo.hashprefix, stxo.idx,
-			// lub.destroyHeight-resultBlock.results[i].createHeight,
-			// stxo.createHeight,
-			// resultBlock.results[i].indexWithinBlock)
-			// }
-
+		lub, open := <-lChan
+		if !open {
+			break
 		}
-
-		ttlResultChan <- resultBlock
+		ttlResultChan <- lookupTTLs(lub, txidFile, txidOffsetFile)
 	}
 
 	err := txidFile.Close()
@@ -253,6 +194,74 @@ func TTLLookupWorker(
 	}
 }
 
+// lookupTTLs finds where in their blocks the outputs a block spends were
+// created.  The txids of the blocks that created them have to be in the txid
+// file, and the block after them too.
+func lookupTTLs(lub ttlLookupBlock,
+	txidFile, txidOffsetFile io.ReaderAt) ttlResultBlock {
+
+	var seekHeight int32
+	var heightOffset, nextOffset int64
+	var startOffsetBytes, nextOffsetBytes [8]byte
+
+	// build a TTL result block
+	var resultBlock ttlResultBlock
+	resultBlock.destroyHeight = lub.destroyHeight
+	resultBlock.results = make([]ttlResult, len(lub.spentTxos))
+
+	// sort the txins by utxo height; hopefully speeds up search
+	sortMiniIns(lub.spentTxos)
+	for i, stxo := range lub.spentTxos {
+		// fmt.Printf("need txid %x from height %d\n", stxo.hashprefix, stxo.height)
+		if stxo.createHeight != seekHeight { // height change, get byte offsets
+			// subtract 1 from stxo height because this file starts at height 1
+			_, err := txidOffsetFile.ReadAt(
+				startOffsetBytes[:], int64(stxo.createHeight-1)*8)
+			if err != nil {
+				fmt.Printf("tried to read at txidoffset file byte %d  ",
+					(stxo.createHeight-1)*8)
+				panic(err)
+			}
+
+			heightOffset = int64(binary.BigEndian.Uint64(startOffsetBytes[:]))
+
+			// TODO: make sure this is OK.  If we always have a
+			// block after the one we're seeking this will not error.
+
+			_, err = txidOffsetFile.ReadAt(
+				nextOffsetBytes[:], int64(stxo.createHeight)*8)
+			if err != nil {
+				fmt.Printf("tried to read next at %d  ", stxo.createHeight*8)
+				panic(err)
+			}
+			nextOffset = int64(binary.BigEndian.Uint64(nextOffsetBytes[:]))
+			// if nextOffset==heightOffset{}
+			if nextOffset < heightOffset {
+				fmt.Printf("nextOffset %d < start %d byte %d\n",
+					nextOffset, heightOffset, stxo.createHeight*8)
+				panic("bad offset")
+			}
+			seekHeight = stxo.createHeight
+		}
+		if stxo.createHeight == resultBlock.destroyHeight {
+			fmt.Printf("\tXXXXh %d stxo %d trying to write 0 TTL %x:%d.\n",
+				resultBlock.destroyHeight, i, stxo.hashprefix, stxo.idx)
+			if stxo.createHeight > 108 {
+				panic("0 ttl")
+			}
+		}
+
+		resultBlock.results[i].createHeight = stxo.createHeight
+		// fmt.Printf("search for create height %d %x:%d from %d range %d\n",
+		// stxo.createHeight, stxo.hashprefix, stxo.idx,
+		// heightOffset, nextOffset-heightOffset)
+
+		resultBlock.results[i].indexWithinBlock =
+			binSearch(stxo, heightOffset, nextOffset, txidFile)
+	}
+	return resultBlock
+}
+
 // actually start with a binary search, easier
 func binSearch(mi miniIn,
 	bottom, top int64, mtxFile io.ReaderAt) uint16 {
@@ -325,5 +334,4 @@ func interpolationSearch(mi miniIn,
 
 	for {
 	}
-	return
 }
@@ -2,12 +2,13 @@ package btcacc
 
 import (
 	"bytes"
-	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"strconv"
+
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 const HashSize = 32
@@ -121,7 +122,13 @@ func (l *LeafData) Deserialize(r io.Reader) (err error) {
 
 // LeafHash turns a LeafData into a LeafHash
 func (l *LeafData) LeafHash() [32]byte {
+	return l.LeafHashWith(accumulator.DefaultHasher)
+}
+
+// LeafHashWith is LeafHash but with the given hash function instead of the
+// default.  Use the same Hasher as the accumulator the leaf goes in.
+func (l *LeafData) LeafHashWith(h accumulator.Hasher) [32]byte {
 	var buf bytes.Buffer
 	l.Serialize(&buf)
-	return sha512.Sum512_256(buf.Bytes())
+	return h.Leaf(buf.Bytes())
 }
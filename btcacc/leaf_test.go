@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 func TestLeafDataSerialize(t *testing.T) {
@@ -36,3 +38,23 @@ func TestLeafDataSerialize(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLeafHashWith(t *testing.T) {
+	ld := LeafData{
+		TxHash:   Hash{1, 2, 3, 4},
+		Amt:      3000,
+		PkScript: []byte{1, 2, 3, 4, 5, 6},
+	}
+
+	if ld.LeafHash() != ld.LeafHashWith(accumulator.DefaultHasher) {
+		t.Fatal("LeafHash isn't the default hasher")
+	}
+
+	h, err := accumulator.NewHasher(accumulator.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.LeafHash() == ld.LeafHashWith(h) {
+		t.Fatal("sha256 leaf hash same as sha512_256")
+	}
+}
@@ -32,6 +32,8 @@ func (ud *UData) ProofSanity(nl uint64, h uint8) bool {
 // on disk
 // aaff aaff 0000 0014 0000 0001 0000 0001 0000 0000 0000 0000 0000 0000
 //  magic   |   size  |  height | numttls |   ttl0  | numTgts | (proof)
+// (older proof files; the batch proof is now in the compact encoding, which
+// Deserialize also reads)
 
 // ToBytes serializes UData into bytes.
 // First, height, 4 bytes.
@@ -56,12 +58,12 @@ func (ud *UData) Serialize(w io.Writer) (err error) {
 		}
 	}
 
-	err = ud.AccProof.Serialize(w)
+	err = ud.AccProof.SerializeCompact(w)
 	if err != nil { // ^ batch proof with lengths internal
 		return
 	}
 
-	// fmt.Printf("accproof %d bytes\n", ud.AccProof.SerializeSize())
+	// fmt.Printf("accproof %d bytes\n", ud.AccProof.SerializeCompactSize())
 
 	// write all the leafdatas
 	for _, ld := range ud.Stxos {
@@ -87,13 +89,14 @@ func (ud *UData) SerializeSize() int {
 		ldsize += l.SerializeSize()
 	}
 
-	ud.AccProof.Serialize(&b)
-	if b.Len() != ud.AccProof.SerializeSize() {
-		fmt.Printf(" b.Len() %d, AccProof.SerializeSize() %d\n",
-			b.Len(), ud.AccProof.SerializeSize())
+	ud.AccProof.SerializeCompact(&b)
+	if b.Len() != ud.AccProof.SerializeCompactSize() {
+		fmt.Printf(" b.Len() %d, AccProof.SerializeCompactSize() %d\n",
+			b.Len(), ud.AccProof.SerializeCompactSize())
 	}
 
-	guess := 8 + (4 * len(ud.TxoTTLs)) + ud.AccProof.SerializeSize() + ldsize
+	guess := 8 + (4 * len(ud.TxoTTLs)) + ud.AccProof.SerializeCompactSize() +
+		ldsize
 
 	// 8B height & numTTLs, 4B per TTL, accProof size, leaf sizes
 	return guess
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 var PollardFilePath string = "pollardFile"
@@ -25,6 +26,16 @@ OPTIONS:
 
   -host                        server to connect to.  Default to localhost
                                if you need a public server, try 35.188.186.244
+
+  -remember=ttl                cache leaves spent within -lookahead blocks.
+                               Default for a new pollard.
+  -remember=lru                cache the last -lrusize leaves added.
+                               Without -remember a saved pollard keeps the
+                               policy it was saved with.
+  -maxnodes                    most nodes to keep in the pollard. Cached
+                               leaves are dropped to stay under it. 0 for
+                               no limit. Without -maxnodes a saved pollard
+                               keeps the limit it was saved with.
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -46,12 +57,19 @@ var (
 
 	checkSig = argCmd.Bool("checksig", true,
 		`check signatures (slower)`)
+	rememberCmd = argCmd.String("remember", "",
+		`which leaves to cache (ttl, lru). Usage: "-remember=lru"`)
 	lookahead = argCmd.Int("lookahead", 1000,
-		`size of the look-ahead cache in blocks`)
+		`size of the look-ahead cache in blocks, for -remember=ttl`)
+	lruSize = argCmd.Int("lrusize", 100000,
+		`how many leaves to cache, for -remember=lru`)
+	maxNodes = argCmd.Int64("maxnodes", -1,
+		`most nodes to keep in the pollard, 0 for no limit`)
 	quitafter = argCmd.Int("quitafter", -1,
 		`quit ibd after n blocks. (for testing)`)
 	profServerCmd = argCmd.String("profserver", "",
-		`Enable pprof server. Usage: 'profserver='port'`)
+		`Enable pprof server, with Prometheus metrics at /metrics. `+
+			`Usage: 'profserver='port'`)
 )
 
 type Config struct {
@@ -63,8 +81,14 @@ type Config struct {
 	// address to watch for txs
 	watchAddr string
 
-	// how much to remember
-	lookAhead int
+	// which leaves to remember.  nil keeps the policy the pollard was
+	// saved with, or defaultPolicy for a new one.
+	policy        accumulator.RememberPolicy
+	defaultPolicy accumulator.RememberPolicy
+
+	// MaxPollardNodes caps how many nodes the pollard keeps.  0 is no cap,
+	// and -1 keeps the cap the pollard was saved with.
+	MaxPollardNodes int64
 
 	// quitafter this many blocks
 	quitafter int
@@ -81,7 +105,7 @@ type Config struct {
 	// enable memory profiling
 	MemProf string
 
-	// enable profiling http server
+	// enable profiling http server, which also serves /metrics
 	ProfServer string
 }
 
@@ -104,7 +128,21 @@ func Parse(args []string) (*Config, error) {
 
 	cfg.remoteHost = *remoteHost
 	cfg.watchAddr = *watchAddr
-	cfg.lookAhead = *lookahead
+	cfg.defaultPolicy = &accumulator.TTLPolicy{Window: int32(*lookahead)}
+	switch *rememberCmd {
+	case "":
+		// keep what the pollard was saved with
+	case "ttl":
+		cfg.policy = &accumulator.TTLPolicy{Window: int32(*lookahead)}
+	case "lru":
+		cfg.policy = accumulator.NewLRUPolicy(uint64(*lruSize))
+	default:
+		return nil, errInvalidRemember(*rememberCmd)
+	}
+	if *maxNodes < -1 {
+		return nil, errInvalidMaxNodes(*maxNodes)
+	}
+	cfg.MaxPollardNodes = *maxNodes
 	cfg.quitafter = *quitafter
 	cfg.checkSig = *checkSig
 
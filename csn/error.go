@@ -6,9 +6,19 @@ import (
 )
 
 var (
-	ErrInvalidNetwork = errors.New("Invalid/not supported net flag given")
+	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
+	ErrInvalidRemember = errors.New("Invalid/not supported remember flag given")
+	ErrInvalidMaxNodes = errors.New("Invalid maxnodes flag given")
 )
 
 func errInvalidNetwork(nType string) error {
 	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
 }
+
+func errInvalidRemember(policy string) error {
+	return fmt.Errorf("%s: %s", ErrInvalidRemember, policy)
+}
+
+func errInvalidMaxNodes(maxNodes int64) error {
+	return fmt.Errorf("%s: %d", ErrInvalidMaxNodes, maxNodes)
+}
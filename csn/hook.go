@@ -2,6 +2,7 @@ package csn
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/wire"
@@ -41,6 +42,11 @@ type Csn struct {
 	CurrentHeight int32
 	pollard       accumulator.Pollard
 
+	// pollardMtx is held while a block goes into the pollard, so the
+	// metrics can read it.  pollardHeight is the last block that went in.
+	pollardMtx    sync.Mutex
+	pollardHeight int32
+
 	WatchOPs  map[wire.OutPoint]bool
 	WatchAdrs map[[20]byte]bool
 	// TODO use better addresses, either []byte or something fancy
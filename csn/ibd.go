@@ -19,9 +19,9 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	// the OS
 	haltRequest := make(chan bool, 1)
 
-	// Channel to alert stopRunIBD it's ok to exit
-	// Makes it wait for flushing to disk
-	haltAccept := make(chan bool, 1)
+	// Channel to alert stopRunIBD it's ok to exit, with why IBD stopped if
+	// it wasn't asked to.  Makes it wait for flushing to disk
+	haltAccept := make(chan error, 1)
 
 	go stopRunIBD(cfg, sig, haltRequest, haltAccept)
 
@@ -38,8 +38,12 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 
 	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
 	// this will be a network reader, with the server sending the same stuff over
-	go uwire.UblockNetworkReader(
-		ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	// the reader's error, once ublockQueue is closed
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- uwire.UblockNetworkReader(
+			ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	}()
 
 	var plustime time.Duration
 	starttime := time.Now()
@@ -47,16 +51,23 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	// bool for stopping the below for loop
 	var stop bool
 	var blockCount int
+	var ibdErr error
 	for ; !stop; c.CurrentHeight++ {
 
 		blocknproof, open := <-ublockQueue
 		if !open {
 			fmt.Printf("ublockQueue channel closed ")
+			// the pollard is on a branch the server left, so it's saved
+			// as it is and the csn stops with the error
+			ibdErr = <-readErr
 			sig <- true
 			break
 		}
 
+		c.pollardMtx.Lock()
 		err := c.putBlockInPollard(blocknproof, &totalTXOAdded, &totalDels, plustime)
+		c.pollardHeight = c.CurrentHeight
+		c.pollardMtx.Unlock()
 		if err != nil {
 			// crash if there's a bad proof or signature, OK for testing
 			panic(err)
@@ -97,7 +108,7 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 
 	fmt.Println("Done Writing")
 
-	haltAccept <- true
+	haltAccept <- ibdErr
 }
 
 // ScanBlock looks through a block using the CSN's maps and sends matches
@@ -192,24 +203,15 @@ func (c *Csn) putBlockInPollard(
 		return err
 	}
 
-	remember := make([]bool, len(ub.UtreexoData.TxoTTLs))
-	for i, ttl := range ub.UtreexoData.TxoTTLs {
-		// 0 means that it's a UTXO. Don't remember.
-		if ttl == 0 {
-			remember[i] = false
-		} else {
-			remember[i] = ttl < c.pollard.Lookahead
-		}
-	}
-
-	// get hashes to add into the accumulator
-	blockAdds := uwire.BlockToAddLeaves(
-		ub.Block, remember, outskip, ub.UtreexoData.Height, outCount)
+	// get hashes to add into the accumulator.  The pollard's policy
+	// decides which to remember based on their ttls.
+	blockAdds := uwire.BlockToAddLeaves(ub.Block, ub.UtreexoData.TxoTTLs,
+		outskip, ub.UtreexoData.Height, outCount)
 	*totalTXOAdded += len(blockAdds) // for benchmarking
 
 	// Utreexo tree modification. blockAdds are the added txos and
 	// AccProof.Targets are the positions of the leaves to delete
-	err = c.pollard.Modify(blockAdds, ub.UtreexoData.AccProof.Targets)
+	_, err = c.pollard.Modify(blockAdds, ub.UtreexoData.AccProof.Targets)
 	if err != nil {
 
 		return fmt.Errorf("csn h %d modify %s", c.CurrentHeight, err.Error())
@@ -51,7 +51,15 @@ func RunIBD(cfg *Config, sig chan bool) error {
 		return fmt.Errorf("initCSNState error: %s", err.Error())
 	}
 
-	pol.Lookahead = int32(cfg.lookAhead)
+	// a restored pollard has the policy and cap it was saved with
+	if cfg.policy != nil {
+		pol.Policy = cfg.policy
+	} else if pol.Policy == nil {
+		pol.Policy = cfg.defaultPolicy
+	}
+	if cfg.MaxPollardNodes != -1 {
+		pol.MaxNodes = uint64(cfg.MaxPollardNodes)
+	}
 
 	// make a new CSN struct and load the pollard into it
 	c := Csn{
@@ -60,6 +68,10 @@ func RunIBD(cfg *Config, sig chan bool) error {
 		utxoStore:       utxos,
 	}
 
+	if cfg.ProfServer != "" {
+		http.Handle("/metrics", util.MetricsHandler(c.metrics))
+	}
+
 	txChan, heightChan, err := c.Start(cfg, height, "compactstate", "", sig)
 	if err != nil {
 		return fmt.Errorf("CSN start error: %s", err.Error())
@@ -111,6 +123,7 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 	c.HeightChan = make(chan int32, 10)
 
 	c.CurrentHeight = height
+	c.pollardHeight = height - 1
 	c.Params = cfg.params
 	c.remoteHost = cfg.remoteHost
 
@@ -152,7 +165,7 @@ func initCSNState() (
 	return
 }
 
-func stopRunIBD(cfg Config, sig chan bool, stopGoing chan bool, done chan bool) {
+func stopRunIBD(cfg Config, sig chan bool, stopGoing chan bool, done chan error) {
 	// Listen for SIGINT, SIGTERM, and SIGQUIT from the user
 	<-sig
 	pprof.StopCPUProfile()
@@ -174,7 +187,7 @@ func stopRunIBD(cfg Config, sig chan bool, stopGoing chan bool, done chan bool)
 	stopGoing <- true
 
 	// Wait until RunIBD() says it's ok to quit
-	<-done
+	ibdErr := <-done
 
 	if cfg.CpuProf != "" {
 		pprof.StopCPUProfile()
@@ -190,5 +203,9 @@ func stopRunIBD(cfg Config, sig chan bool, stopGoing chan bool, done chan bool)
 		runtime.GC()
 		pprof.WriteHeapProfile(f)
 	}
+	if ibdErr != nil {
+		fmt.Printf("IBD stopped: %s\n", ibdErr.Error())
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
@@ -0,0 +1,70 @@
+package csn
+
+import (
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// metrics gives back the height and the pollard stats for /metrics on
+// the pprof server
+func (c *Csn) metrics() []util.Metric {
+	c.pollardMtx.Lock()
+	height := c.pollardHeight
+	stats := c.pollard.Stats()
+	c.pollardMtx.Unlock()
+
+	return append([]util.Metric{{
+		Name:  "utreexo_csn_height",
+		Help:  "Height of the last block added to the pollard.",
+		Value: float64(height),
+	}}, pollardMetrics(stats)...)
+}
+
+// pollardMetrics turns the pollard stats into metrics
+func pollardMetrics(s accumulator.PollardStats) []util.Metric {
+	rs := s.Remember
+	return []util.Metric{
+		{Name: "utreexo_pollard_leaves",
+			Help:  "Leaves in the pollard.",
+			Value: float64(s.NumLeaves)},
+		{Name: "utreexo_pollard_roots",
+			Help:  "Roots of the pollard.",
+			Value: float64(s.Roots)},
+		{Name: "utreexo_pollard_nodes",
+			Help:  "Nodes the pollard has.",
+			Value: float64(s.Nodes)},
+		{Name: "utreexo_pollard_max_nodes",
+			Help:  "Cap on the pollard nodes, 0 if there isn't one.",
+			Value: float64(s.MaxNodes)},
+		{Name: "utreexo_pollard_remembered",
+			Help:  "Nodes the pollard remembers now.",
+			Value: float64(s.CurrentRemember)},
+		{Name: "utreexo_pollard_hashes_total",
+			Help:    "Hashes the pollard has computed.",
+			Counter: true, Value: float64(s.HashesEver)},
+		{Name: "utreexo_pollard_remembered_total",
+			Help:    "Nodes the pollard has ever remembered.",
+			Counter: true, Value: float64(s.RememberEver)},
+		{Name: "utreexo_pollard_over_wire_total",
+			Help:    "Leaves sent to the pollard over the network.",
+			Counter: true, Value: float64(s.OverWire)},
+		{Name: "utreexo_pollard_remember_hits_total",
+			Help:    "Deleted leaves that were remembered.",
+			Counter: true, Value: float64(rs.Hits)},
+		{Name: "utreexo_pollard_remember_misses_total",
+			Help:    "Deleted leaves that weren't remembered.",
+			Counter: true, Value: float64(rs.Misses)},
+		{Name: "utreexo_pollard_forgotten_total",
+			Help:    "Remembered leaves the policy dropped before they were deleted.",
+			Counter: true, Value: float64(rs.Forgotten)},
+		{Name: "utreexo_pollard_evicted_total",
+			Help:    "Remembered leaves dropped to stay under the node cap.",
+			Counter: true, Value: float64(rs.Evicted)},
+		{Name: "utreexo_pollard_proof_hashes_total",
+			Help:    "Proof hashes that came in with batch proofs.",
+			Counter: true, Value: float64(rs.ProofHashes)},
+		{Name: "utreexo_pollard_cached_hashes_total",
+			Help:    "Proof hashes the pollard already had.",
+			Counter: true, Value: float64(rs.CachedHashHits)},
+	}
+}
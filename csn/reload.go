@@ -1,9 +1,11 @@
 package csn
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
+	"io/ioutil"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
@@ -11,12 +13,25 @@ import (
 	"github.com/mit-dci/utreexo/btcacc"
 )
 
+// The pollard file starts with pollardFileMagic and a 4 byte version and
+// ends with a crc32 of everything before it.  Files saved before there was
+// a header start with the number of utxos.
+var pollardFileMagic = [4]byte{0xff, 'c', 's', 'n'}
+
+const pollardFileVersion uint32 = 1
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // restorePollard restores the pollard from disk to memory.
 // If starting anew, it just returns a empty pollard.
 func restorePollard() (height int32, p accumulator.Pollard,
 	utxos map[wire.OutPoint]btcacc.LeafData, err error) {
 	// Restore Pollard
-	pollardFile, err := os.OpenFile(PollardFilePath, os.O_RDWR, 0600)
+	buf, err := ioutil.ReadFile(PollardFilePath)
+	if err != nil {
+		return
+	}
+	pollardFile, err := checkPollardFile(buf)
 	if err != nil {
 		return
 	}
@@ -62,32 +77,65 @@ func restorePollard() (height int32, p accumulator.Pollard,
 // user restarts, they'll be able to resume.
 // Saves height for ibdsim and pollard itself
 func saveIBDsimData(csn *Csn) error {
-	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY, 0600)
+	var polFile bytes.Buffer
+	polFile.Write(pollardFileMagic[:])
+	err := binary.Write(&polFile, binary.BigEndian, pollardFileVersion)
 	if err != nil {
 		return err
 	}
 
 	// save all found utxos
-	err = binary.Write(polFile, binary.BigEndian, uint32(len(csn.utxoStore)))
+	err = binary.Write(&polFile, binary.BigEndian, uint32(len(csn.utxoStore)))
 	if err != nil {
 		return err
 	}
 
 	for _, utxo := range csn.utxoStore {
-		err = utxo.Serialize(polFile)
+		err = utxo.Serialize(&polFile)
 		if err != nil {
 			return err
 		}
 	}
 
 	// write to the heightfile
-	err = binary.Write(polFile, binary.BigEndian, csn.CurrentHeight)
+	err = binary.Write(&polFile, binary.BigEndian, csn.CurrentHeight)
+	if err != nil {
+		return err
+	}
+	err = csn.pollard.WritePollard(&polFile)
 	if err != nil {
 		return err
 	}
-	err = csn.pollard.WritePollard(polFile)
+	err = binary.Write(&polFile, binary.BigEndian,
+		crc32.Checksum(polFile.Bytes(), crcTable))
 	if err != nil {
 		return err
 	}
-	return polFile.Close()
+	return ioutil.WriteFile(PollardFilePath, polFile.Bytes(), 0600)
+}
+
+// checkPollardFile checks the header and checksum of a pollard file and
+// gives back a reader for what's between them.  Files from before there
+// was a header are read as they are.
+func checkPollardFile(buf []byte) (*bytes.Reader, error) {
+	if len(buf) < 4 || !bytes.Equal(buf[:4], pollardFileMagic[:]) {
+		return bytes.NewReader(buf), nil
+	}
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("pollard file is corrupted: %d bytes",
+			len(buf))
+	}
+	version := binary.BigEndian.Uint32(buf[4:8])
+	if version != pollardFileVersion {
+		return nil, fmt.Errorf("pollard file format version %d, only know %d",
+			version, pollardFileVersion)
+	}
+	end := len(buf) - 4
+	if crc32.Checksum(buf[:end], crcTable) !=
+		binary.BigEndian.Uint32(buf[end:]) {
+
+		return nil, fmt.Errorf("pollard file is corrupted: " +
+			"checksum doesn't match")
+	}
+	return bytes.NewReader(buf[8:end]), nil
 }
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// PrometheusContentType is the content type of the Prometheus text format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metric is one value to show to Prometheus
+type Metric struct {
+	// Name is the metric name, like utreexo_forest_leaves
+	Name string
+
+	// Help is the one line description Prometheus shows for it
+	Help string
+
+	// Counter is true for values that only ever go up.  Otherwise it's a
+	// gauge.
+	Counter bool
+
+	Value float64
+}
+
+// WritePrometheus writes metrics in the Prometheus text format
+func WritePrometheus(w io.Writer, metrics []Metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		kind := "gauge"
+		if m.Counter {
+			kind = "counter"
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.Name, m.Help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.Name, kind)
+		fmt.Fprintf(bw, "%s %s\n", m.Name,
+			strconv.FormatFloat(m.Value, 'g', -1, 64))
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serves whatever metrics gives back in the Prometheus text
+// format.  It's meant to go on the pprof server at /metrics.
+func MetricsHandler(metrics func() []Metric) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", PrometheusContentType)
+		err := WritePrometheus(w, metrics())
+		if err != nil {
+			fmt.Printf("metrics: %s\n", err.Error())
+		}
+	})
+}
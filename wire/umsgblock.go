@@ -1,6 +1,7 @@
 package wire
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -20,11 +21,35 @@ import (
 	"github.com/mit-dci/utreexo/util"
 )
 
+// DisconnectMarker is what a bridge node following the tip sends in place
+// of a block's version when blocks it already sent got disconnected in a
+// reorg.  The 4 byte big endian height of the fork comes after it; the
+// blocks after the fork are disconnected, and the next block sent is the
+// one after the fork on the new branch.
+const DisconnectMarker uint32 = 0xffffffff
+
+// DisconnectError is what UblockNetworkReader returns when the server
+// disconnected blocks it already sent.
+type DisconnectError struct {
+	Server string
+	// Fork is the last block still on the server's branch, Sent the last
+	// block that was sent
+	Fork, Sent int32
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("%s disconnected the blocks after %d but already "+
+		"sent up to %d", e.Server, e.Fork, e.Sent)
+}
+
 // UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
+// channel.  It'll try to fill the channel buffer.  It can't undo blocks, so
+// if the server disconnects blocks it already got it closes the channel and
+// returns a *DisconnectError.  Blocks after the fork have to be undone by
+// the caller before asking for them again.
 func UblockNetworkReader(
 	blockChan chan UBlock, remoteServer string,
-	curHeight, lookahead int32) {
+	curHeight, lookahead int32) error {
 
 	d := net.Dialer{Timeout: 2 * time.Second}
 	con, err := d.Dial("tcp", remoteServer)
@@ -52,24 +77,40 @@ func UblockNetworkReader(
 
 	// TODO goroutines for only the Deserialize part might be nice.
 	// Need to sort the blocks though if you're doing that
+	r := bufio.NewReader(con)
 	for ; ; curHeight++ {
+		// the version of the next block, or a disconnect notice
+		next, err := r.Peek(4)
+		if err == nil && binary.LittleEndian.Uint32(next) == DisconnectMarker {
+			var notice [8]byte
+			_, err = io.ReadFull(r, notice[:])
+			if err != nil {
+				return fmt.Errorf("disconnect notice from %s %s",
+					con.RemoteAddr().String(), err.Error())
+			}
+			return &DisconnectError{
+				Server: con.RemoteAddr().String(),
+				Fork:   int32(binary.BigEndian.Uint32(notice[4:])),
+				Sent:   curHeight - 1,
+			}
+		}
 
-		err = ub.Deserialize(con)
+		err = ub.Deserialize(r)
 		if err != nil {
 			fmt.Printf("Deserialize error from connection %s %s\n",
 				con.RemoteAddr().String(), err.Error())
-			return
+			return nil
 		}
 		blockChan <- ub
 	}
 }
 
 // BlockToAdds turns all the new utxos in a msgblock into leafTxos
-// uses remember slice up to number of txos, but doesn't check that it's the
+// uses ttls slice up to number of txos, but doesn't check that it's the
 // right length.  Similar with skiplist, doesn't check it.
 func BlockToAddLeaves(
 	blk *btcutil.Block,
-	remember []bool,
+	ttls []int32,
 	skiplist []uint32,
 	height int32,
 	outCount uint32) (leaves []accumulator.Leaf) {
@@ -107,8 +148,8 @@ func BlockToAddLeaves(
 			l.Amt = out.Value
 			l.PkScript = out.PkScript
 			uleaf := accumulator.Leaf{Hash: l.LeafHash()}
-			if uint32(len(remember)) > txonum {
-				uleaf.Remember = remember[txonum]
+			if uint32(len(ttls)) > txonum {
+				uleaf.TTL = ttls[txonum]
 			}
 			leaves = append(leaves, uleaf)
 			txonum++